@@ -62,10 +62,19 @@ type table struct {
 	output       string
 	version      int
 	outputFormat string
+	db           string
+	name         string
+	topic        string
+	produced     bool //events produced since reader start
+	//partitionColumns of the output topic, values of which are passed to the
+	//streamer in the envelope
+	partitionColumns []string
 }
 
 type mysqlReader struct {
 	gtidSet       *mysql.MysqlGTIDSet
+	gtid          string //GTID of the current transaction
+	eventTime     int64  //MySQL time of the current binlog event, in nanoseconds
 	seqNo         uint64
 	masterCI      *db.Addr
 	tables        map[string]map[string][]*table
@@ -81,6 +90,12 @@ type mysqlReader struct {
 	metrics       *metrics.BinlogReader
 	batchSize     int
 	lock          lock.Lock
+
+	//Exactly-once mode state
+	txn        pipe.TxnProducer
+	txnGtid    string //position committed along with the last transaction
+	txnPending bool   //MySQL transaction is not finished yet
+	txnBegin   bool   //MySQL transaction started by explicit BEGIN
 }
 
 func init() {
@@ -130,7 +145,7 @@ func (b *mysqlReader) pushSchema(tver []*table) bool {
 	for i := 0; i < len(tver); i++ {
 		t := tver[i]
 		log.Debugf("format vvvvv %v %v %v", t.outputFormat, t.encoder.Type(), encoder.Internal.Type())
-		if t.outputFormat != "json" && t.outputFormat != "msgpack" {
+		if t.outputFormat != "json" && t.outputFormat != "msgpack" && t.outputFormat != "protobuf" {
 			continue
 		}
 
@@ -167,6 +182,17 @@ func (b *mysqlReader) addNewTable(st state.Type, i int) bool {
 		return true
 	}
 
+	partCols, err := partitionColumns(t.Service, t.Db, t.Table, t.Input, t.Output, t.Version)
+	if log.EL(b.log, err) {
+		return false
+	}
+
+	row := make([]interface{}, len(enc.Schema().Columns))
+	if _, err = encoder.GetRowColumnValues(enc.Schema(), &row, partCols); err != nil {
+		b.log.Errorf("Invalid partition columns: %v. Won't ingest the table", err)
+		return true
+	}
+
 	pn, err := config.Get().GetChangelogTopicName(t.Service, t.Db, t.Table, t.Input, t.Output, t.Version)
 	if log.EL(b.log, err) {
 		return false
@@ -184,7 +210,12 @@ func (b *mysqlReader) addNewTable(st state.Type, i int) bool {
 		format = t.OutputFormat
 	}
 
-	p, err := pipe.NewProducer(pn)
+	newProducer := pipe.NewProducer
+	if b.txn != nil && config.Get().ChangelogBuffer {
+		newProducer = b.txn.NewProducer
+	}
+
+	p, err := newProducer(pn)
 	if err != nil {
 		return false
 	}
@@ -193,7 +224,7 @@ func (b *mysqlReader) addNewTable(st state.Type, i int) bool {
 
 	b.log.Infof("New table added to MySQL binlog reader (%v,%v,%v,%v,%v,%v), will produce to: %v", t.Service, t.Db, t.Table, t.Output, t.Version, t.OutputFormat, pn)
 
-	nt := &table{t.ID, false, p, t.RawSchema, t.SchemaGtid, t.Service, enc, t.Output, t.Version, t.OutputFormat}
+	nt := &table{t.ID, false, p, t.RawSchema, t.SchemaGtid, t.Service, enc, t.Output, t.Version, t.OutputFormat, t.Db, t.Table, pn, false, partCols}
 
 	if b.tables[t.Db][t.Table] == nil {
 		b.tables[t.Db][t.Table] = make([]*table, 0)
@@ -203,6 +234,21 @@ func (b *mysqlReader) addNewTable(st state.Type, i int) bool {
 	return true
 }
 
+//partitionColumns returns partition columns configured for the Kafka output
+//topic of the table. Streamer needs their values to partition the events read
+//from the buffer
+func partitionColumns(svc string, sdb string, tbl string, input string, output string, ver int) ([]string, error) {
+	cfg := config.Get()
+	if !cfg.ChangelogBuffer || output != "kafka" {
+		return nil, nil
+	}
+	topic, err := cfg.GetOutputTopicName(svc, sdb, tbl, input, output, ver)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.GetKafkaPartitioner(topic).Columns, nil
+}
+
 func (b *mysqlReader) removeDeletedTables() (count uint) {
 	for m := range b.tables {
 		for n := range b.tables[m] {
@@ -310,6 +356,21 @@ func (b *mysqlReader) reloadState() bool {
 	return true
 }
 
+//flushProducers waits for the committed events of all the tables to be
+//acknowledged
+func (b *mysqlReader) flushProducers() bool {
+	for _, sdb := range b.tables {
+		for _, tver := range sdb {
+			for _, t := range tver {
+				if log.EL(b.log, pipe.Flush(t.producer)) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
 /* Generates next seqno, seqno is used as a logical time in the produced events */
 /* Saves seqno in the state every seqnoSaveInterval */
 func (b *mysqlReader) nextSeqNo() uint64 {
@@ -336,7 +397,13 @@ func (b *mysqlReader) updateState(inc bool) bool {
 		b.seqNo += seqnoSaveInterval
 	}
 
-	if log.E(state.SaveBinlogState(&b.dbl, b.gtidSet.String(), b.seqNo)) {
+	//Binlog position can be persisted only after all the produced events are
+	//acknowledged
+	if !b.flushProducers() {
+		return false
+	}
+
+	if log.E(state.SaveBinlogState(&b.dbl, b.statePosition(), b.seqNo)) {
 		return false
 	}
 
@@ -364,9 +431,15 @@ func (b *mysqlReader) updateState(inc bool) bool {
 	return true
 }
 
-func (b *mysqlReader) wrapEvent(outputFormat string, key string, bd []byte, seqno uint64) ([]byte, error) {
-	akey := make([]interface{}, 1)
+//wrapEvent wraps event encoded in the output format into internal format
+//envelope. Envelope key contains row key followed by values of partition
+//columns, which are used by streamer to partition the event. Envelope also carries GTID of
+//the transaction, which streamer passes in the message headers, and MySQL
+//event time, which files are partitioned by
+func (b *mysqlReader) wrapEvent(outputFormat string, key string, part []interface{}, bd []byte, seqno uint64) ([]byte, error) {
+	akey := make([]interface{}, 1, len(part)+1)
 	akey[0] = key
+	akey = append(akey, part...)
 
 	cfw := types.CommonFormatEvent{
 		Type:      outputFormat,
@@ -374,6 +447,8 @@ func (b *mysqlReader) wrapEvent(outputFormat string, key string, bd []byte, seqn
 		SeqNo:     seqno,
 		Timestamp: time.Now().UnixNano(),
 		Fields:    nil,
+		Gtid:      b.gtid,
+		EventTime: b.eventTime,
 	}
 
 	cfb, err := encoder.Internal.CommonFormat(&cfw)
@@ -387,29 +462,46 @@ func (b *mysqlReader) wrapEvent(outputFormat string, key string, bd []byte, seqn
 	return buf.Bytes(), nil
 }
 
+//tableLoc returns location of the table, used to build event headers
+func (b *mysqlReader) tableLoc(t *table) *types.TableLoc {
+	return &types.TableLoc{Service: t.service, Cluster: b.dbl.Cluster, Db: t.db, Table: t.name, Input: "mysql", Output: t.output, Version: t.version}
+}
+
 func (b *mysqlReader) produceRow(tp int, t *table, row *[]interface{}) error {
 	var err error
-	buffered := config.Get().ChangelogBuffer
+	cfg := config.Get()
+	buffered := cfg.ChangelogBuffer
 	seqno := b.nextSeqNo()
 	if seqno == 0 {
 		return fmt.Errorf("Failed to generate next seqno. Current seqno:%+v", b.seqNo)
 	}
 	key := encoder.GetRowKey(t.encoder.Schema(), row)
 	if buffered && b.bufPipe.Type() == "local" {
-		err = t.producer.PushBatch(key, &types.RowMessage{Type: tp, Key: key, Data: row, SeqNo: seqno})
+		err = t.producer.PushBatch(key, &types.RowMessage{Type: tp, Key: key, Data: row, SeqNo: seqno, Gtid: b.gtid, EventTime: b.eventTime})
 	} else {
 		var bd []byte
 		bd, err = t.encoder.Row(tp, row, seqno)
 		if log.EL(b.log, err) {
 			return err
 		}
-		if buffered && t.encoder.Type() != encoder.Internal.Type() {
-			bd, err = b.wrapEvent(t.outputFormat, key, bd, seqno)
+		//Envelope is required to pass GTID to the streamer, when headers
+		//are enabled, values of partition columns, which may be absent
+		//in the common format delete event, and event time
+		if buffered && (t.encoder.Type() != encoder.Internal.Type() || cfg.KafkaHeaders || len(t.partitionColumns) != 0 || cfg.FilePartition.Time == config.PartitionTimeEvent) {
+			var part []interface{}
+			if part, err = encoder.GetRowColumnValues(t.encoder.Schema(), row, t.partitionColumns); log.EL(b.log, err) {
+				return err
+			}
+			bd, err = b.wrapEvent(t.outputFormat, key, part, bd, seqno)
 			if log.EL(b.log, err) {
 				return err
 			}
 		}
-		err = t.producer.PushBatch(key, bd)
+		var opts *pipe.MessageOptions
+		if !buffered && cfg.KafkaHeaders {
+			opts = &pipe.MessageOptions{Headers: pipe.EventHeaders(b.tableLoc(t), t.outputFormat, seqno, b.gtid)}
+		}
+		err = pipe.PushBatchOptions(t.producer, key, bd, opts)
 	}
 	//log.Debugf("Pushed to buffer. seqno=%v, table=%v", seqno, t.id)
 	if shutdown.Initiated() {
@@ -419,6 +511,7 @@ func (b *mysqlReader) produceRow(tp int, t *table, row *[]interface{}) error {
 		b.log.Errorf("Type: %v, Error: %v", tp, err.Error())
 		return err
 	}
+	t.produced = true
 	b.metrics.BinlogRowEventsWritten.Inc(1)
 	return nil
 }
@@ -550,6 +643,8 @@ func (b *mysqlReader) incGTID(v *replication.GTIDEvent) bool {
 		return false
 	}
 
+	b.gtid = fmt.Sprintf("%s:%d", u.String(), v.GNO)
+
 	if s, ok := b.gtidSet.Sets[u.String()]; ok {
 		l := &s.Intervals[len(s.Intervals)-1]
 		if l.Stop == v.GNO {
@@ -559,10 +654,9 @@ func (b *mysqlReader) incGTID(v *replication.GTIDEvent) bool {
 		b.log.Infof("non-sequential gtid event: %+v %+v", l.Stop, v.GNO)
 	}
 
-	gtid := fmt.Sprintf("%s:%d", u.String(), v.GNO)
-	b.log.Infof("non-sequential gtid event: %+v", gtid)
+	b.log.Infof("non-sequential gtid event: %+v", b.gtid)
 	b.log.Infof("out gtid set: %+v", b.gtidSet.String())
-	us, err := mysql.ParseUUIDSet(gtid)
+	us, err := mysql.ParseUUIDSet(b.gtid)
 	if log.E(err) {
 		return false
 	}
@@ -576,6 +670,7 @@ func (b *mysqlReader) handleEvent(ev *replication.BinlogEvent) bool {
 	if ev.Header.Timestamp != 0 {
 		b.metrics.TimeToEncounter.Record(time.Duration(time.Now().Unix()-int64(ev.Header.Timestamp)) * time.Second)
 	}
+	b.eventTime = int64(ev.Header.Timestamp) * int64(time.Second)
 	switch v := ev.Event.(type) {
 	case *replication.FormatDescriptionEvent:
 		b.log.Infof("ServerVersion: %+v, BinlogFormatVersion: %+v, ChecksumAlgorithm: %+v", util.BytesToString(v.ServerVersion), v.Version, v.ChecksumAlgorithm)
@@ -587,14 +682,16 @@ func (b *mysqlReader) handleEvent(ev *replication.BinlogEvent) bool {
 		if !b.handleQueryEvent(ev) {
 			return false
 		}
+		b.txnQuery(util.BytesToString(v.Query))
 	case *replication.GTIDEvent:
 		if !b.incGTID(v) {
 			return false
 		}
+		b.txnPending, b.txnBegin = true, false
 	case *replication.TableMapEvent:
 		//It's already in RowsEvent, not need to handle separately
 	case *replication.XIDEvent:
-		//ignoring
+		b.txnPending = false
 	default:
 		if ev.Header.EventType != replication.HEARTBEAT_EVENT {
 			b.metrics.BinlogUnhandledEvents.Inc(1)
@@ -648,6 +745,10 @@ L:
 	//TODO: Commit only tables which had data in this batch
 	w := b.metrics.ProduceLatency
 	w.Start()
+	if b.txn != nil {
+		defer w.Stop()
+		return b.commitTxn()
+	}
 	for _, sdb := range b.tables {
 		for _, tver := range sdb {
 			for i := 0; i < len(tver); i++ {
@@ -741,8 +842,8 @@ M:
 
 	b.log.Debugf("Finishing MySQL binlog reader")
 
-	if !log.EL(b.log, state.SaveBinlogState(&b.dbl, b.gtidSet.String(), b.seqNo)) {
-		b.log.WithFields(log.Fields{"gtid": b.gtidSet.String(), "SeqNo": b.seqNo}).Infof("Binlog state saved")
+	if b.flushProducers() && !log.EL(b.log, state.SaveBinlogState(&b.dbl, b.statePosition(), b.seqNo)) {
+		b.log.WithFields(log.Fields{"gtid": b.statePosition(), "SeqNo": b.seqNo}).Infof("Binlog state saved")
 	}
 }
 
@@ -831,6 +932,18 @@ func (b *mysqlReader) start(cfg *config.AppConfig) bool {
 		}
 	}
 
+	if cfg.KafkaExactlyOnce {
+		if !b.initTxn() {
+			return true
+		}
+		defer b.closeTxn()
+
+		if gtid, err = b.committedPosition(gtid); log.EL(b.log, err) {
+			return true
+		}
+		b.txnGtid = gtid
+	}
+
 	s, err := mysql.ParseMysqlGTIDSet(gtid)
 	if err != nil {
 		b.log.Errorf("Invalid gtid: '%v' Error: %v", gtid, err.Error())
@@ -0,0 +1,129 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package changelog
+
+import (
+	"github.com/raksh93/storagetapper/log"
+	"github.com/raksh93/storagetapper/pipe"
+	"github.com/raksh93/storagetapper/types"
+)
+
+//txnID is used as both transaction ID of the reader's transactional producer
+//and consumer group ID, which offsets carry committed binlog position
+func (b *mysqlReader) txnID() string {
+	return types.MySvcName + ".reader." + b.dbl.Cluster
+}
+
+//initTxn creates transactional producer of the reader. This aborts
+//unfinished transaction of the previous reader of the cluster
+func (b *mysqlReader) initTxn() bool {
+	var err error
+	b.txn, err = pipe.NewTxnProducer(b.bufPipe, b.txnID())
+	return !log.EL(b.log, err)
+}
+
+func (b *mysqlReader) closeTxn() {
+	log.EL(b.log, b.txn.Close())
+	b.txn = nil
+}
+
+//committedPosition returns binlog position committed along with the last
+//transaction. Position is stored in the metadata of the reader group offsets
+//of the changelog topics, offset is the seqno of the transaction. Returns
+//def if reader hasn't committed any transaction yet
+func (b *mysqlReader) committedPosition(def string) (string, error) {
+	offsets, err := pipe.CommittedOffsets(b.bufPipe, b.txnID())
+	if err != nil {
+		return "", err
+	}
+
+	var last *pipe.Offset
+	for i := range offsets {
+		if offsets[i].Metadata != "" && (last == nil || offsets[i].Offset > last.Offset) {
+			last = &offsets[i]
+		}
+	}
+
+	if last == nil {
+		return def, nil
+	}
+
+	b.log.WithFields(log.Fields{"gtid": last.Metadata, "SeqNo": last.Offset}).Infof("Starting from position committed to Kafka")
+
+	return last.Metadata, nil
+}
+
+//txnQuery tracks the end of MySQL transaction by the query event. Statements
+//not wrapped in BEGIN/COMMIT, like DDL, are transactions by themselves
+func (b *mysqlReader) txnQuery(query string) {
+	switch {
+	case query == "BEGIN":
+		b.txnBegin = true
+	case query == "COMMIT" || !b.txnBegin:
+		b.txnPending = false
+	}
+}
+
+//commitTxn commits events queued by all the tables along with the binlog
+//position. Commit is postponed until the end of MySQL transaction, so as the
+//position never points in the middle of it
+func (b *mysqlReader) commitTxn() bool {
+	if b.txnPending {
+		return true
+	}
+
+	gtid := b.gtidSet.String()
+	if gtid == b.txnGtid {
+		return true
+	}
+
+	//Position is committed to the topics the reader has produced to, since
+	//offsets of nonexistent topics are rejected
+	var offsets []pipe.Offset
+	topics := make(map[string]bool)
+	for _, sdb := range b.tables {
+		for _, tver := range sdb {
+			for _, t := range tver {
+				if t.produced && !topics[t.topic] {
+					topics[t.topic] = true
+					offsets = append(offsets, pipe.Offset{Topic: t.topic, Offset: int64(b.seqNo), Metadata: gtid})
+				}
+			}
+		}
+	}
+
+	if log.EL(b.log, b.txn.Commit(b.txnID(), offsets)) {
+		return false
+	}
+
+	b.txnGtid = gtid
+
+	return true
+}
+
+//statePosition returns binlog position to be saved in the state. In
+//exactly-once mode it's the position of the last committed transaction
+func (b *mysqlReader) statePosition() string {
+	if b.txn != nil {
+		return b.txnGtid
+	}
+	return b.gtidSet.String()
+}
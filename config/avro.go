@@ -0,0 +1,51 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package config
+
+import (
+	"fmt"
+)
+
+// AvroOCFConfig holds options of Avro Object Container Files written by the
+// file based pipes
+type AvroOCFConfig struct {
+	//Enabled makes file based pipes write Avro output format as Object
+	//Container Files, instead of raw records
+	Enabled bool `yaml:"enabled"`
+	//Codec compresses the blocks of records. One of: null, deflate, snappy,
+	//zstandard
+	Codec string `yaml:"codec"`
+	//BlockSize is approximate size of uncompressed block in bytes
+	BlockSize int `yaml:"block_size"`
+}
+
+func (c *AvroOCFConfig) validate() error {
+	switch c.Codec {
+	case "null", "deflate", "snappy", "zstandard":
+	default:
+		return fmt.Errorf("Invalid avro_ocf codec: '%v'. Expected one of: null, deflate, snappy, zstandard", c.Codec)
+	}
+
+	if c.BlockSize <= 0 {
+		return fmt.Errorf("Invalid avro_ocf block_size: %v", c.BlockSize)
+	}
+
+	return nil
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package config
+
+import (
+	"testing"
+)
+
+func TestAvroOCFConfig(t *testing.T) {
+	cfg, err := loadSchedule(t, "avro_ocf:\n    enabled: true\n    codec: snappy\n")
+	checkFail(t, err)
+
+	if !cfg.AvroOCF.Enabled || cfg.AvroOCF.Codec != "snappy" || cfg.AvroOCF.BlockSize != 64*1024 {
+		t.Fatalf("Unexpected avro_ocf config: %+v", cfg.AvroOCF)
+	}
+
+	for _, c := range []string{
+		"avro_ocf:\n    codec: lzma\n",
+		"avro_ocf:\n    block_size: 0\n",
+		"pipe_aes256_key: 12345678901234567890123456789012\navro_ocf:\n    enabled: true\n",
+	} {
+		if _, err := loadSchedule(t, c); err == nil {
+			t.Fatalf("Config should fail to load: %v", c)
+		}
+	}
+}
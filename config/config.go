@@ -38,11 +38,16 @@ type AppConfigODS struct {
 	ServiceName string `yaml:"serviceName"`
 	Port        int    `yaml:"port"`
 
-	MaxNumProcs        int          `yaml:"max_num_procs"`
-	StateUpdateTimeout int          `yaml:"state_update_timeout"`
-	StateConnectURL    string       `yaml:"state_connect_url"`
-	KafkaAddrs         []string     `yaml:"kafka_addresses"`
-	Hadoop             HadoopConfig `yaml:"hadoop"`
+	MaxNumProcs        int             `yaml:"max_num_procs"`
+	StateUpdateTimeout int             `yaml:"state_update_timeout"`
+	StateConnectURL    string          `yaml:"state_connect_url"`
+	KafkaAddrs         []string        `yaml:"kafka_addresses"`
+	KafkaTombstones    string          `yaml:"kafka_tombstones"`
+	Hadoop             HadoopConfig    `yaml:"hadoop"`
+	S3                 S3Config        `yaml:"s3"`
+	MySQLSink          MySQLSinkConfig `yaml:"mysql_sink"`
+	Webhook            WebhookConfig   `yaml:"webhook"`
+	Stream             StreamConfig    `yaml:"stream"`
 
 	ChangelogPipeType                 string                       `yaml:"changelog_pipe_type"`
 	ChangelogTopicNameTemplateDefault string                       `yaml:"changelog_topic_name_template_default"`
@@ -53,14 +58,38 @@ type AppConfigODS struct {
 	OutputTopicNameTemplate        map[string]map[string]string `yaml:"output_topic_name_template"`
 	ClusterConcurrency             int                          `yaml:"cluster_concurrency"`
 
+	DeadLetterTopicNameTemplateDefault string           `yaml:"dead_letter_topic_name_template_default"`
+	DeadLetter                         DeadLetterConfig `yaml:"dead_letter"`
+
+	KafkaPartitioning   KafkaPartitioningConfig `yaml:"kafka_partitioning"`
+	KafkaConsumerGroups bool                    `yaml:"kafka_consumer_groups"`
+	KafkaHeaders        bool                    `yaml:"kafka_headers"`
+	KafkaExactlyOnce    bool                    `yaml:"kafka_exactly_once"`
+	KafkaTxnMaxBytes    int64                   `yaml:"kafka_txn_max_bytes"`
+
+	KafkaTLS       KafkaTLSConfig       `yaml:"kafka_tls"`
+	KafkaSASL      KafkaSASLConfig      `yaml:"kafka_sasl"`
+	KafkaTopics    KafkaTopicsConfig    `yaml:"kafka_topics"`
+	KafkaProducer  KafkaProducerConfig  `yaml:"kafka_producer"`
+	KafkaOversized KafkaOversizedConfig `yaml:"kafka_oversized"`
+
 	PipeBatchSize int `yaml:"pipe_batch_size"`
 
-	OutputPipeConcurrency int  `yaml:"output_pipe_concurrency"`
-	ForceMasterConnection bool `yaml:"force_master_connection"`
+	OutputPipeConcurrency   int  `yaml:"output_pipe_concurrency"`
+	ForceMasterConnection   bool `yaml:"force_master_connection"`
+	StreamerTablesPerWorker int  `yaml:"streamer_tables_per_worker"`
 
 	ThrottleTargetMB   int64 `yaml:"throttle_target_mb"`
 	ThrottleTargetIOPS int64 `yaml:"throttle_target_iops"`
 
+	ClusterThrottleTargetMB   int64 `yaml:"cluster_throttle_target_mb"`
+	ClusterThrottleTargetIOPS int64 `yaml:"cluster_throttle_target_iops"`
+
+	SnapshotSchedule SnapshotScheduleConfig `yaml:"snapshot_schedule"`
+
+	VerifyChunkSize   int `yaml:"verify_chunk_size"`
+	VerifyIdleTimeout int `yaml:"verify_idle_timeout"`
+
 	DefaultInputType string `yaml:"default_input_type"`
 
 	DataDir     string `yaml:"data_dir"`
@@ -72,8 +101,19 @@ type AppConfigODS struct {
 	PipeHMACKey    string `yaml:"pipe_hmac_key"`
 	PipeVerifyHMAC bool   `yaml:"pipe_verify_hmac"`
 
-	PipeCompression  bool `yaml:"pipe_compression"`
-	PipeFileNoHeader bool `yaml:"pipe_file_no_header"`
+	PipeKeyring PipeKeyringConfig `yaml:"pipe_keyring"`
+
+	PipeCompression      bool   `yaml:"pipe_compression"`
+	PipeCompressionCodec string `yaml:"pipe_compression_codec"`
+	PipeCompressionLevel int    `yaml:"pipe_compression_level"`
+	PipeFileNoHeader     bool   `yaml:"pipe_file_no_header"`
+
+	AvroOCF AvroOCFConfig `yaml:"avro_ocf"`
+	Parquet ParquetConfig `yaml:"parquet"`
+
+	FilePartition FilePartitionConfig `yaml:"file_partition"`
+
+	LocalPipeSpill LocalPipeSpillConfig `yaml:"local_pipe_spill"`
 }
 
 // AppConfig is the config struct which the config gets loaded into
@@ -84,8 +124,29 @@ type AppConfig struct {
 	OutputTopicNameTemplateParsed           map[string]map[string]*template.Template
 	ChangelogTopicNameTemplateDefaultParsed *template.Template
 	OutputTopicNameTemplateDefaultParsed    *template.Template
+	DeadLetterTopicNameTemplateParsed       *template.Template
+	WebhookURLTemplateParsed                *template.Template
+	FilePartitionTemplateParsed             *template.Template
 }
 
+//Kafka tombstone modes
+const (
+	//KafkaTombstonesAppend produces tombstone after delete event
+	KafkaTombstonesAppend = "append"
+	//KafkaTombstonesReplace produces tombstone instead of delete event
+	KafkaTombstonesReplace = "replace"
+)
+
+//File pipe compression codecs
+const (
+	CompressionNone   = "none"
+	CompressionZlib   = "zlib"
+	CompressionGzip   = "gzip"
+	CompressionZstd   = "zstd"
+	CompressionSnappy = "snappy"
+	CompressionLZ4    = "lz4"
+)
+
 // HadoopConfig holds hadoop output pipe configuration
 type HadoopConfig struct {
 	User      string   `yaml:"user"`
@@ -93,6 +154,12 @@ type HadoopConfig struct {
 	BaseDir   string   `yaml:"base_dir"`
 }
 
+// MySQLSinkConfig holds MySQL output pipe configuration
+type MySQLSinkConfig struct {
+	//ConnectURL of the target database. Format: user:password@host:port/db
+	ConnectURL string `yaml:"connect_url"`
+}
+
 func getDefaultConfig() *AppConfigODS {
 	return &AppConfigODS{
 		Port: 7836,
@@ -106,23 +173,49 @@ func getDefaultConfig() *AppConfigODS {
 
 		OutputTopicNameTemplateDefault: "hp-tap-{{.Service}}-{{.Db}}-{{.Table}}",
 
+		DeadLetterTopicNameTemplateDefault: "hp-tap-dlq-{{.Service}}-{{.Db}}-{{.Table}}",
+
+		KafkaProducer:    KafkaProducerConfig{MaxInFlightBatches: 4},
+		KafkaTxnMaxBytes: 256 * 1024 * 1024,
+
 		PipeBatchSize:         256,
 		OutputPipeConcurrency: 1,
 		ClusterConcurrency:    0,
 		ForceMasterConnection: false,
 
+		StreamerTablesPerWorker: 1,
+
 		LogType:  "std",
 		LogLevel: "info",
 
 		ThrottleTargetMB:   0,
 		ThrottleTargetIOPS: 0,
 
+		ClusterThrottleTargetMB:   0,
+		ClusterThrottleTargetIOPS: 0,
+
+		VerifyChunkSize:   1000,
+		VerifyIdleTimeout: 10,
+
 		DefaultInputType: "mysql",
 
 		DataDir:     fmt.Sprintf("/var/lib/%s", types.MySvcName),
 		MaxFileSize: 1024 * 1024 * 1024,
 
 		InternalEncoding: "json",
+
+		S3: S3Config{Region: "us-east-1", PartSize: 16 * 1024 * 1024},
+
+		Webhook: WebhookConfig{Timeout: 30, Retries: 5, RetryBackoff: 100, MaxRetryBackoff: 10000, Concurrency: 1},
+
+		Stream: StreamConfig{MaxClients: 16, HeartbeatInterval: 10},
+
+		AvroOCF: AvroOCFConfig{Codec: "null", BlockSize: 64 * 1024},
+		Parquet: ParquetConfig{Codec: "snappy", RowGroupSize: 8 * 1024 * 1024},
+
+		FilePartition: FilePartitionConfig{Time: PartitionTimeProcessing},
+
+		LocalPipeSpill: LocalPipeSpillConfig{MaxDiskBytes: 1024 * 1024 * 1024},
 	}
 }
 
@@ -195,6 +288,125 @@ func parseConfig(cfg *AppConfigODS) (*AppConfig, error) {
 	}
 	c.ChangelogTopicNameTemplateDefaultParsed = td
 
+	td, err = template.New("dltntd").Parse(c.DeadLetterTopicNameTemplateDefault)
+	if err != nil {
+		return nil, err
+	}
+	c.DeadLetterTopicNameTemplateParsed = td
+
+	if c.Webhook.URL != "" {
+		td, err = template.New("webhook").Parse(c.Webhook.URL)
+		if err != nil {
+			return nil, err
+		}
+		c.WebhookURLTemplateParsed = td
+	}
+
+	switch c.KafkaTombstones {
+	case "", KafkaTombstonesAppend, KafkaTombstonesReplace:
+	default:
+		return nil, fmt.Errorf("Invalid kafka_tombstones: '%v'. Expected one of: append, replace", c.KafkaTombstones)
+	}
+
+	switch c.PipeCompressionCodec {
+	case "", CompressionNone, CompressionZlib, CompressionGzip, CompressionZstd, CompressionSnappy, CompressionLZ4:
+	default:
+		return nil, fmt.Errorf("Invalid pipe_compression_codec: '%v'. Expected one of: none, zlib, gzip, zstd, snappy, lz4", c.PipeCompressionCodec)
+	}
+
+	if err = c.DeadLetter.validate(); err != nil {
+		return nil, err
+	}
+
+	if err = c.KafkaPartitioning.validate(); err != nil {
+		return nil, err
+	}
+
+	if err = c.KafkaTLS.validate(); err != nil {
+		return nil, err
+	}
+
+	if err = c.KafkaSASL.validate(); err != nil {
+		return nil, err
+	}
+
+	if err = c.KafkaTopics.validate(); err != nil {
+		return nil, err
+	}
+
+	if err = c.KafkaProducer.validate(); err != nil {
+		return nil, err
+	}
+
+	if err = c.KafkaOversized.validate(); err != nil {
+		return nil, err
+	}
+
+	//Fragments of the chunked message share the message key
+	if c.KafkaOversized.Mode == KafkaOversizedChunk && (c.KafkaTombstones != "" || c.KafkaTopics.compacted()) {
+		return nil, fmt.Errorf("kafka_oversized chunk mode can't be used with compacted topics or kafka_tombstones. Use offload mode instead")
+	}
+
+	if err = c.S3.validate(); err != nil {
+		return nil, err
+	}
+
+	if err = c.Webhook.validate(); err != nil {
+		return nil, err
+	}
+
+	if err = c.Stream.validate(); err != nil {
+		return nil, err
+	}
+
+	if err = c.PipeKeyring.validate(); err != nil {
+		return nil, err
+	}
+
+	if c.PipeKeyring.Envelope && c.PipeFileNoHeader {
+		return nil, fmt.Errorf("pipe_keyring envelope encryption is incompatible with pipe_file_no_header, data key is stored in the header")
+	}
+
+	if err = c.AvroOCF.validate(); err != nil {
+		return nil, err
+	}
+
+	if c.AvroOCF.Enabled && c.PipeEncryption() {
+		return nil, fmt.Errorf("avro_ocf is incompatible with pipe encryption, container files are not encrypted")
+	}
+
+	if err = c.Parquet.validate(); err != nil {
+		return nil, err
+	}
+
+	if c.Parquet.Enabled && c.PipeEncryption() {
+		return nil, fmt.Errorf("parquet is incompatible with pipe encryption, parquet files are not encrypted")
+	}
+
+	if c.Parquet.Enabled && c.AvroOCF.Enabled {
+		return nil, fmt.Errorf("parquet and avro_ocf can't be enabled at the same time")
+	}
+
+	if c.FilePartitionTemplateParsed, err = c.FilePartition.parse(); err != nil {
+		return nil, err
+	}
+
+	if err = c.LocalPipeSpill.validate(); err != nil {
+		return nil, err
+	}
+
+	if c.KafkaExactlyOnce && (!c.KafkaConsumerGroups || !c.ChangelogBuffer || c.ChangelogPipeType != "kafka") {
+		return nil, fmt.Errorf("kafka_exactly_once requires kafka_consumer_groups and Kafka changelog buffer")
+	}
+
+	if c.KafkaTxnMaxBytes <= 0 {
+		return nil, fmt.Errorf("Invalid kafka_txn_max_bytes: %v. Should be positive", c.KafkaTxnMaxBytes)
+	}
+
+	if err = c.SnapshotSchedule.validate(); err != nil {
+		return nil, err
+	}
+
 	return &c, nil
 }
 
@@ -63,6 +63,42 @@ func TestBasic(t *testing.T) {
 	if d.ChangelogTopicNameTemplate == nil {
 		d.ChangelogTopicNameTemplate = make(map[string]map[string]string)
 	}
+	if d.SnapshotSchedule.Default.Windows == nil {
+		d.SnapshotSchedule.Default.Windows = make([]string, 0)
+	}
+	if d.SnapshotSchedule.Clusters == nil {
+		d.SnapshotSchedule.Clusters = make(map[string]SnapshotSchedule)
+	}
+	if d.SnapshotSchedule.Tables == nil {
+		d.SnapshotSchedule.Tables = make(map[string]SnapshotSchedule)
+	}
+	if d.DeadLetter.Clusters == nil {
+		d.DeadLetter.Clusters = make(map[string]DeadLetterPolicy)
+	}
+	if d.DeadLetter.Tables == nil {
+		d.DeadLetter.Tables = make(map[string]DeadLetterPolicy)
+	}
+	if d.KafkaPartitioning.Default.Columns == nil {
+		d.KafkaPartitioning.Default.Columns = make([]string, 0)
+	}
+	if d.KafkaPartitioning.Default.Partitions == nil {
+		d.KafkaPartitioning.Default.Partitions = make(map[string]int32)
+	}
+	if d.KafkaPartitioning.Topics == nil {
+		d.KafkaPartitioning.Topics = make(map[string]KafkaPartitioner)
+	}
+	if d.KafkaTopics.Output == nil {
+		d.KafkaTopics.Output = make(map[string]map[string]KafkaTopicSettings)
+	}
+	if d.KafkaTopics.Changelog == nil {
+		d.KafkaTopics.Changelog = make(map[string]map[string]KafkaTopicSettings)
+	}
+	if d.Webhook.Headers == nil {
+		d.Webhook.Headers = make(map[string]string)
+	}
+	if d.PipeKeyring.Keys == nil {
+		d.PipeKeyring.Keys = make(map[string]PipeKeyConfig)
+	}
 
 	if !reflect.DeepEqual(*d, c.AppConfigODS) {
 		t.Fatalf("loaded should be equal to default")
@@ -160,3 +196,16 @@ func TestConfigNeg(t *testing.T) {
 		t.Fatalf("error should exit the program")
 	}
 }
+
+func TestPipeCompressionCodec(t *testing.T) {
+	cfg, err := loadSchedule(t, "pipe_compression_codec: zstd\npipe_compression_level: 3\n")
+	checkFail(t, err)
+
+	if cfg.PipeCompressionCodec != CompressionZstd || cfg.PipeCompressionLevel != 3 {
+		t.Fatalf("Unexpected compression config: %v %v", cfg.PipeCompressionCodec, cfg.PipeCompressionLevel)
+	}
+
+	if _, err := loadSchedule(t, "pipe_compression_codec: brotli\n"); err == nil {
+		t.Fatalf("Config with unknown compression codec should fail to load")
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import (
+	"fmt"
+
+	"github.com/raksh93/storagetapper/types"
+)
+
+//Dead letter policies
+const (
+	//DeadLetterHalt stops streaming the table on failure. Table is retried
+	//by the next worker which picks it up
+	DeadLetterHalt = "halt"
+	//DeadLetterSkip writes failed event to the dead letter topic and continues
+	DeadLetterSkip = "skip"
+	//DeadLetterRetry retries failed event, then writes it to the dead letter
+	//topic and continues
+	DeadLetterRetry = "retry"
+	//DeadLetterMaxDataSizeDefault is the default limit of the original event
+	//size stored in the dead letter message
+	DeadLetterMaxDataSizeDefault = 64 * 1024
+)
+
+// DeadLetterPolicy defines how streamer handles events it failed to encode or
+// produce
+type DeadLetterPolicy struct {
+	//Policy is one of halt, skip, retry. Default is halt
+	Policy string `yaml:"policy"`
+	//Retries is the number of retries for retry policy
+	Retries int `yaml:"retries"`
+	//Pipe type the dead letters are written to. Table output pipe by default
+	Pipe string `yaml:"pipe"`
+	//MaxDataSize limits the size of the original event stored in the dead
+	//letter message. Larger events are truncated, so as the events which
+	//failed because of their size can be written to the same pipe
+	MaxDataSize int `yaml:"max_data_size"`
+}
+
+// DeadLetterConfig holds dead letter policies. Table policy takes precedence
+// over cluster policy, which in turn takes precedence over the default one
+type DeadLetterConfig struct {
+	Default  DeadLetterPolicy            `yaml:"default"`
+	Clusters map[string]DeadLetterPolicy `yaml:"clusters"`
+	//Tables keyed by "cluster.db.table"
+	Tables map[string]DeadLetterPolicy `yaml:"tables"`
+}
+
+func (p *DeadLetterPolicy) validate() error {
+	switch p.Policy {
+	case "", DeadLetterHalt, DeadLetterSkip, DeadLetterRetry:
+	default:
+		return fmt.Errorf("Invalid dead letter policy: '%v'. Expected one of: halt, skip, retry", p.Policy)
+	}
+
+	if p.Retries < 0 {
+		return fmt.Errorf("Invalid dead letter retries: %v", p.Retries)
+	}
+
+	if p.MaxDataSize < 0 {
+		return fmt.Errorf("Invalid dead letter max data size: %v", p.MaxDataSize)
+	}
+
+	return nil
+}
+
+func (c *DeadLetterConfig) validate() error {
+	if err := c.Default.validate(); err != nil {
+		return err
+	}
+
+	for _, v := range c.Clusters {
+		if err := v.validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, v := range c.Tables {
+		if err := v.validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetDeadLetterPolicy returns dead letter policy for the given table
+func (c *AppConfig) GetDeadLetterPolicy(cluster string, db string, table string) *DeadLetterPolicy {
+	p, ok := c.DeadLetter.Tables[cluster+"."+db+"."+table]
+	if !ok {
+		if p, ok = c.DeadLetter.Clusters[cluster]; !ok {
+			p = c.DeadLetter.Default
+		}
+	}
+
+	if p.Policy == "" {
+		p.Policy = DeadLetterHalt
+	}
+
+	if p.MaxDataSize == 0 {
+		p.MaxDataSize = DeadLetterMaxDataSizeDefault
+	}
+
+	return &p
+}
+
+// GetDeadLetterTopicName returns dead letter topic name
+func (c *AppConfig) GetDeadLetterTopicName(svc string, db string, tbl string, input string, output string, ver int) (string, error) {
+	return getTopicName(c.DeadLetterTopicNameTemplateParsed, &types.TableLoc{Service: svc, Cluster: "", Db: db, Table: tbl, Input: input, Output: output, Version: ver})
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import (
+	"testing"
+)
+
+var testDeadLetterFile = `
+dead_letter:
+    default:
+        policy: skip
+    clusters:
+        clst1:
+            policy: retry
+            retries: 3
+    tables:
+        clst1.db1.t1:
+            policy: halt
+`
+
+func TestDeadLetterPolicy(t *testing.T) {
+	cfg, err := loadSchedule(t, "")
+	checkFail(t, err)
+
+	p := cfg.GetDeadLetterPolicy("clst1", "db1", "t1")
+	if p.Policy != DeadLetterHalt || p.MaxDataSize != DeadLetterMaxDataSizeDefault {
+		t.Fatalf("Expected halt policy by default, got: %+v", p)
+	}
+
+	cfg, err = loadSchedule(t, testDeadLetterFile)
+	checkFail(t, err)
+
+	p = cfg.GetDeadLetterPolicy("clst2", "db1", "t1")
+	if p.Policy != DeadLetterSkip {
+		t.Fatalf("Expected default policy, got: %+v", p)
+	}
+
+	p = cfg.GetDeadLetterPolicy("clst1", "db1", "t2")
+	if p.Policy != DeadLetterRetry || p.Retries != 3 {
+		t.Fatalf("Expected cluster policy, got: %+v", p)
+	}
+
+	p = cfg.GetDeadLetterPolicy("clst1", "db1", "t1")
+	if p.Policy != DeadLetterHalt {
+		t.Fatalf("Expected table policy, got: %+v", p)
+	}
+
+	n, err := cfg.GetDeadLetterTopicName("svc1", "db1", "t1", "mysql", "kafka", 0)
+	checkFail(t, err)
+	if n != "hp-tap-dlq-svc1-db1-t1" {
+		t.Fatalf("Unexpected dead letter topic name: %v", n)
+	}
+}
+
+func TestDeadLetterPolicyNeg(t *testing.T) {
+	for _, c := range []string{
+		"dead_letter:\n    default:\n        policy: ignore\n",
+		"dead_letter:\n    clusters:\n        clst1:\n            policy: retry\n            retries: -1\n",
+		"dead_letter:\n    tables:\n        clst1.db1.t1:\n            policy: drop\n",
+		"dead_letter:\n    default:\n        policy: skip\n        max_data_size: -1\n",
+	} {
+		if _, err := loadSchedule(t, c); err == nil {
+			t.Fatalf("Config should fail to load: %v", c)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+//Times files of the file based pipes can be partitioned by
+const (
+	//PartitionTimeProcessing is the time event is written to the file
+	PartitionTimeProcessing = "processing"
+	//PartitionTimeEvent is MySQL event time from the binlog event header.
+	//Processing time is used for snapshot events
+	PartitionTimeEvent = "event"
+)
+
+// FilePartitionConfig holds partitioned directory layout options of the
+// file based pipes
+type FilePartitionConfig struct {
+	//PathTemplate is the template of the directory of the topic files
+	//relative to the data directory, for example:
+	//{{.Topic}}/dt={{.Date}}/hr={{.Hour}}. Empty for flat layout
+	PathTemplate string `yaml:"path_template"`
+	//Time is the time files are partitioned by: processing or event
+	Time string `yaml:"time"`
+}
+
+//FilePathData is passed to the file partition path template. Time is in
+//UTC, time components are zero padded
+type FilePathData struct {
+	Topic  string
+	Time   time.Time
+	Date   string //YYYY-MM-DD
+	Year   string
+	Month  string
+	Day    string
+	Hour   string
+	Minute string
+}
+
+//Sample times, which differ in every component, used to validate path
+//template
+var (
+	filePathTime1 = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	filePathTime2 = time.Date(1999, 11, 22, 13, 44, 55, 0, time.UTC)
+)
+
+//GetFilePath returns directory of the topic files partition the given time
+//belongs to
+func GetFilePath(t *template.Template, topic string, tm time.Time) (string, error) {
+	tm = tm.UTC()
+	d := &FilePathData{
+		Topic:  topic,
+		Time:   tm,
+		Date:   tm.Format("2006-01-02"),
+		Year:   tm.Format("2006"),
+		Month:  tm.Format("01"),
+		Day:    tm.Format("02"),
+		Hour:   tm.Format("15"),
+		Minute: tm.Format("04"),
+	}
+
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, d); err != nil {
+		return "", err
+	}
+
+	return strings.Trim(buf.String(), "/"), nil
+}
+
+//GetFilePathRoot returns the longest directory prefix of the topic files,
+//which doesn't depend on time, along with the number of partition directory
+//levels below it
+func GetFilePathRoot(t *template.Template, topic string) (string, int, error) {
+	p1, err := GetFilePath(t, topic, filePathTime1)
+	if err != nil {
+		return "", 0, err
+	}
+
+	p2, err := GetFilePath(t, topic, filePathTime2)
+	if err != nil {
+		return "", 0, err
+	}
+
+	s1, s2 := strings.Split(p1, "/"), strings.Split(p2, "/")
+	if len(s1) != len(s2) {
+		return "", 0, fmt.Errorf("number of directory levels of file partition path depends on time: %v, %v", p1, p2)
+	}
+
+	i := 0
+	for i < len(s1) && s1[i] == s2[i] {
+		i++
+	}
+
+	return strings.Join(s1[:i], "/"), len(s1) - i, nil
+}
+
+//parse validates the options and returns parsed path template, nil if
+//partitioning is not configured
+func (c *FilePartitionConfig) parse() (*template.Template, error) {
+	switch c.Time {
+	case PartitionTimeProcessing, PartitionTimeEvent:
+	default:
+		return nil, fmt.Errorf("Invalid file_partition time: '%v'. Expected one of: processing, event", c.Time)
+	}
+
+	if c.PathTemplate == "" {
+		return nil, nil
+	}
+
+	t, err := template.New("file_partition").Parse(c.PathTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	r1, _, err := GetFilePathRoot(t, "topic1")
+	if err != nil {
+		return nil, err
+	}
+
+	r2, _, err := GetFilePathRoot(t, "topic2")
+	if err != nil {
+		return nil, err
+	}
+
+	//Files of different topics must not be mixed in the same directories
+	if r1 == r2 {
+		return nil, fmt.Errorf("file_partition path_template should contain {{.Topic}} in the directory prefix, which doesn't depend on time")
+	}
+
+	if strings.Contains("/"+r1+"/", "/../") {
+		return nil, fmt.Errorf("file_partition path_template should be relative to the data directory")
+	}
+
+	return t, nil
+}
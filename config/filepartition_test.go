@@ -0,0 +1,65 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFilePartitionConfig(t *testing.T) {
+	cfg, err := loadSchedule(t, "file_partition:\n    path_template: \"/{{.Topic}}/dt={{.Date}}/hr={{.Hour}}/\"\n    time: event\n")
+	checkFail(t, err)
+
+	if cfg.FilePartition.Time != PartitionTimeEvent || cfg.FilePartitionTemplateParsed == nil {
+		t.Fatalf("Unexpected file partition config: %+v", cfg.FilePartition)
+	}
+
+	p, err := GetFilePath(cfg.FilePartitionTemplateParsed, "svc.db.t1", time.Date(2020, 3, 4, 5, 6, 7, 0, time.FixedZone("X", 3600)))
+	checkFail(t, err)
+	if p != "svc.db.t1/dt=2020-03-04/hr=04" {
+		t.Fatalf("Unexpected file path: %v", p)
+	}
+
+	root, depth, err := GetFilePathRoot(cfg.FilePartitionTemplateParsed, "svc.db.t1")
+	checkFail(t, err)
+	if root != "svc.db.t1" || depth != 2 {
+		t.Fatalf("Unexpected file path root: %v, depth: %v", root, depth)
+	}
+
+	cfg, err = loadSchedule(t, "")
+	checkFail(t, err)
+	if cfg.FilePartition.Time != PartitionTimeProcessing || cfg.FilePartitionTemplateParsed != nil {
+		t.Fatalf("Partitioning should be disabled by default: %+v", cfg.FilePartition)
+	}
+
+	for _, c := range []string{
+		"file_partition:\n    time: ingestion\n",
+		"file_partition:\n    path_template: \"{{.Topic\"\n",
+		"file_partition:\n    path_template: \"{{.Unknown}}\"\n",
+		"file_partition:\n    path_template: \"dt={{.Date}}/{{.Topic}}\"\n",
+		"file_partition:\n    path_template: \"{{.Topic}}/{{if eq .Hour \\\"00\\\"}}{{.Date}}/{{end}}{{.Hour}}\"\n",
+		"file_partition:\n    path_template: \"../{{.Topic}}/{{.Date}}\"\n",
+	} {
+		if _, err := loadSchedule(t, c); err == nil {
+			t.Fatalf("Config should fail to load: %v", c)
+		}
+	}
+}
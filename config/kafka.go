@@ -0,0 +1,204 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+//Kafka SASL mechanisms
+const (
+	KafkaSASLPlain       = "PLAIN"
+	KafkaSASLScramSHA256 = "SCRAM-SHA-256"
+	KafkaSASLScramSHA512 = "SCRAM-SHA-512"
+)
+
+//Modes of handling messages exceeding maximum Kafka message size
+const (
+	//KafkaOversizedChunk splits the message into numbered fragments
+	KafkaOversizedChunk = "chunk"
+	//KafkaOversizedOffload writes the message to the file pipe and produces
+	//reference to it
+	KafkaOversizedOffload = "offload"
+)
+
+// KafkaTLSConfig holds TLS options of Kafka connections
+type KafkaTLSConfig struct {
+	Enabled bool `yaml:"enabled"`
+	//CAFile is PEM encoded CA certificates file. System CAs are used if empty
+	CAFile string `yaml:"ca_file"`
+	//CertFile and KeyFile are PEM encoded client certificate and key files
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	//ServerName is used to verify server certificate hostname. Broker
+	//address host is used if empty
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// KafkaSASLConfig holds SASL authentication options of Kafka connections.
+// User and password can be read from the files, so as secrets are not
+// required to be inlined in the config
+type KafkaSASLConfig struct {
+	//Mechanism is one of PLAIN, SCRAM-SHA-256, SCRAM-SHA-512. SASL is
+	//disabled if empty
+	Mechanism    string `yaml:"mechanism"`
+	User         string `yaml:"user"`
+	UserFile     string `yaml:"user_file"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+// KafkaProducerConfig holds options of the Kafka output producer
+type KafkaProducerConfig struct {
+	//Async enables idempotent asynchronous producer, which doesn't wait for
+	//the batch to be acknowledged before accepting the next one
+	Async bool `yaml:"async"`
+	//MaxInFlightBatches is the number of committed batches per producer, which
+	//may be not yet acknowledged by Kafka
+	MaxInFlightBatches int `yaml:"max_in_flight_batches"`
+}
+
+func (c *KafkaProducerConfig) validate() error {
+	if c.Async && c.MaxInFlightBatches < 1 {
+		return fmt.Errorf("Invalid kafka_producer max_in_flight_batches: %v. Should be positive", c.MaxInFlightBatches)
+	}
+	return nil
+}
+
+// KafkaOversizedConfig holds options of handling messages exceeding maximum
+// Kafka message size
+type KafkaOversizedConfig struct {
+	//Mode is one of chunk, offload. Oversized messages fail the batch if
+	//empty
+	Mode string `yaml:"mode"`
+	//ChunkSize is maximum fragment payload size. Derived from producer
+	//maximum message size if zero
+	ChunkSize int `yaml:"chunk_size"`
+	//OffloadPipe is the type of the file based pipe the messages are
+	//offloaded to: file or s3. Options of the pipe apply, so the pipe
+	//storage should be accessible by the consumers
+	OffloadPipe string `yaml:"offload_pipe"`
+	//OffloadRetention is the number of hours offloaded messages are kept
+	//for. Messages are not deleted if zero
+	OffloadRetention int `yaml:"offload_retention"`
+}
+
+func (c *KafkaOversizedConfig) validate() error {
+	switch c.Mode {
+	case "", KafkaOversizedChunk:
+	case KafkaOversizedOffload:
+		if c.OffloadPipe == "" {
+			return fmt.Errorf("kafka_oversized offload_pipe required in offload mode")
+		}
+	default:
+		return fmt.Errorf("Invalid kafka_oversized mode: '%v'. Expected one of: chunk, offload", c.Mode)
+	}
+
+	switch c.OffloadPipe {
+	case "", "file", "s3":
+	default:
+		return fmt.Errorf("Invalid kafka_oversized offload_pipe: '%v'. Expected one of: file, s3", c.OffloadPipe)
+	}
+
+	if c.ChunkSize < 0 {
+		return fmt.Errorf("Invalid kafka_oversized chunk_size: %v. Should be positive", c.ChunkSize)
+	}
+
+	if c.OffloadRetention < 0 {
+		return fmt.Errorf("Invalid kafka_oversized offload_retention: %v. Should be positive", c.OffloadRetention)
+	}
+
+	return nil
+}
+
+//compacted returns true if log compaction is enabled in any of the topic
+//settings
+func (c *KafkaTopicsConfig) compacted() bool {
+	all := []KafkaTopicSettings{c.OutputDefault, c.ChangelogDefault}
+	for _, m := range []map[string]map[string]KafkaTopicSettings{c.Output, c.Changelog} {
+		for _, o := range m {
+			for _, s := range o {
+				all = append(all, s)
+			}
+		}
+	}
+	for _, s := range all {
+		if strings.Contains(s.CleanupPolicy, "compact") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *KafkaTLSConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("Both cert_file and key_file required for Kafka TLS client authentication")
+	}
+
+	return nil
+}
+
+func readSecret(value *string, file string) error {
+	if file == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	*value = strings.TrimRight(string(b), "\r\n")
+
+	return nil
+}
+
+//validate reads user and password from the files if specified
+func (c *KafkaSASLConfig) validate() error {
+	switch c.Mechanism {
+	case "":
+		return nil
+	case KafkaSASLPlain, KafkaSASLScramSHA256, KafkaSASLScramSHA512:
+	default:
+		return fmt.Errorf("Invalid Kafka SASL mechanism: '%v'. Expected one of: PLAIN, SCRAM-SHA-256, SCRAM-SHA-512", c.Mechanism)
+	}
+
+	if err := readSecret(&c.User, c.UserFile); err != nil {
+		return err
+	}
+
+	if err := readSecret(&c.Password, c.PasswordFile); err != nil {
+		return err
+	}
+
+	if c.User == "" || c.Password == "" {
+		return fmt.Errorf("Kafka SASL user and password required")
+	}
+
+	return nil
+}
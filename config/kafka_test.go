@@ -0,0 +1,117 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestKafkaSASLSecretFiles(t *testing.T) {
+	f, err := ioutil.TempFile("", "kafka_password")
+	checkFail(t, err)
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	_, err = f.WriteString("secret\n")
+	checkFail(t, err)
+	checkFail(t, f.Close())
+
+	cfg, err := loadSchedule(t, "kafka_sasl:\n    mechanism: SCRAM-SHA-256\n    user: user1\n    password_file: "+f.Name()+"\n")
+	checkFail(t, err)
+
+	if cfg.KafkaSASL.User != "user1" || cfg.KafkaSASL.Password != "secret" {
+		t.Fatalf("Expected credentials read from the file, got: %+v", cfg.KafkaSASL)
+	}
+}
+
+func TestKafkaSecurityNeg(t *testing.T) {
+	for _, c := range []string{
+		"kafka_sasl:\n    mechanism: GSSAPI\n    user: user1\n    password: pwd\n",
+		"kafka_sasl:\n    mechanism: PLAIN\n    user: user1\n",
+		"kafka_sasl:\n    mechanism: PLAIN\n    user: user1\n    password_file: /nonexistent/password\n",
+		"kafka_tls:\n    enabled: true\n    cert_file: /etc/client.pem\n",
+	} {
+		if _, err := loadSchedule(t, c); err == nil {
+			t.Fatalf("Config should fail to load: %v", c)
+		}
+	}
+}
+
+func TestKafkaProducerConfig(t *testing.T) {
+	cfg, err := loadSchedule(t, "kafka_producer:\n    async: true\n")
+	checkFail(t, err)
+
+	if !cfg.KafkaProducer.Async || cfg.KafkaProducer.MaxInFlightBatches != 4 {
+		t.Fatalf("Expected async producer with default in flight batches, got: %+v", cfg.KafkaProducer)
+	}
+
+	if _, err := loadSchedule(t, "kafka_producer:\n    async: true\n    max_in_flight_batches: 0\n"); err == nil {
+		t.Fatalf("Config should fail to load with zero in flight batches")
+	}
+}
+
+func TestKafkaExactlyOnceConfig(t *testing.T) {
+	cfg, err := loadSchedule(t, "kafka_exactly_once: true\nkafka_consumer_groups: true\n")
+	checkFail(t, err)
+
+	if !cfg.KafkaExactlyOnce || cfg.KafkaTxnMaxBytes != 256*1024*1024 {
+		t.Fatalf("Exactly-once mode expected to be enabled with default transaction size: %v", cfg.KafkaTxnMaxBytes)
+	}
+
+	for _, c := range []string{
+		"kafka_exactly_once: true\n",
+		"kafka_exactly_once: true\nkafka_consumer_groups: true\nchangelog_buffer: false\n",
+		"kafka_exactly_once: true\nkafka_consumer_groups: true\nchangelog_pipe_type: local\n",
+		"kafka_exactly_once: true\nkafka_consumer_groups: true\nkafka_txn_max_bytes: 0\n",
+	} {
+		if _, err := loadSchedule(t, c); err == nil {
+			t.Fatalf("Config should fail to load: %v", c)
+		}
+	}
+}
+
+func TestKafkaOversizedConfig(t *testing.T) {
+	cfg, err := loadSchedule(t, "kafka_oversized:\n  mode: offload\n  offload_pipe: s3\n  offload_retention: 168\n")
+	checkFail(t, err)
+
+	if cfg.KafkaOversized.Mode != KafkaOversizedOffload || cfg.KafkaOversized.OffloadPipe != "s3" || cfg.KafkaOversized.OffloadRetention != 168 {
+		t.Fatalf("Unexpected oversized config: %+v", cfg.KafkaOversized)
+	}
+
+	_, err = loadSchedule(t, "kafka_oversized:\n  mode: chunk\n  chunk_size: 65536\n")
+	checkFail(t, err)
+
+	for _, c := range []string{
+		"kafka_oversized:\n  mode: drop\n",
+		"kafka_oversized:\n  mode: offload\n",
+		"kafka_oversized:\n  mode: offload\n  offload_pipe: kafka\n",
+		"kafka_oversized:\n  mode: offload\n  offload_pipe: file\n  offload_retention: -1\n",
+		"kafka_oversized:\n  mode: chunk\n  chunk_size: -1\n",
+		"kafka_oversized:\n  mode: chunk\nkafka_tombstones: append\n",
+		"kafka_oversized:\n  mode: chunk\nkafka_topics:\n  output_default:\n    cleanup_policy: compact\n",
+		"kafka_oversized:\n  mode: chunk\nkafka_topics:\n  changelog:\n    mysql:\n      kafka:\n        cleanup_policy: compact,delete\n",
+	} {
+		if _, err := loadSchedule(t, c); err == nil {
+			t.Fatalf("Config should fail to load: %v", c)
+		}
+	}
+}
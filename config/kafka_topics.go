@@ -0,0 +1,134 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import (
+	"fmt"
+)
+
+// KafkaTopicSettings defines settings of the topics created by the service.
+// Zero values are inherited from the default settings or broker defaults
+type KafkaTopicSettings struct {
+	Partitions        int32 `yaml:"partitions"`
+	ReplicationFactor int16 `yaml:"replication_factor"`
+	RetentionMs       int64 `yaml:"retention_ms"`
+	//CleanupPolicy is one of delete, compact or "compact,delete"
+	CleanupPolicy string `yaml:"cleanup_policy"`
+}
+
+// KafkaTopicsConfig holds topic provisioning options. Topic settings can be
+// specified per input and output types the same way as topic name templates
+type KafkaTopicsConfig struct {
+	//Create topics when table is registered
+	Create bool `yaml:"create"`
+	//Validate settings of registered tables topics on startup
+	Validate bool `yaml:"validate"`
+	//Delete topics when table is deregistered
+	Delete bool `yaml:"delete"`
+
+	OutputDefault    KafkaTopicSettings                       `yaml:"output_default"`
+	Output           map[string]map[string]KafkaTopicSettings `yaml:"output"`
+	ChangelogDefault KafkaTopicSettings                       `yaml:"changelog_default"`
+	Changelog        map[string]map[string]KafkaTopicSettings `yaml:"changelog"`
+}
+
+func (s *KafkaTopicSettings) validate() error {
+	switch s.CleanupPolicy {
+	case "", "delete", "compact", "compact,delete", "delete,compact":
+	default:
+		return fmt.Errorf("Invalid topic cleanup policy: '%v'", s.CleanupPolicy)
+	}
+
+	if s.Partitions < 0 || s.ReplicationFactor < 0 || s.RetentionMs < -1 {
+		return fmt.Errorf("Invalid topic settings: %+v", s)
+	}
+
+	return nil
+}
+
+func (c *KafkaTopicsConfig) validate() error {
+	if err := c.OutputDefault.validate(); err != nil {
+		return err
+	}
+
+	if err := c.ChangelogDefault.validate(); err != nil {
+		return err
+	}
+
+	for _, m := range []map[string]map[string]KafkaTopicSettings{c.Output, c.Changelog} {
+		for _, inp := range m {
+			for _, s := range inp {
+				if err := s.validate(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func topicSettings(def KafkaTopicSettings, m map[string]map[string]KafkaTopicSettings, input string, output string) *KafkaTopicSettings {
+	s, ok := m[input][output]
+	if !ok {
+		return &def
+	}
+
+	if s.Partitions == 0 {
+		s.Partitions = def.Partitions
+	}
+	if s.ReplicationFactor == 0 {
+		s.ReplicationFactor = def.ReplicationFactor
+	}
+	if s.RetentionMs == 0 {
+		s.RetentionMs = def.RetentionMs
+	}
+	if s.CleanupPolicy == "" {
+		s.CleanupPolicy = def.CleanupPolicy
+	}
+
+	return &s
+}
+
+// GetKafkaTopics returns Kafka topics of the table along with their settings.
+// Changelog topic is returned if changelog pipe type is kafka and output topic
+// if output pipe type is kafka
+func (c *AppConfig) GetKafkaTopics(svc string, db string, tbl string, input string, output string, ver int) (map[string]*KafkaTopicSettings, error) {
+	res := make(map[string]*KafkaTopicSettings)
+
+	if c.ChangelogPipeType == "kafka" {
+		n, err := c.GetChangelogTopicName(svc, db, tbl, input, output, ver)
+		if err != nil {
+			return nil, err
+		}
+		res[n] = topicSettings(c.KafkaTopics.ChangelogDefault, c.KafkaTopics.Changelog, input, output)
+	}
+
+	if output == "kafka" {
+		n, err := c.GetOutputTopicName(svc, db, tbl, input, output, ver)
+		if err != nil {
+			return nil, err
+		}
+		res[n] = topicSettings(c.KafkaTopics.OutputDefault, c.KafkaTopics.Output, input, output)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import (
+	"testing"
+)
+
+var testKafkaTopicsFile = `
+changelog_pipe_type: kafka
+kafka_topics:
+    create: true
+    output_default:
+        partitions: 8
+        replication_factor: 3
+        retention_ms: 86400000
+    output:
+        mysql:
+            kafka:
+                cleanup_policy: compact
+    changelog_default:
+        partitions: 4
+        replication_factor: 2
+`
+
+func TestGetKafkaTopics(t *testing.T) {
+	cfg, err := loadSchedule(t, testKafkaTopicsFile)
+	checkFail(t, err)
+
+	topics, err := cfg.GetKafkaTopics("svc1", "db1", "t1", "mysql", "kafka", 0)
+	checkFail(t, err)
+
+	if len(topics) != 2 {
+		t.Fatalf("Expected changelog and output topics, got: %+v", topics)
+	}
+
+	o := topics["hp-tap-svc1-db1-t1"]
+	if o == nil || o.Partitions != 8 || o.ReplicationFactor != 3 || o.RetentionMs != 86400000 || o.CleanupPolicy != "compact" {
+		t.Fatalf("Unexpected output topic settings: %+v", o)
+	}
+
+	c := topics["storagetapper.service.svc1.db.db1.table.t1"]
+	if c == nil || c.Partitions != 4 || c.ReplicationFactor != 2 || c.CleanupPolicy != "" {
+		t.Fatalf("Unexpected changelog topic settings: %+v", c)
+	}
+
+	topics, err = cfg.GetKafkaTopics("svc1", "db1", "t1", "mysql", "hdfs", 0)
+	checkFail(t, err)
+	if len(topics) != 1 {
+		t.Fatalf("Expected changelog topic only, got: %+v", topics)
+	}
+}
+
+func TestKafkaTopicsNeg(t *testing.T) {
+	for _, c := range []string{
+		"kafka_topics:\n    output_default:\n        cleanup_policy: remove\n",
+		"kafka_topics:\n    changelog:\n        mysql:\n            kafka:\n                partitions: -1\n",
+	} {
+		if _, err := loadSchedule(t, c); err == nil {
+			t.Fatalf("Config should fail to load: %v", c)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package config
+
+import (
+	"fmt"
+)
+
+//aes256KeyLen is the length of AES-256 key in bytes
+const aes256KeyLen = 32
+
+// PipeKeyConfig holds encryption and authentication keys of the file based
+// pipes. Keys can be read from the files instead
+type PipeKeyConfig struct {
+	AES256Key     string `yaml:"aes256_key"`
+	AES256KeyFile string `yaml:"aes256_key_file"`
+	HMACKey       string `yaml:"hmac_key"`
+	HMACKeyFile   string `yaml:"hmac_key_file"`
+}
+
+// PipeKeyringConfig holds named keys of the file based pipes. ID of the key
+// the file is written with is stored in the file header, so as files remain
+// readable after active key is changed, as long as their keys are in the
+// keyring
+type PipeKeyringConfig struct {
+	//Active is the ID of the key new files are written with. Files are
+	//written with pipe_aes256_key and pipe_hmac_key if it's empty
+	Active string                   `yaml:"active"`
+	Keys   map[string]PipeKeyConfig `yaml:"keys"`
+	//Envelope encrypts every file with random data key. Data key is
+	//encrypted by the active key, which is the master key then, and stored in
+	//the file header
+	Envelope bool `yaml:"envelope"`
+}
+
+//validate reads the keys from the files if specified
+func (c *PipeKeyringConfig) validate() error {
+	for id, k := range c.Keys {
+		if id == "" {
+			return fmt.Errorf("pipe_keyring key id can't be empty")
+		}
+
+		if err := readSecret(&k.AES256Key, k.AES256KeyFile); err != nil {
+			return err
+		}
+
+		if err := readSecret(&k.HMACKey, k.HMACKeyFile); err != nil {
+			return err
+		}
+
+		if k.AES256Key != "" && len(k.AES256Key) != aes256KeyLen {
+			return fmt.Errorf("Invalid pipe_keyring key '%v': AES-256 key should be %v bytes long", id, aes256KeyLen)
+		}
+
+		c.Keys[id] = k
+	}
+
+	if c.Active != "" {
+		if _, ok := c.Keys[c.Active]; !ok {
+			return fmt.Errorf("pipe_keyring active key '%v' is not in the keyring", c.Active)
+		}
+	}
+
+	if c.Envelope && (c.Active == "" || c.Keys[c.Active].AES256Key == "") {
+		return fmt.Errorf("pipe_keyring envelope encryption requires active key with aes256_key")
+	}
+
+	return nil
+}
+
+//PipeEncryption returns true if file based pipes encrypt new files
+func (c *AppConfig) PipeEncryption() bool {
+	if c.PipeKeyring.Active != "" {
+		return c.PipeKeyring.Keys[c.PipeKeyring.Active].AES256Key != ""
+	}
+	return c.PipeAES256Key != ""
+}
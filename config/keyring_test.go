@@ -0,0 +1,77 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestPipeKeyringConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "master_key")
+	checkFail(t, err)
+	defer func() { _ = os.Remove(f.Name()) }()
+	_, err = f.WriteString("abcdefghijklmnopqrstuvwxyz123456\n")
+	checkFail(t, err)
+	checkFail(t, f.Close())
+
+	cfg, err := loadSchedule(t, `pipe_keyring:
+    active: k2
+    envelope: true
+    keys:
+        k1:
+            aes256_key: "12345678901234567890123456789012"
+            hmac_key: hmac1
+        k2:
+            aes256_key_file: `+f.Name()+`
+            hmac_key: hmac2
+`)
+	checkFail(t, err)
+
+	k := cfg.PipeKeyring.Keys["k2"]
+	if cfg.PipeKeyring.Active != "k2" || !cfg.PipeKeyring.Envelope || k.AES256Key != "abcdefghijklmnopqrstuvwxyz123456" || k.HMACKey != "hmac2" {
+		t.Fatalf("Unexpected keyring config: %+v", cfg.PipeKeyring)
+	}
+
+	if !cfg.PipeEncryption() {
+		t.Fatalf("Active key encrypts files")
+	}
+
+	cfg, err = loadSchedule(t, "pipe_keyring:\n    active: k1\n    keys:\n        k1:\n            hmac_key: hmac1\n")
+	checkFail(t, err)
+	if cfg.PipeEncryption() {
+		t.Fatalf("Active key without aes256_key doesn't encrypt files")
+	}
+
+	for _, c := range []string{
+		"pipe_keyring:\n    active: k3\n    keys:\n        k1:\n            hmac_key: hmac1\n",
+		"pipe_keyring:\n    keys:\n        k1:\n            aes256_key: short\n",
+		"pipe_keyring:\n    keys:\n        k1:\n            aes256_key_file: /nonexistent/key/file\n",
+		"pipe_keyring:\n    envelope: true\n    active: k1\n    keys:\n        k1:\n            hmac_key: hmac1\n",
+		"pipe_keyring:\n    envelope: true\n",
+		"pipe_file_no_header: true\npipe_keyring:\n    envelope: true\n    active: k1\n    keys:\n        k1:\n            aes256_key: \"12345678901234567890123456789012\"\n",
+		"avro_ocf:\n    enabled: true\npipe_keyring:\n    active: k1\n    keys:\n        k1:\n            aes256_key: \"12345678901234567890123456789012\"\n",
+	} {
+		if _, err := loadSchedule(t, c); err == nil {
+			t.Fatalf("Config should fail to load: %v", c)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package config
+
+import (
+	"fmt"
+)
+
+// LocalPipeSpillConfig holds disk spilling options of the local pipe
+type LocalPipeSpillConfig struct {
+	//Dir enables spilling of the messages, which don't fit in memory, to the
+	//files in this directory. Spilled messages are lost on restart
+	Dir string `yaml:"dir"`
+	//MaxMemoryMessages is the number of messages kept in memory per key.
+	//0 means pipe batch size
+	MaxMemoryMessages int `yaml:"max_memory_messages"`
+	//MaxDiskBytes is the maximum size of the spilled messages per key.
+	//Producer blocks when it's reached. 0 - unlimited
+	MaxDiskBytes int64 `yaml:"max_disk_bytes"`
+}
+
+func (c *LocalPipeSpillConfig) validate() error {
+	if c.MaxMemoryMessages < 0 {
+		return fmt.Errorf("Invalid local_pipe_spill max_memory_messages: %v", c.MaxMemoryMessages)
+	}
+
+	if c.MaxDiskBytes < 0 {
+		return fmt.Errorf("Invalid local_pipe_spill max_disk_bytes: %v", c.MaxDiskBytes)
+	}
+
+	return nil
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package config
+
+import (
+	"testing"
+)
+
+func TestLocalPipeSpillConfig(t *testing.T) {
+	cfg, err := loadSchedule(t, "local_pipe_spill:\n    dir: /tmp/spill\n    max_memory_messages: 100\n")
+	checkFail(t, err)
+
+	if cfg.LocalPipeSpill.Dir != "/tmp/spill" || cfg.LocalPipeSpill.MaxMemoryMessages != 100 || cfg.LocalPipeSpill.MaxDiskBytes != 1024*1024*1024 {
+		t.Fatalf("Unexpected local pipe spill config: %+v", cfg.LocalPipeSpill)
+	}
+
+	for _, c := range []string{
+		"local_pipe_spill:\n    max_memory_messages: -1\n",
+		"local_pipe_spill:\n    max_disk_bytes: -1\n",
+	} {
+		if _, err := loadSchedule(t, c); err == nil {
+			t.Fatalf("Config should fail to load: %v", c)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package config
+
+import (
+	"fmt"
+)
+
+// ParquetConfig holds options of Parquet files written by the file based
+// pipes
+type ParquetConfig struct {
+	//Enabled makes file based pipes write Avro output format as Parquet files
+	Enabled bool `yaml:"enabled"`
+	//Codec compresses the pages. One of: uncompressed, snappy, gzip, zstd
+	Codec string `yaml:"codec"`
+	//RowGroupSize is approximate size of the row group buffered in memory
+	//before it's written to the file, in bytes of Avro encoded rows
+	RowGroupSize int `yaml:"row_group_size"`
+	//MaxFileAge in seconds. File is closed when it's older. 0 - unlimited
+	MaxFileAge int `yaml:"max_file_age"`
+}
+
+func (c *ParquetConfig) validate() error {
+	switch c.Codec {
+	case "uncompressed", "snappy", "gzip", "zstd":
+	default:
+		return fmt.Errorf("Invalid parquet codec: '%v'. Expected one of: uncompressed, snappy, gzip, zstd", c.Codec)
+	}
+
+	if c.RowGroupSize <= 0 {
+		return fmt.Errorf("Invalid parquet row_group_size: %v", c.RowGroupSize)
+	}
+
+	if c.MaxFileAge < 0 {
+		return fmt.Errorf("Invalid parquet max_file_age: %v", c.MaxFileAge)
+	}
+
+	return nil
+}
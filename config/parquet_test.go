@@ -0,0 +1,45 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package config
+
+import (
+	"testing"
+)
+
+func TestParquetConfig(t *testing.T) {
+	cfg, err := loadSchedule(t, "parquet:\n    enabled: true\n    max_file_age: 60\n")
+	checkFail(t, err)
+
+	if !cfg.Parquet.Enabled || cfg.Parquet.Codec != "snappy" || cfg.Parquet.RowGroupSize != 8*1024*1024 || cfg.Parquet.MaxFileAge != 60 {
+		t.Fatalf("Unexpected parquet config: %+v", cfg.Parquet)
+	}
+
+	for _, c := range []string{
+		"parquet:\n    codec: lzo\n",
+		"parquet:\n    row_group_size: 0\n",
+		"parquet:\n    max_file_age: -1\n",
+		"pipe_aes256_key: 12345678901234567890123456789012\nparquet:\n    enabled: true\n",
+		"avro_ocf:\n    enabled: true\nparquet:\n    enabled: true\n",
+	} {
+		if _, err := loadSchedule(t, c); err == nil {
+			t.Fatalf("Config should fail to load: %v", c)
+		}
+	}
+}
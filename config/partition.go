@@ -0,0 +1,104 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import (
+	"fmt"
+)
+
+//Kafka partitioner types
+const (
+	//KafkaPartitionerHash is FNV-1a hash of the partition key, same as sarama
+	//default partitioner
+	KafkaPartitionerHash = "hash"
+	//KafkaPartitionerMurmur2 is compatible with Java client default partitioner
+	KafkaPartitionerMurmur2 = "murmur2"
+	//KafkaPartitionerExplicit maps partition keys to partitions explicitly,
+	//keys missing in the map partitioned by murmur2
+	KafkaPartitionerExplicit = "explicit"
+)
+
+// KafkaPartitioner defines how messages are distributed between partitions
+// of the output topic
+type KafkaPartitioner struct {
+	//Type is one of hash, murmur2, explicit. Producer default partitioner is
+	//used when empty
+	Type string `yaml:"type"`
+	//Columns the partition key is built of. Message key is used as partition
+	//key by default
+	Columns []string `yaml:"columns"`
+	//Partitions maps partition keys to partitions for explicit partitioner
+	Partitions map[string]int32 `yaml:"partitions"`
+}
+
+// KafkaPartitioningConfig holds default partitioner and per output topic
+// partitioners
+type KafkaPartitioningConfig struct {
+	Default KafkaPartitioner            `yaml:"default"`
+	Topics  map[string]KafkaPartitioner `yaml:"topics"`
+}
+
+func (p *KafkaPartitioner) validate() error {
+	switch p.Type {
+	case "", KafkaPartitionerHash, KafkaPartitionerMurmur2:
+	case KafkaPartitionerExplicit:
+		if len(p.Partitions) == 0 {
+			return fmt.Errorf("Explicit partitioner requires partitions map")
+		}
+	default:
+		return fmt.Errorf("Invalid partitioner type: '%v'. Expected one of: hash, murmur2, explicit", p.Type)
+	}
+
+	if p.Type == "" && len(p.Columns) != 0 {
+		return fmt.Errorf("Partitioner type is required when partition columns specified")
+	}
+
+	for k, v := range p.Partitions {
+		if v < 0 {
+			return fmt.Errorf("Invalid partition %v for key '%v'", v, k)
+		}
+	}
+
+	return nil
+}
+
+func (c *KafkaPartitioningConfig) validate() error {
+	if err := c.Default.validate(); err != nil {
+		return err
+	}
+
+	for _, v := range c.Topics {
+		if err := v.validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetKafkaPartitioner returns partitioner of the given output topic
+func (c *AppConfig) GetKafkaPartitioner(topic string) *KafkaPartitioner {
+	p, ok := c.KafkaPartitioning.Topics[topic]
+	if !ok {
+		p = c.KafkaPartitioning.Default
+	}
+	return &p
+}
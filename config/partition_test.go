@@ -0,0 +1,66 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import (
+	"testing"
+)
+
+var testPartitioningFile = `
+kafka_partitioning:
+    default:
+        type: murmur2
+    topics:
+        hp-tap-svc1-db1-t1:
+            type: explicit
+            columns:
+                - tenant_id
+            partitions:
+                tenant1: 3
+`
+
+func TestKafkaPartitioner(t *testing.T) {
+	cfg, err := loadSchedule(t, testPartitioningFile)
+	checkFail(t, err)
+
+	p := cfg.GetKafkaPartitioner("hp-tap-svc1-db1-t2")
+	if p.Type != KafkaPartitionerMurmur2 || len(p.Columns) != 0 {
+		t.Fatalf("Expected default partitioner, got: %+v", p)
+	}
+
+	p = cfg.GetKafkaPartitioner("hp-tap-svc1-db1-t1")
+	if p.Type != KafkaPartitionerExplicit || len(p.Columns) != 1 || p.Columns[0] != "tenant_id" || p.Partitions["tenant1"] != 3 {
+		t.Fatalf("Expected topic partitioner, got: %+v", p)
+	}
+}
+
+func TestKafkaPartitionerNeg(t *testing.T) {
+	for _, c := range []string{
+		"kafka_partitioning:\n    default:\n        type: crc32\n",
+		"kafka_partitioning:\n    default:\n        type: explicit\n",
+		"kafka_partitioning:\n    default:\n        columns:\n            - tenant_id\n",
+		"kafka_partitioning:\n    topics:\n        t1:\n            type: explicit\n            partitions:\n                k1: -1\n",
+	} {
+		if _, err := loadSchedule(t, c); err == nil {
+			t.Fatalf("Config should fail to load: %v", c)
+		}
+	}
+}
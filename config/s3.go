@@ -0,0 +1,66 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import (
+	"fmt"
+)
+
+//minS3PartSize is the minimum size of multipart upload part, except the last
+//one, allowed by S3
+const minS3PartSize = 5 * 1024 * 1024
+
+// S3Config holds S3 compatible object storage output pipe configuration
+type S3Config struct {
+	//Endpoint is the URL of S3 compatible service. AWS S3 regional endpoint
+	//is used if empty
+	Endpoint string `yaml:"endpoint"`
+	Region   string `yaml:"region"`
+	Bucket   string `yaml:"bucket"`
+	//BaseDir is the prefix of the object keys
+	BaseDir string `yaml:"base_dir"`
+	//Anonymous requests are sent if AccessKeyID is empty
+	AccessKeyID         string `yaml:"access_key_id"`
+	SecretAccessKey     string `yaml:"secret_access_key"`
+	SecretAccessKeyFile string `yaml:"secret_access_key_file"`
+	//PathStyle puts bucket name into the URL path instead of the host name
+	PathStyle bool `yaml:"path_style"`
+	//PartSize is the size of multipart upload parts. Files smaller than that
+	//are uploaded in a single request
+	PartSize int `yaml:"part_size"`
+}
+
+//validate reads secret access key from the file if specified
+func (c *S3Config) validate() error {
+	if c.PartSize < minS3PartSize {
+		return fmt.Errorf("Invalid s3 part_size: %v. Should be at least %v", c.PartSize, minS3PartSize)
+	}
+
+	if err := readSecret(&c.SecretAccessKey, c.SecretAccessKeyFile); err != nil {
+		return err
+	}
+
+	if c.AccessKeyID != "" && c.SecretAccessKey == "" {
+		return fmt.Errorf("S3 secret access key required")
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestS3Config(t *testing.T) {
+	f, err := ioutil.TempFile("", "s3_secret")
+	checkFail(t, err)
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	_, err = f.WriteString("secret\n")
+	checkFail(t, err)
+	checkFail(t, f.Close())
+
+	cfg, err := loadSchedule(t, "s3:\n    bucket: bucket1\n    access_key_id: key1\n    secret_access_key_file: "+f.Name()+"\n")
+	checkFail(t, err)
+
+	if cfg.S3.SecretAccessKey != "secret" || cfg.S3.Region != "us-east-1" || cfg.S3.PartSize != 16*1024*1024 {
+		t.Fatalf("Unexpected S3 config: %+v", cfg.S3)
+	}
+
+	for _, c := range []string{
+		"s3:\n    part_size: 1024\n",
+		"s3:\n    access_key_id: key1\n",
+		"s3:\n    access_key_id: key1\n    secret_access_key_file: /nonexistent/secret\n",
+	} {
+		if _, err := loadSchedule(t, c); err == nil {
+			t.Fatalf("Config should fail to load: %v", c)
+		}
+	}
+}
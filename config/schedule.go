@@ -0,0 +1,161 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SnapshotSchedule restricts when and how many table snapshots can run
+type SnapshotSchedule struct {
+	//Windows is the list of allowed time ranges in HH:MM-HH:MM format. Range
+	//may wrap around midnight. Empty list means snapshots allowed at any time
+	Windows []string `yaml:"windows"`
+	//Timezone the windows are specified in. UTC by default
+	Timezone string `yaml:"timezone"`
+	//MaxConcurrent limits number of snapshots running concurrently on the
+	//cluster. Zero means no limit
+	MaxConcurrent int `yaml:"max_concurrent"`
+	//Priority of the snapshot. Snapshots of lower priority tables are
+	//deferred while there are higher priority tables waiting for snapshot on
+	//the same cluster
+	Priority int `yaml:"priority"`
+}
+
+// SnapshotScheduleConfig holds snapshot schedules. Table schedule takes
+// precedence over cluster schedule, which in turn takes precedence over the
+// default one
+type SnapshotScheduleConfig struct {
+	Default  SnapshotSchedule            `yaml:"default"`
+	Clusters map[string]SnapshotSchedule `yaml:"clusters"`
+	//Tables keyed by "cluster.db.table"
+	Tables map[string]SnapshotSchedule `yaml:"tables"`
+}
+
+func parseWindowTime(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+//parseWindow returns window boundaries in minutes since midnight
+func parseWindow(w string) (int, int, error) {
+	r := strings.Split(w, "-")
+	if len(r) != 2 {
+		return 0, 0, fmt.Errorf("Invalid snapshot window: '%v'. Expected format: HH:MM-HH:MM", w)
+	}
+
+	from, err := parseWindowTime(r[0])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	to, err := parseWindowTime(r[1])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return from, to, nil
+}
+
+func (s *SnapshotSchedule) validate() error {
+	for _, w := range s.Windows {
+		if _, _, err := parseWindow(w); err != nil {
+			return err
+		}
+	}
+
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return err
+	}
+
+	if s.MaxConcurrent < 0 {
+		return fmt.Errorf("Invalid max_concurrent: %v", s.MaxConcurrent)
+	}
+
+	return nil
+}
+
+// Allowed returns true if snapshot can be started at the given moment of time
+func (s *SnapshotSchedule) Allowed(now time.Time) (bool, error) {
+	if len(s.Windows) == 0 {
+		return true, nil
+	}
+
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return false, err
+	}
+
+	now = now.In(loc)
+	m := now.Hour()*60 + now.Minute()
+
+	for _, w := range s.Windows {
+		from, to, err := parseWindow(w)
+		if err != nil {
+			return false, err
+		}
+		if (from <= to && m >= from && m < to) || (from > to && (m >= from || m < to)) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (c *SnapshotScheduleConfig) validate() error {
+	if err := c.Default.validate(); err != nil {
+		return err
+	}
+
+	for _, v := range c.Clusters {
+		if err := v.validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, v := range c.Tables {
+		if err := v.validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetSnapshotSchedule returns snapshot schedule for the given table
+func (c *AppConfig) GetSnapshotSchedule(cluster string, db string, table string) *SnapshotSchedule {
+	if s, ok := c.SnapshotSchedule.Tables[cluster+"."+db+"."+table]; ok {
+		return &s
+	}
+
+	if s, ok := c.SnapshotSchedule.Clusters[cluster]; ok {
+		return &s
+	}
+
+	s := c.SnapshotSchedule.Default
+
+	return &s
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+var testScheduleFile = `
+snapshot_schedule:
+    default:
+        windows:
+            - "22:00-06:00"
+        max_concurrent: 2
+    clusters:
+        clst1:
+            windows:
+                - "01:00-02:00"
+                - "13:30-14:00"
+            timezone: "America/Los_Angeles"
+            max_concurrent: 1
+    tables:
+        clst1.db1.t1:
+            priority: 10
+`
+
+func loadSchedule(t *testing.T, content string) (*AppConfig, error) {
+	def = &stdConfig{}
+
+	loadFile = func(_ string) ([]byte, error) {
+		return []byte(content), nil
+	}
+
+	if err := Load(); err != nil {
+		return nil, err
+	}
+
+	return Get(), nil
+}
+
+func checkAllowed(t *testing.T, s *SnapshotSchedule, tm string, expected bool) {
+	n, err := time.Parse(time.RFC3339, tm)
+	checkFail(t, err)
+	r, err := s.Allowed(n)
+	checkFail(t, err)
+	if r != expected {
+		t.Fatalf("%v: expected %v, got %v", tm, expected, r)
+	}
+}
+
+func TestSnapshotSchedule(t *testing.T) {
+	cfg, err := loadSchedule(t, testScheduleFile)
+	checkFail(t, err)
+
+	s := cfg.GetSnapshotSchedule("clst2", "db1", "t1")
+	if s.MaxConcurrent != 2 || s.Priority != 0 {
+		t.Fatalf("Expected default schedule, got: %+v", s)
+	}
+	checkAllowed(t, s, "2017-01-01T23:00:00Z", true)
+	checkAllowed(t, s, "2017-01-01T03:00:00Z", true)
+	checkAllowed(t, s, "2017-01-01T06:00:00Z", false)
+	checkAllowed(t, s, "2017-01-01T12:00:00Z", false)
+	checkAllowed(t, s, "2017-01-01T22:00:00Z", true)
+
+	s = cfg.GetSnapshotSchedule("clst1", "db1", "t2")
+	if s.MaxConcurrent != 1 {
+		t.Fatalf("Expected cluster schedule, got: %+v", s)
+	}
+	//Los Angeles is UTC-8 in January
+	checkAllowed(t, s, "2017-01-01T09:30:00Z", true)
+	checkAllowed(t, s, "2017-01-01T01:30:00Z", false)
+	checkAllowed(t, s, "2017-01-01T21:45:00Z", true)
+	checkAllowed(t, s, "2017-01-01T22:00:00Z", false)
+
+	s = cfg.GetSnapshotSchedule("clst1", "db1", "t1")
+	if s.Priority != 10 || s.MaxConcurrent != 0 {
+		t.Fatalf("Expected table schedule, got: %+v", s)
+	}
+	checkAllowed(t, s, "2017-01-01T12:00:00Z", true)
+}
+
+func TestSnapshotScheduleNeg(t *testing.T) {
+	for _, c := range []string{
+		"snapshot_schedule:\n    default:\n        windows:\n            - \"22:00\"\n",
+		"snapshot_schedule:\n    default:\n        windows:\n            - \"25:00-01:00\"\n",
+		"snapshot_schedule:\n    clusters:\n        clst1:\n            timezone: \"No/Such_Zone\"\n",
+		"snapshot_schedule:\n    tables:\n        clst1.db1.t1:\n            max_concurrent: -1\n",
+	} {
+		if _, err := loadSchedule(t, c); err == nil {
+			t.Fatalf("Config should fail to load: %v", c)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import (
+	"fmt"
+)
+
+// StreamConfig holds options of the output events streaming endpoint
+type StreamConfig struct {
+	//MaxClients is the maximum number of concurrent streams served by the
+	//instance
+	MaxClients int `yaml:"max_clients"`
+	//HeartbeatInterval in seconds. Heartbeat is sent to the client when there
+	//is no events during the interval
+	HeartbeatInterval int `yaml:"heartbeat_interval"`
+}
+
+func (c *StreamConfig) validate() error {
+	if c.MaxClients <= 0 {
+		return fmt.Errorf("Invalid stream max_clients: %v", c.MaxClients)
+	}
+
+	if c.HeartbeatInterval <= 0 {
+		return fmt.Errorf("Invalid stream heartbeat_interval: %v", c.HeartbeatInterval)
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// WebhookConfig holds HTTP webhook output pipe configuration
+type WebhookConfig struct {
+	//URL is a template of the endpoint URL. {{.Topic}} is replaced by the
+	//topic name
+	URL string `yaml:"url"`
+	//Timeout of single request in seconds
+	Timeout int `yaml:"timeout"`
+	//Retries is the number of retries of failed request
+	Retries int `yaml:"retries"`
+	//RetryBackoff is the delay before the first retry in milliseconds. It's
+	//doubled on every subsequent retry up to MaxRetryBackoff
+	RetryBackoff    int `yaml:"retry_backoff"`
+	MaxRetryBackoff int `yaml:"max_retry_backoff"`
+	//Concurrency is the number of requests sent in parallel by the producer.
+	//Messages with the same key are always sent by the same request
+	Concurrency int `yaml:"concurrency"`
+	//Headers are added to every request
+	Headers map[string]string `yaml:"headers"`
+}
+
+//WebhookURLData is passed to the webhook URL template
+type WebhookURLData struct {
+	Topic string
+}
+
+func (c *WebhookConfig) validate() error {
+	if c.Timeout <= 0 {
+		return fmt.Errorf("Invalid webhook timeout: %v", c.Timeout)
+	}
+
+	if c.Retries < 0 {
+		return fmt.Errorf("Invalid webhook retries: %v", c.Retries)
+	}
+
+	if c.RetryBackoff <= 0 || c.MaxRetryBackoff < c.RetryBackoff {
+		return fmt.Errorf("Invalid webhook retry backoff: %v, max: %v", c.RetryBackoff, c.MaxRetryBackoff)
+	}
+
+	if c.Concurrency <= 0 {
+		return fmt.Errorf("Invalid webhook concurrency: %v", c.Concurrency)
+	}
+
+	return nil
+}
+
+// GetWebhookURL returns webhook endpoint URL for the given topic
+func (c *AppConfig) GetWebhookURL(topic string) (string, error) {
+	if c.WebhookURLTemplateParsed == nil {
+		return "", fmt.Errorf("webhook.url is not configured")
+	}
+
+	buf := &bytes.Buffer{}
+	if err := c.WebhookURLTemplateParsed.Execute(buf, &WebhookURLData{Topic: topic}); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import (
+	"testing"
+)
+
+func TestWebhookConfig(t *testing.T) {
+	cfg, err := loadSchedule(t, "webhook:\n    url: http://localhost/events/{{.Topic}}\n")
+	checkFail(t, err)
+
+	if cfg.Webhook.Timeout != 30 || cfg.Webhook.Retries != 5 || cfg.Webhook.Concurrency != 1 {
+		t.Fatalf("Unexpected webhook config: %+v", cfg.Webhook)
+	}
+
+	url, err := cfg.GetWebhookURL("topic1")
+	checkFail(t, err)
+	if url != "http://localhost/events/topic1" {
+		t.Fatalf("Unexpected webhook URL: %v", url)
+	}
+
+	cfg, err = loadSchedule(t, "")
+	checkFail(t, err)
+	if _, err = cfg.GetWebhookURL("topic1"); err == nil {
+		t.Fatalf("Webhook URL shouldn't be configured")
+	}
+
+	for _, c := range []string{
+		"webhook:\n    url: http://localhost/{{.Topic\n",
+		"webhook:\n    concurrency: 0\n",
+		"webhook:\n    retries: -1\n",
+		"webhook:\n    retry_backoff: 0\n",
+		"webhook:\n    retry_backoff: 100\n    max_retry_backoff: 10\n",
+		"webhook:\n    timeout: 0\n",
+	} {
+		if _, err := loadSchedule(t, c); err == nil {
+			t.Fatalf("Config should fail to load: %v", c)
+		}
+	}
+}
@@ -24,6 +24,10 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/raksh93/storagetapper/log"
 )
@@ -38,6 +42,36 @@ func (a *Addr) Log() log.Logger {
 	return log.WithFields(log.Fields{"user": a.User, "host": a.Host, "port": a.Port, "db": a.Db})
 }
 
+//ParseConnectURL parses connection URL in the form of
+//user:password@host:port/db. Port defaults to 3306, db is optional
+func ParseConnectURL(cs string) (*Addr, error) {
+	/* url.Parse requires scheme in the beginning of the URL, just prepend
+	* with random scheme if it wasn't in the config file URL */
+	if !strings.Contains(cs, "://") {
+		cs = "dsn://" + cs
+	}
+	u, err := url.Parse(cs)
+	if err != nil {
+		return nil, err
+	}
+	var host, port string = u.Host, ""
+	if strings.Contains(u.Host, ":") {
+		host, port, _ = net.SplitHostPort(u.Host)
+	}
+	if u.User.Username() == "" || host == "" {
+		return nil, errors.New("Host and username required in DB connect URL")
+	}
+	if port == "" {
+		port = "3306"
+	}
+	uport, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	pwd, _ := u.User.Password()
+	return &Addr{Host: host, Port: uint16(uport), User: u.User.Username(), Pwd: pwd, Db: strings.Trim(u.Path, "/")}, nil
+}
+
 //Open opens database connection by given address
 func Open(ci *Addr) (*sql.DB, error) {
 	ci.Log().Debugf("Connect string")
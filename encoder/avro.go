@@ -22,6 +22,7 @@ package encoder
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"strings"
 
@@ -69,6 +70,16 @@ func (e *avroEncoder) EncodeSchema(seqno uint64) ([]byte, error) {
 	return nil, nil
 }
 
+//AvroSchema returns current Avro schema of the encoder, which is written to
+//the metadata of Avro container files
+func AvroSchema(enc Encoder) ([]byte, error) {
+	e, ok := enc.(*avroEncoder)
+	if !ok {
+		return nil, fmt.Errorf("%v encoder doesn't have Avro schema", enc.Type())
+	}
+	return json.Marshal(e.outSchema)
+}
+
 //Row convert raw binary log event into Avro record
 func (e *avroEncoder) Row(tp int, row *[]interface{}, seqno uint64) ([]byte, error) {
 	r, err := goavro.NewRecord(*e.setter)
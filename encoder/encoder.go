@@ -112,6 +112,21 @@ func GetRowKey(s *types.TableSchema, row *[]interface{}) string {
 	return key
 }
 
+//GetRowColumnValues returns values of the given columns of the row
+func GetRowColumnValues(s *types.TableSchema, row *[]interface{}, columns []string) ([]interface{}, error) {
+	res := make([]interface{}, 0, len(columns))
+	for _, c := range columns {
+		i := 0
+		for ; i < len(s.Columns) && s.Columns[i].Name != c; i++ {
+		}
+		if i == len(s.Columns) || i >= len(*row) {
+			return nil, fmt.Errorf("Column '%v' not found in the table %v.%v", c, s.DBName, s.TableName)
+		}
+		res = append(res, (*row)[i])
+	}
+	return res, nil
+}
+
 //GetCommonFormatKey concatenates common format key into string
 func GetCommonFormatKey(cf *types.CommonFormatEvent) string {
 	var key string
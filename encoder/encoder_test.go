@@ -381,7 +381,7 @@ func TestSchema(t *testing.T) {
 		if enc.Type() == "avro" {
 			test.Assert(t, schema == nil && err == nil, "Avro doesn't support schema encoding")
 			continue
-		} else if enc.Type() == "msgpack" {
+		} else if enc.Type() == "msgpack" || enc.Type() == "protobuf" {
 			d, err1 := enc.DecodeEvent(schema)
 			test.CheckFail(err1, t)
 			schema, err1 = json.Marshal(d)
@@ -167,6 +167,11 @@ func fixField(f *interface{}, typ string) (err error) {
 	return
 }
 
+//FixJSONValue restores the type of the column value decoded from JSON
+func FixJSONValue(v *interface{}, dataType string) error {
+	return fixField(v, dataType)
+}
+
 func (e *jsonEncoder) fixFieldTypes(res *types.CommonFormatEvent) (err error) {
 	k := 0
 
@@ -186,7 +191,9 @@ func (e *jsonEncoder) fixFieldTypes(res *types.CommonFormatEvent) (err error) {
 				}
 			}
 
-			if e.inSchema.Columns[i].Key == "PRI" && k < len(res.Key) {
+			//Key of the wrapped event is the row key followed by the values
+			//of partition columns, it's not the primary key
+			if e.inSchema.Columns[i].Key == "PRI" && k < len(res.Key) && (res.Type == "insert" || res.Type == "delete") {
 				err = fixField(&res.Key[k], e.inSchema.Columns[i].DataType)
 				if err != nil {
 					return err
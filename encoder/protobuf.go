@@ -0,0 +1,741 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package encoder
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/raksh93/storagetapper/log"
+	"github.com/raksh93/storagetapper/state"
+	"github.com/raksh93/storagetapper/types"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+//Field numbers of the Event message
+const (
+	pbEventType       = 1
+	pbEventSeqNo      = 2
+	pbEventTimestamp  = 3
+	pbEventGtid       = 4
+	pbEventKey        = 5
+	pbEventFields     = 6
+	pbEventRow        = 7
+	pbEventDescriptor = 8
+	pbEventEventTime  = 9
+	pbEventEnvelope   = 15
+)
+
+//pbValueTypes are the types of the generic Value message fields, field
+//numbers start from 1 in this order
+var pbValueTypes = []descriptorpb.FieldDescriptorProto_Type{
+	descriptorpb.FieldDescriptorProto_TYPE_INT32,
+	descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	descriptorpb.FieldDescriptorProto_TYPE_UINT32,
+	descriptorpb.FieldDescriptorProto_TYPE_UINT64,
+	descriptorpb.FieldDescriptorProto_TYPE_FLOAT,
+	descriptorpb.FieldDescriptorProto_TYPE_DOUBLE,
+	descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	descriptorpb.FieldDescriptorProto_TYPE_BYTES,
+	descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+}
+
+func init() {
+	registerPlugin("protobuf", initProtobufEncoder)
+}
+
+//protobufEncoder implements Encoder interface for Protocol Buffers format.
+//It inherits the methods from jsonEncoder.
+//Insert and delete events carry the values in the Row message generated from
+//the table schema. Field numbers of the Row are persisted in the state, so as
+//they are stable across ALTER TABLEs. Schema events, envelopes and events
+//encoded without table schema carry the values in generic Key and Fields
+type protobufEncoder struct {
+	jsonEncoder
+	event      protoreflect.MessageDescriptor
+	value      protoreflect.MessageDescriptor
+	field      protoreflect.MessageDescriptor
+	valueKinds map[protoreflect.Kind]protoreflect.FieldDescriptor
+	columns    []protoreflect.FieldDescriptor //Row fields by input column index, nil for filtered columns
+	names      map[string]protoreflect.FieldDescriptor
+	descriptor []byte //Serialized FileDescriptorSet
+}
+
+func initProtobufEncoder(service string, db string, table string) (Encoder, error) {
+	e := &protobufEncoder{jsonEncoder: jsonEncoder{Service: service, Db: db, Table: table}}
+	return e, e.buildDescriptor(nil)
+}
+
+//Type returns this encoder type
+func (e *protobufEncoder) Type() string {
+	return "protobuf"
+}
+
+//ProtobufDescriptor returns serialized FileDescriptorSet of the messages
+//produced by the encoder. Event message is the top level message
+func ProtobufDescriptor(enc Encoder) ([]byte, error) {
+	e, ok := enc.(*protobufEncoder)
+	if !ok {
+		return nil, fmt.Errorf("%v encoder doesn't have Protobuf descriptor", enc.Type())
+	}
+	return e.descriptor, nil
+}
+
+//UpdateCodec refreshes the schema from state DB and regenerates message
+//descriptor
+func (e *protobufEncoder) UpdateCodec() error {
+	if err := e.jsonEncoder.UpdateCodec(); err != nil {
+		return err
+	}
+
+	columns := make(map[string]string)
+	for i := 0; i < len(e.inSchema.Columns); i++ {
+		columns[e.inSchema.Columns[i].Name] = protobufTypeName(protobufType(&e.inSchema.Columns[i]))
+	}
+
+	numbers, err := state.GetFieldNumbers(e.Service, e.Db, e.Table, columns)
+	if log.E(err) {
+		return err
+	}
+
+	return e.buildDescriptor(numbers)
+}
+
+//protobufType maps MySQL column type to Protobuf field type
+func protobufType(c *types.ColumnSchema) descriptorpb.FieldDescriptorProto_Type {
+	unsigned := strings.Contains(strings.ToLower(c.Type), "unsigned")
+	switch strings.ToLower(c.DataType) {
+	case "int", "integer":
+		if unsigned {
+			return descriptorpb.FieldDescriptorProto_TYPE_UINT32
+		}
+		return descriptorpb.FieldDescriptorProto_TYPE_INT32
+	case "tinyint", "smallint", "mediumint", "year":
+		return descriptorpb.FieldDescriptorProto_TYPE_INT32
+	case "bigint":
+		if unsigned {
+			return descriptorpb.FieldDescriptorProto_TYPE_UINT64
+		}
+		return descriptorpb.FieldDescriptorProto_TYPE_INT64
+	case "float":
+		return descriptorpb.FieldDescriptorProto_TYPE_FLOAT
+	case "double", "real":
+		return descriptorpb.FieldDescriptorProto_TYPE_DOUBLE
+	case "decimal", "numeric":
+		//Exact value doesn't fit into double
+		return descriptorpb.FieldDescriptorProto_TYPE_STRING
+	case "bit", "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob", "tinytext", "text", "mediumtext", "longtext":
+		return descriptorpb.FieldDescriptorProto_TYPE_BYTES
+	}
+	return descriptorpb.FieldDescriptorProto_TYPE_STRING
+}
+
+//protobufTypeName returns type name as used in .proto files
+func protobufTypeName(t descriptorpb.FieldDescriptorProto_Type) string {
+	return strings.ToLower(strings.TrimPrefix(t.String(), "TYPE_"))
+}
+
+//protobufName converts the name to valid Protobuf identifier
+func protobufName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 || b[0] >= '0' && b[0] <= '9' {
+		b = append([]byte{'_'}, b...)
+	}
+	return string(b)
+}
+
+func pbField(name string, number int, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+	return &descriptorpb.FieldDescriptorProto{
+		Name:   proto.String(name),
+		Number: proto.Int32(int32(number)),
+		Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		Type:   typ.Enum(),
+	}
+}
+
+func pbMessageField(name string, number int, typeName string, repeated bool) *descriptorpb.FieldDescriptorProto {
+	f := pbField(name, number, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE)
+	f.TypeName = proto.String(typeName)
+	if repeated {
+		f.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	}
+	return f
+}
+
+//buildDescriptor generates messages descriptor from the output schema.
+//Generic descriptor, without Row fields, is generated when there is no schema
+func (e *protobufEncoder) buildDescriptor(numbers map[string]int) error {
+	pkg := "storagetapper"
+	row := &descriptorpb.DescriptorProto{Name: proto.String("Row")}
+
+	if e.inSchema != nil {
+		pkg += "." + protobufName(e.Service) + "." + protobufName(e.Db) + "." + protobufName(e.Table)
+		used := make(map[string]bool)
+		for i, j := 0, 0; i < len(e.inSchema.Columns); i++ {
+			if filteredField(e.filter, i, &j) {
+				continue
+			}
+			c := &e.inSchema.Columns[i]
+			name := protobufName(c.Name)
+			if used[name] {
+				name += "_" + strconv.Itoa(numbers[c.Name])
+			}
+			used[name] = true
+
+			//Proto3 optional fields, so as NULLs are distinguishable from
+			//zero values
+			f := pbField(name, numbers[c.Name], protobufType(c))
+			f.OneofIndex = proto.Int32(int32(len(row.OneofDecl)))
+			f.Proto3Optional = proto.Bool(true)
+			row.OneofDecl = append(row.OneofDecl, &descriptorpb.OneofDescriptorProto{Name: proto.String("_" + name)})
+			row.Field = append(row.Field, f)
+		}
+	}
+
+	value := &descriptorpb.DescriptorProto{
+		Name:      proto.String("Value"),
+		OneofDecl: []*descriptorpb.OneofDescriptorProto{{Name: proto.String("kind")}},
+	}
+	for i, t := range pbValueTypes {
+		f := pbField(protobufTypeName(t)+"_value", i+1, t)
+		f.OneofIndex = proto.Int32(0)
+		value.Field = append(value.Field, f)
+	}
+
+	field := &descriptorpb.DescriptorProto{
+		Name: proto.String("Field"),
+		Field: []*descriptorpb.FieldDescriptorProto{
+			pbField("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+			pbMessageField("value", 2, "."+pkg+".Value", false),
+		},
+	}
+
+	event := &descriptorpb.DescriptorProto{
+		Name: proto.String("Event"),
+		Field: []*descriptorpb.FieldDescriptorProto{
+			pbField("type", pbEventType, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+			pbField("seq_no", pbEventSeqNo, descriptorpb.FieldDescriptorProto_TYPE_UINT64),
+			pbField("timestamp", pbEventTimestamp, descriptorpb.FieldDescriptorProto_TYPE_INT64),
+			pbField("gtid", pbEventGtid, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+			pbMessageField("key", pbEventKey, "."+pkg+".Value", true),
+			pbMessageField("fields", pbEventFields, "."+pkg+".Field", true),
+			pbMessageField("row", pbEventRow, "."+pkg+".Row", false),
+			pbField("descriptor", pbEventDescriptor, descriptorpb.FieldDescriptorProto_TYPE_BYTES),
+			pbField("event_time", pbEventEventTime, descriptorpb.FieldDescriptorProto_TYPE_INT64),
+			pbField("envelope", pbEventEnvelope, descriptorpb.FieldDescriptorProto_TYPE_BOOL),
+		},
+	}
+
+	fdp := &descriptorpb.FileDescriptorProto{
+		Name:        proto.String(strings.Replace(pkg, ".", "/", -1) + ".proto"),
+		Package:     proto.String(pkg),
+		Syntax:      proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{event, row, value, field},
+	}
+
+	fd, err := protodesc.NewFile(fdp, nil)
+	if err != nil {
+		return err
+	}
+
+	e.descriptor, err = proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{fdp}})
+	if err != nil {
+		return err
+	}
+
+	e.event = fd.Messages().ByName("Event")
+	e.value = fd.Messages().ByName("Value")
+	e.field = fd.Messages().ByName("Field")
+
+	e.valueKinds = make(map[protoreflect.Kind]protoreflect.FieldDescriptor)
+	for i := 0; i < e.value.Fields().Len(); i++ {
+		f := e.value.Fields().Get(i)
+		e.valueKinds[f.Kind()] = f
+	}
+
+	e.columns, e.names = nil, make(map[string]protoreflect.FieldDescriptor)
+	if e.inSchema != nil {
+		e.columns = make([]protoreflect.FieldDescriptor, len(e.inSchema.Columns))
+		rowFields := fd.Messages().ByName("Row").Fields()
+		for i, j := 0, 0; i < len(e.inSchema.Columns); i++ {
+			if filteredField(e.filter, i, &j) {
+				continue
+			}
+			e.columns[i] = rowFields.ByNumber(protoreflect.FieldNumber(numbers[e.inSchema.Columns[i].Name]))
+			e.names[e.inSchema.Columns[i].Name] = e.columns[i]
+		}
+	}
+
+	log.Debugf("Protobuf descriptor updated: %v", pkg)
+
+	return nil
+}
+
+//EncodeSchema encodes current output schema
+func (e *protobufEncoder) EncodeSchema(seqno uint64) ([]byte, error) {
+	return e.Row(types.Schema, nil, seqno)
+}
+
+//Row encodes row into Protobuf Event message
+func (e *protobufEncoder) Row(tp int, row *[]interface{}, seqno uint64) ([]byte, error) {
+	cf := e.convertRowToCommonFormat(tp, row, e.inSchema, seqno, e.filter)
+	return e.encode(cf)
+}
+
+//CommonFormat encodes common format event into Protobuf Event message
+func (e *protobufEncoder) CommonFormat(cf *types.CommonFormatEvent) ([]byte, error) {
+	if cf.Type == "schema" {
+		err := e.UpdateCodec()
+		if err != nil {
+			return nil, err
+		}
+	}
+	cf = filterCommonFormat(e.filter, cf)
+	return e.encode(cf)
+}
+
+func (e *protobufEncoder) encode(cf *types.CommonFormatEvent) ([]byte, error) {
+	m := dynamicpb.NewMessage(e.event)
+	f := e.event.Fields()
+
+	m.Set(f.ByNumber(pbEventType), protoreflect.ValueOfString(cf.Type))
+	m.Set(f.ByNumber(pbEventSeqNo), protoreflect.ValueOfUint64(cf.SeqNo))
+	m.Set(f.ByNumber(pbEventTimestamp), protoreflect.ValueOfInt64(cf.Timestamp))
+	m.Set(f.ByNumber(pbEventGtid), protoreflect.ValueOfString(cf.Gtid))
+	m.Set(f.ByNumber(pbEventEventTime), protoreflect.ValueOfInt64(cf.EventTime))
+
+	if e.inSchema != nil && (cf.Type == "insert" || cf.Type == "delete") {
+		row, err := e.encodeRow(cf)
+		if err != nil {
+			return nil, err
+		}
+		m.Set(f.ByNumber(pbEventRow), protoreflect.ValueOfMessage(row))
+	} else {
+		e.encodeGeneric(m, cf)
+		if e.inSchema != nil && cf.Type == "schema" {
+			m.Set(f.ByNumber(pbEventDescriptor), protoreflect.ValueOfBytes(e.descriptor))
+		}
+	}
+
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	//Envelope is followed by the wrapped event, so mark the end of the
+	//envelope for UnwrapEvent. The marker is appended explicitly because
+	//Marshal doesn't guarantee the order of the fields
+	if cf.Type != "insert" && cf.Type != "delete" && cf.Type != "schema" {
+		b = protowire.AppendTag(b, pbEventEnvelope, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+
+	return b, nil
+}
+
+//encodeRow fills Row message from the event key and fields. Fields not in
+//the output schema are skipped. NULL fields are not set
+func (e *protobufEncoder) encodeRow(cf *types.CommonFormatEvent) (protoreflect.Message, error) {
+	row := dynamicpb.NewMessage(e.event.Fields().ByNumber(pbEventRow).Message())
+
+	k := 0
+	for i := 0; i < len(e.inSchema.Columns); i++ {
+		if e.inSchema.Columns[i].Key != "PRI" {
+			continue
+		}
+		if k >= len(cf.Key) || e.columns[i] == nil {
+			return nil, fmt.Errorf("event key doesn't match primary key of %v.%v.%v", e.Service, e.Db, e.Table)
+		}
+		if err := setProtobufField(row, e.columns[i], cf.Key[k]); err != nil {
+			return nil, err
+		}
+		k++
+	}
+
+	if cf.Fields != nil {
+		for _, v := range *cf.Fields {
+			if fd := e.names[v.Name]; fd != nil {
+				if err := setProtobufField(row, fd, v.Value); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return row, nil
+}
+
+func (e *protobufEncoder) encodeGeneric(m protoreflect.Message, cf *types.CommonFormatEvent) {
+	f := e.event.Fields()
+
+	if len(cf.Key) != 0 {
+		key := m.Mutable(f.ByNumber(pbEventKey)).List()
+		for _, v := range cf.Key {
+			key.Append(protoreflect.ValueOfMessage(e.encodeValue(v)))
+		}
+	}
+
+	if cf.Fields != nil && len(*cf.Fields) != 0 {
+		fields := m.Mutable(f.ByNumber(pbEventFields)).List()
+		for _, v := range *cf.Fields {
+			fm := dynamicpb.NewMessage(e.field)
+			fm.Set(e.field.Fields().ByNumber(1), protoreflect.ValueOfString(v.Name))
+			fm.Set(e.field.Fields().ByNumber(2), protoreflect.ValueOfMessage(e.encodeValue(v.Value)))
+			fields.Append(protoreflect.ValueOfMessage(fm))
+		}
+	}
+}
+
+//encodeValue converts value to generic Value message, preserving its type.
+//Value with no field set is NULL
+func (e *protobufEncoder) encodeValue(v interface{}) protoreflect.Message {
+	m := dynamicpb.NewMessage(e.value)
+
+	var k protoreflect.Kind
+	var pv protoreflect.Value
+	switch t := v.(type) {
+	case nil:
+		return m
+	case bool:
+		k, pv = protoreflect.BoolKind, protoreflect.ValueOfBool(t)
+	case int8:
+		k, pv = protoreflect.Int32Kind, protoreflect.ValueOfInt32(int32(t))
+	case int16:
+		k, pv = protoreflect.Int32Kind, protoreflect.ValueOfInt32(int32(t))
+	case int32:
+		k, pv = protoreflect.Int32Kind, protoreflect.ValueOfInt32(t)
+	case int:
+		k, pv = protoreflect.Int64Kind, protoreflect.ValueOfInt64(int64(t))
+	case int64:
+		k, pv = protoreflect.Int64Kind, protoreflect.ValueOfInt64(t)
+	case uint8:
+		k, pv = protoreflect.Uint32Kind, protoreflect.ValueOfUint32(uint32(t))
+	case uint16:
+		k, pv = protoreflect.Uint32Kind, protoreflect.ValueOfUint32(uint32(t))
+	case uint32:
+		k, pv = protoreflect.Uint32Kind, protoreflect.ValueOfUint32(t)
+	case uint:
+		k, pv = protoreflect.Uint64Kind, protoreflect.ValueOfUint64(uint64(t))
+	case uint64:
+		k, pv = protoreflect.Uint64Kind, protoreflect.ValueOfUint64(t)
+	case float32:
+		k, pv = protoreflect.FloatKind, protoreflect.ValueOfFloat32(t)
+	case float64:
+		k, pv = protoreflect.DoubleKind, protoreflect.ValueOfFloat64(t)
+	case string:
+		k, pv = protoreflect.StringKind, protoreflect.ValueOfString(t)
+	case []byte:
+		k, pv = protoreflect.BytesKind, protoreflect.ValueOfBytes(t)
+	default:
+		k, pv = protoreflect.StringKind, protoreflect.ValueOfString(fmt.Sprintf("%v", t))
+	}
+
+	m.Set(e.valueKinds[k], pv)
+
+	return m
+}
+
+func (e *protobufEncoder) decodeValue(m protoreflect.Message) interface{} {
+	f := m.WhichOneof(e.value.Oneofs().ByName("kind"))
+	if f == nil {
+		return nil
+	}
+	return protobufGoValue(f.Kind(), m.Get(f))
+}
+
+//protobufGoValue converts field value to the Go type used in common format
+func protobufGoValue(k protoreflect.Kind, v protoreflect.Value) interface{} {
+	switch k {
+	case protoreflect.BoolKind:
+		return v.Bool()
+	case protoreflect.Int32Kind:
+		return int32(v.Int())
+	case protoreflect.Int64Kind:
+		return v.Int()
+	case protoreflect.Uint32Kind:
+		return uint32(v.Uint())
+	case protoreflect.Uint64Kind:
+		return v.Uint()
+	case protoreflect.FloatKind:
+		return float32(v.Float())
+	case protoreflect.DoubleKind:
+		return v.Float()
+	case protoreflect.StringKind:
+		return v.String()
+	case protoreflect.BytesKind:
+		if v.Bytes() == nil {
+			return []byte{}
+		}
+		return v.Bytes()
+	}
+	return nil
+}
+
+func protobufInt(v interface{}) (int64, error) {
+	switch t := v.(type) {
+	case int8:
+		return int64(t), nil
+	case int16:
+		return int64(t), nil
+	case int32:
+		return int64(t), nil
+	case int:
+		return int64(t), nil
+	case int64:
+		return t, nil
+	case uint8:
+		return int64(t), nil
+	case uint16:
+		return int64(t), nil
+	case uint32:
+		return int64(t), nil
+	case uint:
+		return int64(t), nil
+	case uint64:
+		return int64(t), nil
+	case float32:
+		return int64(t), nil
+	case float64:
+		return int64(t), nil
+	case string:
+		return strconv.ParseInt(t, 10, 64)
+	case []byte:
+		return strconv.ParseInt(string(t), 10, 64)
+	}
+	return 0, fmt.Errorf("can't convert %T to integer", v)
+}
+
+func protobufUint(v interface{}) (uint64, error) {
+	switch t := v.(type) {
+	case string:
+		return strconv.ParseUint(t, 10, 64)
+	case []byte:
+		return strconv.ParseUint(string(t), 10, 64)
+	case uint64:
+		return t, nil
+	case uint:
+		return uint64(t), nil
+	}
+	i, err := protobufInt(v)
+	return uint64(i), err
+}
+
+func protobufFloat(v interface{}) (float64, error) {
+	switch t := v.(type) {
+	case float32:
+		return float64(t), nil
+	case float64:
+		return t, nil
+	case string:
+		return strconv.ParseFloat(t, 64)
+	case []byte:
+		return strconv.ParseFloat(string(t), 64)
+	}
+	i, err := protobufInt(v)
+	return float64(i), err
+}
+
+//setProtobufField converts the value to the field type and sets the field
+func setProtobufField(m protoreflect.Message, f protoreflect.FieldDescriptor, v interface{}) error {
+	if v == nil {
+		return nil
+	}
+
+	var pv protoreflect.Value
+	var err error
+	switch f.Kind() {
+	case protoreflect.Int32Kind:
+		var i int64
+		i, err = protobufInt(v)
+		pv = protoreflect.ValueOfInt32(int32(i))
+	case protoreflect.Int64Kind:
+		var i int64
+		i, err = protobufInt(v)
+		pv = protoreflect.ValueOfInt64(i)
+	case protoreflect.Uint32Kind:
+		var u uint64
+		u, err = protobufUint(v)
+		pv = protoreflect.ValueOfUint32(uint32(u))
+	case protoreflect.Uint64Kind:
+		var u uint64
+		u, err = protobufUint(v)
+		pv = protoreflect.ValueOfUint64(u)
+	case protoreflect.FloatKind:
+		var d float64
+		d, err = protobufFloat(v)
+		pv = protoreflect.ValueOfFloat32(float32(d))
+	case protoreflect.DoubleKind:
+		var d float64
+		d, err = protobufFloat(v)
+		pv = protoreflect.ValueOfFloat64(d)
+	case protoreflect.BytesKind:
+		switch t := v.(type) {
+		case []byte:
+			pv = protoreflect.ValueOfBytes(t)
+		case string:
+			pv = protoreflect.ValueOfBytes([]byte(t))
+		default:
+			err = fmt.Errorf("can't convert %T to bytes", v)
+		}
+	default:
+		switch t := v.(type) {
+		case string:
+			pv = protoreflect.ValueOfString(t)
+		case []byte:
+			pv = protoreflect.ValueOfString(string(t))
+		case float64:
+			pv = protoreflect.ValueOfString(strconv.FormatFloat(t, 'f', -1, 64))
+		default:
+			pv = protoreflect.ValueOfString(fmt.Sprintf("%v", t))
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("field %v: %v", f.Name(), err)
+	}
+
+	m.Set(f, pv)
+
+	return nil
+}
+
+// UnwrapEvent splits the event header and payload
+// cfEvent is populated with the 'header' information aka the first decoding.
+// Data after the header returned in the payload parameter
+func (e *protobufEncoder) UnwrapEvent(data []byte, cfEvent *types.CommonFormatEvent) (payload []byte, err error) {
+	//Envelope ends with the envelope marker field, event which is not
+	//wrapped has no marker and has no payload
+	var n int
+	for n < len(data) {
+		num, typ, l := protowire.ConsumeTag(data[n:])
+		if l < 0 {
+			return nil, protowire.ParseError(l)
+		}
+		m := protowire.ConsumeFieldValue(num, typ, data[n+l:])
+		if m < 0 {
+			return nil, protowire.ParseError(m)
+		}
+		n += l + m
+		if num == pbEventEnvelope {
+			break
+		}
+	}
+
+	c, err := e.DecodeEvent(data[:n])
+	if err != nil {
+		return
+	}
+	*cfEvent = *c
+
+	if e.inSchema != nil && cfEvent.Type == "schema" {
+		if err = e.UpdateCodec(); err != nil {
+			return
+		}
+	}
+
+	return data[n:], nil
+}
+
+//DecodeEvent decodes Protobuf Event message into CommonFormatEvent struct
+func (e *protobufEncoder) DecodeEvent(b []byte) (*types.CommonFormatEvent, error) {
+	m := dynamicpb.NewMessage(e.event)
+	if err := proto.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+
+	f := e.event.Fields()
+	cf := &types.CommonFormatEvent{
+		Type:      m.Get(f.ByNumber(pbEventType)).String(),
+		SeqNo:     m.Get(f.ByNumber(pbEventSeqNo)).Uint(),
+		Timestamp: m.Get(f.ByNumber(pbEventTimestamp)).Int(),
+		Gtid:      m.Get(f.ByNumber(pbEventGtid)).String(),
+		EventTime: m.Get(f.ByNumber(pbEventEventTime)).Int(),
+	}
+
+	if cf.Type == "" {
+		return nil, fmt.Errorf("broken protobuf event, type is not set")
+	}
+
+	if m.Has(f.ByNumber(pbEventRow)) {
+		return cf, e.decodeRow(cf, m.Get(f.ByNumber(pbEventRow)).Message())
+	}
+
+	key := m.Get(f.ByNumber(pbEventKey)).List()
+	for i := 0; i < key.Len(); i++ {
+		cf.Key = append(cf.Key, e.decodeValue(key.Get(i).Message()))
+	}
+
+	fields := m.Get(f.ByNumber(pbEventFields)).List()
+	if fields.Len() != 0 {
+		cf.Fields = new([]types.CommonFormatField)
+		for i := 0; i < fields.Len(); i++ {
+			fm := fields.Get(i).Message()
+			*cf.Fields = append(*cf.Fields, types.CommonFormatField{
+				Name:  fm.Get(e.field.Fields().ByNumber(1)).String(),
+				Value: e.decodeValue(fm.Get(e.field.Fields().ByNumber(2)).Message()),
+			})
+		}
+	}
+
+	return cf, nil
+}
+
+//decodeRow restores key and fields from the Row message. Fields of the
+//columns missing in the message are NULL
+func (e *protobufEncoder) decodeRow(cf *types.CommonFormatEvent, row protoreflect.Message) error {
+	if e.inSchema == nil {
+		return fmt.Errorf("table schema is required to decode %v event", cf.Type)
+	}
+
+	if cf.Type != "delete" {
+		cf.Fields = new([]types.CommonFormatField)
+	}
+
+	for i := 0; i < len(e.inSchema.Columns); i++ {
+		f := e.columns[i]
+		if f == nil {
+			continue
+		}
+		var v interface{}
+		if row.Has(f) {
+			v = protobufGoValue(f.Kind(), row.Get(f))
+		}
+		if e.inSchema.Columns[i].Key == "PRI" {
+			cf.Key = append(cf.Key, v)
+		}
+		if cf.Fields != nil {
+			*cf.Fields = append(*cf.Fields, types.CommonFormatField{Name: e.inSchema.Columns[i].Name, Value: v})
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,268 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package encoder
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/raksh93/storagetapper/test"
+	"github.com/raksh93/storagetapper/types"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+var testProtobufColumns = []types.ColumnSchema{
+	{Name: "id", DataType: "bigint", Type: "bigint(20)", Key: "PRI"},
+	{Name: "name", DataType: "varchar", Type: "varchar(32)"},
+	{Name: "data", DataType: "blob", Type: "blob"},
+	{Name: "score", DataType: "float", Type: "float"},
+	{Name: "amount", DataType: "decimal", Type: "decimal(10,2)"},
+	{Name: "cnt", DataType: "int", Type: "int(10) unsigned"},
+	{Name: "big", DataType: "bigint", Type: "bigint(20) unsigned"},
+	{Name: "ts", DataType: "timestamp", Type: "timestamp"},
+	{Name: "col-1", DataType: "tinyint", Type: "tinyint(4)"},
+}
+
+var testProtobufNumbers = map[string]int{"id": 1, "name": 2, "data": 3, "score": 4, "amount": 5, "cnt": 6, "big": 7, "ts": 8, "col-1": 9}
+
+//newTestProtobufEncoder creates encoder with given schema and field numbers,
+//bypassing the state
+func newTestProtobufEncoder(t *testing.T, columns []types.ColumnSchema, numbers map[string]int, filter []int) *protobufEncoder {
+	enc, err := initProtobufEncoder("pb_svc", "pb_db", "pb-table")
+	test.CheckFail(err, t)
+	e := enc.(*protobufEncoder)
+	e.inSchema = &types.TableSchema{DBName: "pb_db", TableName: "pb-table", Columns: columns}
+	e.filter = filter
+	test.CheckFail(e.buildDescriptor(numbers), t)
+	return e
+}
+
+func TestProtobufRow(t *testing.T) {
+	e := newTestProtobufEncoder(t, testProtobufColumns, testProtobufNumbers, nil)
+
+	row := []interface{}{int64(1), "name1", []byte("data1"), float32(1.5), 12.25, uint32(4294967295), uint64(18446744073709551615), "2017-07-06 11:55:57", int8(-3)}
+	encoded, err := e.Row(types.Insert, &row, 5)
+	test.CheckFail(err, t)
+
+	decoded, err := e.DecodeEvent(encoded)
+	test.CheckFail(err, t)
+
+	ref := &types.CommonFormatEvent{Type: "insert", Key: []interface{}{int64(1)}, SeqNo: 5, Timestamp: 0, Fields: &[]types.CommonFormatField{
+		{Name: "id", Value: int64(1)}, {Name: "name", Value: "name1"}, {Name: "data", Value: []byte("data1")}, {Name: "score", Value: float32(1.5)},
+		{Name: "amount", Value: "12.25"}, {Name: "cnt", Value: uint32(4294967295)}, {Name: "big", Value: uint64(18446744073709551615)},
+		{Name: "ts", Value: "2017-07-06 11:55:57"}, {Name: "col-1", Value: int32(-3)},
+	}}
+	test.Assert(t, reflect.DeepEqual(ref, decoded), "decoded different from initial: %+v %+v", decoded, decoded.Fields)
+
+	//NULLs and zero values are distinguishable
+	cf := &types.CommonFormatEvent{Type: "insert", Key: []interface{}{int64(0)}, SeqNo: 6, Timestamp: 123, Fields: &[]types.CommonFormatField{
+		{Name: "id", Value: int64(0)}, {Name: "name", Value: ""}, {Name: "data", Value: []byte{}}, {Name: "score", Value: nil},
+		{Name: "amount", Value: nil}, {Name: "cnt", Value: uint32(0)}, {Name: "big", Value: nil}, {Name: "ts", Value: nil}, {Name: "col-1", Value: nil},
+	}}
+	encoded, err = e.CommonFormat(cf)
+	test.CheckFail(err, t)
+	decoded, err = e.DecodeEvent(encoded)
+	test.CheckFail(err, t)
+	test.Assert(t, reflect.DeepEqual(cf, decoded), "decoded different from initial: %+v %+v", decoded, decoded.Fields)
+
+	//Delete carries primary key only
+	encoded, err = e.Row(types.Delete, &row, 7)
+	test.CheckFail(err, t)
+	decoded, err = e.DecodeEvent(encoded)
+	test.CheckFail(err, t)
+	ref = &types.CommonFormatEvent{Type: "delete", Key: []interface{}{int64(1)}, SeqNo: 7, Timestamp: 0}
+	test.Assert(t, reflect.DeepEqual(ref, decoded), "decoded different from initial: %+v", decoded)
+
+	//Values are converted to the column type
+	cf = &types.CommonFormatEvent{Type: "insert", Key: []interface{}{"10"}, Fields: &[]types.CommonFormatField{{Name: "name", Value: []byte("abc")}, {Name: "data", Value: "def"}, {Name: "amount", Value: "1.5"}}}
+	encoded, err = e.CommonFormat(cf)
+	test.CheckFail(err, t)
+	decoded, err = e.DecodeEvent(encoded)
+	test.CheckFail(err, t)
+	f := *decoded.Fields
+	test.Assert(t, decoded.Key[0] == int64(10) && f[1].Value == "abc" && string(f[2].Value.([]byte)) == "def" && f[4].Value == "1.5", "unexpected conversion: %+v %+v", decoded, f)
+
+	//Decimals keep exact value, which doesn't fit into double
+	cf = &types.CommonFormatEvent{Type: "insert", Key: []interface{}{int64(1)}, Fields: &[]types.CommonFormatField{{Name: "amount", Value: []byte("12345678901234567.89")}}}
+	encoded, err = e.CommonFormat(cf)
+	test.CheckFail(err, t)
+	decoded, err = e.DecodeEvent(encoded)
+	test.CheckFail(err, t)
+	f = *decoded.Fields
+	test.Assert(t, f[4].Value == "12345678901234567.89", "decimal value should be exact: %+v", f[4].Value)
+
+	cf = &types.CommonFormatEvent{Type: "insert", Key: []interface{}{int64(1)}, Fields: &[]types.CommonFormatField{{Name: "score", Value: "not a number"}}}
+	_, err = e.CommonFormat(cf)
+	test.Assert(t, err != nil, "conversion error expected")
+
+	_, err = e.CommonFormat(&types.CommonFormatEvent{Type: "delete"})
+	test.Assert(t, err != nil, "primary key is required")
+}
+
+func TestProtobufFilter(t *testing.T) {
+	//"name" and "data" are not in the output schema
+	e := newTestProtobufEncoder(t, testProtobufColumns, testProtobufNumbers, []int{1, 2})
+
+	row := []interface{}{int64(1), "name1", []byte("data1"), float32(1.5), 12.25, uint32(1), uint64(2), "ts", int8(3)}
+	encoded, err := e.Row(types.Insert, &row, 1)
+	test.CheckFail(err, t)
+
+	decoded, err := e.DecodeEvent(encoded)
+	test.CheckFail(err, t)
+
+	ref := &types.CommonFormatEvent{Type: "insert", Key: []interface{}{int64(1)}, SeqNo: 1, Fields: &[]types.CommonFormatField{
+		{Name: "id", Value: int64(1)}, {Name: "score", Value: float32(1.5)}, {Name: "amount", Value: "12.25"}, {Name: "cnt", Value: uint32(1)},
+		{Name: "big", Value: uint64(2)}, {Name: "ts", Value: "ts"}, {Name: "col-1", Value: int32(3)},
+	}}
+	test.Assert(t, reflect.DeepEqual(ref, decoded), "decoded different from initial: %+v %+v", decoded, decoded.Fields)
+
+	test.Assert(t, e.event.Fields().ByName("row").Message().Fields().Len() == 7, "filtered fields shouldn't be in the descriptor")
+}
+
+//Messages encoded before ALTER TABLE can be decoded after it and vice versa
+func TestProtobufFieldNumbers(t *testing.T) {
+	before := newTestProtobufEncoder(t, []types.ColumnSchema{
+		{Name: "id", DataType: "bigint", Type: "bigint(20)", Key: "PRI"},
+		{Name: "f1", DataType: "varchar", Type: "varchar(32)"},
+		{Name: "f2", DataType: "int", Type: "int(11)"},
+	}, map[string]int{"id": 1, "f1": 2, "f2": 3}, nil)
+
+	//f1 dropped, f3 added in the middle, f2 type changed
+	after := newTestProtobufEncoder(t, []types.ColumnSchema{
+		{Name: "id", DataType: "bigint", Type: "bigint(20)", Key: "PRI"},
+		{Name: "f3", DataType: "varchar", Type: "varchar(32)"},
+		{Name: "f2", DataType: "varchar", Type: "varchar(32)"},
+	}, map[string]int{"id": 1, "f3": 4, "f2": 5}, nil)
+
+	encoded, err := before.Row(types.Insert, &[]interface{}{int64(1), "val1", int32(2)}, 1)
+	test.CheckFail(err, t)
+
+	decoded, err := after.DecodeEvent(encoded)
+	test.CheckFail(err, t)
+	ref := &types.CommonFormatEvent{Type: "insert", Key: []interface{}{int64(1)}, SeqNo: 1, Fields: &[]types.CommonFormatField{
+		{Name: "id", Value: int64(1)}, {Name: "f3", Value: nil}, {Name: "f2", Value: nil},
+	}}
+	test.Assert(t, reflect.DeepEqual(ref, decoded), "decoded different from expected: %+v %+v", decoded, decoded.Fields)
+
+	encoded, err = after.Row(types.Insert, &[]interface{}{int64(2), "val3", "val2"}, 2)
+	test.CheckFail(err, t)
+
+	decoded, err = before.DecodeEvent(encoded)
+	test.CheckFail(err, t)
+	ref = &types.CommonFormatEvent{Type: "insert", Key: []interface{}{int64(2)}, SeqNo: 2, Fields: &[]types.CommonFormatField{
+		{Name: "id", Value: int64(2)}, {Name: "f1", Value: nil}, {Name: "f2", Value: nil},
+	}}
+	test.Assert(t, reflect.DeepEqual(ref, decoded), "decoded different from expected: %+v %+v", decoded, decoded.Fields)
+}
+
+func TestProtobufGeneric(t *testing.T) {
+	enc, err := InitEncoder("protobuf", "", "", "")
+	test.CheckFail(err, t)
+
+	cf := &types.CommonFormatEvent{Type: "insert", Key: []interface{}{"k1", int64(2), nil}, SeqNo: 3, Timestamp: 4, Gtid: "gtid1", Fields: &[]types.CommonFormatField{
+		{Name: "f1", Value: int32(1)}, {Name: "f2", Value: uint64(2)}, {Name: "f3", Value: float32(3)}, {Name: "f4", Value: 4.5},
+		{Name: "f5", Value: true}, {Name: "f6", Value: []byte{}}, {Name: "f7", Value: nil}, {Name: "f8", Value: uint32(8)}, {Name: "f9", Value: int64(0)},
+	}}
+
+	encoded, err := enc.CommonFormat(cf)
+	test.CheckFail(err, t)
+	decoded, err := enc.DecodeEvent(encoded)
+	test.CheckFail(err, t)
+	test.Assert(t, reflect.DeepEqual(cf, decoded), "decoded different from initial: %+v %+v", decoded, decoded.Fields)
+
+	//Row message can't be decoded without table schema
+	e := newTestProtobufEncoder(t, testProtobufColumns, testProtobufNumbers, nil)
+	encoded, err = e.Row(types.Delete, &[]interface{}{int64(1)}, 1)
+	test.CheckFail(err, t)
+	_, err = enc.DecodeEvent(encoded)
+	test.Assert(t, err != nil, "error expected")
+}
+
+func TestProtobufUnwrap(t *testing.T) {
+	e := newTestProtobufEncoder(t, testProtobufColumns, testProtobufNumbers, nil)
+	env, err := InitEncoder("protobuf", "", "", "")
+	test.CheckFail(err, t)
+
+	ref := &types.CommonFormatEvent{Type: "delete", Key: []interface{}{int64(1)}, SeqNo: 2}
+	payload, err := e.CommonFormat(ref)
+	test.CheckFail(err, t)
+
+	//Envelope fields are the same as in the wrapped message, only the first
+	//occurrence should be taken
+	w := &types.CommonFormatEvent{Type: "protobuf", Key: []interface{}{"11", int64(1)}, SeqNo: 2, Timestamp: 5, Gtid: "gtid1", EventTime: 6}
+	wrapped, err := env.CommonFormat(w)
+	test.CheckFail(err, t)
+	wrapped = append(wrapped, payload...)
+
+	cf := &types.CommonFormatEvent{}
+	p, err := e.UnwrapEvent(wrapped, cf)
+	test.CheckFail(err, t)
+	test.Assert(t, reflect.DeepEqual(cf, w), "unexpected envelope: %+v", cf)
+	test.Assert(t, bytes.Equal(p, payload), "unexpected payload")
+
+	decoded, err := e.DecodeEvent(p)
+	test.CheckFail(err, t)
+	test.Assert(t, reflect.DeepEqual(ref, decoded), "decoded different from initial: %+v", decoded)
+
+	//Event which is not wrapped
+	cf = &types.CommonFormatEvent{}
+	p, err = e.UnwrapEvent(payload, cf)
+	test.CheckFail(err, t)
+	test.Assert(t, len(p) == 0 && reflect.DeepEqual(cf, ref), "unexpected event: %+v", cf)
+
+	_, err = e.UnwrapEvent(wrapped[:3], cf)
+	test.Assert(t, err != nil, "error expected on truncated input")
+}
+
+func TestProtobufDescriptor(t *testing.T) {
+	e := newTestProtobufEncoder(t, testProtobufColumns, testProtobufNumbers, nil)
+
+	d, err := ProtobufDescriptor(e)
+	test.CheckFail(err, t)
+
+	//Schema event carries the descriptor
+	encoded, err := e.EncodeSchema(1)
+	test.CheckFail(err, t)
+	m := e.event.Fields().ByName("descriptor")
+	test.Assert(t, m != nil && bytes.Contains(encoded, d), "schema event should contain descriptor")
+
+	decoded, err := e.DecodeEvent(encoded)
+	test.CheckFail(err, t)
+	test.Assert(t, decoded.Type == "schema" && reflect.DeepEqual(decoded.Key, []interface{}{"id"}) && (*decoded.Fields)[8].Value == "tinyint(4)", "unexpected schema event: %+v", decoded)
+
+	var set descriptorpb.FileDescriptorSet
+	test.CheckFail(proto.Unmarshal(d, &set), t)
+	files, err := protodesc.NewFiles(&set)
+	test.CheckFail(err, t)
+
+	md, err := files.FindDescriptorByName("storagetapper.pb_svc.pb_db.pb_table.Row")
+	test.CheckFail(err, t)
+	test.Assert(t, md.FullName() == "storagetapper.pb_svc.pb_db.pb_table.Row", "unexpected descriptor: %v", md.FullName())
+
+	_, err = files.FindDescriptorByName("storagetapper.pb_svc.pb_db.pb_table.Event")
+	test.CheckFail(err, t)
+
+	_, err = ProtobufDescriptor(&jsonEncoder{})
+	test.Assert(t, err != nil, "json encoder doesn't have protobuf descriptor")
+}
@@ -56,13 +56,24 @@ type myLock struct {
 	ci       db.Addr
 	n        int
 	ntickets int
+	parent   *myLock //owner of the connection for shared locks
 }
 
 /*Create an instance of Lock*/
 //ntickets - is concurrency allowed for the lock, meaing n processes can hold the lock
 //at the same time
 func Create(ci *db.Addr, ntickets int) Lock {
-	return &myLock{nil, "", *ci, 0, ntickets}
+	return &myLock{nil, "", *ci, 0, ntickets, nil}
+}
+
+/*CreateShared creates an instance of Lock, which uses connection of the parent
+lock, so as multiple locks can be held using single connection.*/
+//Closing shared lock releases the lock only, connection is closed when parent
+//lock is closed. Since MySQL locks are reentrant in the same connection,
+//caller should not acquire the same lock twice using locks sharing connection
+func CreateShared(parent Lock, ntickets int) Lock {
+	p := parent.(*myLock)
+	return &myLock{nil, "", p.ci, 0, ntickets, p}
 }
 
 func (m *myLock) log() log.Logger {
@@ -70,6 +81,16 @@ func (m *myLock) log() log.Logger {
 }
 
 func (m *myLock) closeConn() bool {
+	if m.parent != nil {
+		//Close parent connection only if it hasn't been reopened already by
+		//another lock sharing it
+		c := m.conn
+		m.conn = nil
+		if c != nil && c == m.parent.conn {
+			return m.parent.closeConn()
+		}
+		return true
+	}
 	if m.conn == nil {
 		return true
 	}
@@ -80,6 +101,11 @@ func (m *myLock) closeConn() bool {
 }
 
 func (m *myLock) openConn() bool {
+	if m.parent != nil {
+		res := m.parent.openConn()
+		m.conn = m.parent.conn
+		return res
+	}
 	if m.conn != nil {
 		return true
 	}
@@ -169,5 +195,11 @@ func (m *myLock) Unlock() bool {
 }
 
 func (m *myLock) Close() bool {
+	if m.parent != nil {
+		//Connection is owned by the parent, so release the lock explicitly
+		res := m.conn == nil || !m.IsLockedByMe() || m.Unlock()
+		m.conn = nil
+		return res
+	}
 	return m.closeConn()
 }
@@ -289,6 +289,35 @@ func TestFailUnlock(t *testing.T) {
 	}
 }
 
+func TestLockShared(t *testing.T) {
+	test.SkipIfNoMySQLAvailable(t)
+
+	parent := Create(dbAddr, 1)
+	defer parent.Close()
+
+	lock1 := CreateShared(parent, 1)
+	lock2 := CreateShared(parent, 1)
+	other := Create(dbAddr, 1)
+	defer other.Close()
+
+	test.Assert(t, lock1.TryLock("test_lock_shared_1"), "should acquire first lock")
+	test.Assert(t, lock2.TryLock("test_lock_shared_2"), "should acquire second lock")
+	test.Assert(t, lock1.(*myLock).conn == lock2.(*myLock).conn, "locks should share connection")
+
+	test.Assert(t, !other.TryLock("test_lock_shared_1"), "first lock should be held")
+	test.Assert(t, !other.TryLock("test_lock_shared_2"), "second lock should be held")
+
+	//Closing shared lock releases the lock, but keeps connection for others
+	test.Assert(t, lock1.Close(), "close failed")
+	test.Assert(t, other.TryLock("test_lock_shared_1"), "first lock should be released")
+	test.Assert(t, lock2.Refresh(), "second lock should still be held")
+
+	//Broken connection should be reestablished and lock reacquired
+	test.CheckFail(parent.(*myLock).conn.Close(), t)
+	test.Assert(t, lock2.Refresh(), "second lock should be reacquired")
+	test.Assert(t, lock2.Close(), "close failed")
+}
+
 func TestLockNegative(t *testing.T) {
 	test.SkipIfNoMySQLAvailable(t)
 
@@ -93,6 +93,43 @@ func schemaGet(namespace string, schemaName string, typ string) (*types.AvroSche
 	return a, err
 }
 
+//validateKafkaTopics checks settings of the registered tables topics, creating
+//missing topics if topics provisioning is enabled
+func validateKafkaTopics(cfg *config.AppConfig) {
+	rows, err := state.Get()
+	if log.E(err) {
+		return
+	}
+
+	topics := make(map[string]*config.KafkaTopicSettings)
+	for _, r := range rows {
+		t, err := cfg.GetKafkaTopics(r.Service, r.Db, r.Table, r.Input, r.Output, r.Version)
+		if log.E(err) {
+			return
+		}
+		for n, s := range t {
+			topics[n] = s
+		}
+	}
+
+	missing, err := pipe.ValidateKafkaTopics(cfg, topics)
+	log.E(err)
+
+	if len(missing) == 0 {
+		return
+	}
+
+	log.Warnf("Topics of registered tables missing: %v", missing)
+
+	if cfg.KafkaTopics.Create {
+		create := make(map[string]*config.KafkaTopicSettings)
+		for _, n := range missing {
+			create[n] = topics[n]
+		}
+		log.E(pipe.CreateKafkaTopics(cfg, create))
+	}
+}
+
 /*mainLow extracted for the tests to be able to run with different
 * configurations */
 func mainLow(cfg *config.AppConfig) {
@@ -119,6 +156,10 @@ func mainLow(cfg *config.AppConfig) {
 		return
 	}
 
+	if cfg.KafkaTopics.Validate {
+		validateKafkaTopics(cfg)
+	}
+
 	/*TODO: Add ability to gracefully shutdown the HTTP server */
 	go server.StartHTTPServer(cfg.PortDyn)
 
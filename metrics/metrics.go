@@ -74,6 +74,9 @@ type Snapshot struct {
 type Streamer struct {
 	Events
 	TimeInBuffer *Timer
+
+	EventsRetried      *Counter
+	EventsDeadLettered *Counter
 }
 
 //BinlogReader contains metrics related to binlog reader
@@ -89,6 +92,22 @@ type BinlogReader struct {
 	NumTablesIngesting *Counter
 }
 
+//Verify contains metrics related to source vs output verification job
+type Verify struct {
+	NumWorkers       *ProcessCounter
+	ChunksVerified   *Counter
+	ChunksMismatched *Counter
+	RowsExtra        *Counter
+}
+
+//LocalPipe contains metrics related to disk spilling of the local pipe
+type LocalPipe struct {
+	SpillMessages   *Counter
+	SpillBytes      *Counter
+	MessagesSpilled *Counter
+	SpillFull       *Counter
+}
+
 //getEventsMetrics returns the Events metrics object for a given process (BinlogReader, Snapshot or Streamer)
 func getEventsMetrics(process string, tags map[string]string) Events {
 	c := GetGlobal()
@@ -124,6 +143,9 @@ func GetStreamerMetrics(tags map[string]string) *Streamer {
 	return &Streamer{
 		Events:       getEventsMetrics("streamer", tags),
 		TimeInBuffer: TimerInit(c.factory, "time_in_buffer", tags),
+
+		EventsRetried:      CounterInit(c.factory, "streamer_events_retried", tags),
+		EventsDeadLettered: CounterInit(c.factory, "streamer_events_dead_lettered", tags),
 	}
 }
 
@@ -135,6 +157,28 @@ func GetSnapshotMetrics(tags map[string]string) *Snapshot {
 	}
 }
 
+//GetVerifyMetrics initializes and returns a Verify metrics object
+func GetVerifyMetrics(tags map[string]string) *Verify {
+	c := GetGlobal()
+	return &Verify{
+		NumWorkers:       ProcessCounterInit(c.factory, "num_verify_workers", tags),
+		ChunksVerified:   CounterInit(c.factory, "verify_chunks_verified", tags),
+		ChunksMismatched: CounterInit(c.factory, "verify_chunks_mismatched", tags),
+		RowsExtra:        CounterInit(c.factory, "verify_rows_extra", tags),
+	}
+}
+
+//GetLocalPipeMetrics initializes and returns a LocalPipe metrics object
+func GetLocalPipeMetrics(tags map[string]string) *LocalPipe {
+	c := GetGlobal()
+	return &LocalPipe{
+		SpillMessages:   CounterInit(c.factory, "local_pipe_spill_messages", tags),
+		SpillBytes:      CounterInit(c.factory, "local_pipe_spill_bytes", tags),
+		MessagesSpilled: CounterInit(c.factory, "local_pipe_messages_spilled", tags),
+		SpillFull:       CounterInit(c.factory, "local_pipe_spill_full", tags),
+	}
+}
+
 var m *Metrics
 
 //Init initializes global metrics structure
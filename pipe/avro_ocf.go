@@ -0,0 +1,483 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package pipe
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+
+	"github.com/DataDog/zstd"
+	"github.com/golang/snappy"
+)
+
+//Avro Object Container Files support.
+//See: https://avro.apache.org/docs/1.8.2/spec.html#Object+Container+Files
+
+const ocfMagic = "Obj\x01"
+const ocfSyncSize = 16
+
+type ocfCodec struct {
+	encode func(b []byte) ([]byte, error)
+	decode func(b []byte) ([]byte, error)
+}
+
+var ocfCodecs = map[string]ocfCodec{
+	"null": {
+		encode: func(b []byte) ([]byte, error) { return b, nil },
+		decode: func(b []byte) ([]byte, error) { return b, nil },
+	},
+	"deflate": {
+		encode: func(b []byte) ([]byte, error) {
+			var buf bytes.Buffer
+			w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+			if err != nil {
+				return nil, err
+			}
+			if _, err = w.Write(b); err != nil {
+				return nil, err
+			}
+			err = w.Close()
+			return buf.Bytes(), err
+		},
+		decode: func(b []byte) ([]byte, error) {
+			return ioutil.ReadAll(flate.NewReader(bytes.NewReader(b)))
+		},
+	},
+	//Snappy compressed block is followed by CRC32 of the uncompressed data
+	"snappy": {
+		encode: func(b []byte) ([]byte, error) {
+			crc := make([]byte, 4)
+			binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(b))
+			return append(snappy.Encode(nil, b), crc...), nil
+		},
+		decode: func(b []byte) ([]byte, error) {
+			if len(b) < 4 {
+				return nil, fmt.Errorf("snappy block is too short")
+			}
+			r, err := snappy.Decode(nil, b[:len(b)-4])
+			if err != nil {
+				return nil, err
+			}
+			if crc32.ChecksumIEEE(r) != binary.BigEndian.Uint32(b[len(b)-4:]) {
+				return nil, fmt.Errorf("snappy block checksum mismatch")
+			}
+			return r, nil
+		},
+	},
+	"zstandard": {
+		encode: func(b []byte) ([]byte, error) { return zstd.Compress(nil, b) },
+		decode: func(b []byte) ([]byte, error) { return zstd.Decompress(nil, b) },
+	},
+}
+
+func writeVarint(w io.Writer, v int64) error {
+	b := make([]byte, binary.MaxVarintLen64)
+	_, err := w.Write(b[:binary.PutVarint(b, v)])
+	return err
+}
+
+func writeAvroBytes(w io.Writer, b []byte) error {
+	if err := writeVarint(w, int64(len(b))); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func readAvroBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("invalid avro bytes length: %v", n)
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+//ocfWriter writes every Write call as a separate Avro record. Records are
+//accumulated and written as a block, when block size is reached or on Flush
+type ocfWriter struct {
+	w         io.Writer
+	codec     ocfCodec
+	sync      []byte
+	blockSize int
+	buf       bytes.Buffer
+	count     int64
+}
+
+//newOCFWriter writes container file header with given writer schema and block
+//codec
+func newOCFWriter(w io.Writer, schema []byte, codec string, blockSize int) (*ocfWriter, error) {
+	c, ok := ocfCodecs[codec]
+	if !ok {
+		return nil, fmt.Errorf("unsupported avro container codec: %v", codec)
+	}
+
+	o := &ocfWriter{w: w, codec: c, sync: make([]byte, ocfSyncSize), blockSize: blockSize}
+	if _, err := io.ReadFull(rand.Reader, o.sync); err != nil {
+		return nil, err
+	}
+
+	var h bytes.Buffer
+	h.WriteString(ocfMagic)
+	//File metadata is a map with a single block of two entries
+	_ = writeVarint(&h, 2)
+	_ = writeAvroBytes(&h, []byte("avro.schema"))
+	_ = writeAvroBytes(&h, schema)
+	_ = writeAvroBytes(&h, []byte("avro.codec"))
+	_ = writeAvroBytes(&h, []byte(codec))
+	_ = writeVarint(&h, 0)
+	h.Write(o.sync)
+
+	if _, err := w.Write(h.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+func (o *ocfWriter) Write(b []byte) (int, error) {
+	o.buf.Write(b)
+	o.count++
+	if o.buf.Len() >= o.blockSize {
+		if err := o.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+//Flush writes accumulated records as a block
+func (o *ocfWriter) Flush() error {
+	if o.count == 0 {
+		return nil
+	}
+
+	data, err := o.codec.encode(o.buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	var h bytes.Buffer
+	_ = writeVarint(&h, o.count)
+	_ = writeAvroBytes(&h, data)
+	h.Write(o.sync)
+
+	if _, err = o.w.Write(h.Bytes()); err != nil {
+		return err
+	}
+
+	o.buf.Reset()
+	o.count = 0
+
+	return nil
+}
+
+//ocfReader reads records from the container file blocks
+type ocfReader struct {
+	r      *bufio.Reader
+	schema []byte
+	codec  ocfCodec
+	sync   []byte
+	walker *avroWalker
+
+	data  []byte
+	block *bytes.Reader
+	count int64
+}
+
+//isOCF checks if the reader is positioned at the beginning of container file
+func isOCF(r *bufio.Reader) bool {
+	b, err := r.Peek(len(ocfMagic))
+	return err == nil && string(b) == ocfMagic
+}
+
+func newOCFReader(r *bufio.Reader) (*ocfReader, error) {
+	if _, err := r.Discard(len(ocfMagic)); err != nil {
+		return nil, err
+	}
+
+	meta := make(map[string][]byte)
+	for {
+		n, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		if n < 0 {
+			//Negative count is followed by the block size
+			n = -n
+			if _, err = binary.ReadVarint(r); err != nil {
+				return nil, err
+			}
+		}
+		for ; n > 0; n-- {
+			k, err := readAvroBytes(r)
+			if err != nil {
+				return nil, err
+			}
+			if meta[string(k)], err = readAvroBytes(r); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	codec := string(meta["avro.codec"])
+	if codec == "" {
+		codec = "null"
+	}
+	c, ok := ocfCodecs[codec]
+	if !ok {
+		return nil, fmt.Errorf("unsupported avro container codec: %v", codec)
+	}
+
+	w, err := newAvroWalker(meta["avro.schema"])
+	if err != nil {
+		return nil, err
+	}
+
+	o := &ocfReader{r: r, schema: meta["avro.schema"], codec: c, sync: make([]byte, ocfSyncSize), walker: w}
+	if _, err = io.ReadFull(r, o.sync); err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+func (o *ocfReader) readBlock() error {
+	count, err := binary.ReadVarint(o.r)
+	if err != nil {
+		return err
+	}
+	if count < 0 {
+		return fmt.Errorf("invalid avro container block records count: %v", count)
+	}
+
+	data, err := readAvroBytes(o.r)
+	if err != nil {
+		return err
+	}
+
+	sync := make([]byte, ocfSyncSize)
+	if _, err = io.ReadFull(o.r, sync); err != nil {
+		return err
+	}
+	if !bytes.Equal(sync, o.sync) {
+		return fmt.Errorf("avro container file sync marker mismatch")
+	}
+
+	if o.data, err = o.codec.decode(data); err != nil {
+		return err
+	}
+	o.block = bytes.NewReader(o.data)
+	o.count = count
+
+	return nil
+}
+
+//next returns binary encoded record. Returns io.EOF at the end of file
+func (o *ocfReader) next() ([]byte, error) {
+	for o.count == 0 {
+		if err := o.readBlock(); err != nil {
+			return nil, err
+		}
+	}
+
+	start := len(o.data) - o.block.Len()
+	if err := o.walker.skip(o.walker.schema, o.block); err != nil {
+		return nil, err
+	}
+	o.count--
+
+	return o.data[start : len(o.data)-o.block.Len()], nil
+}
+
+//avroWalker finds boundaries of binary encoded records, by walking their
+//schema
+type avroWalker struct {
+	schema interface{}
+	names  map[string]interface{}
+}
+
+func newAvroWalker(schema []byte) (*avroWalker, error) {
+	w := &avroWalker{names: make(map[string]interface{})}
+	if err := json.Unmarshal(schema, &w.schema); err != nil {
+		return nil, err
+	}
+	w.define(w.schema, "")
+	return w, nil
+}
+
+//define collects named types, so as they can be referenced by name
+func (w *avroWalker) define(s interface{}, namespace string) {
+	switch t := s.(type) {
+	case []interface{}:
+		for _, v := range t {
+			w.define(v, namespace)
+		}
+	case map[string]interface{}:
+		if ns, ok := t["namespace"].(string); ok {
+			namespace = ns
+		}
+		if name, ok := t["name"].(string); ok {
+			w.names[name] = t
+			if namespace != "" {
+				w.names[namespace+"."+name] = t
+			}
+		}
+		w.define(t["type"], namespace)
+		w.define(t["items"], namespace)
+		w.define(t["values"], namespace)
+		if fields, ok := t["fields"].([]interface{}); ok {
+			for _, f := range fields {
+				if m, ok := f.(map[string]interface{}); ok {
+					w.define(m["type"], namespace)
+				}
+			}
+		}
+	}
+}
+
+func skipAvroBytes(r *bytes.Reader, n int64) error {
+	if n < 0 || n > int64(r.Len()) {
+		return io.ErrUnexpectedEOF
+	}
+	_, err := r.Seek(n, io.SeekCurrent)
+	return err
+}
+
+//skipBlocks skips array or map blocks
+func (w *avroWalker) skipBlocks(r *bytes.Reader, item func() error) error {
+	for {
+		n, err := binary.ReadVarint(r)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		if n < 0 {
+			//Negative count is followed by the block size in bytes
+			sz, err := binary.ReadVarint(r)
+			if err != nil {
+				return err
+			}
+			if err = skipAvroBytes(r, sz); err != nil {
+				return err
+			}
+			continue
+		}
+		for ; n > 0; n-- {
+			if err = item(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+//skip advances the reader past the value of given schema
+func (w *avroWalker) skip(s interface{}, r *bytes.Reader) error {
+	switch t := s.(type) {
+	case string:
+		return w.skipType(t, nil, r)
+	case []interface{}:
+		//Union is encoded as branch index followed by the value
+		i, err := binary.ReadVarint(r)
+		if err != nil {
+			return err
+		}
+		if i < 0 || i >= int64(len(t)) {
+			return fmt.Errorf("invalid avro union branch: %v", i)
+		}
+		return w.skip(t[i], r)
+	case map[string]interface{}:
+		if typ, ok := t["type"].(string); ok {
+			return w.skipType(typ, t, r)
+		}
+		return w.skip(t["type"], r)
+	}
+	return fmt.Errorf("invalid avro schema: %v", s)
+}
+
+func (w *avroWalker) skipType(typ string, s map[string]interface{}, r *bytes.Reader) error {
+	switch typ {
+	case "null":
+		return nil
+	case "boolean":
+		_, err := r.ReadByte()
+		return err
+	case "int", "long", "enum":
+		_, err := binary.ReadVarint(r)
+		return err
+	case "float":
+		return skipAvroBytes(r, 4)
+	case "double":
+		return skipAvroBytes(r, 8)
+	case "bytes", "string":
+		n, err := binary.ReadVarint(r)
+		if err != nil {
+			return err
+		}
+		return skipAvroBytes(r, n)
+	case "fixed":
+		size, _ := s["size"].(float64)
+		return skipAvroBytes(r, int64(size))
+	case "record", "error":
+		fields, _ := s["fields"].([]interface{})
+		for _, f := range fields {
+			m, ok := f.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("invalid avro record field: %v", f)
+			}
+			if err := w.skip(m["type"], r); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "array":
+		return w.skipBlocks(r, func() error { return w.skip(s["items"], r) })
+	case "map":
+		return w.skipBlocks(r, func() error {
+			if err := w.skipType("string", nil, r); err != nil {
+				return err
+			}
+			return w.skip(s["values"], r)
+		})
+	}
+
+	if n, ok := w.names[typ]; ok {
+		return w.skip(n, r)
+	}
+
+	return fmt.Errorf("unsupported avro type: %v", typ)
+}
@@ -0,0 +1,221 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package pipe
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/test"
+)
+
+var ocfTestSchema = `{"type":"record","name":"row","namespace":"storagetapper","fields":[` +
+	`{"name":"f1","type":"string"},{"name":"f2","type":["null","long"]},` +
+	`{"name":"f3","type":{"type":"array","items":"int"}}]}`
+
+func avroLong(v int64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutVarint(b, v)]
+}
+
+func avroString(s string) []byte {
+	return append(avroLong(int64(len(s))), s...)
+}
+
+//ocfTestRecord encodes record of ocfTestSchema
+func ocfTestRecord(i int) []byte {
+	b := avroString("value" + string(rune('a'+i%26)))
+	if i%2 == 0 {
+		b = append(b, avroLong(0)...)
+	} else {
+		b = append(b, avroLong(1)...)
+		b = append(b, avroLong(int64(i*1000))...)
+	}
+	b = append(b, avroLong(int64(i%3))...)
+	for j := 0; j < i%3; j++ {
+		b = append(b, avroLong(int64(j))...)
+	}
+	if i%3 != 0 {
+		b = append(b, avroLong(0)...)
+	}
+	return b
+}
+
+func ocfTestPipe(codec string) *filePipe {
+	return &filePipe{datadir: baseDir, maxFileSize: 1024 * 1024, delimited: true, avroOCF: config.AvroOCFConfig{Enabled: true, Codec: codec, BlockSize: 64}}
+}
+
+func TestAvroOCFRoundTrip(t *testing.T) {
+	for _, codec := range []string{"null", "deflate", "snappy", "zstandard"} {
+		deleteTestTopics(t)
+
+		fp := ocfTestPipe(codec)
+
+		c, err := fp.NewConsumer("ocf-test-topic")
+		test.CheckFail(err, t)
+
+		p, err := fp.NewProducer("ocf-test-topic")
+		test.CheckFail(err, t)
+		p.SetFormat("avro")
+
+		err = p.PushSchema("", []byte(ocfTestSchema))
+		test.CheckFail(err, t)
+
+		for i := 0; i < 100; i++ {
+			err = p.PushBatch("log", ocfTestRecord(i))
+			test.CheckFail(err, t)
+			if i%10 == 0 {
+				test.CheckFail(p.PushBatchCommit(), t)
+			}
+		}
+
+		err = p.Close()
+		test.CheckFail(err, t)
+
+		for i := 0; i < 100; i++ {
+			test.Assert(t, c.FetchNext(), "there should be a message %v", i)
+			m, err := c.Pop()
+			test.CheckFail(err, t)
+			test.Assert(t, bytes.Equal(m.([]byte), ocfTestRecord(i)), "%v: read back incorrect record %v: %x", codec, i, m)
+		}
+
+		h := c.(*fileConsumer).header
+		test.Assert(t, h.Format == "avro" && string(h.Schema) == ocfTestSchema, "unexpected header: %+v", h)
+
+		err = c.Close()
+		test.CheckFail(err, t)
+
+		files, err := ioutil.ReadDir(baseDir + "/ocf-test-topic")
+		test.CheckFail(err, t)
+		test.Assert(t, len(files) == 1, "expected single file, got: %v", len(files))
+
+		b, err := ioutil.ReadFile(baseDir + "/ocf-test-topic/" + files[0].Name())
+		test.CheckFail(err, t)
+		test.Assert(t, string(b[:4]) == ocfMagic, "file should start with container magic")
+	}
+}
+
+func TestAvroOCFSchemaChange(t *testing.T) {
+	deleteTestTopics(t)
+
+	fp := ocfTestPipe("null")
+
+	p, err := fp.NewProducer("ocf-test-topic")
+	test.CheckFail(err, t)
+	p.SetFormat("avro")
+
+	err = p.Push(ocfTestRecord(0))
+	test.Assert(t, err != nil, "push without schema should fail")
+
+	err = p.PushSchema("", []byte(ocfTestSchema))
+	test.CheckFail(err, t)
+	test.CheckFail(p.PushK("log", ocfTestRecord(1)), t)
+
+	//Same schema doesn't rotate the file
+	err = p.PushSchema("", []byte(ocfTestSchema))
+	test.CheckFail(err, t)
+	test.CheckFail(p.PushK("log", ocfTestRecord(2)), t)
+
+	schema2 := `{"type":"record","name":"row","fields":[{"name":"f1","type":"string"}]}`
+	err = p.PushSchema("", []byte(schema2))
+	test.CheckFail(err, t)
+	test.CheckFail(p.PushK("log", avroString("new")), t)
+
+	err = p.Close()
+	test.CheckFail(err, t)
+
+	files, err := ioutil.ReadDir(baseDir + "/ocf-test-topic")
+	test.CheckFail(err, t)
+	test.Assert(t, len(files) == 2, "expected two files, got: %v", len(files))
+
+	expected := []struct {
+		schema  string
+		records [][]byte
+	}{
+		{ocfTestSchema, [][]byte{ocfTestRecord(1), ocfTestRecord(2)}},
+		{schema2, [][]byte{avroString("new")}},
+	}
+
+	for i, e := range expected {
+		f, err := os.Open(baseDir + "/ocf-test-topic/" + files[i].Name())
+		test.CheckFail(err, t)
+
+		r, err := newOCFReader(bufio.NewReader(f))
+		test.CheckFail(err, t)
+		test.Assert(t, string(r.schema) == e.schema, "unexpected schema: %v", string(r.schema))
+
+		for _, rec := range e.records {
+			m, err := r.next()
+			test.CheckFail(err, t)
+			test.Assert(t, bytes.Equal(m, rec), "read back incorrect record: %x", m)
+		}
+
+		_, err = r.next()
+		test.Assert(t, err != nil, "there should be no more records")
+
+		test.CheckFail(f.Close(), t)
+	}
+}
+
+func TestAvroWalker(t *testing.T) {
+	schema := `{"type":"record","name":"r","fields":[` +
+		`{"name":"a","type":"boolean"},{"name":"b","type":"float"},{"name":"c","type":"double"},` +
+		`{"name":"d","type":{"type":"fixed","name":"f4","size":4}},` +
+		`{"name":"e","type":{"type":"enum","name":"en","symbols":["x","y"]}},` +
+		`{"name":"f","type":{"type":"map","values":"bytes"}},` +
+		`{"name":"g","type":["null","f4"]},` +
+		`{"name":"h","type":{"type":"long","logicalType":"timestamp-millis"}}]}`
+
+	w, err := newAvroWalker([]byte(schema))
+	test.CheckFail(err, t)
+
+	var rec []byte
+	rec = append(rec, 1)
+	rec = append(rec, 0, 0, 0, 0)
+	rec = append(rec, 0, 0, 0, 0, 0, 0, 0, 0)
+	rec = append(rec, 'a', 'b', 'c', 'd')
+	rec = append(rec, avroLong(1)...)
+	//Map with negative block count, followed by block size
+	blk := append(avroString("k"), avroString("v")...)
+	rec = append(rec, avroLong(-1)...)
+	rec = append(rec, avroLong(int64(len(blk)))...)
+	rec = append(rec, blk...)
+	rec = append(rec, avroLong(1)...)
+	rec = append(rec, avroString("k2")...)
+	rec = append(rec, avroString("v2")...)
+	rec = append(rec, avroLong(0)...)
+	rec = append(rec, avroLong(1)...)
+	rec = append(rec, 'e', 'f', 'g', 'h')
+	rec = append(rec, avroLong(1234567890)...)
+
+	r := bytes.NewReader(append(rec, 0xff))
+	err = w.skip(w.schema, r)
+	test.CheckFail(err, t)
+	test.Assert(t, r.Len() == 1, "walker should stop at the end of record, remaining: %v", r.Len())
+
+	r = bytes.NewReader(rec[:len(rec)-3])
+	err = w.skip(w.schema, r)
+	test.Assert(t, err != nil, "truncated record should fail")
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package pipe
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+
+	"github.com/DataDog/zstd"
+	"github.com/golang/snappy"
+	"github.com/pierrec/lz4"
+	"github.com/raksh93/storagetapper/config"
+)
+
+type compressWriter interface {
+	writerFlusher
+	io.Closer
+}
+
+//compressionCodec creates compressing writers and decompressing readers.
+//Level 0 means codec's default compression level
+type compressionCodec struct {
+	writer func(w io.Writer, level int) (compressWriter, error)
+	reader func(r io.Reader) (io.Reader, error)
+}
+
+var compressionCodecs = map[string]compressionCodec{
+	config.CompressionZlib: {
+		writer: func(w io.Writer, level int) (compressWriter, error) {
+			if level == 0 {
+				level = zlib.DefaultCompression
+			}
+			return zlib.NewWriterLevel(w, level)
+		},
+		reader: func(r io.Reader) (io.Reader, error) {
+			return zlib.NewReader(r)
+		},
+	},
+	config.CompressionGzip: {
+		writer: func(w io.Writer, level int) (compressWriter, error) {
+			if level == 0 {
+				level = gzip.DefaultCompression
+			}
+			return gzip.NewWriterLevel(w, level)
+		},
+		reader: func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	config.CompressionZstd: {
+		writer: func(w io.Writer, level int) (compressWriter, error) {
+			if level == 0 {
+				level = zstd.DefaultCompression
+			}
+			z := zstd.NewWriterLevel(w, level)
+			return &bufferedCompressor{bufio.NewWriter(z), z}, nil
+		},
+		reader: func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r), nil
+		},
+	},
+	config.CompressionSnappy: {
+		writer: func(w io.Writer, level int) (compressWriter, error) {
+			return snappy.NewBufferedWriter(w), nil
+		},
+		reader: func(r io.Reader) (io.Reader, error) {
+			return snappy.NewReader(r), nil
+		},
+	},
+	config.CompressionLZ4: {
+		writer: func(w io.Writer, level int) (compressWriter, error) {
+			return &lz4FrameWriter{z: lz4.NewWriter(w), w: w, level: level}, nil
+		},
+		reader: func(r io.Reader) (io.Reader, error) {
+			return lz4.NewReader(r), nil
+		},
+	},
+}
+
+//bufferedCompressor accumulates small writes for the compressors, which
+//encode every Write call as a separate block and have no Flush
+type bufferedCompressor struct {
+	*bufio.Writer
+	c io.WriteCloser
+}
+
+func (b *bufferedCompressor) Close() error {
+	if err := b.Writer.Flush(); err != nil {
+		return err
+	}
+	return b.c.Close()
+}
+
+//lz4FrameWriter terminates LZ4 frame on every Flush and starts new one on
+//the next Write. lz4.Writer.Flush doesn't reset its block buffer, so flushing
+//it repeatedly emits already written data again. Reader handles concatenated
+//frames, so flushed part of the file is always readable
+type lz4FrameWriter struct {
+	z     *lz4.Writer
+	w     io.Writer
+	level int
+	open  bool
+}
+
+func (l *lz4FrameWriter) Write(p []byte) (int, error) {
+	if !l.open {
+		l.z.Reset(l.w)
+		l.z.Header.CompressionLevel = l.level
+		l.open = true
+	}
+	return l.z.Write(p)
+}
+
+func (l *lz4FrameWriter) Flush() error {
+	if !l.open {
+		return nil
+	}
+	l.open = false
+	return l.z.Close()
+}
+
+func (l *lz4FrameWriter) Close() error {
+	return l.Flush()
+}
+
+//pipeCompression returns compression codec configured for file based pipes.
+//Legacy pipe_compression flag means zlib, empty string means no compression
+func pipeCompression(cfg *config.AppConfig) string {
+	switch {
+	case cfg.PipeCompressionCodec == config.CompressionNone:
+		return ""
+	case cfg.PipeCompressionCodec != "":
+		return cfg.PipeCompressionCodec
+	case cfg.PipeCompression:
+		return config.CompressionZlib
+	}
+	return ""
+}
+
+func newCompressWriter(codec string, w io.Writer, level int) (compressWriter, error) {
+	c, ok := compressionCodecs[codec]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression codec: %v", codec)
+	}
+	return c.writer(w, level)
+}
+
+func newDecompressReader(codec string, r io.Reader) (io.Reader, error) {
+	c, ok := compressionCodecs[codec]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression codec: %v", codec)
+	}
+	return c.reader(r)
+}
+
+//headerCompression returns compression codec recorded in the file header
+//filters
+func headerCompression(h *Header) (string, error) {
+	var codec string
+	for _, f := range h.Filters {
+		if f == aesFilter {
+			continue
+		}
+		if _, ok := compressionCodecs[f]; !ok {
+			return "", fmt.Errorf("unsupported file filter: %v", f)
+		}
+		codec = f
+	}
+	return codec, nil
+}
+
+//compressedFile releases decompressor resources along with the file
+type compressedFile struct {
+	io.ReadCloser
+	decompressor io.Closer
+}
+
+func (f *compressedFile) Close() error {
+	//Decompression errors are already reported by Read
+	_ = f.decompressor.Close()
+	return f.ReadCloser.Close()
+}
@@ -22,7 +22,7 @@ package pipe
 
 import (
 	"bufio"
-	"compress/zlib"
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
@@ -37,9 +37,11 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"sort"
 	"strings"
 	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -52,6 +54,13 @@ import (
 
 var delimiter byte = '\n'
 
+//aesFilter is recorded in the file header filters of encrypted files
+const aesFilter = "aes256-cfb"
+
+//filePollInterval is how often consumer of partitioned layout checks for the
+//new files
+var filePollInterval = time.Second
+
 //Delimited enables producing delimited message to text files and length
 //prepended messages to binary files
 var Delimited = false
@@ -63,6 +72,13 @@ type fs interface {
 	ReadDir(dirname string) ([]os.FileInfo, error)
 	OpenRead(name string, offset int64) (io.ReadCloser, error)
 	OpenWrite(name string) (io.WriteCloser, io.Seeker, error)
+	Remove(name string) error
+}
+
+//poller is implemented by the file systems, which don't support change
+//notifications, so as consumers poll them for the new files
+type poller interface {
+	pollInterval() time.Duration
 }
 
 type filePipe struct {
@@ -71,9 +87,17 @@ type filePipe struct {
 	AESKey      string
 	HMACKey     string
 	verifyHMAC  bool
-	compression bool
+	keyring     *keyring //named keys, nil if only AESKey and HMACKey are configured
+	compression string   //compression codec, empty for no compression
+	level       int      //compression level, 0 for codec default
 	noHeader    bool
+	avroOCF     config.AvroOCFConfig
+	parquet     config.ParquetConfig
+	partition   *template.Template //partition path template, nil for flat layout
+	eventTime   bool               //partition by event time instead of processing time
 	delimited   bool
+
+	initialOffset *int64 //overrides global InitialOffset when not nil
 }
 
 type writerFlusher interface {
@@ -88,6 +112,9 @@ type file struct {
 	offset int64
 	hash   *hashWriter
 	writer writerFlusher
+
+	created time.Time
+	dir     string //partition directory
 }
 
 // fileProducer synchronously pushes messages to File using topic specified during producer creation
@@ -115,7 +142,10 @@ type fileConsumer struct {
 	reader *bufio.Reader
 	header Header
 	fs     fs
-	text   bool //Determined by the Format field of the file header. See openFile
+	text   bool   //Determined by the Format field of the file header. See openFile
+	codec  string //Determined by the Filters field of the file header. See openFile
+	ocf    *ocfReader
+	key    fileKey //Keys of the current file. See fileKey
 
 	msg []byte
 	err error
@@ -137,7 +167,7 @@ func init() {
 }
 
 func initFilePipe(pctx context.Context, batchSize int, cfg *config.AppConfig, db *sql.DB) (Pipe, error) {
-	return &filePipe{cfg.DataDir, cfg.MaxFileSize, cfg.PipeAES256Key, cfg.PipeHMACKey, cfg.PipeVerifyHMAC, cfg.PipeCompression, cfg.PipeFileNoHeader, Delimited}, nil
+	return &filePipe{cfg.DataDir, cfg.MaxFileSize, cfg.PipeAES256Key, cfg.PipeHMACKey, cfg.PipeVerifyHMAC, newKeyring(cfg), pipeCompression(cfg), cfg.PipeCompressionLevel, cfg.PipeFileNoHeader, cfg.AvroOCF, cfg.Parquet, cfg.FilePartitionTemplateParsed, cfg.FilePartition.Time == config.PartitionTimeEvent, Delimited, nil}, nil
 }
 
 // Type returns Pipe type as File
@@ -153,7 +183,7 @@ func (p *filePipe) NewProducer(topic string) (Producer, error) {
 func (p *filePipe) initConsumer(c *fileConsumer) (Consumer, error) {
 	c.ctx, c.cancel = context.WithCancel(context.Background())
 
-	fn, offset, err := c.seek(c.topic, InitialOffset)
+	fn, offset, err := c.seek(c.topic, startOffset(p.initialOffset))
 	if log.E(err) {
 		return nil, err
 	}
@@ -167,6 +197,10 @@ func (p *filePipe) initConsumer(c *fileConsumer) (Consumer, error) {
 	return c, nil
 }
 
+func (p *filePipe) setInitialOffset(offset int64) {
+	p.initialOffset = &offset
+}
+
 //NewConsumer registers a new file consumer with context
 func (p *filePipe) NewConsumer(topic string) (Consumer, error) {
 	c := &fileConsumer{filePipe: p, topic: topic, fs: p}
@@ -205,10 +239,81 @@ func (p *fileProducer) topicPath(topic string) string {
 	return topicPath(p.datadir, topic)
 }
 
+//topicPath returns the directory of the topic files. In partitioned layout
+//this is the directory of the topic partitions
 func (p *fileConsumer) topicPath(topic string) string {
+	if p.partition != nil {
+		root, _, err := config.GetFilePathRoot(p.partition, topic)
+		if !log.E(err) {
+			return topicPath(p.datadir, root)
+		}
+	}
 	return topicPath(p.datadir, topic)
 }
 
+//partitionFileInfo is the file in the partition directory. Name is relative
+//to the topicPath
+type partitionFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (f *partitionFileInfo) Name() string {
+	return f.name
+}
+
+//readDir returns the topic files sorted by name. In partitioned layout it
+//returns the files of all the partitions, so as names sort in partition order
+func (p *fileConsumer) readDir(topic string) ([]os.FileInfo, error) {
+	if p.partition == nil {
+		return p.fs.ReadDir(p.topicPath(topic))
+	}
+
+	_, depth, err := config.GetFilePathRoot(p.partition, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := p.readPartitions(p.topicPath(topic), "", depth)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+	return files, nil
+}
+
+func (p *fileConsumer) readPartitions(dir string, prefix string, depth int) ([]os.FileInfo, error) {
+	files, err := p.fs.ReadDir(dir + prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []os.FileInfo
+	for _, f := range files {
+		if depth == 0 {
+			if !f.IsDir() {
+				res = append(res, &partitionFileInfo{f, prefix + f.Name()})
+			}
+			continue
+		}
+
+		if !f.IsDir() {
+			continue
+		}
+
+		r, err := p.readPartitions(dir, prefix+f.Name()+"/", depth-1)
+		//Partition can be removed by retention concurrently
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		res = append(res, r...)
+	}
+
+	return res, nil
+}
+
 /*
 func (p *fileConsumer) parseFileName(name string) (string, int64, error) {
 	ehint := "Expected file name format 'unixtimestamp.seqno.partitionkey'"
@@ -228,7 +333,7 @@ func (p *fileConsumer) parseFileName(name string) (string, int64, error) {
 */
 
 func (p *fileConsumer) nextFile(topic string, curFile string) (string, error) {
-	files, err := p.fs.ReadDir(p.topicPath(topic))
+	files, err := p.readDir(topic)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return "", nil
@@ -253,7 +358,7 @@ func (p *fileConsumer) nextFile(topic string, curFile string) (string, error) {
 }
 
 func (p *fileConsumer) seek(topic string, offset int64) (string, int64, error) {
-	files, err := p.fs.ReadDir(p.topicPath(topic))
+	files, err := p.readDir(topic)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return "", 0, nil
@@ -277,15 +382,30 @@ func (p *fileConsumer) seek(topic string, offset int64) (string, int64, error) {
 	return "", 0, fmt.Errorf("Arbitrary offsets not supported, only OffsetOldest and OffsetNewest offsets supported")
 }
 
-func (p *fileProducer) newFileName(key string) string {
+func (p *fileProducer) newFileName(key string, dir string) string {
 	p.seqno++ //Precaution to not generate file with the same name if timestamps are equal
-	return fmt.Sprintf("%s%010d.%03d.%s.open", p.topicPath(p.topic), time.Now().Unix(), p.seqno, key)
+	return fmt.Sprintf("%s%010d.%03d.%s.open", dir, time.Now().Unix(), p.seqno, key)
 }
 
-func (p *fileProducer) initCrypterWriter(writer io.Writer, iv []byte) (io.Writer, error) {
+//partitionPath returns the directory of the files of the partition the given
+//time belongs to
+func (p *fileProducer) partitionPath(tm time.Time) (string, error) {
+	if p.partition == nil {
+		return p.topicPath(p.topic), nil
+	}
+
+	dir, err := config.GetFilePath(p.partition, p.topic, tm)
+	if err != nil {
+		return "", err
+	}
+
+	return topicPath(p.datadir, dir), nil
+}
+
+func (p *fileProducer) initCrypterWriter(writer io.Writer, aesKey string, iv []byte) (io.Writer, error) {
 	var crypter cipher.Stream
-	if p.AESKey != "" {
-		block, err := aes.NewCipher([]byte(p.AESKey))
+	if aesKey != "" {
+		block, err := aes.NewCipher([]byte(aesKey))
 		if err != nil {
 			return nil, err
 		}
@@ -297,12 +417,16 @@ func (p *fileProducer) initCrypterWriter(writer io.Writer, iv []byte) (io.Writer
 	return writer, nil
 }
 
-func (p *fileProducer) newFile(key string) error {
-	if err := p.fs.MkdirAll(p.topicPath(p.topic), 0770); err != nil {
+func (p *fileProducer) newFile(key string, dir string) error {
+	if p.container() && len(p.header.Schema) == 0 {
+		return fmt.Errorf("avro schema is required to write container file")
+	}
+
+	if err := p.fs.MkdirAll(dir, 0770); err != nil {
 		return err
 	}
 
-	n := p.newFileName(key)
+	n := p.newFileName(key, dir)
 	f, seeker, err := p.fs.OpenWrite(n)
 	if err != nil {
 		return err
@@ -318,22 +442,52 @@ func (p *fileProducer) newFile(key string) error {
 		}
 	}
 
+	if p.container() {
+		var w writerFlusher
+		if p.parquet.Enabled {
+			w, err = newParquetWriter(f, p.header.Schema, p.parquet.Codec, p.parquet.RowGroupSize)
+		} else {
+			w, err = newOCFWriter(f, p.header.Schema, p.avroOCF.Codec, p.avroOCF.BlockSize)
+		}
+		if err != nil {
+			return err
+		}
+
+		_ = p.closeFile(p.files[key])
+
+		log.Debugf("Opened container file: %v, %v", key, n)
+
+		p.files[key] = &file{n, f, seeker, offset, nil, w, time.Now(), dir}
+
+		return nil
+	}
+
+	keyID, fk := p.writeKey()
+	p.header.KeyID, p.header.DataKey = keyID, ""
+
 	iv := make([]byte, aes.BlockSize)
-	if p.AESKey != "" {
+	if fk.AESKey != "" {
 		if _, err = io.ReadFull(rand.Reader, iv); err != nil {
 			return err
 		}
 		p.header.IV = fmt.Sprintf("%0x", iv)
+
+		if p.keyring != nil && p.keyring.envelope {
+			fk.AESKey, p.header.DataKey, err = newDataKey(fk.AESKey)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	if offset == 0 && !p.noHeader {
 		p.header.Delimited = p.delimited
 		p.header.Filters = nil
-		if p.AESKey != "" {
-			p.header.Filters = append(p.header.Filters, "aes256-cfb")
+		if fk.AESKey != "" {
+			p.header.Filters = append(p.header.Filters, aesFilter)
 		}
-		if p.compression {
-			p.header.Filters = append(p.header.Filters, "zlib")
+		if p.compression != "" {
+			p.header.Filters = append(p.header.Filters, p.compression)
 		}
 		var hash []byte
 		if seeker != nil {
@@ -344,32 +498,43 @@ func (p *fileProducer) newFile(key string) error {
 		}
 	}
 
-	hw := &hashWriter{writer, hmac.New(sha256.New, []byte(p.HMACKey))}
+	hw := &hashWriter{writer, hmac.New(sha256.New, []byte(fk.HMACKey))}
 	writer = hw
 
-	writer, err = p.initCrypterWriter(writer, iv)
+	writer, err = p.initCrypterWriter(writer, fk.AESKey, iv)
 	if err != nil {
 		return err
 	}
 
 	var bufWriter writerFlusher = bufio.NewWriter(writer)
-	if p.compression {
-		bufWriter = zlib.NewWriter(writer)
+	if p.compression != "" {
+		bufWriter, err = newCompressWriter(p.compression, writer, p.level)
+		if err != nil {
+			return err
+		}
 	}
 
 	_ = p.closeFile(p.files[key])
 
 	log.Debugf("Opened: %v, %v compression: %v", key, n, p.compression)
 
-	p.files[key] = &file{n, f, seeker, offset, hw, bufWriter}
+	p.files[key] = &file{n, f, seeker, offset, hw, bufWriter, time.Now(), dir}
 
 	return nil
 }
 
-func (p *fileProducer) getFile(key string) (*file, error) {
+func (p *fileProducer) getFile(key string, dir string) (*file, error) {
 	f := p.files[key]
+	if f != nil && f.dir != dir {
+		//Message belongs to another partition
+		if err := p.closeFile(f); err != nil {
+			return nil, err
+		}
+		delete(p.files, key)
+		f = nil
+	}
 	if f == nil {
-		if err := p.newFile(key); err != nil {
+		if err := p.newFile(key, dir); err != nil {
 			return nil, err
 		}
 		f = p.files[key]
@@ -383,7 +548,13 @@ func (p *fileProducer) closeFile(f *file) error {
 		if err := f.writer.Flush(); log.E(err) {
 			rerr = err
 		}
-		if f.seek != nil && !p.noHeader {
+		//Finalize compressed stream
+		if c, ok := f.writer.(io.Closer); ok {
+			if err := c.Close(); log.E(err) {
+				rerr = err
+			}
+		}
+		if f.seek != nil && !p.noHeader && !p.container() {
 			if _, err := f.seek.Seek(0, os.SEEK_SET); log.E(err) {
 				rerr = err
 			}
@@ -403,7 +574,7 @@ func (p *fileProducer) closeFile(f *file) error {
 }
 
 func (p *fileProducer) writeBinaryMsgLength(f *file, len int) error {
-	if p.text || !p.delimited {
+	if p.text || !p.delimited || p.container() {
 		return nil
 	}
 
@@ -425,8 +596,8 @@ func (p *fileProducer) writeTextMsgDelimiter(f *file) error {
 	return err
 }
 
-//Push produces message to File topic
-func (p *fileProducer) push(key string, in interface{}, batch bool) error {
+//Push produces message to the file of the partition of the given time
+func (p *fileProducer) push(key string, in interface{}, batch bool, tm time.Time) error {
 	var bytes []byte
 	switch in.(type) {
 	case []byte:
@@ -435,7 +606,12 @@ func (p *fileProducer) push(key string, in interface{}, batch bool) error {
 		return fmt.Errorf("File pipe can handle binary arrays only")
 	}
 
-	f, err := p.getFile(key)
+	dir, err := p.partitionPath(tm)
+	if err != nil {
+		return err
+	}
+
+	f, err := p.getFile(key, dir)
 	if err != nil {
 		return err
 	}
@@ -461,7 +637,7 @@ func (p *fileProducer) push(key string, in interface{}, batch bool) error {
 	}
 
 	f.offset += int64(len(bytes)) + 1
-	if f.offset >= p.maxFileSize {
+	if f.offset >= p.maxFileSize || p.expired(f) {
 		if batch {
 			if err := f.writer.Flush(); err != nil {
 				return err
@@ -476,18 +652,58 @@ func (p *fileProducer) push(key string, in interface{}, batch bool) error {
 
 //PushK sends a keyed message to File
 func (p *fileProducer) PushK(key string, in interface{}) error {
-	return p.push(key, in, false)
+	return p.push(key, in, false, time.Now())
 }
 
 //Push produces message to File topic
 func (p *fileProducer) Push(in interface{}) error {
-	return p.push("default", in, false)
+	return p.push("default", in, false, time.Now())
 }
 
 //PushBatch stashes a keyed message into batch which will be send to File by
 //PushBatchCommit
 func (p *fileProducer) PushBatch(key string, in interface{}) error {
-	return p.push(key, in, true)
+	return p.push(key, in, true, time.Now())
+}
+
+//pushBatchOptions stashes the message the same way as PushBatch. Message is
+//written to the partition of the options event time, if files are
+//partitioned by event time
+func (p *fileProducer) pushBatchOptions(key string, in interface{}, opts *MessageOptions) error {
+	tm := time.Now()
+	if p.eventTime && opts != nil && !opts.EventTime.IsZero() {
+		tm = opts.EventTime
+	}
+	return p.push(key, in, true, tm)
+}
+
+//pushFile writes the message to the separate file, which is closed
+//immediately. Returns file name relative to the data directory
+func (p *fileProducer) pushFile(key string, data []byte) (string, error) {
+	tm := time.Now()
+	dir, err := p.partitionPath(tm)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := p.getFile(key, dir)
+	if err != nil {
+		return "", err
+	}
+
+	if err = p.push(key, data, false, tm); err != nil {
+		return "", err
+	}
+
+	//push closes the file when it reaches maximum size
+	if p.files[key] == f {
+		if err = p.closeFile(f); err != nil {
+			return "", err
+		}
+		delete(p.files, key)
+	}
+
+	return strings.TrimPrefix(strings.TrimSuffix(f.name, ".open"), topicPath(p.datadir, "")), nil
 }
 
 //PushBatchCommit commits currently queued messages in the producer
@@ -498,7 +714,14 @@ func (p *fileProducer) PushBatchCommit() error {
 	return nil
 }
 
+//PushSchema closes current file, so as new file starts with the new schema.
+//In Avro container mode data is Avro writer schema, which is written to the
+//metadata of the subsequent files
 func (p *fileProducer) PushSchema(key string, data []byte) error {
+	if p.container() {
+		return p.setContainerSchema(data)
+	}
+
 	if err := p.PushBatchCommit(); err != nil {
 		return err
 	}
@@ -514,7 +737,46 @@ func (p *fileProducer) PushSchema(key string, data []byte) error {
 
 	p.header.Schema = data
 
-	return p.push(key, data, false)
+	return p.push(key, data, false, time.Now())
+}
+
+//container returns true when producer writes Avro Object Container Files or
+//Parquet files, which require Avro schema
+func (p *fileProducer) container() bool {
+	return (p.avroOCF.Enabled || p.parquet.Enabled) && p.header.Format == "avro"
+}
+
+//expired returns true when Parquet file reached its maximum age
+func (p *fileProducer) expired(f *file) bool {
+	return p.parquet.Enabled && p.parquet.MaxFileAge > 0 && p.container() &&
+		time.Since(f.created) >= time.Duration(p.parquet.MaxFileAge)*time.Second
+}
+
+//flush closes Parquet files, because buffered rows become persistent only
+//when file footer is written. Called before consumer positions are saved
+func (p *fileProducer) flush() error {
+	if !p.parquet.Enabled || !p.container() {
+		return nil
+	}
+
+	err := p.Close()
+	p.files = make(map[string]*file)
+
+	return err
+}
+
+//setContainerSchema closes all the files on schema change, because container
+//file can have only one schema
+func (p *fileProducer) setContainerSchema(schema []byte) error {
+	if len(schema) == 0 || bytes.Equal(schema, p.header.Schema) {
+		return nil
+	}
+
+	err := p.Close()
+	p.files = make(map[string]*file)
+	p.header.Schema = schema
+
+	return err
 }
 
 // Close File Producer
@@ -577,7 +839,39 @@ func (p *fileConsumer) waitForNextFile(watcher *fsnotify.Watcher) (bool, error)
 	}
 }
 
+//pollAndOpenNextFile is waitAndOpenNextFile for the file systems without
+//change notifications
+func (p *fileConsumer) pollAndOpenNextFile(interval time.Duration) bool {
+	for {
+		var nextFn string
+		nextFn, p.err = p.nextFile(p.topic, p.name)
+		if log.E(p.err) {
+			return true
+		}
+
+		if nextFn != "" && !strings.HasSuffix(nextFn, ".open") {
+			p.openFile(nextFn, 0)
+			return true
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-p.ctx.Done():
+			return false
+		}
+	}
+}
+
 func (p *fileConsumer) waitAndOpenNextFile() bool {
+	if pl, ok := p.fs.(poller); ok {
+		return p.pollAndOpenNextFile(pl.pollInterval())
+	}
+
+	//Watcher doesn't see the files in the new partition directories
+	if p.partition != nil {
+		return p.pollAndOpenNextFile(filePollInterval)
+	}
+
 	for {
 		//Need to start watching before p.nextFile() to avoid race condition
 		var watcher *fsnotify.Watcher
@@ -630,11 +924,15 @@ func (p *fileConsumer) checkHMAC(fn string, HMACRef string) error {
 	}
 
 	buf := make([]byte, 32768)
-	h := hmac.New(sha256.New, []byte(p.HMACKey))
+	h := hmac.New(sha256.New, []byte(p.key.HMACKey))
 
 	for {
 		var n int
 		n, err = file.Read(buf)
+		//Reader may return data along with EOF
+		if n != 0 {
+			_, _ = h.Write(buf[:n])
+		}
 		if err != nil {
 			if err == io.EOF {
 				break
@@ -642,9 +940,6 @@ func (p *fileConsumer) checkHMAC(fn string, HMACRef string) error {
 			log.E(err)
 			return err
 		}
-		if n != 0 {
-			_, _ = h.Write(buf[:n])
-		}
 	}
 
 	err = file.Close()
@@ -660,6 +955,41 @@ func (p *fileConsumer) checkHMAC(fn string, HMACRef string) error {
 	return nil
 }
 
+//fileKey returns the keys of the current file, selected by the key ID from
+//the header. Data key of envelope encrypted file is decrypted by the selected
+//key. AES key is empty if the file is not encrypted
+func (p *fileConsumer) fileKey() (fileKey, error) {
+	if p.noHeader {
+		_, k := p.writeKey()
+		return k, nil
+	}
+
+	k, err := p.readKey(p.header.KeyID)
+	if err != nil {
+		return k, err
+	}
+
+	encrypted := false
+	for _, f := range p.header.Filters {
+		encrypted = encrypted || f == aesFilter
+	}
+
+	if !encrypted {
+		k.AESKey = ""
+		return k, nil
+	}
+
+	if k.AESKey == "" {
+		return k, fmt.Errorf("file is encrypted, but encryption key '%v' is not configured", p.header.KeyID)
+	}
+
+	if p.header.DataKey != "" {
+		k.AESKey, err = unwrapDataKey(k.AESKey, p.header.DataKey)
+	}
+
+	return k, err
+}
+
 func (p *fileConsumer) openFileInitFilter() (err error) {
 	iv := make([]byte, hex.DecodedLen(len(p.header.IV)))
 	_, p.err = hex.Decode(iv, []byte(p.header.IV))
@@ -667,8 +997,7 @@ func (p *fileConsumer) openFileInitFilter() (err error) {
 		return
 	}
 
-	//TODO: Get encryption and compression type from Filters field of the header
-	if p.AESKey != "" || p.compression {
+	if p.key.AESKey != "" || p.codec != "" {
 		//Header reader cached more then just a header, so need to reopen
 		log.E(p.file.Close())
 		p.file, err = p.fs.OpenRead(p.name, 0)
@@ -676,14 +1005,16 @@ func (p *fileConsumer) openFileInitFilter() (err error) {
 			return
 		}
 
-		if err = skipHeader(p.file); err != nil {
-			return
+		if !p.noHeader {
+			if err = skipHeader(p.file); err != nil {
+				return
+			}
 		}
 
 		var reader io.Reader = p.file
-		if p.AESKey != "" {
+		if p.key.AESKey != "" {
 			var block cipher.Block
-			block, err = aes.NewCipher([]byte(p.AESKey))
+			block, err = aes.NewCipher([]byte(p.key.AESKey))
 			if log.E(err) {
 				return
 			}
@@ -692,11 +1023,14 @@ func (p *fileConsumer) openFileInitFilter() (err error) {
 			reader = cipher.StreamReader{S: crypter, R: p.file}
 		}
 
-		if p.compression {
-			reader, err = zlib.NewReader(reader)
+		if p.codec != "" {
+			reader, err = newDecompressReader(p.codec, reader)
 			if log.E(err) {
 				return
 			}
+			if c, ok := reader.(io.Closer); ok {
+				p.file = &compressedFile{p.file, c}
+			}
 		}
 
 		p.reader = bufio.NewReader(reader)
@@ -714,6 +1048,7 @@ func (p *fileConsumer) openFile(nextFn string, offset int64) {
 	defer func() {
 		if p.err != nil {
 			p.reader = nil
+			p.ocf = nil
 			log.E(p.file.Close())
 			p.file = nil
 		}
@@ -721,13 +1056,34 @@ func (p *fileConsumer) openFile(nextFn string, offset int64) {
 
 	p.reader = bufio.NewReader(p.file)
 
+	if (!p.noHeader || p.avroOCF.Enabled) && isOCF(p.reader) {
+		p.err = p.openContainerFile(nextFn, offset)
+		return
+	}
+
+	if b, err := p.reader.Peek(len(parquetMagic)); err == nil && string(b) == parquetMagic {
+		p.err = fmt.Errorf("consuming parquet files is not supported: %v", nextFn)
+		log.E(p.err)
+		return
+	}
+
 	p.header.Delimited = p.delimited
+	p.codec = p.compression
 	if !p.noHeader {
 		p.header, p.err = readHeader(p.reader)
 		if log.E(p.err) {
 			return
 		}
 
+		p.codec, p.err = headerCompression(&p.header)
+		if log.E(p.err) {
+			return
+		}
+	}
+
+	p.key, p.err = p.fileKey()
+	if log.E(p.err) {
+		return
 	}
 
 	if !p.header.Delimited {
@@ -764,11 +1120,45 @@ func (p *fileConsumer) openFile(nextFn string, offset int64) {
 	log.Debugf("Consumer opened: %v, header: %+v", p.name, p.header)
 }
 
+//openContainerFile prepares reading of Avro Object Container File records
+func (p *fileConsumer) openContainerFile(nextFn string, offset int64) error {
+	if p.verifyHMAC {
+		return fmt.Errorf("HMAC verification of Avro container files is not supported")
+	}
+
+	r, err := newOCFReader(p.reader)
+	if log.E(err) {
+		return err
+	}
+
+	if offset != 0 {
+		log.E(p.file.Close())
+		p.file, err = p.fs.OpenRead(p.topicPath(p.topic)+nextFn, offset)
+		if log.E(err) {
+			return err
+		}
+		p.reader = bufio.NewReader(p.file)
+		r.r = p.reader
+	}
+
+	p.header = Header{Format: "avro", Schema: r.schema, Delimited: true}
+	p.text = false
+	p.codec = ""
+	p.ocf = r
+	p.name = p.topicPath(p.topic) + nextFn
+
+	log.Debugf("Consumer opened avro container file: %v", p.name)
+
+	return nil
+}
+
 func (p *fileConsumer) fetchNextLow() bool {
 	//reader and file can be nil when directory is empty during
 	//NewConsumer
 	if p.reader != nil {
-		if !p.text {
+		if p.ocf != nil {
+			p.msg, p.err = p.ocf.next()
+		} else if !p.text {
 			var sz uint64
 			sz, p.err = binary.ReadUvarint(p.reader)
 			if p.err == nil {
@@ -789,7 +1179,7 @@ func (p *fileConsumer) fetchNextLow() bool {
 			return true
 		}
 
-		if p.err != io.EOF && (!p.compression || p.err != io.ErrUnexpectedEOF) {
+		if p.err != io.EOF && (p.codec == "" || p.err != io.ErrUnexpectedEOF) {
 			log.E(p.err)
 			return true
 		}
@@ -797,6 +1187,7 @@ func (p *fileConsumer) fetchNextLow() bool {
 		log.E(p.file.Close())
 		p.reader = nil
 		p.file = nil
+		p.ocf = nil
 		log.Debugf("Consumer closed: %v", p.name)
 
 		if p.text && p.delimited && len(p.msg) != 0 {
@@ -809,6 +1200,31 @@ func (p *fileConsumer) fetchNextLow() bool {
 	return false
 }
 
+//readFile reads the message from the file written by pushFile
+func (p *filePipe) readFile(name string) ([]byte, error) {
+	return p.readFileFS(p, name)
+}
+
+//readFileFS reads the message from the file written by pushFile to the given
+//file system
+func (p *filePipe) readFileFS(fsys fs, name string) ([]byte, error) {
+	c := &fileConsumer{filePipe: p, topic: path.Dir(name), fs: fsys}
+	c.openFile(path.Base(name), 0)
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	if !c.fetchNextLow() {
+		return nil, fmt.Errorf("No message in the file: %v", name)
+	}
+
+	if c.file != nil {
+		log.E(c.file.Close())
+	}
+
+	return c.msg, c.err
+}
+
 //FetchNext fetches next message from File and commits offset read
 func (p *fileConsumer) FetchNext() bool {
 	for {
@@ -859,6 +1275,11 @@ func (p *fileConsumer) SetFormat(format string) {
 	p.text = format == "json" || format == "text"
 }
 
+//Headers are not supported by file pipe
+func (p *fileConsumer) Headers() map[string]string {
+	return nil
+}
+
 func (p *fileProducer) SetFormat(format string) {
 	p.header.Format = format
 	p.text = format == "json" || format == "text"
@@ -892,3 +1313,7 @@ func (p *filePipe) OpenWrite(name string) (io.WriteCloser, io.Seeker, error) {
 	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0640)
 	return f, f, err
 }
+
+func (p *filePipe) Remove(name string) error {
+	return os.Remove(name)
+}
@@ -1,10 +1,15 @@
 package pipe
 
 import (
+	"bufio"
+	"compress/gzip"
 	"io/ioutil"
 	"os"
 	"testing"
+	"text/template"
+	"time"
 
+	"github.com/raksh93/storagetapper/config"
 	"github.com/raksh93/storagetapper/shutdown"
 	"github.com/raksh93/storagetapper/test"
 )
@@ -21,7 +26,7 @@ func deleteTestTopics(t *testing.T) {
 
 func testFileBasic(size int64, AESKey string, HMACKey string, t *testing.T) {
 	verifyHMAC := HMACKey != ""
-	p := &filePipe{datadir: baseDir, maxFileSize: size, AESKey: AESKey, HMACKey: HMACKey, verifyHMAC: verifyHMAC, compression: cfg.PipeCompression, noHeader: cfg.PipeFileNoHeader, delimited: true}
+	p := &filePipe{datadir: baseDir, maxFileSize: size, AESKey: AESKey, HMACKey: HMACKey, verifyHMAC: verifyHMAC, compression: pipeCompression(cfg), level: cfg.PipeCompressionLevel, noHeader: cfg.PipeFileNoHeader, delimited: true}
 
 	startCh = make(chan bool)
 
@@ -319,8 +324,168 @@ func TestFileCompressionAndEncryption(t *testing.T) {
 	testFileBasic(1, AESKey, HMACKey, t)
 }
 
+func TestFileCompressionCodecs(t *testing.T) {
+	defer func() { cfg.PipeCompressionCodec, cfg.PipeCompressionLevel = "", 0 }()
+	for _, c := range []string{config.CompressionGzip, config.CompressionZstd, config.CompressionSnappy, config.CompressionLZ4} {
+		cfg.PipeCompressionCodec = c
+		cfg.PipeCompressionLevel = 0
+		testFileBasic(1, "", "", t)
+		cfg.PipeCompressionLevel = 1
+		testFileBasic(1024, "", "", t)
+	}
+}
+
+func TestFileCompressionNoHeader(t *testing.T) {
+	cfg.PipeCompressionCodec = config.CompressionZstd
+	cfg.PipeFileNoHeader = true
+	defer func() { cfg.PipeCompressionCodec, cfg.PipeFileNoHeader = "", false }()
+	testFileBasic(1, "", "", t)
+}
+
+//Consumer should detect the codec from the file header regardless of its own
+//configuration
+func TestFileCompressionDetect(t *testing.T) {
+	deleteTestTopics(t)
+
+	pp := &filePipe{datadir: baseDir, maxFileSize: 1024, compression: config.CompressionGzip, level: 9, delimited: true}
+	cp := &filePipe{datadir: baseDir, maxFileSize: 1024, compression: config.CompressionSnappy, delimited: true}
+
+	c, err := cp.NewConsumer("codec-test-topic")
+	test.CheckFail(err, t)
+
+	p, err := pp.NewProducer("codec-test-topic")
+	test.CheckFail(err, t)
+	p.SetFormat("json")
+
+	msgs := []string{`{"first":1}`, `{"second":2}`}
+	for _, m := range msgs {
+		err = p.Push([]byte(m))
+		test.CheckFail(err, t)
+	}
+
+	err = p.Close()
+	test.CheckFail(err, t)
+
+	for _, m := range msgs {
+		test.Assert(t, c.FetchNext(), "there should be a message")
+		r, err := c.Pop()
+		test.CheckFail(err, t)
+		test.Assert(t, string(r.([]byte)) == m, "read back incorrect message: %v", string(r.([]byte)))
+	}
+
+	h := c.(*fileConsumer).header
+	test.Assert(t, len(h.Filters) == 1 && h.Filters[0] == config.CompressionGzip, "unexpected filters: %v", h.Filters)
+
+	err = c.Close()
+	test.CheckFail(err, t)
+
+	//Data after the header should be readable by standard gzip tools
+	files, err := ioutil.ReadDir(baseDir + "/codec-test-topic")
+	test.CheckFail(err, t)
+	test.Assert(t, len(files) == 1, "expected single file, got: %v", len(files))
+
+	f, err := os.Open(baseDir + "/codec-test-topic/" + files[0].Name())
+	test.CheckFail(err, t)
+	defer func() { test.CheckFail(f.Close(), t) }()
+
+	r := bufio.NewReader(f)
+	_, err = r.ReadBytes(delimiter)
+	test.CheckFail(err, t)
+
+	z, err := gzip.NewReader(r)
+	test.CheckFail(err, t)
+	b, err := ioutil.ReadAll(z)
+	test.CheckFail(err, t)
+	test.Assert(t, string(b) == msgs[0]+"\n"+msgs[1]+"\n", "unexpected file content: %v", string(b))
+}
+
+func TestFileCompressionUnsupported(t *testing.T) {
+	_, err := newCompressWriter("brotli", ioutil.Discard, 0)
+	test.Assert(t, err != nil, "unsupported codec should fail")
+
+	_, err = headerCompression(&Header{Filters: []string{aesFilter, "brotli"}})
+	test.Assert(t, err != nil, "unsupported filter should fail")
+
+	codec, err := headerCompression(&Header{Filters: []string{aesFilter, config.CompressionLZ4}})
+	test.CheckFail(err, t)
+	test.Assert(t, codec == config.CompressionLZ4, "unexpected codec: %v", codec)
+}
+
 func TestFileNoHeader(t *testing.T) {
 	cfg.PipeFileNoHeader = true
 	defer func() { cfg.PipeFileNoHeader = false }()
 	testFileBasic(1, "", "", t)
 }
+
+func TestFilePartitioned(t *testing.T) {
+	topic := "file-partition-test-topic"
+	deleteTestTopics(t)
+
+	savePoll := filePollInterval
+	filePollInterval = 10 * time.Millisecond
+	defer func() { filePollInterval = savePoll }()
+
+	tmpl := template.Must(template.New("partition").Parse("{{.Topic}}/dt={{.Date}}/hr={{.Hour}}"))
+	fp := &filePipe{datadir: baseDir, maxFileSize: 1024, partition: tmpl, eventTime: true, delimited: true}
+
+	//Consumer waits for the topic directory to be created
+	c1, err := fp.NewConsumer(topic)
+	test.CheckFail(err, t)
+
+	p, err := fp.NewProducer(topic)
+	test.CheckFail(err, t)
+	p.SetFormat("json")
+
+	events := []struct {
+		msg string
+		tm  time.Time
+	}{
+		{`{"Test" : "2020-01-01 23"}`, time.Date(2020, 1, 1, 23, 59, 0, 0, time.UTC)},
+		{`{"Test" : "2020-01-02 00"}`, time.Date(2020, 1, 2, 0, 30, 0, 0, time.UTC)},
+		{`{"Test" : "2020-01-02 01"}`, time.Date(2020, 1, 2, 1, 10, 0, 0, time.UTC)},
+		{`{"Test" : "2020-01-02 00 late"}`, time.Date(2020, 1, 2, 0, 45, 0, 0, time.UTC)},
+	}
+
+	for _, e := range events {
+		test.CheckFail(PushBatchOptions(p, "log", []byte(e.msg), &MessageOptions{EventTime: e.tm}), t)
+	}
+
+	//Messages without event time go to the partition of processing time
+	now := `{"Test" : "now"}`
+	test.CheckFail(p.PushBatch("log", []byte(now)), t)
+	test.CheckFail(p.PushBatchCommit(), t)
+	test.CheckFail(p.Close(), t)
+
+	for _, d := range []string{"dt=2020-01-01/hr=23", "dt=2020-01-02/hr=00", "dt=2020-01-02/hr=01", time.Now().UTC().Format("dt=2006-01-02/hr=15")} {
+		files, err := ioutil.ReadDir(baseDir + "/" + topic + "/" + d)
+		test.CheckFail(err, t)
+		test.Assert(t, len(files) != 0, "no files in partition %v", d)
+	}
+
+	//Partitions are consumed in order
+	for _, m := range []string{events[0].msg, events[1].msg, events[3].msg, events[2].msg, now} {
+		consumeAndCheck(t, c1, m)
+	}
+
+	saveOffset := InitialOffset
+	InitialOffset = OffsetOldest
+	defer func() { InitialOffset = saveOffset }()
+
+	c2, err := fp.NewConsumer(topic)
+	test.CheckFail(err, t)
+	consumeAndCheck(t, c2, events[0].msg)
+
+	test.CheckFail(c1.Close(), t)
+	test.CheckFail(c2.Close(), t)
+
+	//Processing time partitioning ignores event time
+	fp.eventTime = false
+	p, err = fp.NewProducer(topic)
+	test.CheckFail(err, t)
+	test.CheckFail(PushBatchOptions(p, "log", []byte(now), &MessageOptions{EventTime: events[0].tm}), t)
+	test.CheckFail(p.Close(), t)
+
+	files, err := ioutil.ReadDir(baseDir + "/" + topic + "/dt=2020-01-01/hr=23")
+	test.CheckFail(err, t)
+	test.Assert(t, len(files) == 1, "unexpected number of files in partition: %v", len(files))
+}
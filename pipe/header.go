@@ -15,6 +15,8 @@ type Header struct {
 	Delimited bool     `json:",omitempty"`
 	HMAC      string   `json:"HMAC-SHA256,omitempty"`
 	IV        string   `json:"AES256-CFB-IV,omitempty"`
+	KeyID     string   `json:",omitempty"` //ID of the keyring key
+	DataKey   string   `json:",omitempty"` //File key encrypted by the keyring key
 }
 
 func writeHeader(header *Header, hash []byte, f io.Writer) error {
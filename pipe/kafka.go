@@ -24,6 +24,7 @@ import (
 	"database/sql"
 	"fmt"
 	"golang.org/x/net/context" //"context"
+	"sort"
 	"sync"
 
 	"github.com/Shopify/sarama"
@@ -61,6 +62,7 @@ type kafkaPartition struct {
 	consumer      sarama.PartitionConsumer
 	childConsumer chan *sarama.ConsumerMessage
 	nextMsg       *sarama.ConsumerMessage
+	fragments     fragments
 }
 
 type topicConsumer struct {
@@ -73,7 +75,8 @@ type topicConsumer struct {
 // KafkaPipe is wrapper on top of Sarama library to produce/consume through kafka
 //  * after failure shutdown pipe guarantees to resent last batchSize messages,
 //meaning batchSize messages may be inflight, reading (batchSize+1)th message
-//automatically acknowledges previous batch.
+//automatically acknowledges previous batch. Window is extended by
+//max_in_flight_batches batches when async producer is enabled.
 //  * producer caches and sents maximum batchSize messages at once
 type KafkaPipe struct {
 	ctx            context.Context
@@ -84,15 +87,43 @@ type KafkaPipe struct {
 	lock           sync.RWMutex //protects consumers map, which can be modified by concurrent NewConsumer/closeConsumer
 	batchSize      int
 	Config         *sarama.Config
-}
-
-// kafkaProducer synchronously pushes messages to Kafka using topic specified during producer creation
+	initialOffset  *int64 //overrides global InitialOffset when not nil
+	consumerGroups bool   //use Kafka consumer groups instead of kafka_offsets
+	//startOffsets override saved and initial offsets of the topic partitions
+	startOffsets map[string]map[int32]int64
+
+	//producer is shared by all the producers created by the pipe in multi
+	//table mode, since sarama producer is safe for concurrent use and
+	//maintains connections to every broker. Otherwise every producer has its
+	//own sarama producer, created with the pipe config current at the time
+	producer     sarama.SyncProducer
+	producerRefs int
+	producerLock sync.Mutex
+
+	//asyncProducer is shared the same way as producer, its acknowledgements
+	//are routed to the producers by the dispatcher goroutine
+	asyncProducer sarama.AsyncProducer
+	asyncWg       sync.WaitGroup
+}
+
+// kafkaProducer pushes messages to Kafka using topic specified during producer creation.
+// Batches are sent synchronously, unless async producer is enabled
 type kafkaProducer struct {
+	pipe     *KafkaPipe
 	topic    string
 	ctx      context.Context
 	producer sarama.SyncProducer
 	batch    []*sarama.ProducerMessage
 	batchPtr int
+	own      bool //producer is not shared and closed by Close
+
+	maxMessageBytes int
+	oversized       *oversizedHandler
+
+	async       sarama.AsyncProducer
+	maxInFlight int
+	inFlight    []*asyncBatch
+	err         error //first async batch error, fails all subsequent commits
 }
 
 // kafkaConsumer consumes messages from Kafka using topic and partition specified during consumer creation
@@ -104,6 +135,8 @@ type kafkaConsumer struct {
 	ch     chan *sarama.ConsumerMessage
 	msg    *sarama.ConsumerMessage
 	err    error
+
+	oversized *oversizedHandler
 }
 
 func init() {
@@ -111,7 +144,7 @@ func init() {
 }
 
 func initKafkaPipe(pctx context.Context, batchSize int, cfg *config.AppConfig, db *sql.DB) (Pipe, error) {
-	return &KafkaPipe{ctx: pctx, kafkaAddrs: cfg.KafkaAddrs, conn: db, batchSize: batchSize}, nil
+	return &KafkaPipe{ctx: pctx, kafkaAddrs: cfg.KafkaAddrs, conn: db, batchSize: batchSize, consumerGroups: cfg.KafkaConsumerGroups}, nil
 }
 
 // Type returns Pipe type as Kafka
@@ -121,13 +154,9 @@ func (p *KafkaPipe) Type() string {
 
 // Init initializes Kafka pipe creating kafka_offsets table
 func (p *KafkaPipe) Init() error {
-	var err error
-	var config *sarama.Config
-	if KafkaConfig != nil {
-		config = KafkaConfig
-	}
-	if p.Config != nil {
-		config = p.Config
+	config, err := p.saramaConfig()
+	if log.E(err) {
+		return err
 	}
 	p.consumers = make(map[string]*topicConsumer)
 	p.saramaConsumer, err = sarama.NewConsumer(p.kafkaAddrs, config)
@@ -138,15 +167,17 @@ func (p *KafkaPipe) Init() error {
 		log.Warnf("No DB configured, offset won't be persisted")
 		return nil
 	}
-	err = util.ExecSQL(p.conn, `CREATE TABLE IF NOT EXISTS `+types.MyDbName+`.kafka_offsets (
+	return p.createOffsetsTable()
+}
+
+func (p *KafkaPipe) createOffsetsTable() error {
+	err := util.ExecSQL(p.conn, `CREATE TABLE IF NOT EXISTS `+types.MyDbName+`.kafka_offsets (
 		topic VARCHAR(255) CHARACTER SET utf8 NOT NULL,
 		partitionId INT NOT NULL DEFAULT 0,
 		offset BIGINT NOT NULL DEFAULT 0,
 		PRIMARY KEY(topic, partitionId))`)
-	if log.E(err) {
-		return err
-	}
-	return nil
+	log.E(err)
+	return err
 }
 
 //DeleteKafkaOffsets delete offsets for specified topic
@@ -156,26 +187,137 @@ func DeleteKafkaOffsets(conn *sql.DB, topic string) bool {
 	return true
 }
 
-//NewProducer registers a new sync producer
+//NewProducer registers a new sync or async producer
 func (p *KafkaPipe) NewProducer(topic string) (Producer, error) {
-	var config *sarama.Config
-	if KafkaConfig != nil {
-		config = KafkaConfig
+	pcfg := config.Get().KafkaProducer
+	shared := config.Get().StreamerTablesPerWorker > 1
+	oversized := newOversizedHandler(config.Get())
+	config, err := p.saramaConfig()
+	if log.E(err) {
+		return nil, err
+	}
+	//Partitioner which respects per topic partitioning configuration
+	config.Producer.Partitioner = newPartitionerConstructor(config.Producer.Partitioner)
+	config.Producer.Return.Successes = true
+
+	if !pcfg.Async && !shared {
+		producer, err := sarama.NewSyncProducer(p.kafkaAddrs, config)
+		if log.E(err) {
+			return nil, err
+		}
+		return &kafkaProducer{
+			pipe:            p,
+			topic:           topic,
+			ctx:             p.ctx,
+			producer:        producer,
+			batch:           make([]*sarama.ProducerMessage, p.batchSize),
+			own:             true,
+			maxMessageBytes: config.Producer.MaxMessageBytes,
+			oversized:       oversized,
+		}, nil
+	}
+
+	p.producerLock.Lock()
+	defer p.producerLock.Unlock()
+
+	if pcfg.Async {
+		enableIdempotence(config)
+		if err := p.startAsyncProducer(config); log.E(err) {
+			return nil, err
+		}
+	} else if p.producer == nil {
+		producer, err := sarama.NewSyncProducer(p.kafkaAddrs, config)
+		if log.E(err) {
+			return nil, err
+		}
+		p.producer = producer
+	}
+	p.producerRefs++
+
+	return &kafkaProducer{
+		pipe:            p,
+		topic:           topic,
+		ctx:             p.ctx,
+		producer:        p.producer,
+		batch:           make([]*sarama.ProducerMessage, p.batchSize),
+		maxMessageBytes: config.Producer.MaxMessageBytes,
+		oversized:       oversized,
+		async:           p.asyncProducer,
+		maxInFlight:     pcfg.MaxInFlightBatches,
+	}, nil
+}
+
+//saramaConfig returns copy of the pipe or global sarama config, with TLS and
+//SASL options applied
+func (p *KafkaPipe) saramaConfig() (*sarama.Config, error) {
+	return newSaramaConfig(p.Config)
+}
+
+func newSaramaConfig(base *sarama.Config) (*sarama.Config, error) {
+	var c sarama.Config
+	if base != nil {
+		c = *base
+	} else if KafkaConfig != nil {
+		c = *KafkaConfig
+	} else {
+		c = *sarama.NewConfig()
 	}
-	if p.Config != nil {
-		config = p.Config
+	cfg := config.Get()
+	//Record headers require message format introduced in Kafka 0.11
+	if cfg.KafkaHeaders && !c.Version.IsAtLeast(sarama.V0_11_0_0) {
+		c.Version = sarama.V0_11_0_0
 	}
-	//if config == nil {
-	//p.config = sarama.NewConfig()
-	//p.config.Producer.Partitioner = sarama.NewManualPartitioner
-	//p.config.Producer.Return.Successes = true
-	//}
-	producer, err := sarama.NewSyncProducer(p.kafkaAddrs, config)
-	if log.E(err) {
+	//Fragment and offload headers require Kafka 0.11 also
+	if cfg.KafkaOversized.Mode != "" && !c.Version.IsAtLeast(sarama.V0_11_0_0) {
+		c.Version = sarama.V0_11_0_0
+	}
+	//Skip messages of aborted transactions
+	if cfg.KafkaExactlyOnce {
+		if !c.Version.IsAtLeast(sarama.V0_11_0_0) {
+			c.Version = sarama.V0_11_0_0
+		}
+		c.Consumer.IsolationLevel = sarama.ReadCommitted
+	}
+	if err := applySecurity(&c, cfg); err != nil {
 		return nil, err
 	}
+	return &c, nil
+}
 
-	return &kafkaProducer{topic, p.ctx, producer, make([]*sarama.ProducerMessage, p.batchSize), 0}, nil
+//closeProducer closes shared sarama producer when last producer of the pipe is
+//closed
+func (p *KafkaPipe) closeProducer() error {
+	p.producerLock.Lock()
+	defer p.producerLock.Unlock()
+
+	if p.producerRefs > 1 {
+		p.producerRefs--
+		return nil
+	}
+
+	p.producerRefs = 0
+
+	var err error
+	if p.producer != nil {
+		err = p.producer.Close()
+		p.producer = nil
+	}
+	if p.asyncProducer != nil {
+		p.closeAsyncProducer()
+	}
+	return err
+}
+
+//unackedMessages returns the number of the last consumed messages, which may
+//be not yet acknowledged by the downstream producer, so as they have to be
+//consumed again after failure. Async producer leaves up to
+//max_in_flight_batches committed batches unacknowledged
+func (p *KafkaPipe) unackedMessages() int64 {
+	n := int64(p.batchSize)
+	if pcfg := config.Get().KafkaProducer; pcfg.Async {
+		n *= int64(pcfg.MaxInFlightBatches + 1)
+	}
+	return n
 }
 
 func (p *KafkaPipe) getOffsets(topic string) (map[int32]kafkaPartition, error) {
@@ -298,16 +440,19 @@ func (p *KafkaPipe) initTopicConsumer(topic string) error {
 		return err
 	}
 	for _, i := range parts {
-		o := InitialOffset
+		o := startOffset(p.initialOffset)
 		if v, ok := offsets[i]; ok {
 			o = v.offset
 		}
+		if v, ok := p.startOffsets[topic][i]; ok {
+			o = v
+		}
 		log.Debugf("start consuming partition %v from offset %v for topic %v", i, o, topic)
 		pc, err := p.saramaConsumer.ConsumePartition(topic, i, o)
 		if log.E(err) {
 			return err
 		}
-		c.partitions = append(c.partitions, kafkaPartition{i, InitialOffset, InitialOffset, pc, nil, nil})
+		c.partitions = append(c.partitions, kafkaPartition{i, InitialOffset, InitialOffset, pc, nil, nil, fragments{}})
 	}
 
 	p.consumers[topic] = c
@@ -315,10 +460,34 @@ func (p *KafkaPipe) initTopicConsumer(topic string) error {
 	return nil
 }
 
+//setInitialOffset also disables consumer groups for the pipe, so as its
+//consumers don't interfere with the group offsets
+func (p *KafkaPipe) setInitialOffset(offset int64) {
+	p.initialOffset = &offset
+	p.consumerGroups = false
+}
+
+//setStartOffsets implies setInitialOffset, so as unspecified partitions are
+//consumed from the oldest offset
+func (p *KafkaPipe) setStartOffsets(offsets []Offset) {
+	p.setInitialOffset(OffsetOldest)
+	p.startOffsets = make(map[string]map[int32]int64)
+	for _, o := range offsets {
+		if p.startOffsets[o.Topic] == nil {
+			p.startOffsets[o.Topic] = make(map[int32]int64)
+		}
+		p.startOffsets[o.Topic][o.Partition] = o.Offset
+	}
+}
+
 //NewConsumer registers a new kafka consumer
 func (p *KafkaPipe) NewConsumer(topic string) (Consumer, error) {
 	log.Debugf("Registering consumer %v", topic)
 
+	if p.consumerGroups {
+		return p.newGroupConsumer(topic)
+	}
+
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
@@ -352,17 +521,34 @@ func (p *KafkaPipe) NewConsumer(topic string) (Consumer, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	log.Debugf("Registered consumer %v", topic)
-	return &kafkaConsumer{p, topic, ctx, cancel, ch, nil, nil}, nil
+	return &kafkaConsumer{p, topic, ctx, cancel, ch, nil, nil, newOversizedHandler(config.Get())}, nil
 }
 
-func (p *KafkaPipe) commitOffset(topic string, partition int32, offset int64, persistInterval int64) error {
+//partition returns consumed partition of the topic or nil if it's unknown
+func (p *KafkaPipe) partition(topic string, partition int32) *kafkaPartition {
 	tc := p.consumers[topic]
-	if p.conn == nil || tc == nil {
+	if tc == nil {
 		return nil
 	}
 
-	//BUG: Wrong. Partition is id not an index
-	tp := &tc.partitions[partition]
+	for i := 0; i < len(tc.partitions); i++ {
+		if tc.partitions[i].id == partition {
+			return &tc.partitions[i]
+		}
+	}
+
+	return nil
+}
+
+func (p *KafkaPipe) commitOffset(topic string, partition int32, offset int64, persistInterval int64) error {
+	if p.conn == nil || p.consumers[topic] == nil {
+		return nil
+	}
+
+	tp := p.partition(topic, partition)
+	if tp == nil {
+		return fmt.Errorf("Unknown partition %v of topic %v", partition, topic)
+	}
 	if tp.offset == InitialOffset {
 		tp.savedOffset = offset
 	}
@@ -373,7 +559,7 @@ func (p *KafkaPipe) commitOffset(topic string, partition int32, offset int64, pe
 	}
 
 	if persistInterval != 0 {
-		offset = offset - int64(p.batchSize) + 1
+		offset = tp.fragments.resume(offset, p.unackedMessages())
 	} else {
 		offset++ //graceful shutdown, all messages acked, start from next offset next time
 	}
@@ -495,23 +681,67 @@ func (p *kafkaProducer) PushK(key string, in interface{}) error {
 }
 
 //PushBatch stashes a keyed message into batch which will be send to Kafka by
-//PushBatchCommit
+//PushBatchCommit. Nil message is sent as a tombstone, which allows log
+//compaction to remove the key from the topic
 func (p *kafkaProducer) PushBatch(key string, in interface{}) error {
+	return p.pushBatchOptions(key, in, nil)
+}
+
+//pushBatchOptions stashes a keyed message, which is partitioned by the
+//options partition key, unless it's empty, and carries options headers
+func (p *kafkaProducer) pushBatchOptions(key string, in interface{}, opts *MessageOptions) error {
 	var bytes []byte
 	switch in.(type) {
+	case nil:
 	case []byte:
 		bytes = in.([]byte)
 	default:
 		return fmt.Errorf("Kafka pipe can handle binary arrays only")
 	}
 
+	var partKey string
+	var headers []sarama.RecordHeader
+	if opts != nil {
+		partKey = opts.PartitionKey
+		headers = recordHeaders(opts.Headers)
+	}
+
+	//Handle oversized message early, instead of failing whole batch on commit
+	if messageSize(key, bytes, headers) > p.maxMessageBytes {
+		parts, err := p.oversized.split(p.topic, key, bytes, headers, p.maxMessageBytes)
+		if err != nil {
+			return err
+		}
+		for _, m := range parts {
+			if err = p.appendMessage(key, m.value, partKey, m.headers); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return p.appendMessage(key, bytes, partKey, headers)
+}
+
+//appendMessage stashes the message into the batch, committing the batch when
+//it's full
+func (p *kafkaProducer) appendMessage(key string, bytes []byte, partKey string, headers []sarama.RecordHeader) error {
 	if p.batch[p.batchPtr] == nil {
 		p.batch[p.batchPtr] = new(sarama.ProducerMessage)
 	}
 
 	p.batch[p.batchPtr].Topic = p.topic
 	p.batch[p.batchPtr].Key = sarama.StringEncoder(key)
-	p.batch[p.batchPtr].Value = sarama.ByteEncoder(bytes)
+	p.batch[p.batchPtr].Headers = headers
+	p.batch[p.batchPtr].Metadata = nil
+	if partKey != "" {
+		p.batch[p.batchPtr].Metadata = &messageMetadata{partKey: partKey}
+	}
+	if bytes != nil {
+		p.batch[p.batchPtr].Value = sarama.ByteEncoder(bytes)
+	} else {
+		p.batch[p.batchPtr].Value = nil
+	}
 
 	p.batchPtr++
 
@@ -522,8 +752,14 @@ func (p *kafkaProducer) PushBatch(key string, in interface{}) error {
 	return nil
 }
 
-//PushBatchCommit commits currently queued messages in the producer
+//PushBatchCommit commits currently queued messages in the producer. Async
+//producer returns without waiting for acknowledgement, unless maximum number
+//of batches is in flight already
 func (p *kafkaProducer) PushBatchCommit() error {
+	if p.async != nil {
+		return p.pushBatchCommitAsync()
+	}
+
 	if p.batchPtr == 0 {
 		return nil
 	}
@@ -545,29 +781,64 @@ func (p *kafkaProducer) PushSchema(key string, data []byte) error {
 	return p.PushBatch(key, data)
 }
 
-// Close Kafka Producer
+// Close Kafka Producer. Async producer waits for in flight batches to be
+// acknowledged
 func (p *kafkaProducer) Close() error {
-	err := p.producer.Close()
+	err := p.flush()
+	var e error
+	if p.own {
+		e = p.producer.Close()
+	} else {
+		e = p.pipe.closeProducer()
+	}
+	if err == nil {
+		err = e
+	}
 	log.E(err)
 	return err
 }
 
-//FetchNext fetches next message from Kafka and commits offset read
+//FetchNext fetches next message from Kafka and commits offset read.
+//Fragments of the chunked message are accumulated until the message is
+//complete
 func (p *kafkaConsumer) FetchNext() bool {
-	select {
-	case msg, ok := <-p.ch:
-		if !ok {
+	for {
+		select {
+		case msg, ok := <-p.ch:
+			if !ok {
+				return false
+			}
+			if p.fetchMessage(msg) {
+				return true
+			}
+		case <-p.ctx.Done():
 			return false
 		}
-		p.msg = msg
-		p.pipe.lock.RLock()
-		defer p.pipe.lock.RUnlock()
-		p.err = p.pipe.commitOffset(p.msg.Topic, p.msg.Partition, p.msg.Offset, offsetPersistInterval)
+	}
+}
+
+//fetchMessage returns false if the message is a fragment of incomplete
+//message
+func (p *kafkaConsumer) fetchMessage(msg *sarama.ConsumerMessage) bool {
+	p.pipe.lock.RLock()
+	defer p.pipe.lock.RUnlock()
+
+	tp := p.pipe.partition(msg.Topic, msg.Partition)
+	if tp == nil {
+		p.msg, p.err = msg, fmt.Errorf("Unknown partition %v of topic %v", msg.Partition, msg.Topic)
 		log.E(p.err)
 		return true
-	case <-p.ctx.Done():
 	}
-	return false
+
+	p.msg, p.err = p.oversized.assemble(&tp.fragments, msg, p.pipe.unackedMessages())
+	if p.msg == nil {
+		return false
+	}
+	if p.err == nil {
+		p.err = p.pipe.commitOffset(p.msg.Topic, p.msg.Partition, p.msg.Offset, offsetPersistInterval)
+	}
+	log.E(p.err)
+	return true
 }
 
 //Pop pops pipe message
@@ -603,6 +874,67 @@ func (p *kafkaProducer) SetFormat(format string) {
 func (p *kafkaConsumer) SetFormat(format string) {
 }
 
+//groupID is empty, since the consumer doesn't belong to a Kafka consumer group
+func (p *kafkaConsumer) groupID() string {
+	return ""
+}
+
+func (p *kafkaConsumer) nextOffset() *Offset {
+	if p.msg == nil {
+		return nil
+	}
+	return &Offset{Topic: p.msg.Topic, Partition: p.msg.Partition, Offset: p.msg.Offset + 1}
+}
+
+//Headers returns record headers of the last fetched message
+func (p *kafkaConsumer) Headers() map[string]string {
+	if p.msg == nil {
+		return nil
+	}
+	return headersMap(p.msg.Headers)
+}
+
+//messageKey returns key of the last fetched message
+func (p *kafkaConsumer) messageKey() string {
+	if p.msg == nil {
+		return ""
+	}
+	return string(p.msg.Key)
+}
+
+//recordHeaders converts headers map to Kafka record headers, sorted by name
+//to produce deterministic messages
+func recordHeaders(h map[string]string) []sarama.RecordHeader {
+	if len(h) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	r := make([]sarama.RecordHeader, 0, len(h))
+	for _, k := range keys {
+		r = append(r, sarama.RecordHeader{Key: []byte(k), Value: []byte(h[k])})
+	}
+	return r
+}
+
+//headersMap converts Kafka record headers to a map. Last value wins for
+//duplicate header names
+func headersMap(h []*sarama.RecordHeader) map[string]string {
+	if len(h) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(h))
+	for _, v := range h {
+		if v != nil {
+			m[string(v.Key)] = string(v.Value)
+		}
+	}
+	return m
+}
+
 /*
 type saramaLogger struct {
 }
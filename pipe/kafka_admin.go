@@ -0,0 +1,185 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pipe
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/log"
+)
+
+func newKafkaAdmin(cfg *config.AppConfig) (sarama.ClusterAdmin, error) {
+	c, err := newSaramaConfig(nil)
+	if err != nil {
+		return nil, err
+	}
+	//DescribeConfigs requests require 0.11
+	if !c.Version.IsAtLeast(sarama.V0_11_0_0) {
+		c.Version = sarama.V0_11_0_0
+	}
+	return sarama.NewClusterAdmin(cfg.KafkaAddrs, c)
+}
+
+func topicConfigEntries(s *config.KafkaTopicSettings) map[string]*string {
+	entries := make(map[string]*string)
+	if s.RetentionMs != 0 {
+		v := strconv.FormatInt(s.RetentionMs, 10)
+		entries["retention.ms"] = &v
+	}
+	if s.CleanupPolicy != "" {
+		v := s.CleanupPolicy
+		entries["cleanup.policy"] = &v
+	}
+	return entries
+}
+
+//CreateKafkaTopics creates given topics with given settings. Existing topics
+//are left intact
+func CreateKafkaTopics(cfg *config.AppConfig, topics map[string]*config.KafkaTopicSettings) error {
+	if len(topics) == 0 {
+		return nil
+	}
+
+	admin, err := newKafkaAdmin(cfg)
+	if log.E(err) {
+		return err
+	}
+	defer func() { log.E(admin.Close()) }()
+
+	for t, s := range topics {
+		if s.Partitions == 0 || s.ReplicationFactor == 0 {
+			return fmt.Errorf("Number of partitions and replication factor required to create topic %v", t)
+		}
+
+		err = admin.CreateTopic(t, &sarama.TopicDetail{NumPartitions: s.Partitions, ReplicationFactor: s.ReplicationFactor, ConfigEntries: topicConfigEntries(s)}, false)
+		if e, ok := err.(*sarama.TopicError); ok && e.Err == sarama.ErrTopicAlreadyExists {
+			log.Debugf("Topic %v exists already", t)
+			continue
+		}
+		if log.E(err) {
+			return err
+		}
+
+		log.Infof("Created topic %v with settings %+v", t, *s)
+	}
+
+	return nil
+}
+
+//ValidateKafkaTopics compares settings of existing topics with given
+//settings. Returns the list of missing topics and error describing
+//mismatches found
+func ValidateKafkaTopics(cfg *config.AppConfig, topics map[string]*config.KafkaTopicSettings) ([]string, error) {
+	admin, err := newKafkaAdmin(cfg)
+	if log.E(err) {
+		return nil, err
+	}
+	defer func() { log.E(admin.Close()) }()
+
+	existing, err := admin.ListTopics()
+	if log.E(err) {
+		return nil, err
+	}
+
+	var missing []string
+	var mismatch string
+	for t, s := range topics {
+		d, ok := existing[t]
+		if !ok {
+			missing = append(missing, t)
+			continue
+		}
+
+		if s.Partitions != 0 && d.NumPartitions != s.Partitions {
+			mismatch += fmt.Sprintf("%v: partitions %v, expected %v; ", t, d.NumPartitions, s.Partitions)
+		}
+		if s.ReplicationFactor != 0 && d.ReplicationFactor != s.ReplicationFactor {
+			mismatch += fmt.Sprintf("%v: replication factor %v, expected %v; ", t, d.ReplicationFactor, s.ReplicationFactor)
+		}
+		for k, v := range topicConfigEntries(s) {
+			if e := d.ConfigEntries[k]; e == nil || *e != *v {
+				var cur string
+				if e != nil {
+					cur = *e
+				}
+				mismatch += fmt.Sprintf("%v: %v '%v', expected '%v'; ", t, k, cur, *v)
+			}
+		}
+	}
+
+	if mismatch != "" {
+		return missing, fmt.Errorf("Topic settings mismatch: %v", mismatch)
+	}
+
+	return missing, nil
+}
+
+//DeleteKafkaTopics deletes given topics. Missing topics are skipped
+func DeleteKafkaTopics(cfg *config.AppConfig, topics []string) error {
+	if len(topics) == 0 {
+		return nil
+	}
+
+	admin, err := newKafkaAdmin(cfg)
+	if log.E(err) {
+		return err
+	}
+	defer func() { log.E(admin.Close()) }()
+
+	for _, t := range topics {
+		err = admin.DeleteTopic(t)
+		if err == sarama.ErrUnknownTopicOrPartition {
+			continue
+		}
+		if log.E(err) {
+			return err
+		}
+		log.Infof("Deleted topic %v", t)
+	}
+
+	return nil
+}
+
+//kafkaTopicCompacted returns true if log compaction is enabled for the topic
+func kafkaTopicCompacted(cfg *config.AppConfig, topic string) (bool, error) {
+	admin, err := newKafkaAdmin(cfg)
+	if err != nil {
+		return false, err
+	}
+	defer func() { log.E(admin.Close()) }()
+
+	entries, err := admin.DescribeConfig(sarama.ConfigResource{Type: sarama.TopicResource, Name: topic, ConfigNames: []string{"cleanup.policy"}})
+	if err != nil {
+		return false, err
+	}
+
+	for _, e := range entries {
+		if e.Name == "cleanup.policy" && strings.Contains(e.Value, "compact") {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
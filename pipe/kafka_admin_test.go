@@ -0,0 +1,54 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pipe
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/test"
+)
+
+func TestKafkaTopicsAdmin(t *testing.T) {
+	test.SkipIfNoKafkaAvailable(t)
+
+	topic := fmt.Sprintf("topic_admin_%v", time.Now().UnixNano())
+	topics := map[string]*config.KafkaTopicSettings{topic: {Partitions: 2, ReplicationFactor: 1, RetentionMs: 3600000, CleanupPolicy: "compact"}}
+
+	missing, err := ValidateKafkaTopics(cfg, topics)
+	test.CheckFail(err, t)
+	test.Assert(t, len(missing) == 1 && missing[0] == topic, "topic should be missing, got: %v", missing)
+
+	test.CheckFail(CreateKafkaTopics(cfg, topics), t)
+	//Creating existing topic is not an error
+	test.CheckFail(CreateKafkaTopics(cfg, topics), t)
+
+	missing, err = ValidateKafkaTopics(cfg, topics)
+	test.CheckFail(err, t)
+	test.Assert(t, len(missing) == 0, "topic should exist, missing: %v", missing)
+
+	_, err = ValidateKafkaTopics(cfg, map[string]*config.KafkaTopicSettings{topic: {Partitions: 4, CleanupPolicy: "delete"}})
+	test.Assert(t, err != nil, "settings mismatch expected")
+
+	test.CheckFail(DeleteKafkaTopics(cfg, []string{topic}), t)
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pipe
+
+import (
+	"github.com/Shopify/sarama"
+	"github.com/raksh93/storagetapper/log"
+)
+
+//asyncBatch tracks acknowledgements of the messages of the batch sent by
+//async producer. Modified by dispatcher goroutine only, done is closed when
+//all the messages are acknowledged or failed
+type asyncBatch struct {
+	pending int
+	err     error
+	done    chan struct{}
+}
+
+func (b *asyncBatch) ack(err error) {
+	if err != nil && b.err == nil {
+		b.err = err
+	}
+	b.pending--
+	if b.pending == 0 {
+		close(b.done)
+	}
+}
+
+//enableIdempotence configures the producer to assign sequence numbers to the
+//messages, so brokers discard duplicates resent on retries and preserve the
+//order of messages within partition
+func enableIdempotence(c *sarama.Config) {
+	if !c.Version.IsAtLeast(sarama.V0_11_0_0) {
+		c.Version = sarama.V0_11_0_0
+	}
+	c.Producer.Idempotent = true
+	c.Producer.RequiredAcks = sarama.WaitForAll
+	c.Producer.Return.Successes = true
+	c.Producer.Return.Errors = true
+	if c.Producer.Retry.Max < 1 {
+		c.Producer.Retry.Max = 1
+	}
+	c.Net.MaxOpenRequests = 1
+}
+
+//startAsyncProducer creates shared async producer and starts its
+//acknowledgements dispatcher, if not started already
+func (p *KafkaPipe) startAsyncProducer(c *sarama.Config) error {
+	if p.asyncProducer != nil {
+		return nil
+	}
+
+	producer, err := sarama.NewAsyncProducer(p.kafkaAddrs, c)
+	if err != nil {
+		return err
+	}
+	p.asyncProducer = producer
+
+	p.asyncWg.Add(1)
+	go p.dispatchAcks(producer)
+
+	return nil
+}
+
+//dispatchAcks routes acknowledgements and errors of the shared async producer
+//to the batches the messages belong to, until producer is closed
+func (p *KafkaPipe) dispatchAcks(producer sarama.AsyncProducer) {
+	defer p.asyncWg.Done()
+
+	successes, errs := producer.Successes(), producer.Errors()
+	for successes != nil || errs != nil {
+		select {
+		case m, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			ackMessage(m, nil)
+		case e, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			log.Errorf("Failed to produce message to topic %v: %v", e.Msg.Topic, e.Err)
+			ackMessage(e.Msg, e.Err)
+		}
+	}
+}
+
+func ackMessage(m *sarama.ProducerMessage, err error) {
+	if md, ok := m.Metadata.(*messageMetadata); ok && md.batch != nil {
+		md.batch.ack(err)
+	}
+}
+
+//closeAsyncProducer closes shared async producer, which flushes buffered
+//messages, and waits for the dispatcher to deliver their acknowledgements
+func (p *KafkaPipe) closeAsyncProducer() {
+	p.asyncProducer.AsyncClose()
+	p.asyncWg.Wait()
+	p.asyncProducer = nil
+}
+
+//pushBatchCommitAsync hands off queued messages to the async producer.
+//Returns the error of any previously committed batch. Producer fails all the
+//commits after the error, so as messages of the failed batch are not skipped
+//by the consumer
+func (p *kafkaProducer) pushBatchCommitAsync() error {
+	if err := p.waitBatches(p.maxInFlight); err != nil {
+		return err
+	}
+
+	if p.batchPtr == 0 {
+		return nil
+	}
+
+	b := &asyncBatch{pending: p.batchPtr, done: make(chan struct{})}
+	for i := 0; i < p.batchPtr; i++ {
+		m := p.batch[i]
+		md, ok := m.Metadata.(*messageMetadata)
+		if !ok {
+			md = &messageMetadata{}
+			m.Metadata = md
+		}
+		md.batch = b
+
+		select {
+		case p.async.Input() <- m:
+		case <-p.ctx.Done():
+			p.err = p.ctx.Err()
+			return p.err
+		}
+
+		//Message is owned by the producer until acknowledged
+		p.batch[i] = nil
+	}
+
+	p.batchPtr = 0
+	p.inFlight = append(p.inFlight, b)
+
+	return p.waitBatches(p.maxInFlight)
+}
+
+//waitBatches removes acknowledged batches from the head of the in flight
+//queue, waiting for the oldest batches while more than max batches are in
+//flight. Returns the first batch error
+func (p *kafkaProducer) waitBatches(max int) error {
+	for p.err == nil && len(p.inFlight) != 0 {
+		b := p.inFlight[0]
+		if len(p.inFlight) > max {
+			<-b.done
+		} else {
+			select {
+			case <-b.done:
+			default:
+				return nil
+			}
+		}
+		p.inFlight[0] = nil
+		p.inFlight = p.inFlight[1:]
+		p.err = b.err
+	}
+	return p.err
+}
+
+//flush waits for all the committed batches to be acknowledged
+func (p *kafkaProducer) flush() error {
+	if p.async == nil {
+		return nil
+	}
+	return p.waitBatches(0)
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pipe
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/raksh93/storagetapper/test"
+)
+
+func TestAsyncBatchFailure(t *testing.T) {
+	done := func(err error) *asyncBatch {
+		b := &asyncBatch{pending: 2, done: make(chan struct{})}
+		b.ack(nil)
+		b.ack(err)
+		return b
+	}
+
+	p := &kafkaProducer{maxInFlight: 2}
+	p.inFlight = []*asyncBatch{done(nil), done(fmt.Errorf("broker error")), done(nil)}
+
+	test.Assert(t, p.waitBatches(2) != nil, "batch error expected")
+	test.Assert(t, len(p.inFlight) == 1, "batches after the failed one should stay in flight")
+
+	//Error is sticky, so as commit retries don't skip failed batch
+	test.Assert(t, p.pushBatchCommitAsync() != nil, "commit should fail after batch error")
+	test.Assert(t, p.waitBatches(0) != nil, "flush should fail after batch error")
+}
+
+func TestAsyncBatchAck(t *testing.T) {
+	b := &asyncBatch{pending: 3, done: make(chan struct{})}
+	p := &kafkaProducer{maxInFlight: 1, inFlight: []*asyncBatch{b}}
+
+	b.ack(nil)
+	b.ack(nil)
+	test.CheckFail(p.waitBatches(1), t)
+	test.Assert(t, len(p.inFlight) == 1, "unacknowledged batch should stay in flight")
+
+	b.ack(nil)
+	test.CheckFail(p.waitBatches(1), t)
+	test.Assert(t, len(p.inFlight) == 0, "acknowledged batch should be removed")
+}
@@ -0,0 +1,358 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pipe
+
+import (
+	"fmt"
+	"golang.org/x/net/context" //"context"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/log"
+	"github.com/raksh93/storagetapper/types"
+	"github.com/raksh93/storagetapper/util"
+)
+
+//partitionCheckInterval determines how often group consumer checks the
+//number of topic partitions, rejoining the group when it's changed, so as new
+//partitions get assigned
+var partitionCheckInterval = 30 * time.Second
+
+//groupMessage is the message along with the group session it's received in
+type groupMessage struct {
+	*sarama.ConsumerMessage
+	sess sarama.ConsumerGroupSession
+}
+
+// kafkaGroupConsumer consumes the topic as a member of Kafka consumer group.
+// Partitions are distributed between group members by Kafka and offsets are
+// committed to Kafka
+//  * same as kafkaConsumer, after failure shutdown, it guarantees to resend
+//last batchSize messages
+type kafkaGroupConsumer struct {
+	pipe   *KafkaPipe
+	topic  string
+	client sarama.Client
+	group  sarama.ConsumerGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	ch     chan *groupMessage
+	msg    *groupMessage
+	err    error
+	last   map[int32]*groupMessage //last message received from every partition
+
+	oversized *oversizedHandler
+	fragments map[int32]*fragments
+
+	//txnOffsets is set when offsets are committed by transactional producer
+	//instead of the consumer
+	txnOffsets bool
+}
+
+func groupID(topic string) string {
+	return types.MySvcName + "." + topic
+}
+
+//newGroupConsumer creates consumer, which joins consumer group of the topic
+func (p *KafkaPipe) newGroupConsumer(topic string) (Consumer, error) {
+	txnOffsets := config.Get().KafkaExactlyOnce
+	oversized := newOversizedHandler(config.Get())
+	config, err := p.saramaConfig()
+	if log.E(err) {
+		return nil, err
+	}
+	if !config.Version.IsAtLeast(sarama.V0_10_2_0) {
+		config.Version = sarama.V0_10_2_0
+	}
+	config.Consumer.Offsets.Initial = startOffset(p.initialOffset)
+
+	client, err := sarama.NewClient(p.kafkaAddrs, config)
+	if log.E(err) {
+		return nil, err
+	}
+
+	if err = p.migrateOffsets(client, topic); log.E(err) {
+		log.E(client.Close())
+		return nil, err
+	}
+
+	group, err := sarama.NewConsumerGroupFromClient(groupID(topic), client)
+	if log.E(err) {
+		log.E(client.Close())
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &kafkaGroupConsumer{pipe: p, topic: topic, client: client, group: group, ctx: ctx, cancel: cancel, ch: make(chan *groupMessage), last: make(map[int32]*groupMessage), txnOffsets: txnOffsets, oversized: oversized, fragments: make(map[int32]*fragments)}
+
+	c.wg.Add(1)
+	go c.consume()
+
+	log.Debugf("Registered group consumer %v", topic)
+	return c, nil
+}
+
+//migrateOffsets moves offsets of the topic from kafka_offsets table to the
+//consumer group. Group offsets are moved forward only, so offsets committed by
+//the group already are preserved
+func (p *KafkaPipe) migrateOffsets(client sarama.Client, topic string) error {
+	if p.conn == nil {
+		return nil
+	}
+
+	err := p.createOffsetsTable()
+	if err != nil {
+		return err
+	}
+
+	offsets, err := p.getOffsets(topic)
+	if err != nil || len(offsets) == 0 {
+		return err
+	}
+
+	log.Infof("Migrating offsets of topic %v to consumer group %v", topic, groupID(topic))
+
+	if _, err = syncGroupOffsets(client, topic, offsets, true); err != nil {
+		return err
+	}
+
+	//Check that offsets reached Kafka before deleting them from the table
+	synced, err := syncGroupOffsets(client, topic, offsets, false)
+	if err != nil {
+		return err
+	}
+	if !synced {
+		return fmt.Errorf("Failed to commit offsets of topic %v to consumer group", topic)
+	}
+
+	return util.ExecSQL(p.conn, "DELETE FROM kafka_offsets WHERE topic=?", topic)
+}
+
+//syncGroupOffsets marks given offsets in the consumer group, if mark is true.
+//Returns true if group offsets are greater or equal to the given offsets
+func syncGroupOffsets(client sarama.Client, topic string, offsets map[int32]kafkaPartition, mark bool) (bool, error) {
+	om, err := sarama.NewOffsetManagerFromClient(groupID(topic), client)
+	if err != nil {
+		return false, err
+	}
+	//Close flushes marked offsets
+	defer func() { log.E(om.Close()) }()
+
+	synced := true
+	for _, v := range offsets {
+		pom, err := om.ManagePartition(topic, v.id)
+		if err != nil {
+			return false, err
+		}
+		if mark {
+			pom.MarkOffset(v.offset, "")
+		}
+		if o, _ := pom.NextOffset(); o < v.offset {
+			synced = false
+		}
+	}
+
+	return synced, nil
+}
+
+//consume joins the group and consumes assigned partitions, rejoining after
+//every rebalance, until consumer is closed
+func (p *kafkaGroupConsumer) consume() {
+	defer p.wg.Done()
+
+	for p.ctx.Err() == nil {
+		parts, err := p.client.Partitions(p.topic)
+		if !log.E(err) {
+			ctx, cancel := context.WithCancel(p.ctx)
+			go p.watchPartitions(ctx, cancel, len(parts))
+			err = p.group.Consume(ctx, []string{p.topic}, p)
+			cancel()
+		}
+		if err != nil && p.ctx.Err() == nil {
+			log.Errorf("Group consumer of topic %v failed: %v", p.topic, err)
+			select {
+			case <-time.After(time.Second):
+			case <-p.ctx.Done():
+			}
+		}
+	}
+}
+
+//watchPartitions ends the group session when the number of topic partitions
+//changes, so as the group is rebalanced
+func (p *kafkaGroupConsumer) watchPartitions(ctx context.Context, cancel context.CancelFunc, nparts int) {
+	ticker := time.NewTicker(partitionCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.client.RefreshMetadata(p.topic); log.E(err) {
+				continue
+			}
+			parts, err := p.client.Partitions(p.topic)
+			if !log.E(err) && len(parts) != nparts {
+				log.Infof("Number of partitions of topic %v changed from %v to %v. Rebalancing", p.topic, nparts, len(parts))
+				cancel()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+//Setup is called by sarama at the beginning of the group session
+func (p *kafkaGroupConsumer) Setup(sess sarama.ConsumerGroupSession) error {
+	log.Debugf("Group session started. Topic: %v, claims: %v", p.topic, sess.Claims())
+	return nil
+}
+
+//Cleanup is called by sarama at the end of the group session
+func (p *kafkaGroupConsumer) Cleanup(sess sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+//ConsumeClaim pushes messages of the claimed partition to the consumer
+func (p *kafkaGroupConsumer) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for msg := range claim.Messages() {
+		//Copy data to our buffer
+		b := make([]byte, len(msg.Value))
+		copy(b, msg.Value)
+		msg.Value = b
+
+		select {
+		case p.ch <- &groupMessage{msg, sess}:
+		case <-sess.Context().Done():
+			return nil
+		}
+	}
+	return nil
+}
+
+//FetchNext fetches next message from Kafka, acknowledging the message
+//batchSize messages behind in the same partition. Fragments of the chunked
+//message are accumulated until the message is complete
+func (p *kafkaGroupConsumer) FetchNext() bool {
+	for {
+		select {
+		case msg := <-p.ch:
+			f := p.fragments[msg.Partition]
+			if f == nil {
+				f = &fragments{}
+				p.fragments[msg.Partition] = f
+			}
+			unacked := p.pipe.unackedMessages()
+			m, err := p.oversized.assemble(f, msg.ConsumerMessage, unacked)
+			if m == nil {
+				continue
+			}
+			log.E(err)
+			p.msg, p.err = &groupMessage{m, msg.sess}, err
+			p.last[m.Partition] = p.msg
+			if o := f.resume(m.Offset, unacked); o >= 0 && !p.txnOffsets {
+				msg.sess.MarkOffset(m.Topic, m.Partition, o, "")
+			}
+			return true
+		case <-p.ctx.Done():
+			return false
+		}
+	}
+}
+
+//Pop pops pipe message
+func (p *kafkaGroupConsumer) Pop() (interface{}, error) {
+	return p.msg.Value, p.err
+}
+
+//SaveOffset marks all the received messages as consumed. Offsets are
+//committed to Kafka asynchronously and when consumer is closed
+func (p *kafkaGroupConsumer) SaveOffset() error {
+	if p.txnOffsets {
+		return nil
+	}
+	for _, m := range p.last {
+		m.sess.MarkOffset(m.Topic, m.Partition, m.Offset+1, "")
+	}
+	return nil
+}
+
+func (p *kafkaGroupConsumer) close(graceful bool) error {
+	if graceful {
+		log.E(p.SaveOffset())
+	}
+
+	p.cancel()
+	p.wg.Wait()
+
+	err := p.group.Close()
+	if e := p.client.Close(); e != nil && err == nil {
+		err = e
+	}
+
+	log.Debugf("Closed group consumer for topic: %v, graceful %v", p.topic, graceful)
+
+	return err
+}
+
+//Close commits offsets of all the received messages and leaves the group
+func (p *kafkaGroupConsumer) Close() error {
+	return p.close(true)
+}
+
+//CloseOnFailure leaves the group without committing offsets of the last
+//batchSize messages
+func (p *kafkaGroupConsumer) CloseOnFailure() error {
+	return p.close(false)
+}
+
+func (p *kafkaGroupConsumer) SetFormat(format string) {
+}
+
+func (p *kafkaGroupConsumer) groupID() string {
+	return groupID(p.topic)
+}
+
+func (p *kafkaGroupConsumer) nextOffset() *Offset {
+	if p.msg == nil {
+		return nil
+	}
+	return &Offset{Topic: p.msg.Topic, Partition: p.msg.Partition, Offset: p.msg.Offset + 1}
+}
+
+//Headers returns record headers of the last fetched message
+func (p *kafkaGroupConsumer) Headers() map[string]string {
+	if p.msg == nil {
+		return nil
+	}
+	return headersMap(p.msg.Headers)
+}
+
+//messageKey returns key of the last fetched message
+func (p *kafkaGroupConsumer) messageKey() string {
+	if p.msg == nil {
+		return ""
+	}
+	return string(p.msg.Key)
+}
@@ -0,0 +1,473 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pipe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/log"
+	"golang.org/x/net/context" //"context"
+)
+
+//Headers of the oversized messages
+const (
+	//HeaderFragment is set on the fragments of the chunked message. The value
+	//is "id/index/count"
+	HeaderFragment = "fragment"
+	//HeaderOffload is set on the reference to the message offloaded to the
+	//file based pipe. Header value is the pipe type, message value is the
+	//file name
+	HeaderOffload = "offload"
+)
+
+//fragmentOverhead is reserved for fragment header and record encoding
+//overhead of every fragment
+var fragmentOverhead = 128
+
+//offloadCleanupInterval is how often producers delete offloaded messages of
+//the topic, which are older than retention
+var offloadCleanupInterval = time.Hour
+
+//messagePart is the message or the part of it produced instead of the
+//oversized message
+type messagePart struct {
+	value   []byte
+	headers []sarama.RecordHeader
+}
+
+//oversizedHandler splits oversized messages on the producer side and
+//reassembles them on the consumer side
+type oversizedHandler struct {
+	mode      string
+	chunkSize int
+
+	//offload is the file pipe of the offloaded messages, which writes to the
+	//file system of the configured pipe type
+	offload     *filePipe
+	offloadFS   fs
+	offloadType string
+	retention   time.Duration
+	cleaned     map[string]time.Time //last cleanup time per topic
+	err         error                //offload pipe configuration error
+
+	//compacted checks cleanup policy of the topic before chunking the
+	//message. Fragments share the key of the original message, so
+	//compaction would keep the last fragment only
+	compacted func(topic string) (bool, error)
+	mu        sync.Mutex
+	checked   map[string]bool
+}
+
+//newOversizedHandler creates the handler. Offload pipe configuration errors
+//are reported when the pipe is used
+func newOversizedHandler(cfg *config.AppConfig) *oversizedHandler {
+	h := &oversizedHandler{mode: cfg.KafkaOversized.Mode, chunkSize: cfg.KafkaOversized.ChunkSize}
+	if cfg.KafkaOversized.OffloadPipe != "" {
+		h.offloadType = cfg.KafkaOversized.OffloadPipe
+		h.retention = time.Duration(cfg.KafkaOversized.OffloadRetention) * time.Hour
+		h.offload, h.offloadFS, h.err = offloadPipe(cfg)
+	}
+	if h.mode == config.KafkaOversizedChunk {
+		h.compacted = func(topic string) (bool, error) { return kafkaTopicCompacted(cfg, topic) }
+	}
+	return h
+}
+
+//offloadPipe returns the file pipe, which writes to the file system of the
+//configured offload pipe type. Pipe encryption, compression and HMAC options
+//apply. Every message is written to the separate file in flat layout
+func offloadPipe(cfg *config.AppConfig) (*filePipe, fs, error) {
+	p, err := Create(context.Background(), cfg.KafkaOversized.OffloadPipe, 0, cfg, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var f *filePipe
+	var fsys fs
+	switch v := p.(type) {
+	case *filePipe:
+		f, fsys = v, v
+	case *s3Pipe:
+		if v.err != nil {
+			return nil, nil, v.err
+		}
+		f, fsys = &v.filePipe, v
+	default:
+		return nil, nil, fmt.Errorf("Unsupported kafka_oversized offload_pipe: %v", p.Type())
+	}
+
+	o := *f
+	o.noHeader, o.avroOCF, o.parquet, o.partition, o.delimited = false, config.AvroOCFConfig{}, config.ParquetConfig{}, nil, true
+
+	return &o, fsys, nil
+}
+
+//offloadTopic returns the file pipe topic of the messages offloaded from the
+//Kafka topic
+func offloadTopic(topic string) string {
+	return "kafka_offload/" + topic
+}
+
+func messageSize(key string, value []byte, headers []sarama.RecordHeader) int {
+	size := len(key) + len(value)
+	for _, h := range headers {
+		size += len(h.Key) + len(h.Value)
+	}
+	return size
+}
+
+const (
+	//recordBatchOverhead is the size of the v2 record batch header
+	recordBatchOverhead = 61
+	//recordOverhead is the maximum encoding overhead of the v2 record:
+	//length, attributes, timestamp and offset deltas, key and value lengths
+	//and headers count
+	recordOverhead = 5*binary.MaxVarintLen32 + binary.MaxVarintLen64 + 1
+	//recordHeaderOverhead is the maximum encoding overhead of the record
+	//header: key and value lengths
+	recordHeaderOverhead = 2 * binary.MaxVarintLen32
+)
+
+//recordSize returns maximum encoded size of the message in the record batch
+func recordSize(key string, value []byte, headers []sarama.RecordHeader) int {
+	return messageSize(key, value, headers) + recordOverhead + len(headers)*recordHeaderOverhead
+}
+
+func fragmentID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+//split returns the parts to be produced instead of the message exceeding
+//maximum message size
+func (h *oversizedHandler) split(topic string, key string, value []byte, headers []sarama.RecordHeader, max int) ([]messagePart, error) {
+	size := messageSize(key, value, headers)
+
+	switch h.mode {
+	case config.KafkaOversizedChunk:
+		if err := h.checkCompaction(topic); err != nil {
+			return nil, err
+		}
+		return h.chunk(value, headers, max-(size-len(value)))
+	case config.KafkaOversizedOffload:
+		return h.offloadMessage(topic, value, headers)
+	}
+
+	return nil, fmt.Errorf("Message size %v exceeds maximum allowed %v", size, max)
+}
+
+//checkCompaction fails chunking of the messages produced to the compacted
+//topic. Successful checks are cached per topic
+func (h *oversizedHandler) checkCompaction(topic string) error {
+	if h.compacted == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.checked[topic] {
+		return nil
+	}
+
+	c, err := h.compacted(topic)
+	if err != nil {
+		return err
+	}
+	if c {
+		return fmt.Errorf("kafka_oversized chunk mode is not supported for compacted topic %v. Compaction keeps the last fragment of the message only. Use offload mode instead", topic)
+	}
+
+	if h.checked == nil {
+		h.checked = make(map[string]bool)
+	}
+	h.checked[topic] = true
+
+	return nil
+}
+
+//chunk splits the value into fragments, every fragment carries the headers
+//of the original message
+func (h *oversizedHandler) chunk(value []byte, headers []sarama.RecordHeader, avail int) ([]messagePart, error) {
+	size := avail - fragmentOverhead
+	if h.chunkSize != 0 && h.chunkSize < size {
+		size = h.chunkSize
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("No space left for the message fragment payload. Message key and headers size exceeds maximum")
+	}
+
+	id, err := fragmentID()
+	if err != nil {
+		return nil, err
+	}
+
+	n := (len(value) + size - 1) / size
+	parts := make([]messagePart, 0, n)
+	for i := 0; i < n; i++ {
+		end := (i + 1) * size
+		if end > len(value) {
+			end = len(value)
+		}
+		f := sarama.RecordHeader{Key: []byte(HeaderFragment), Value: []byte(fmt.Sprintf("%s/%d/%d", id, i, n))}
+		parts = append(parts, messagePart{value[i*size : end], append(append([]sarama.RecordHeader{}, headers...), f)})
+	}
+
+	log.Debugf("Message of size %v split into %v fragments", len(value), n)
+
+	return parts, nil
+}
+
+//offloadMessage writes the value to the offload pipe and returns reference
+//message, which carries the headers of the original message
+func (h *oversizedHandler) offloadMessage(topic string, value []byte, headers []sarama.RecordHeader) ([]messagePart, error) {
+	if h.err != nil {
+		return nil, h.err
+	}
+	if h.offload == nil {
+		return nil, fmt.Errorf("kafka_oversized offload_pipe is not configured")
+	}
+
+	id, err := fragmentID()
+	if err != nil {
+		return nil, err
+	}
+
+	fp := &fileProducer{filePipe: h.offload, topic: offloadTopic(topic), files: make(map[string]*file), fs: h.offloadFS}
+	name, err := fp.pushFile(id, value)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Message of size %v offloaded to %v %v", len(value), h.offloadType, name)
+
+	h.cleanup(topic)
+
+	o := sarama.RecordHeader{Key: []byte(HeaderOffload), Value: []byte(h.offloadType)}
+	return []messagePart{{[]byte(name), append(append([]sarama.RecordHeader{}, headers...), o)}}, nil
+}
+
+//cleanup deletes offloaded messages of the topic, which are older than
+//retention. Runs once per offloadCleanupInterval per topic
+func (h *oversizedHandler) cleanup(topic string) {
+	if h.retention == 0 {
+		return
+	}
+
+	h.mu.Lock()
+	if time.Since(h.cleaned[topic]) < offloadCleanupInterval {
+		h.mu.Unlock()
+		return
+	}
+	if h.cleaned == nil {
+		h.cleaned = make(map[string]time.Time)
+	}
+	h.cleaned[topic] = time.Now()
+	h.mu.Unlock()
+
+	dir := topicPath(h.offload.datadir, offloadTopic(topic))
+	files, err := h.offloadFS.ReadDir(dir)
+	if log.E(err) {
+		return
+	}
+
+	var n int
+	for _, f := range files {
+		if f.IsDir() || strings.HasSuffix(f.Name(), ".open") || time.Since(f.ModTime()) <= h.retention {
+			continue
+		}
+		if !log.E(h.offloadFS.Remove(dir + f.Name())) {
+			n++
+		}
+	}
+
+	if n != 0 {
+		log.Infof("Deleted %v offloaded messages of topic %v older than %v", n, topic, h.retention)
+	}
+}
+
+//fragments holds partition state of reassembling the chunked messages.
+//It also keeps first offsets of the recently received messages, so as
+//consumers don't resume from the middle of the chunked message
+type fragments struct {
+	id     string
+	count  int
+	first  int64
+	parts  [][]byte
+	starts []int64
+}
+
+func (f *fragments) reset() {
+	f.id, f.count, f.parts = "", 0, nil
+}
+
+//track records first offset of the complete message, keeping offsets of the
+//last window messages only
+func (f *fragments) track(first int64, window int64) {
+	f.starts = append(f.starts, first)
+	if int64(len(f.starts)) > window {
+		f.starts = f.starts[int64(len(f.starts))-window:]
+	}
+}
+
+//resume returns the offset consumer should resume from after failure,
+//so as the last window messages are resent. Fragments of the chunked
+//messages are not counted as separate messages
+func (f *fragments) resume(offset int64, window int64) int64 {
+	r := offset - window + 1
+	if n := int64(len(f.starts)); n > 0 {
+		i := n - window
+		if i < 0 {
+			i = 0
+		}
+		if f.starts[i] < r {
+			r = f.starts[i]
+		}
+	}
+	return r
+}
+
+func parseFragment(v []byte) (id string, index int, count int, err error) {
+	s := strings.Split(string(v), "/")
+	if len(s) != 3 {
+		return "", 0, 0, fmt.Errorf("Invalid fragment header: %v", string(v))
+	}
+	if index, err = strconv.Atoi(s[1]); err != nil {
+		return
+	}
+	if count, err = strconv.Atoi(s[2]); err != nil {
+		return
+	}
+	if index < 0 || index >= count {
+		err = fmt.Errorf("Invalid fragment header: %v", string(v))
+	}
+	return s[0], index, count, err
+}
+
+//withoutHeader returns copy of the headers, without the given one
+func withoutHeader(headers []*sarama.RecordHeader, key string) []*sarama.RecordHeader {
+	res := make([]*sarama.RecordHeader, 0, len(headers))
+	for _, h := range headers {
+		if string(h.Key) != key {
+			res = append(res, h)
+		}
+	}
+	return res
+}
+
+func findHeader(headers []*sarama.RecordHeader, key string) *sarama.RecordHeader {
+	for _, h := range headers {
+		if string(h.Key) == key {
+			return h
+		}
+	}
+	return nil
+}
+
+//assemble returns complete message, reassembled from the fragments or read
+//from the file pipe. Returns nil if the message is a fragment of incomplete
+//message. window is the number of the recent messages to keep offsets of
+func (h *oversizedHandler) assemble(f *fragments, msg *sarama.ConsumerMessage, window int64) (*sarama.ConsumerMessage, error) {
+	fh := findHeader(msg.Headers, HeaderFragment)
+	if fh == nil {
+		if f.id != "" {
+			log.Warnf("Dropping incomplete message %v of topic %v partition %v", f.id, msg.Topic, msg.Partition)
+			f.reset()
+		}
+		if h.mode == config.KafkaOversizedChunk {
+			f.track(msg.Offset, window)
+		}
+		if o := findHeader(msg.Headers, HeaderOffload); o != nil {
+			return h.load(msg, string(o.Value))
+		}
+		return msg, nil
+	}
+
+	id, index, count, err := parseFragment(fh.Value)
+	if err != nil {
+		return msg, err
+	}
+
+	if index == 0 {
+		if f.id != "" {
+			log.Warnf("Dropping incomplete message %v of topic %v partition %v", f.id, msg.Topic, msg.Partition)
+		}
+		f.reset()
+		f.id, f.count, f.first = id, count, msg.Offset
+	} else if id != f.id || index != len(f.parts) || count != f.count {
+		//Consumer started from the middle of the message, which was
+		//consumed already
+		log.Warnf("Skipping orphan fragment %v of message %v of topic %v partition %v offset %v", index, id, msg.Topic, msg.Partition, msg.Offset)
+		return nil, nil
+	}
+
+	f.parts = append(f.parts, msg.Value)
+	if len(f.parts) < f.count {
+		return nil, nil
+	}
+
+	m := *msg
+	m.Value = bytes.Join(f.parts, nil)
+	m.Headers = withoutHeader(msg.Headers, HeaderFragment)
+
+	if h.mode == config.KafkaOversizedChunk {
+		f.track(f.first, window)
+	}
+	f.reset()
+
+	return &m, nil
+}
+
+//load reads offloaded message from the offload pipe
+func (h *oversizedHandler) load(msg *sarama.ConsumerMessage, pipeType string) (*sarama.ConsumerMessage, error) {
+	if h.err != nil {
+		return msg, h.err
+	}
+	if h.offload == nil {
+		return msg, fmt.Errorf("Offloaded message received, but kafka_oversized offload_pipe is not configured")
+	}
+	if pipeType != h.offloadType {
+		return msg, fmt.Errorf("Message offloaded to %v pipe, but kafka_oversized offload_pipe is %v", pipeType, h.offloadType)
+	}
+
+	m := *msg
+	var err error
+	m.Value, err = h.offload.readFileFS(h.offloadFS, string(msg.Value))
+	if err != nil {
+		return msg, err
+	}
+	m.Headers = withoutHeader(msg.Headers, HeaderOffload)
+
+	return &m, nil
+}
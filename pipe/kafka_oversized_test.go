@@ -0,0 +1,231 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pipe
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/shutdown"
+	"github.com/raksh93/storagetapper/state"
+	"github.com/raksh93/storagetapper/test"
+)
+
+func consumerMessages(topic string, offset int64, parts []messagePart) []*sarama.ConsumerMessage {
+	var res []*sarama.ConsumerMessage
+	for i, v := range parts {
+		m := &sarama.ConsumerMessage{Topic: topic, Offset: offset + int64(i), Value: v.value}
+		for j := range v.headers {
+			m.Headers = append(m.Headers, &v.headers[j])
+		}
+		res = append(res, m)
+	}
+	return res
+}
+
+func TestOversizedChunk(t *testing.T) {
+	h := &oversizedHandler{mode: config.KafkaOversizedChunk, chunkSize: 10}
+	value := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	headers := recordHeaders(map[string]string{HeaderTable: "t1"})
+
+	parts, err := h.split("topic1", "key1", value, headers, fragmentOverhead+40)
+	test.CheckFail(err, t)
+	test.Assert(t, len(parts) == 4, "expected 4 fragments, got %v", len(parts))
+
+	_, err = h.split("topic1", "key1", value, headers, fragmentOverhead)
+	test.Assert(t, err != nil, "should fail when there is no space for fragment payload")
+
+	msgs := consumerMessages("topic1", 5, parts)
+	//Complete message followed by orphan fragment and the message again
+	msgs = append(msgs, consumerMessages("topic1", 9, parts[2:])...)
+	msgs = append(msgs, consumerMessages("topic1", 11, parts)...)
+
+	var f fragments
+	var res []*sarama.ConsumerMessage
+	for _, m := range msgs {
+		r, err := h.assemble(&f, m, 3)
+		test.CheckFail(err, t)
+		if r != nil {
+			res = append(res, r)
+		}
+	}
+
+	test.Assert(t, len(res) == 2, "expected 2 complete messages, got %v", len(res))
+	for _, r := range res {
+		test.Assert(t, bytes.Equal(r.Value, value), "reassembled value mismatch: %v", string(r.Value))
+		test.Assert(t, len(r.Headers) == 1 && string(r.Headers[0].Key) == HeaderTable, "fragment header should be removed: %v", r.Headers)
+	}
+	test.Assert(t, res[1].Offset == 14, "complete message should have offset of the last fragment, got %v", res[1].Offset)
+
+	//Resume from the beginning of the first message, which is one of the
+	//last 3 messages
+	test.Assert(t, f.resume(14, 3) == 5, "unexpected resume offset %v", f.resume(14, 3))
+
+	r, err := h.assemble(&f, &sarama.ConsumerMessage{Topic: "topic1", Offset: 15, Value: []byte("small")}, 2)
+	test.CheckFail(err, t)
+	test.Assert(t, r != nil && string(r.Value) == "small", "non fragmented message should pass through")
+	test.Assert(t, f.resume(15, 2) == 11, "unexpected resume offset %v", f.resume(15, 2))
+}
+
+func TestOversizedChunkCompacted(t *testing.T) {
+	var calls int
+	h := &oversizedHandler{mode: config.KafkaOversizedChunk, chunkSize: 10, compacted: func(topic string) (bool, error) {
+		calls++
+		return topic == "compacted", nil
+	}}
+	value := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+
+	_, err := h.split("compacted", "key1", value, nil, fragmentOverhead+40)
+	test.Assert(t, err != nil, "chunking should fail for compacted topic")
+
+	for i := 0; i < 2; i++ {
+		_, err = h.split("topic1", "key1", value, nil, fragmentOverhead+40)
+		test.CheckFail(err, t)
+	}
+	test.Assert(t, calls == 2, "cleanup policy check should be cached, got %v calls", calls)
+}
+
+func TestOversizedResume(t *testing.T) {
+	var f fragments
+	test.Assert(t, f.resume(10, 3) == 8, "should resend last window messages, got %v", f.resume(10, 3))
+
+	for i := int64(0); i < 10; i++ {
+		f.track(i, 3)
+	}
+	test.Assert(t, len(f.starts) == 3, "should keep window offsets only, got %v", len(f.starts))
+	test.Assert(t, f.resume(9, 3) == 7, "unexpected resume offset %v", f.resume(9, 3))
+}
+
+func TestOversizedOffload(t *testing.T) {
+	dir := baseDir + "/offload"
+	test.CheckFail(os.RemoveAll(dir), t)
+
+	fp := &filePipe{datadir: dir, maxFileSize: 1024, delimited: true}
+	h := &oversizedHandler{mode: config.KafkaOversizedOffload, offload: fp, offloadFS: fp, offloadType: "file"}
+	value := bytes.Repeat([]byte("offloaded"), 100)
+
+	parts, err := h.split("topic1", "key1", value, nil, 100)
+	test.CheckFail(err, t)
+	test.Assert(t, len(parts) == 1 && len(parts[0].value) < 100, "expected single reference message, got %v", len(parts))
+
+	var f fragments
+	r, err := h.assemble(&f, consumerMessages("topic1", 0, parts)[0], 1)
+	test.CheckFail(err, t)
+	test.Assert(t, bytes.Equal(r.Value, value), "offloaded value mismatch")
+	test.Assert(t, len(r.Headers) == 0, "offload header should be removed: %v", r.Headers)
+
+	c := &oversizedHandler{mode: config.KafkaOversizedOffload, offload: fp, offloadFS: fp, offloadType: "s3"}
+	_, err = c.assemble(&f, consumerMessages("topic1", 0, parts)[0], 1)
+	test.Assert(t, err != nil, "should fail when offloaded to another pipe type")
+
+	h.offload = nil
+	_, err = h.assemble(&f, consumerMessages("topic1", 0, parts)[0], 1)
+	test.Assert(t, err != nil, "should fail when offload pipe is not configured")
+}
+
+func TestOversizedOffloadS3(t *testing.T) {
+	s3 := newFakeS3("bucket1")
+	p, done := newTestS3Pipe(t, s3)
+	defer done()
+
+	h := &oversizedHandler{mode: config.KafkaOversizedOffload, offload: &p.filePipe, offloadFS: p, offloadType: "s3"}
+	value := bytes.Repeat([]byte("offloaded"), 100)
+
+	parts, err := h.split("topic1", "key1", value, nil, 100)
+	test.CheckFail(err, t)
+	test.Assert(t, len(s3.objects) == 1, "expected offloaded object, got %v", len(s3.objects))
+
+	var f fragments
+	r, err := h.assemble(&f, consumerMessages("topic1", 0, parts)[0], 1)
+	test.CheckFail(err, t)
+	test.Assert(t, bytes.Equal(r.Value, value), "offloaded value mismatch")
+}
+
+func TestOversizedOffloadRetention(t *testing.T) {
+	dir := baseDir + "/offload"
+	test.CheckFail(os.RemoveAll(dir), t)
+
+	fp := &filePipe{datadir: dir, maxFileSize: 1024, delimited: true}
+	h := &oversizedHandler{mode: config.KafkaOversizedOffload, offload: fp, offloadFS: fp, offloadType: "file", retention: time.Hour}
+
+	var names []string
+	for i := 0; i < 2; i++ {
+		parts, err := h.split("topic1", "key1", bytes.Repeat([]byte("offloaded"), 100), nil, 100)
+		test.CheckFail(err, t)
+		names = append(names, string(parts[0].value))
+	}
+
+	//Expire the first message and force the cleanup
+	old := time.Now().Add(-2 * time.Hour)
+	test.CheckFail(os.Chtimes(dir+"/"+names[0], old, old), t)
+	h.cleaned = nil
+	_, err := h.split("topic1", "key1", bytes.Repeat([]byte("offloaded"), 100), nil, 100)
+	test.CheckFail(err, t)
+
+	_, err = os.Stat(dir + "/" + names[0])
+	test.Assert(t, os.IsNotExist(err), "expired message should be deleted: %v", err)
+	_, err = os.Stat(dir + "/" + names[1])
+	test.CheckFail(err, t)
+}
+
+func TestKafkaOversized(t *testing.T) {
+	test.SkipIfNoKafkaAvailable(t)
+	test.SkipIfNoMySQLAvailable(t)
+
+	shutdown.Setup()
+	defer func() {
+		shutdown.Initiate()
+		shutdown.Wait()
+	}()
+
+	if !state.Init(cfg) {
+		t.Fatalf("Failed to init State")
+	}
+
+	cfg.KafkaOversized = config.KafkaOversizedConfig{Mode: config.KafkaOversizedChunk}
+	defer func() { cfg.KafkaOversized = config.KafkaOversizedConfig{} }()
+
+	p := createPipe(2)
+	p.Config.Producer.MaxMessageBytes = 1024
+
+	consumer, err := p.NewConsumer("topic_oversized")
+	test.CheckFail(err, t)
+	producer, err := p.NewProducer("topic_oversized")
+	test.CheckFail(err, t)
+
+	large := string(bytes.Repeat([]byte("large message "), 500))
+
+	test.CheckFail(producer.PushBatch("key1", []byte("small1")), t)
+	test.CheckFail(producer.PushBatch("key2", []byte(large)), t)
+	test.CheckFail(producer.PushBatch("key3", []byte("small2")), t)
+	test.CheckFail(producer.PushBatchCommit(), t)
+
+	test.Assert(t, consumeMessage(consumer, t) == "small1", "first message expected")
+	test.Assert(t, consumeMessage(consumer, t) == large, "large message should be reassembled")
+	test.Assert(t, consumeMessage(consumer, t) == "small2", "last message expected")
+
+	test.CheckFail(producer.Close(), t)
+	test.CheckFail(consumer.Close(), t)
+}
@@ -0,0 +1,231 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pipe
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/raksh93/storagetapper/config"
+)
+
+//applySecurity configures TLS and SASL of the sarama config from the
+//application config
+func applySecurity(c *sarama.Config, cfg *config.AppConfig) error {
+	if cfg.KafkaTLS.Enabled {
+		t, err := tlsConfig(&cfg.KafkaTLS)
+		if err != nil {
+			return err
+		}
+		c.Net.TLS.Enable = true
+		c.Net.TLS.Config = t
+	}
+
+	s := &cfg.KafkaSASL
+	if s.Mechanism == "" {
+		return nil
+	}
+
+	c.Net.SASL.Enable = true
+	c.Net.SASL.User = s.User
+	c.Net.SASL.Password = s.Password
+	c.Net.SASL.Mechanism = sarama.SASLMechanism(s.Mechanism)
+
+	switch s.Mechanism {
+	case config.KafkaSASLScramSHA256:
+		c.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{hash: sha256.New} }
+	case config.KafkaSASLScramSHA512:
+		c.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{hash: sha512.New} }
+	}
+
+	//SCRAM is authenticated using SaslAuthenticate requests
+	if s.Mechanism != config.KafkaSASLPlain && !c.Version.IsAtLeast(sarama.V1_0_0_0) {
+		c.Version = sarama.V1_0_0_0
+	}
+
+	return nil
+}
+
+func tlsConfig(cfg *config.KafkaTLSConfig) (*tls.Config, error) {
+	t := &tls.Config{ServerName: cfg.ServerName, InsecureSkipVerify: cfg.InsecureSkipVerify}
+
+	if cfg.CAFile != "" {
+		b, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		t.RootCAs = x509.NewCertPool()
+		if !t.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("No certificates found in %v", cfg.CAFile)
+		}
+	}
+
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		t.Certificates = []tls.Certificate{cert}
+	}
+
+	return t, nil
+}
+
+//scramClient implements client side of SCRAM authentication, RFC 5802,
+//without channel binding
+type scramClient struct {
+	hash     func() hash.Hash
+	user     string
+	password string
+	nonce    string
+	step     int
+
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func (s *scramClient) Begin(user string, password string, authzID string) error {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	s.nonce = base64.RawStdEncoding.EncodeToString(b)
+	s.user = strings.NewReplacer("=", "=3D", ",", "=2C").Replace(user)
+	s.password = password
+	s.step = 0
+	return nil
+}
+
+func (s *scramClient) Step(challenge string) (string, error) {
+	s.step++
+	switch s.step {
+	case 1:
+		s.clientFirstBare = "n=" + s.user + ",r=" + s.nonce
+		return "n,," + s.clientFirstBare, nil
+	case 2:
+		return s.clientFinal(challenge)
+	case 3:
+		return "", s.verifyServerFinal(challenge)
+	}
+	return "", fmt.Errorf("Unexpected SCRAM step %v", s.step)
+}
+
+func (s *scramClient) Done() bool {
+	return s.step >= 3
+}
+
+func scramAttrs(msg string) map[byte]string {
+	attrs := make(map[byte]string)
+	for _, a := range strings.Split(msg, ",") {
+		if len(a) >= 2 && a[1] == '=' {
+			attrs[a[0]] = a[2:]
+		}
+	}
+	return attrs
+}
+
+func (s *scramClient) hmac(key []byte, msg string) []byte {
+	h := hmac.New(s.hash, key)
+	_, _ = h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+//pbkdf2 derives the key of hash size, RFC 2898
+func (s *scramClient) pbkdf2(salt []byte, iter int) []byte {
+	prf := hmac.New(s.hash, []byte(s.password))
+	_, _ = prf.Write(salt)
+	_, _ = prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+	res := append([]byte(nil), u...)
+	for i := 1; i < iter; i++ {
+		prf.Reset()
+		_, _ = prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range res {
+			res[j] ^= u[j]
+		}
+	}
+	return res
+}
+
+func (s *scramClient) clientFinal(serverFirst string) (string, error) {
+	attrs := scramAttrs(serverFirst)
+
+	nonce := attrs['r']
+	if !strings.HasPrefix(nonce, s.nonce) || len(nonce) == len(s.nonce) {
+		return "", fmt.Errorf("Invalid SCRAM server nonce")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(attrs['s'])
+	if err != nil {
+		return "", fmt.Errorf("Invalid SCRAM salt: %v", err)
+	}
+
+	iter, err := strconv.Atoi(attrs['i'])
+	if err != nil || iter < 1 {
+		return "", fmt.Errorf("Invalid SCRAM iteration count: %v", attrs['i'])
+	}
+
+	saltedPassword := s.pbkdf2(salt, iter)
+	clientKey := s.hmac(saltedPassword, "Client Key")
+	h := s.hash()
+	_, _ = h.Write(clientKey)
+	storedKey := h.Sum(nil)
+
+	//"biws" is base64 of "n,," GS2 header
+	clientFinal := "c=biws,r=" + nonce
+	authMessage := s.clientFirstBare + "," + serverFirst + "," + clientFinal
+
+	proof := s.hmac(storedKey, authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+
+	s.serverSignature = s.hmac(s.hmac(saltedPassword, "Server Key"), authMessage)
+
+	return clientFinal + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+func (s *scramClient) verifyServerFinal(serverFinal string) error {
+	attrs := scramAttrs(serverFinal)
+	if e, ok := attrs['e']; ok {
+		return fmt.Errorf("SCRAM authentication failed: %v", e)
+	}
+
+	v, err := base64.StdEncoding.DecodeString(attrs['v'])
+	if err != nil || subtle.ConstantTimeCompare(v, s.serverSignature) != 1 {
+		return fmt.Errorf("Invalid SCRAM server signature")
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pipe
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/test"
+)
+
+//Test vector from RFC 7677
+func TestScramClient(t *testing.T) {
+	s := &scramClient{hash: sha256.New}
+	test.CheckFail(s.Begin("user", "pencil", ""), t)
+	s.nonce = "rOprNGfwEbeRWgbNEkqO"
+
+	msg, err := s.Step("")
+	test.CheckFail(err, t)
+	test.Assert(t, msg == "n,,n=user,r=rOprNGfwEbeRWgbNEkqO", "unexpected client first message: %v", msg)
+
+	msg, err = s.Step("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	test.CheckFail(err, t)
+	test.Assert(t, msg == "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", "unexpected client final message: %v", msg)
+	test.Assert(t, !s.Done(), "exchange is not finished yet")
+
+	_, err = s.Step("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")
+	test.CheckFail(err, t)
+	test.Assert(t, s.Done(), "exchange should be finished")
+}
+
+func TestScramClientNeg(t *testing.T) {
+	s := &scramClient{hash: sha256.New}
+	test.CheckFail(s.Begin("user", "pencil", ""), t)
+	_, err := s.Step("")
+	test.CheckFail(err, t)
+
+	_, err = s.Step("r=othernonce,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	test.Assert(t, err != nil, "server nonce should start with client nonce")
+
+	s = &scramClient{hash: sha256.New}
+	test.CheckFail(s.Begin("user", "pencil", ""), t)
+	_, err = s.Step("")
+	test.CheckFail(err, t)
+	_, err = s.Step("r=" + s.nonce + "srv,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	test.CheckFail(err, t)
+	_, err = s.Step("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")
+	test.Assert(t, err != nil, "server signature verification should fail")
+}
+
+func TestApplySecurity(t *testing.T) {
+	c := sarama.NewConfig()
+	cfg := &config.AppConfig{}
+	cfg.KafkaSASL = config.KafkaSASLConfig{Mechanism: config.KafkaSASLScramSHA512, User: "user", Password: "pencil"}
+	cfg.KafkaTLS = config.KafkaTLSConfig{Enabled: true, ServerName: "kafka.local"}
+
+	test.CheckFail(applySecurity(c, cfg), t)
+	test.Assert(t, c.Net.TLS.Enable && c.Net.TLS.Config.ServerName == "kafka.local", "TLS should be enabled")
+	test.Assert(t, c.Net.SASL.Enable && c.Net.SASL.Mechanism == sarama.SASLTypeSCRAMSHA512, "SASL SCRAM should be enabled")
+	test.Assert(t, c.Net.SASL.User == "user" && c.Net.SASL.Password == "pencil", "SASL credentials expected")
+	test.Assert(t, c.Version.IsAtLeast(sarama.V1_0_0_0), "SCRAM requires Kafka 1.0")
+	test.CheckFail(c.Validate(), t)
+
+	cfg.KafkaTLS.CAFile = "/nonexistent/ca.pem"
+	test.Assert(t, applySecurity(sarama.NewConfig(), cfg) != nil, "should fail on missing CA file")
+}
@@ -22,16 +22,19 @@ package pipe
 
 import (
 	"fmt"
+	"reflect"
 	"strconv"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/raksh93/storagetapper/config"
 	"github.com/raksh93/storagetapper/log"
 	"github.com/raksh93/storagetapper/shutdown"
 	"github.com/raksh93/storagetapper/state"
 	"github.com/raksh93/storagetapper/test"
+	"github.com/raksh93/storagetapper/types"
 	"github.com/raksh93/storagetapper/util"
 )
 
@@ -335,6 +338,259 @@ func TestKafkaBigMessage(t *testing.T) {
 	test.CheckFail(err, t)
 }
 
+func TestKafkaTombstone(t *testing.T) {
+	test.SkipIfNoKafkaAvailable(t)
+	test.SkipIfNoMySQLAvailable(t)
+
+	shutdown.Setup()
+	defer func() {
+		shutdown.Initiate()
+		shutdown.Wait()
+	}()
+
+	if !state.Init(cfg) {
+		t.Fatalf("Failed to init State")
+	}
+
+	//Don't check returned error because table might not exist
+	_ = util.ExecSQL(state.GetDB(), "DROP TABLE IF EXISTS kafka_offsets")
+
+	p := createPipe(1)
+
+	consumer, err := p.NewConsumer("topic_tombstone")
+	test.CheckFail(err, t)
+	producer, err := p.NewProducer("topic_tombstone")
+	test.CheckFail(err, t)
+
+	test.CheckFail(producer.PushBatch("key1", []byte("deleted")), t)
+	test.CheckFail(producer.PushBatch("key1", nil), t)
+	test.CheckFail(producer.PushBatchCommit(), t)
+
+	test.Assert(t, consumeMessage(consumer, t) == "deleted", "delete event expected")
+
+	test.Assert(t, consumer.FetchNext(), "tombstone expected")
+	res, err := consumer.Pop()
+	test.CheckFail(err, t)
+	test.Assert(t, res.([]byte) == nil, "tombstone should have nil value, got: %v", res)
+
+	test.CheckFail(consumer.Close(), t)
+	test.CheckFail(producer.Close(), t)
+}
+
+func TestKafkaStartOffsets(t *testing.T) {
+	test.SkipIfNoKafkaAvailable(t)
+
+	shutdown.Setup()
+	defer func() {
+		shutdown.Initiate()
+		shutdown.Wait()
+	}()
+
+	topic := fmt.Sprintf("topic_start_offsets_%v", time.Now().UnixNano())
+
+	p := createPipe(1)
+	p.conn = nil
+	producer, err := p.NewProducer(topic)
+	test.CheckFail(err, t)
+	for i := 1; i <= 3; i++ {
+		test.CheckFail(producer.PushBatch("key1", []byte(fmt.Sprintf("msg%v", i))), t)
+	}
+	test.CheckFail(producer.PushBatchCommit(), t)
+	test.CheckFail(producer.Close(), t)
+
+	p = createPipe(1)
+	p.conn = nil
+	test.Assert(t, SetStartOffsets(p, []Offset{{Topic: topic, Partition: 0, Offset: 1}}), "kafka pipe should support start offsets")
+	consumer, err := p.NewConsumer(topic)
+	test.CheckFail(err, t)
+
+	test.Assert(t, consumeMessage(consumer, t) == "msg2", "consumer should start from the given offset")
+	o := NextOffset(consumer)
+	test.Assert(t, o != nil && o.Topic == topic && o.Partition == 0 && o.Offset == 2, "unexpected next offset: %+v", o)
+	test.Assert(t, consumeMessage(consumer, t) == "msg3", "msg3 expected")
+
+	test.CheckFail(consumer.CloseOnFailure(), t)
+}
+
+func TestKafkaHeaders(t *testing.T) {
+	test.SkipIfNoKafkaAvailable(t)
+	test.SkipIfNoMySQLAvailable(t)
+
+	shutdown.Setup()
+	defer func() {
+		shutdown.Initiate()
+		shutdown.Wait()
+	}()
+
+	if !state.Init(cfg) {
+		t.Fatalf("Failed to init State")
+	}
+
+	//Don't check returned error because table might not exist
+	_ = util.ExecSQL(state.GetDB(), "DROP TABLE IF EXISTS kafka_offsets")
+
+	cfg.KafkaHeaders = true
+	defer func() { cfg.KafkaHeaders = false }()
+
+	p := createPipe(1)
+
+	consumer, err := p.NewConsumer("topic_headers")
+	test.CheckFail(err, t)
+	producer, err := p.NewProducer("topic_headers")
+	test.CheckFail(err, t)
+
+	loc := &types.TableLoc{Service: "svc1", Cluster: "clst1", Db: "db1", Table: "t1", Version: 3}
+	h := EventHeaders(loc, "avro", 17, "uuid1:5")
+
+	test.CheckFail(PushBatchOptions(producer, "key1", []byte("with headers"), &MessageOptions{Headers: h}), t)
+	test.CheckFail(producer.PushBatch("key2", []byte("without headers")), t)
+	test.CheckFail(producer.PushBatchCommit(), t)
+
+	test.Assert(t, consumeMessage(consumer, t) == "with headers", "first message expected")
+	test.Assert(t, reflect.DeepEqual(consumer.Headers(), h), "expected headers %v, got %v", h, consumer.Headers())
+
+	test.Assert(t, consumeMessage(consumer, t) == "without headers", "second message expected")
+	test.Assert(t, consumer.Headers() == nil, "no headers expected, got: %v", consumer.Headers())
+
+	test.CheckFail(consumer.Close(), t)
+	test.CheckFail(producer.Close(), t)
+}
+
+func TestKafkaAsyncProducer(t *testing.T) {
+	test.SkipIfNoKafkaAvailable(t)
+	test.SkipIfNoMySQLAvailable(t)
+
+	shutdown.Setup()
+	defer func() {
+		shutdown.Initiate()
+		shutdown.Wait()
+	}()
+
+	if !state.Init(cfg) {
+		t.Fatalf("Failed to init State")
+	}
+
+	//Don't check returned error because table might not exist
+	_ = util.ExecSQL(state.GetDB(), "DROP TABLE IF EXISTS kafka_offsets")
+
+	cfg.KafkaProducer = config.KafkaProducerConfig{Async: true, MaxInFlightBatches: 2}
+	defer func() { cfg.KafkaProducer = config.KafkaProducerConfig{MaxInFlightBatches: 4} }()
+
+	p := createPipe(4)
+	test.Assert(t, p.unackedMessages() == 12, "consumer should account for in flight batches, got: %v", p.unackedMessages())
+
+	consumer, err := p.NewConsumer("topic_async")
+	test.CheckFail(err, t)
+	producer, err := p.NewProducer("topic_async")
+	test.CheckFail(err, t)
+
+	for i := 0; i < 10*p.batchSize; i++ {
+		test.CheckFail(producer.PushBatch("key", []byte(fmt.Sprintf("msg%v", i))), t)
+		test.Assert(t, len(producer.(*kafkaProducer).inFlight) <= 2, "in flight batches should be bounded")
+	}
+	test.CheckFail(producer.PushBatchCommit(), t)
+	test.CheckFail(Flush(producer), t)
+	test.Assert(t, len(producer.(*kafkaProducer).inFlight) == 0, "all batches should be acknowledged after flush")
+
+	//Single key messages are expected in order
+	for i := 0; i < 10*p.batchSize; i++ {
+		m := consumeMessage(consumer, t)
+		test.Assert(t, m == fmt.Sprintf("msg%v", i), "expected msg%v, got %v", i, m)
+	}
+
+	test.CheckFail(consumer.Close(), t)
+	test.CheckFail(producer.Close(), t)
+	test.Assert(t, p.asyncProducer == nil, "shared async producer should be closed")
+}
+
+func TestKafkaSharedProducer(t *testing.T) {
+	test.SkipIfNoKafkaAvailable(t)
+
+	p := createPipe(2)
+
+	p1, err := p.NewProducer("topic_shared")
+	test.CheckFail(err, t)
+	p2, err := p.NewProducer("topic_shared")
+	test.CheckFail(err, t)
+	test.Assert(t, p1.(*kafkaProducer).producer != p2.(*kafkaProducer).producer, "producers shouldn't be shared in single table mode")
+	test.CheckFail(p1.Close(), t)
+	test.CheckFail(p2.Close(), t)
+
+	cfg.StreamerTablesPerWorker = 2
+	defer func() { cfg.StreamerTablesPerWorker = 1 }()
+
+	p1, err = p.NewProducer("topic_shared")
+	test.CheckFail(err, t)
+	p2, err = p.NewProducer("topic_shared")
+	test.CheckFail(err, t)
+	test.Assert(t, p1.(*kafkaProducer).producer == p2.(*kafkaProducer).producer, "producer should be shared in multi table mode")
+	test.CheckFail(p1.Close(), t)
+	test.Assert(t, p.producer != nil, "shared producer should be closed by the last producer")
+	test.CheckFail(p2.Close(), t)
+	test.Assert(t, p.producer == nil, "shared producer should be closed")
+}
+
+func TestKafkaConsumerGroup(t *testing.T) {
+	test.SkipIfNoKafkaAvailable(t)
+	test.SkipIfNoMySQLAvailable(t)
+
+	shutdown.Setup()
+	defer func() {
+		shutdown.Initiate()
+		shutdown.Wait()
+	}()
+
+	if !state.Init(cfg) {
+		t.Fatalf("Failed to init State")
+	}
+
+	//Group offsets survive test restarts, so use new topic every time
+	topic := fmt.Sprintf("topic_group_%v", time.Now().UnixNano())
+
+	p := createPipe(1)
+	test.CheckFail(p.Init(), t)
+
+	producer, err := p.NewProducer(topic)
+	test.CheckFail(err, t)
+
+	push := func(from int, to int) {
+		for i := from; i < to; i++ {
+			test.CheckFail(producer.PushBatch("key", []byte("msg."+strconv.Itoa(i))), t)
+		}
+		test.CheckFail(producer.PushBatchCommit(), t)
+	}
+
+	consume := func(from int, to int) {
+		c, err := p.NewConsumer(topic)
+		test.CheckFail(err, t)
+		for i := from; i < to; i++ {
+			m := consumeMessage(c, t)
+			test.Assert(t, m == "msg."+strconv.Itoa(i), "expected msg.%v, got: %v", i, m)
+		}
+		test.CheckFail(c.Close(), t)
+	}
+
+	push(0, 10)
+
+	//Offset to be migrated to the consumer group
+	err = util.ExecSQL(state.GetDB(), "INSERT INTO kafka_offsets VALUES(?,?,?)", topic, 0, 5)
+	test.CheckFail(err, t)
+
+	p.consumerGroups = true
+	consume(5, 10)
+
+	var cnt int
+	err = util.QueryRowSQL(state.GetDB(), "SELECT COUNT(*) FROM kafka_offsets WHERE topic=?", topic).Scan(&cnt)
+	test.CheckFail(err, t)
+	test.Assert(t, cnt == 0, "offsets should be deleted after migration")
+
+	//Should continue from the offset committed to the group by graceful close
+	push(10, 13)
+	consume(10, 13)
+
+	test.CheckFail(producer.Close(), t)
+}
+
 func TestKafkaOffsets(t *testing.T) {
 	test.SkipIfNoKafkaAvailable(t)
 	test.SkipIfNoMySQLAvailable(t)
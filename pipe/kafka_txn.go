@@ -0,0 +1,617 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pipe
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/log"
+)
+
+//txnTimeout is the time after which broker aborts the transaction not
+//committed by the producer
+var txnTimeout = 60 * time.Second
+
+//Transaction coordinator requests are retried txnRetries times with
+//txnRetryBackoff interval when coordinator is not available or previous
+//transaction is still being completed
+var txnRetries = 30
+var txnRetryBackoff = 100 * time.Millisecond
+
+//kafkaTxnProducer implements Kafka transactional producer on top of sarama
+//protocol primitives, since sarama producers are not transactional.
+//Messages are buffered in memory and produced by Commit, so transaction
+//lasts for the duration of Commit only. Not safe for concurrent use
+type kafkaTxnProducer struct {
+	id     string
+	client sarama.Client
+	conf   *sarama.Config
+	coord  *sarama.Broker //transaction coordinator
+
+	pid   int64
+	epoch int16
+	seq   map[string]map[int32]int32 //next sequence number of the partition
+
+	partitioners map[string]sarama.Partitioner
+	msgs         []*sarama.ProducerMessage
+	size         int64 //size of the queued messages
+	maxSize      int64 //maximum size of the transaction, unlimited if zero
+	err          error //transaction failure, producer can't be used after it
+
+	maxMessageBytes int
+	oversized       *oversizedHandler
+}
+
+//kafkaTxnTopicProducer queues topic messages to the transactional producer
+type kafkaTxnTopicProducer struct {
+	txn   *kafkaTxnProducer
+	topic string
+}
+
+func (p *KafkaPipe) newTxnProducer(id string) (TxnProducer, error) {
+	conf, err := p.saramaConfig()
+	if log.E(err) {
+		return nil, err
+	}
+	if !conf.Version.IsAtLeast(sarama.V0_11_0_0) {
+		conf.Version = sarama.V0_11_0_0
+	}
+	conf.Producer.Partitioner = newPartitionerConstructor(conf.Producer.Partitioner)
+
+	client, err := sarama.NewClient(p.kafkaAddrs, conf)
+	if log.E(err) {
+		return nil, err
+	}
+
+	t := &kafkaTxnProducer{id: id, client: client, conf: conf, partitioners: make(map[string]sarama.Partitioner), maxMessageBytes: conf.Producer.MaxMessageBytes, maxSize: config.Get().KafkaTxnMaxBytes, oversized: newOversizedHandler(config.Get())}
+
+	if err = t.initProducerID(); log.E(err) {
+		log.E(t.Close())
+		return nil, err
+	}
+
+	log.Debugf("Initialized transactional producer %v, producer id %v, epoch %v", id, t.pid, t.epoch)
+
+	return t, nil
+}
+
+func (p *KafkaPipe) committedOffsets(group string) ([]Offset, error) {
+	conf, err := p.saramaConfig()
+	if err != nil {
+		return nil, err
+	}
+	if !conf.Version.IsAtLeast(sarama.V0_10_2_0) {
+		conf.Version = sarama.V0_10_2_0
+	}
+
+	client, err := sarama.NewClient(p.kafkaAddrs, conf)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { log.E(client.Close()) }()
+
+	b, err := client.Coordinator(group)
+	if err != nil {
+		return nil, err
+	}
+
+	//Version 2 request without partitions fetches offsets of all the topics
+	resp, err := b.FetchOffset(&sarama.OffsetFetchRequest{Version: 2, ConsumerGroup: group})
+	if err != nil {
+		return nil, err
+	}
+	if err = kafkaError(resp.Err); err != nil {
+		return nil, err
+	}
+
+	var res []Offset
+	for topic, partitions := range resp.Blocks {
+		for partition, b := range partitions {
+			if b.Err == sarama.ErrNoError && b.Offset >= 0 {
+				res = append(res, Offset{Topic: topic, Partition: partition, Offset: b.Offset, Metadata: b.Metadata})
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func kafkaError(err sarama.KError) error {
+	if err == sarama.ErrNoError {
+		return nil
+	}
+	return err
+}
+
+//retry calls f until it succeeds, returns non retriable error or retries
+//are exhausted. Coordinator is looked up again if it has moved
+func (t *kafkaTxnProducer) retry(f func() error) error {
+	var err error
+	for i := 0; i < txnRetries; i++ {
+		if t.coord == nil {
+			err = t.findCoordinator()
+		}
+		if err == nil {
+			err = f()
+		}
+
+		switch err {
+		case sarama.ErrNotCoordinatorForConsumer, sarama.ErrConsumerCoordinatorNotAvailable:
+			t.closeCoordinator()
+		case sarama.ErrConcurrentTransactions, sarama.ErrOffsetsLoadInProgress:
+		default:
+			return err
+		}
+
+		time.Sleep(txnRetryBackoff)
+	}
+	return err
+}
+
+func (t *kafkaTxnProducer) findCoordinator() error {
+	b, err := t.client.Controller()
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.FindCoordinator(&sarama.FindCoordinatorRequest{Version: 1, CoordinatorKey: t.id, CoordinatorType: sarama.CoordinatorTransaction})
+	if err != nil {
+		return err
+	}
+	if err = kafkaError(resp.Err); err != nil {
+		return err
+	}
+
+	if err = resp.Coordinator.Open(t.conf); err != nil && err != sarama.ErrAlreadyConnected {
+		return err
+	}
+	t.coord = resp.Coordinator
+
+	return nil
+}
+
+func (t *kafkaTxnProducer) closeCoordinator() {
+	if t.coord != nil {
+		log.E(t.coord.Close())
+		t.coord = nil
+	}
+}
+
+//initProducerID obtains producer ID and epoch of the transaction ID. This
+//fences previous producer with the same transaction ID and aborts its
+//unfinished transaction
+func (t *kafkaTxnProducer) initProducerID() error {
+	return t.retry(func() error {
+		resp, err := t.coord.InitProducerID(&sarama.InitProducerIDRequest{TransactionalID: &t.id, TransactionTimeout: txnTimeout})
+		if err != nil {
+			return err
+		}
+		if err = kafkaError(resp.Err); err != nil {
+			return err
+		}
+		t.pid, t.epoch = resp.ProducerID, resp.ProducerEpoch
+		t.seq = make(map[string]map[int32]int32)
+		return nil
+	})
+}
+
+//NewProducer returns producer of the topic, which queues messages to the
+//transaction
+func (t *kafkaTxnProducer) NewProducer(topic string) (Producer, error) {
+	return &kafkaTxnTopicProducer{txn: t, topic: topic}, nil
+}
+
+//Commit produces queued messages and commits the offsets in a transaction
+func (t *kafkaTxnProducer) Commit(group string, offsets []Offset) error {
+	if t.err != nil {
+		return t.err
+	}
+	if group == "" {
+		offsets = nil
+	}
+	if len(t.msgs) == 0 && len(offsets) == 0 {
+		return nil
+	}
+
+	t.err = t.commit(group, offsets)
+	t.msgs, t.size = nil, 0
+
+	if log.E(t.err) {
+		log.E(t.endTxn(false))
+	}
+
+	return t.err
+}
+
+func (t *kafkaTxnProducer) commit(group string, offsets []Offset) error {
+	batches, err := t.partition()
+	if err != nil {
+		return err
+	}
+
+	if len(batches) != 0 {
+		if err = t.addPartitions(batches); err != nil {
+			return err
+		}
+		if err = t.produce(batches); err != nil {
+			return err
+		}
+	}
+
+	if len(offsets) != 0 {
+		if err = t.commitOffsets(group, offsets); err != nil {
+			return err
+		}
+	}
+
+	return t.endTxn(true)
+}
+
+//partition groups queued messages by topic and partition
+func (t *kafkaTxnProducer) partition() (map[string]map[int32][]*sarama.ProducerMessage, error) {
+	res := make(map[string]map[int32][]*sarama.ProducerMessage)
+	for _, m := range t.msgs {
+		partitions, err := t.client.Partitions(m.Topic)
+		if err != nil {
+			return nil, err
+		}
+		if len(partitions) == 0 {
+			return nil, fmt.Errorf("No partitions available for topic %v", m.Topic)
+		}
+
+		p := t.partitioners[m.Topic]
+		if p == nil {
+			p = t.conf.Producer.Partitioner(m.Topic)
+			t.partitioners[m.Topic] = p
+		}
+
+		i, err := p.Partition(m, int32(len(partitions)))
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || int(i) >= len(partitions) {
+			return nil, fmt.Errorf("Partitioner returned invalid partition %v for topic %v", i, m.Topic)
+		}
+		m.Partition = partitions[i]
+
+		if res[m.Topic] == nil {
+			res[m.Topic] = make(map[int32][]*sarama.ProducerMessage)
+		}
+		res[m.Topic][m.Partition] = append(res[m.Topic][m.Partition], m)
+	}
+	return res, nil
+}
+
+func (t *kafkaTxnProducer) addPartitions(batches map[string]map[int32][]*sarama.ProducerMessage) error {
+	tp := make(map[string][]int32)
+	for topic, partitions := range batches {
+		for p := range partitions {
+			tp[topic] = append(tp[topic], p)
+		}
+	}
+
+	return t.retry(func() error {
+		resp, err := t.coord.AddPartitionsToTxn(&sarama.AddPartitionsToTxnRequest{TransactionalID: t.id, ProducerID: t.pid, ProducerEpoch: t.epoch, TopicPartitions: tp})
+		if err != nil {
+			return err
+		}
+		for _, partitions := range resp.Errors {
+			for _, p := range partitions {
+				if err = kafkaError(p.Err); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+//recordBatches splits partition messages into transactional record batches
+//not exceeding maximum message size
+func (t *kafkaTxnProducer) recordBatches(topic string, partition int32, msgs []*sarama.ProducerMessage) ([]*sarama.RecordBatch, error) {
+	if t.seq[topic] == nil {
+		t.seq[topic] = make(map[int32]int32)
+	}
+	seq := t.seq[topic][partition]
+
+	var res []*sarama.RecordBatch
+	var b *sarama.RecordBatch
+	var size int
+	now := time.Now()
+	for _, m := range msgs {
+		r, err := newRecord(m)
+		if err != nil {
+			return nil, err
+		}
+
+		s := len(r.Key) + len(r.Value) + recordOverhead
+		for _, h := range r.Headers {
+			s += len(h.Key) + len(h.Value) + recordHeaderOverhead
+		}
+
+		if b == nil || size+s > t.maxMessageBytes {
+			b = &sarama.RecordBatch{Version: 2, FirstTimestamp: now, MaxTimestamp: now, ProducerID: t.pid, ProducerEpoch: t.epoch, FirstSequence: seq, IsTransactional: true}
+			res = append(res, b)
+			size = recordBatchOverhead
+		}
+
+		r.OffsetDelta = int64(len(b.Records))
+		b.Records = append(b.Records, r)
+		b.LastOffsetDelta = int32(r.OffsetDelta)
+		size += s
+		seq++
+	}
+
+	t.seq[topic][partition] = seq
+
+	return res, nil
+}
+
+func newRecord(m *sarama.ProducerMessage) (*sarama.Record, error) {
+	r := &sarama.Record{}
+
+	var err error
+	if m.Key != nil {
+		if r.Key, err = m.Key.Encode(); err != nil {
+			return nil, err
+		}
+	}
+	if m.Value != nil {
+		if r.Value, err = m.Value.Encode(); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range m.Headers {
+		r.Headers = append(r.Headers, &m.Headers[i])
+	}
+
+	return r, nil
+}
+
+//produce sends record batches to partition leaders. Every produce request
+//contains at most one batch of every partition, so as batches of the
+//partition are appended in order
+func (t *kafkaTxnProducer) produce(batches map[string]map[int32][]*sarama.ProducerMessage) error {
+	type partitionBatches struct {
+		topic     string
+		partition int32
+		batches   []*sarama.RecordBatch
+	}
+
+	var pending []*partitionBatches
+	for topic, partitions := range batches {
+		for p, msgs := range partitions {
+			rb, err := t.recordBatches(topic, p, msgs)
+			if err != nil {
+				return err
+			}
+			pending = append(pending, &partitionBatches{topic, p, rb})
+		}
+	}
+
+	for len(pending) != 0 {
+		requests := make(map[*sarama.Broker]*sarama.ProduceRequest)
+		var next []*partitionBatches
+		for _, pb := range pending {
+			leader, err := t.client.Leader(pb.topic, pb.partition)
+			if err != nil {
+				return err
+			}
+			r := requests[leader]
+			if r == nil {
+				r = &sarama.ProduceRequest{TransactionalID: &t.id, RequiredAcks: sarama.WaitForAll, Timeout: int32(t.conf.Producer.Timeout / time.Millisecond), Version: 3}
+				requests[leader] = r
+			}
+			r.AddBatch(pb.topic, pb.partition, pb.batches[0])
+			if pb.batches = pb.batches[1:]; len(pb.batches) != 0 {
+				next = append(next, pb)
+			}
+		}
+
+		for b, r := range requests {
+			resp, err := b.Produce(r)
+			if err != nil {
+				return err
+			}
+			if err = produceError(resp); err != nil {
+				return err
+			}
+		}
+
+		pending = next
+	}
+
+	return nil
+}
+
+func produceError(resp *sarama.ProduceResponse) error {
+	for topic, partitions := range resp.Blocks {
+		for p, b := range partitions {
+			if err := kafkaError(b.Err); err != nil {
+				return fmt.Errorf("Failed to produce to topic %v partition %v: %v", topic, p, err)
+			}
+		}
+	}
+	if len(resp.Blocks) == 0 {
+		return fmt.Errorf("Empty produce response")
+	}
+	return nil
+}
+
+//commitOffsets adds consumer group offsets to the transaction
+func (t *kafkaTxnProducer) commitOffsets(group string, offsets []Offset) error {
+	err := t.retry(func() error {
+		resp, err := t.coord.AddOffsetsToTxn(&sarama.AddOffsetsToTxnRequest{TransactionalID: t.id, ProducerID: t.pid, ProducerEpoch: t.epoch, GroupID: group})
+		if err != nil {
+			return err
+		}
+		return kafkaError(resp.Err)
+	})
+	if err != nil {
+		return err
+	}
+
+	req := &sarama.TxnOffsetCommitRequest{TransactionalID: t.id, GroupID: group, ProducerID: t.pid, ProducerEpoch: t.epoch, Topics: make(map[string][]*sarama.PartitionOffsetMetadata)}
+	for i := range offsets {
+		o := &offsets[i]
+		req.Topics[o.Topic] = append(req.Topics[o.Topic], &sarama.PartitionOffsetMetadata{Partition: o.Partition, Offset: o.Offset, Metadata: &o.Metadata})
+	}
+
+	for i := 0; ; i++ {
+		err = t.txnOffsetCommit(group, req)
+		if i >= txnRetries || (err != sarama.ErrNotCoordinatorForConsumer && err != sarama.ErrConsumerCoordinatorNotAvailable && err != sarama.ErrOffsetsLoadInProgress) {
+			return err
+		}
+		log.E(t.client.RefreshCoordinator(group))
+		time.Sleep(txnRetryBackoff)
+	}
+}
+
+//txnOffsetCommit sends offsets to the group coordinator
+func (t *kafkaTxnProducer) txnOffsetCommit(group string, req *sarama.TxnOffsetCommitRequest) error {
+	b, err := t.client.Coordinator(group)
+	if err != nil {
+		return err
+	}
+	resp, err := b.TxnOffsetCommit(req)
+	if err != nil {
+		return err
+	}
+	for _, partitions := range resp.Topics {
+		for _, p := range partitions {
+			if err = kafkaError(p.Err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//endTxn commits or aborts the transaction
+func (t *kafkaTxnProducer) endTxn(commit bool) error {
+	return t.retry(func() error {
+		resp, err := t.coord.EndTxn(&sarama.EndTxnRequest{TransactionalID: t.id, ProducerID: t.pid, ProducerEpoch: t.epoch, TransactionResult: commit})
+		if err != nil {
+			return err
+		}
+		return kafkaError(resp.Err)
+	})
+}
+
+//Close closes the producer discarding not committed messages
+func (t *kafkaTxnProducer) Close() error {
+	t.closeCoordinator()
+	return t.client.Close()
+}
+
+//PushBatch queues the message to the transaction
+func (p *kafkaTxnTopicProducer) PushBatch(key string, in interface{}) error {
+	return p.pushBatchOptions(key, in, nil)
+}
+
+func (p *kafkaTxnTopicProducer) pushBatchOptions(key string, in interface{}, opts *MessageOptions) error {
+	var bytes []byte
+	switch b := in.(type) {
+	case nil:
+	case []byte:
+		bytes = b
+	default:
+		return fmt.Errorf("Kafka pipe can handle binary arrays only")
+	}
+
+	var metadata interface{}
+	var headers []sarama.RecordHeader
+	if opts != nil {
+		headers = recordHeaders(opts.Headers)
+		if opts.PartitionKey != "" {
+			metadata = &messageMetadata{partKey: opts.PartitionKey}
+		}
+	}
+
+	parts := []messagePart{{bytes, headers}}
+	//Single record batch has to fit maximum message size
+	if recordSize(key, bytes, headers)+recordBatchOverhead > p.txn.maxMessageBytes {
+		var err error
+		if parts, err = p.txn.oversized.split(p.topic, key, bytes, headers, p.txn.maxMessageBytes-recordBatchOverhead); err != nil {
+			return err
+		}
+	}
+
+	for _, v := range parts {
+		m := &sarama.ProducerMessage{Topic: p.topic, Key: sarama.StringEncoder(key), Headers: v.headers, Metadata: metadata}
+		if v.value != nil {
+			m.Value = sarama.ByteEncoder(v.value)
+		}
+		p.txn.msgs = append(p.txn.msgs, m)
+		p.txn.size += int64(messageSize(key, v.value, v.headers))
+	}
+
+	return p.txn.checkSize()
+}
+
+//checkSize fails the transaction when queued messages exceed maximum
+//transaction size. Transaction can't be split, since it would commit the
+//part of MySQL transaction or streamer batch
+func (t *kafkaTxnProducer) checkSize() error {
+	if t.maxSize == 0 || t.size <= t.maxSize {
+		return nil
+	}
+
+	t.err = fmt.Errorf("Transaction of %v messages exceeds kafka_txn_max_bytes %v. Increase kafka_txn_max_bytes to fit the largest MySQL transaction", len(t.msgs), t.maxSize)
+	t.msgs, t.size = nil, 0
+
+	return t.err
+}
+
+//PushBatchCommit commits the transaction without consumer offsets
+func (p *kafkaTxnTopicProducer) PushBatchCommit() error {
+	return p.txn.Commit("", nil)
+}
+
+//Push produces the message in a separate transaction
+func (p *kafkaTxnTopicProducer) Push(in interface{}) error {
+	return p.PushK("", in)
+}
+
+//PushK produces keyed message in a separate transaction
+func (p *kafkaTxnTopicProducer) PushK(key string, in interface{}) error {
+	if err := p.PushBatch(key, in); err != nil {
+		return err
+	}
+	return p.PushBatchCommit()
+}
+
+//PushSchema queues schema message to the transaction
+func (p *kafkaTxnTopicProducer) PushSchema(key string, data []byte) error {
+	return p.PushBatch(key, data)
+}
+
+//Close is no-op, transactional producer is closed by its owner
+func (p *kafkaTxnTopicProducer) Close() error {
+	return nil
+}
+
+func (p *kafkaTxnTopicProducer) SetFormat(format string) {
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pipe
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/raksh93/storagetapper/shutdown"
+	"github.com/raksh93/storagetapper/state"
+	"github.com/raksh93/storagetapper/test"
+	"github.com/raksh93/storagetapper/util"
+)
+
+func TestTxnMaxSize(t *testing.T) {
+	p := &kafkaTxnProducer{maxMessageBytes: 200, maxSize: 20, oversized: &oversizedHandler{}}
+	tp, err := p.NewProducer("topic1")
+	test.CheckFail(err, t)
+
+	test.CheckFail(tp.PushBatch("k", []byte("0123456789")), t)
+	err = tp.PushBatch("k", []byte("0123456789"))
+	test.Assert(t, err != nil && len(p.msgs) == 0, "transaction exceeding maximum size should fail")
+	test.Assert(t, p.Commit("", nil) == err, "failed transaction can't be committed")
+}
+
+func TestTxnRecordBatches(t *testing.T) {
+	p := &kafkaTxnProducer{pid: 5, epoch: 2, seq: make(map[string]map[int32]int32)}
+	//Every message is 4 bytes, so only 2 of them fit with framing overhead,
+	//tombstone is 1 byte and fits into the second batch
+	p.maxMessageBytes = recordBatchOverhead + 3*recordOverhead + 9
+
+	var msgs []*sarama.ProducerMessage
+	for _, v := range []string{"aaa", "bbb", "ccc", "ddd", ""} {
+		m := &sarama.ProducerMessage{Key: sarama.StringEncoder("k")}
+		if v != "" {
+			m.Value = sarama.ByteEncoder(v)
+		}
+		msgs = append(msgs, m)
+	}
+
+	b, err := p.recordBatches("topic1", 3, msgs)
+	test.CheckFail(err, t)
+
+	test.Assert(t, len(b) == 2, "expected 2 batches, got %v", len(b))
+	for i, rb := range b {
+		test.Assert(t, rb.IsTransactional && rb.ProducerID == 5 && rb.ProducerEpoch == 2, "transactional batch expected: %+v", rb)
+		test.Assert(t, rb.FirstSequence == int32(i*2), "batch %v: unexpected first sequence %v", i, rb.FirstSequence)
+		test.Assert(t, rb.LastOffsetDelta == int32(len(rb.Records)-1), "batch %v: unexpected last offset delta %v", i, rb.LastOffsetDelta)
+	}
+	test.Assert(t, len(b[1].Records) == 3 && b[1].Records[2].Value == nil, "tombstone should have nil value")
+
+	b, err = p.recordBatches("topic1", 3, msgs[:1])
+	test.CheckFail(err, t)
+	test.Assert(t, b[0].FirstSequence == 5, "sequence should continue, got %v", b[0].FirstSequence)
+
+	b, err = p.recordBatches("topic1", 4, msgs[:1])
+	test.CheckFail(err, t)
+	test.Assert(t, b[0].FirstSequence == 0, "sequence is per partition, got %v", b[0].FirstSequence)
+}
+
+func TestKafkaTxn(t *testing.T) {
+	test.SkipIfNoKafkaAvailable(t)
+	test.SkipIfNoMySQLAvailable(t)
+
+	shutdown.Setup()
+	defer func() {
+		shutdown.Initiate()
+		shutdown.Wait()
+	}()
+
+	if !state.Init(cfg) {
+		t.Fatalf("Failed to init State")
+	}
+
+	//Don't check returned error because table might not exist
+	_ = util.ExecSQL(state.GetDB(), "DROP TABLE IF EXISTS kafka_offsets")
+
+	cfg.KafkaExactlyOnce = true
+	defer func() { cfg.KafkaExactlyOnce = false }()
+
+	p := createPipe(1)
+
+	consumer, err := p.NewConsumer("topic_txn")
+	test.CheckFail(err, t)
+
+	txn, err := NewTxnProducer(p, "test_txn")
+	test.CheckFail(err, t)
+	producer, err := txn.NewProducer("topic_txn")
+	test.CheckFail(err, t)
+
+	test.CheckFail(producer.PushBatch("key1", []byte("committed1")), t)
+	test.CheckFail(producer.PushBatch("key2", []byte("committed2")), t)
+	offsets := []Offset{{Topic: "topic_txn", Partition: 0, Offset: 7, Metadata: "position1"}}
+	test.CheckFail(txn.Commit("test_txn_group", offsets), t)
+
+	test.Assert(t, consumeMessage(consumer, t) == "committed1", "first committed message expected")
+	test.Assert(t, consumeMessage(consumer, t) == "committed2", "second committed message expected")
+
+	committed, err := CommittedOffsets(p, "test_txn_group")
+	test.CheckFail(err, t)
+	test.Assert(t, len(committed) == 1 && committed[0] == offsets[0], "expected offsets %+v, got %+v", offsets, committed)
+
+	//New producer with the same transaction ID fences the previous one
+	txn2, err := NewTxnProducer(p, "test_txn")
+	test.CheckFail(err, t)
+
+	test.CheckFail(producer.PushBatch("key3", []byte("fenced")), t)
+	test.Assert(t, txn.Commit("", nil) != nil, "fenced producer should fail to commit")
+	test.Assert(t, producer.PushBatchCommit() != nil, "producer should fail after transaction failure")
+
+	producer2, err := txn2.NewProducer("topic_txn")
+	test.CheckFail(err, t)
+	test.CheckFail(producer2.PushBatch("key4", []byte("committed3")), t)
+	test.CheckFail(producer2.PushBatchCommit(), t)
+
+	test.Assert(t, consumeMessage(consumer, t) == "committed3", "messages of the fenced producer shouldn't be consumed")
+
+	test.CheckFail(consumer.Close(), t)
+	test.CheckFail(txn.Close(), t)
+	test.CheckFail(txn2.Close(), t)
+}
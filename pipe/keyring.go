@@ -0,0 +1,135 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package pipe
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/raksh93/storagetapper/config"
+)
+
+//fileKey holds the keys file is encrypted and authenticated with
+type fileKey struct {
+	AESKey  string
+	HMACKey string
+}
+
+//keyring holds named keys. ID of the key file is written with is stored in
+//the file header, so as consumer selects the key to read the file with
+type keyring struct {
+	keys     map[string]fileKey
+	active   string
+	envelope bool
+}
+
+func newKeyring(cfg *config.AppConfig) *keyring {
+	if len(cfg.PipeKeyring.Keys) == 0 {
+		return nil
+	}
+
+	k := &keyring{keys: make(map[string]fileKey), active: cfg.PipeKeyring.Active, envelope: cfg.PipeKeyring.Envelope}
+	for id, v := range cfg.PipeKeyring.Keys {
+		k.keys[id] = fileKey{v.AES256Key, v.HMACKey}
+	}
+
+	return k
+}
+
+//writeKey returns ID and keys new files are written with. Empty ID means
+//pipe_aes256_key and pipe_hmac_key
+func (p *filePipe) writeKey() (string, fileKey) {
+	if p.keyring != nil && p.keyring.active != "" {
+		return p.keyring.active, p.keyring.keys[p.keyring.active]
+	}
+	return "", fileKey{p.AESKey, p.HMACKey}
+}
+
+//readKey returns the keys of the file written with the given key ID
+func (p *filePipe) readKey(id string) (fileKey, error) {
+	if id == "" {
+		return fileKey{p.AESKey, p.HMACKey}, nil
+	}
+
+	if p.keyring != nil {
+		if k, ok := p.keyring.keys[id]; ok {
+			return k, nil
+		}
+	}
+
+	return fileKey{}, fmt.Errorf("encryption key '%v' is not in the keyring", id)
+}
+
+//newDataKey generates random file data key. Returns the key and the key
+//encrypted by the master key, hex encoded
+func newDataKey(masterKey string) (string, string, error) {
+	key := make([]byte, aes.BlockSize*2)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", "", err
+	}
+
+	gcm, err := newKeyWrapper(masterKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", "", err
+	}
+
+	return string(key), hex.EncodeToString(gcm.Seal(nonce, nonce, key, nil)), nil
+}
+
+//unwrapDataKey decrypts data key encrypted by newDataKey
+func unwrapDataKey(masterKey string, wrapped string) (string, error) {
+	b, err := hex.DecodeString(wrapped)
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := newKeyWrapper(masterKey)
+	if err != nil {
+		return "", err
+	}
+
+	if len(b) < gcm.NonceSize() {
+		return "", fmt.Errorf("data key is too short")
+	}
+
+	key, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt data key: %v", err)
+	}
+
+	return string(key), nil
+}
+
+func newKeyWrapper(masterKey string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher([]byte(masterKey))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package pipe
+
+import (
+	"bufio"
+	"os"
+	"testing"
+
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/test"
+)
+
+var testKeys = map[string]fileKey{
+	"k1": {"12345678901234567890123456789012", "hmac1"},
+	"k2": {"abcdefghijklmnopqrstuvwxyz123456", "hmac2"},
+}
+
+func newKeyringProducer(t *testing.T, fp *filePipe, topic string) Producer {
+	p, err := fp.NewProducer(topic)
+	test.CheckFail(err, t)
+	p.SetFormat("json")
+	return p
+}
+
+//produceKeyringFile writes single message file and returns the file name
+//relative to the data directory along with the header
+func produceKeyringFile(t *testing.T, p Producer, msg string) (string, Header) {
+	n, err := p.(*fileProducer).pushFile("log", []byte(msg))
+	test.CheckFail(err, t)
+
+	f, err := os.Open(baseDir + "/" + n)
+	test.CheckFail(err, t)
+	defer func() { test.CheckFail(f.Close(), t) }()
+
+	h, err := readHeader(bufio.NewReader(f))
+	test.CheckFail(err, t)
+
+	return n, h
+}
+
+func TestFileKeyring(t *testing.T) {
+	deleteTestTopics(t)
+
+	legacy := &filePipe{datadir: baseDir, maxFileSize: 1024, AESKey: testKeys["k2"].AESKey, HMACKey: testKeys["k2"].HMACKey, delimited: true}
+	n0, h := produceKeyringFile(t, newKeyringProducer(t, legacy, "legacy-test-topic"), "message0")
+	test.Assert(t, h.KeyID == "" && h.DataKey == "", "legacy key has no id: %+v", h)
+
+	kr := &keyring{keys: testKeys, active: "k1"}
+	fp := &filePipe{datadir: baseDir, maxFileSize: 1024, keyring: kr, delimited: true}
+	p := newKeyringProducer(t, fp, "keyring-test-topic")
+	n1, h := produceKeyringFile(t, p, "message1")
+	test.Assert(t, h.KeyID == "k1" && h.DataKey == "" && len(h.Filters) == 1 && h.Filters[0] == aesFilter, "unexpected header: %+v", h)
+
+	//Rotate active key
+	kr.active = "k2"
+	n2, h := produceKeyringFile(t, p, "message2")
+	test.Assert(t, h.KeyID == "k2", "unexpected key id: %v", h.KeyID)
+
+	//Files written with any key of the keyring and legacy key are readable
+	cp := &filePipe{datadir: baseDir, maxFileSize: 1024, AESKey: testKeys["k2"].AESKey, HMACKey: testKeys["k2"].HMACKey, verifyHMAC: true, keyring: kr, delimited: true}
+	for i, n := range []string{n0, n1, n2} {
+		m, err := cp.readFile(n)
+		test.CheckFail(err, t)
+		test.Assert(t, string(m) == "message"+string(rune('0'+i)), "unexpected message: %v", string(m))
+	}
+
+	//Key removed from the keyring
+	cp.keyring = &keyring{keys: map[string]fileKey{"k2": testKeys["k2"]}, active: "k2"}
+	_, err := cp.readFile(n1)
+	test.Assert(t, err != nil, "file of unknown key shouldn't be readable")
+
+	//Wrong HMAC key
+	cp.keyring = &keyring{keys: map[string]fileKey{"k1": {testKeys["k1"].AESKey, "hmac2"}}}
+	_, err = cp.readFile(n1)
+	test.Assert(t, err != nil, "file authentication should fail")
+
+	//Encrypted file can't be read without key
+	_, err = (&filePipe{datadir: baseDir, maxFileSize: 1024, delimited: true}).readFile(n0)
+	test.Assert(t, err != nil, "encrypted file shouldn't be readable without key")
+}
+
+func TestFileKeyringEnvelope(t *testing.T) {
+	deleteTestTopics(t)
+
+	kr := &keyring{keys: testKeys, active: "k1", envelope: true}
+	fp := &filePipe{datadir: baseDir, maxFileSize: 1024, keyring: kr, verifyHMAC: true, delimited: true}
+
+	p := newKeyringProducer(t, fp, "envelope-test-topic")
+	n1, h1 := produceKeyringFile(t, p, "message1")
+	n2, h2 := produceKeyringFile(t, p, "message2")
+	test.Assert(t, h1.KeyID == "k1" && h1.DataKey != "" && h1.DataKey != h2.DataKey, "every file should have its own data key: %+v, %+v", h1, h2)
+
+	//Data key is not the master key
+	k, err := unwrapDataKey(testKeys["k1"].AESKey, h1.DataKey)
+	test.CheckFail(err, t)
+	test.Assert(t, len(k) == 32 && k != testKeys["k1"].AESKey, "unexpected data key")
+
+	for i, n := range []string{n1, n2} {
+		m, err := fp.readFile(n)
+		test.CheckFail(err, t)
+		test.Assert(t, string(m) == "message"+string(rune('1'+i)), "unexpected message: %v", string(m))
+	}
+
+	//Data key can't be decrypted by another master key
+	cp := &filePipe{datadir: baseDir, maxFileSize: 1024, keyring: &keyring{keys: map[string]fileKey{"k1": testKeys["k2"]}}, delimited: true}
+	_, err = cp.readFile(n1)
+	test.Assert(t, err != nil, "data key shouldn't be decrypted by wrong master key")
+
+	//Consumer
+	cp = &filePipe{datadir: baseDir, maxFileSize: 1024, keyring: kr, verifyHMAC: true, delimited: true}
+	cp.setInitialOffset(OffsetOldest)
+	c, err := cp.NewConsumer("envelope-test-topic")
+	test.CheckFail(err, t)
+	consumeAndCheck(t, c, "message1")
+	consumeAndCheck(t, c, "message2")
+	test.CheckFail(c.Close(), t)
+}
+
+func TestNewKeyring(t *testing.T) {
+	test.Assert(t, newKeyring(&config.AppConfig{}) == nil, "keyring shouldn't be created if no keys configured")
+
+	cfg := &config.AppConfig{}
+	cfg.PipeKeyring = config.PipeKeyringConfig{Active: "k1", Envelope: true, Keys: map[string]config.PipeKeyConfig{"k1": {AES256Key: "aes", HMACKey: "hmac"}}}
+	kr := newKeyring(cfg)
+	test.Assert(t, kr.active == "k1" && kr.envelope && kr.keys["k1"] == fileKey{"aes", "hmac"}, "unexpected keyring: %+v", kr)
+}
@@ -26,15 +26,24 @@ import (
 	"sync"
 
 	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/log"
 	"golang.org/x/net/context" //"context"
 )
 
 //LocalPipe pipe based on channels
 type LocalPipe struct {
 	mutex     sync.Mutex
-	c         map[string](chan interface{})
+	c         map[string]*localQueue
 	ctx       context.Context
 	batchSize int
+	spill     config.LocalPipeSpillConfig
+}
+
+//localQueue is the channel of the key along with its disk overflow, if
+//spilling is enabled
+type localQueue struct {
+	ch    chan interface{}
+	spill *localSpill
 }
 
 //localProducerConsumer implements both producer and consumer
@@ -43,6 +52,7 @@ type localProducerConsumer struct {
 	ctx     context.Context
 	msg     interface{}
 	closeCh chan bool
+	spill   *localSpill
 }
 
 func init() {
@@ -50,7 +60,7 @@ func init() {
 }
 
 func initLocalPipe(pctx context.Context, batchSize int, cfg *config.AppConfig, db *sql.DB) (Pipe, error) {
-	return &LocalPipe{c: make(map[string](chan interface{})), ctx: pctx, batchSize: batchSize}, nil
+	return &LocalPipe{c: make(map[string]*localQueue), ctx: pctx, batchSize: batchSize, spill: cfg.LocalPipeSpill}, nil
 }
 
 //Type returns type of the type
@@ -60,13 +70,28 @@ func (p *LocalPipe) Type() string {
 
 func (p *LocalPipe) registerProducerConsumer(ctx context.Context, key string) (*localProducerConsumer, error) {
 	p.mutex.Lock()
-	ch := p.c[key]
-	if ch == nil {
-		ch = make(chan interface{}, p.batchSize)
-		p.c[key] = ch
+	defer p.mutex.Unlock()
+
+	q := p.c[key]
+	if q == nil {
+		size := p.batchSize
+		if p.spill.MaxMemoryMessages != 0 {
+			size = p.spill.MaxMemoryMessages
+		}
+		q = &localQueue{ch: make(chan interface{}, size)}
+
+		if p.spill.Dir != "" {
+			var err error
+			q.spill, err = newLocalSpill(p.ctx, p.spill.Dir, key, p.spill.MaxDiskBytes, q.ch)
+			if log.E(err) {
+				return nil, err
+			}
+		}
+
+		p.c[key] = q
 	}
-	p.mutex.Unlock()
-	return &localProducerConsumer{ch, ctx, nil, make(chan bool)}, nil
+
+	return &localProducerConsumer{q.ch, ctx, nil, make(chan bool), q.spill}, nil
 }
 
 //NewConsumer registers consumer with the given pipe name
@@ -80,6 +105,10 @@ func (p *LocalPipe) NewProducer(key string) (Producer, error) {
 }
 
 func (p *localProducerConsumer) pushLow(b interface{}) error {
+	if p.spill != nil {
+		return p.spill.push(p.ctx, p.closeCh, p.ch, b)
+	}
+
 	select {
 	case p.ch <- b:
 		return nil
@@ -157,3 +186,8 @@ func (p *localProducerConsumer) SaveOffset() error {
 //SetFormat specifies format, which pipe can pass down the stack
 func (p *localProducerConsumer) SetFormat(format string) {
 }
+
+//Headers are not supported by local pipe
+func (p *localProducerConsumer) Headers() map[string]string {
+	return nil
+}
@@ -0,0 +1,316 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package pipe
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/raksh93/storagetapper/log"
+	"github.com/raksh93/storagetapper/metrics"
+	"github.com/raksh93/storagetapper/types"
+	"golang.org/x/net/context" //"context"
+)
+
+//localSpillFileSize is the size of the spill files. Files are deleted once
+//all their messages are moved to memory
+var localSpillFileSize int64 = 16 * 1024 * 1024
+
+//Kinds of the spilled messages
+const (
+	spillNil = iota
+	spillBytes
+	spillRow
+)
+
+//localSpillMessage is the gob encoded spilled message
+type localSpillMessage struct {
+	Kind byte
+	Row  *types.RowMessage
+	Data []byte
+}
+
+//localSpill is the on-disk overflow queue of the local pipe key. Messages,
+//which don't fit in the channel, are written to the files in the file pipe
+//format and moved back to the channel, in order, as consumer frees up space
+type localSpill struct {
+	mutex    sync.Mutex
+	dir      string
+	producer *fileProducer
+	consumer *fileConsumer
+	maxBytes int64
+
+	open   int64 //number of messages in the file being written
+	closed int64 //number of messages in the closed files, not yet moved
+	bytes  int64 //size of the spilled messages, not yet moved
+	err    error //error of the mover, fails subsequent pushes
+
+	spilled chan bool //wakes up mover when messages are spilled
+	moved   chan bool //wakes up producer waiting for disk space
+
+	metrics *metrics.LocalPipe
+}
+
+func init() {
+	//MySQL driver returns time.Time for temporal columns if configured so
+	gob.Register(time.Time{})
+}
+
+//newLocalSpill creates spill queue of the key and starts the mover, which
+//moves spilled messages to the channel. Leftovers of the previous run are
+//removed, because local pipe doesn't persist messages across restarts
+func newLocalSpill(ctx context.Context, dir string, key string, maxBytes int64, ch chan interface{}) (*localSpill, error) {
+	fp := &filePipe{datadir: dir, maxFileSize: localSpillFileSize, delimited: true}
+	fp.setInitialOffset(OffsetOldest)
+
+	if err := os.RemoveAll(topicPath(dir, key)); err != nil {
+		return nil, err
+	}
+
+	p, err := fp.NewProducer(key)
+	if err != nil {
+		return nil, err
+	}
+	p.SetFormat("gob")
+
+	c, err := fp.NewConsumer(key)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &localSpill{
+		dir:      topicPath(dir, key),
+		producer: p.(*fileProducer),
+		consumer: c.(*fileConsumer),
+		maxBytes: maxBytes,
+		spilled:  make(chan bool, 1),
+		moved:    make(chan bool, 1),
+		metrics:  metrics.GetLocalPipeMetrics(map[string]string{"key": key}),
+	}
+
+	go s.move(ctx, ch)
+
+	return s, nil
+}
+
+func encodeSpillMessage(msg interface{}) ([]byte, error) {
+	var m localSpillMessage
+	switch v := msg.(type) {
+	case nil:
+		m.Kind = spillNil
+	case []byte:
+		m.Kind, m.Data = spillBytes, v
+	case *types.RowMessage:
+		m.Kind, m.Row = spillRow, v
+	default:
+		return nil, fmt.Errorf("local pipe can't spill message of type %T", msg)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&m); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decodeSpillMessage(b []byte) (interface{}, error) {
+	var m localSpillMessage
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&m); err != nil {
+		return nil, err
+	}
+
+	switch m.Kind {
+	case spillNil:
+		return nil, nil
+	case spillBytes:
+		//gob doesn't distinguish empty and nil slices, while nil message
+		//means end of stream
+		if m.Data == nil {
+			m.Data = []byte{}
+		}
+		return m.Data, nil
+	case spillRow:
+		return m.Row, nil
+	}
+
+	return nil, fmt.Errorf("unknown spilled message kind: %v", m.Kind)
+}
+
+func notify(ch chan bool) {
+	select {
+	case ch <- true:
+	default:
+	}
+}
+
+//push sends the message to the channel if nothing is spilled and there is
+//space in the channel, otherwise writes it to the spill file. Blocks while
+//spill reached maximum size
+func (s *localSpill) push(ctx context.Context, closeCh chan bool, ch chan interface{}, msg interface{}) error {
+	for {
+		s.mutex.Lock()
+
+		if s.err != nil {
+			s.mutex.Unlock()
+			return s.err
+		}
+
+		if s.open+s.closed == 0 {
+			select {
+			case ch <- msg:
+				s.mutex.Unlock()
+				return nil
+			default:
+			}
+		}
+
+		if s.maxBytes == 0 || s.bytes < s.maxBytes {
+			err := s.write(msg)
+			s.mutex.Unlock()
+			notify(s.spilled)
+			return err
+		}
+
+		s.mutex.Unlock()
+
+		s.metrics.SpillFull.Inc(1)
+
+		select {
+		case <-s.moved:
+		case <-ctx.Done():
+			return fmt.Errorf("Context canceled")
+		case <-closeCh:
+			return fmt.Errorf("Context canceled")
+		}
+	}
+}
+
+func (s *localSpill) write(msg interface{}) error {
+	b, err := encodeSpillMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	if err = s.producer.PushBatch("spill", b); err != nil {
+		return err
+	}
+
+	s.open++
+	s.bytes += int64(len(b))
+
+	s.metrics.SpillMessages.Inc(1)
+	s.metrics.SpillBytes.Inc(int64(len(b)))
+	s.metrics.MessagesSpilled.Inc(1)
+
+	return nil
+}
+
+//waitClosed makes the messages of the file being written available to the
+//consumer, if all the closed files have been moved already. Waits for the
+//messages to be spilled if there is none. Returns false if context canceled
+func (s *localSpill) waitClosed(ctx context.Context) bool {
+	for {
+		s.mutex.Lock()
+		if s.closed == 0 && s.open != 0 {
+			if err := s.producer.Close(); log.E(err) {
+				s.err = err
+			}
+			s.producer.files = make(map[string]*file)
+			s.closed, s.open = s.open, 0
+		}
+		n := s.closed
+		s.mutex.Unlock()
+
+		if n != 0 {
+			return true
+		}
+
+		select {
+		case <-s.spilled:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+//move moves spilled messages to the channel in order and removes the files
+//moved completely
+func (s *localSpill) move(ctx context.Context, ch chan interface{}) {
+	defer s.close()
+
+	var prev string
+	for s.waitClosed(ctx) {
+		if !s.consumer.FetchNext() {
+			return
+		}
+
+		b, err := s.consumer.Pop()
+		var msg interface{}
+		if err == nil {
+			msg, err = decodeSpillMessage(b.([]byte))
+		}
+
+		if prev != "" && prev != s.consumer.name {
+			log.E(os.Remove(prev))
+		}
+		prev = s.consumer.name
+
+		if log.E(err) {
+			s.mutex.Lock()
+			s.err = err
+			s.mutex.Unlock()
+			return
+		}
+
+		select {
+		case ch <- msg:
+		case <-ctx.Done():
+			return
+		}
+
+		s.mutex.Lock()
+		s.closed--
+		s.bytes -= int64(len(b.([]byte)))
+		s.mutex.Unlock()
+
+		s.metrics.SpillMessages.Dec(1)
+		s.metrics.SpillBytes.Dec(int64(len(b.([]byte))))
+
+		notify(s.moved)
+	}
+}
+
+func (s *localSpill) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	log.E(s.consumer.CloseOnFailure())
+	log.E(s.producer.Close())
+	log.E(os.RemoveAll(s.dir))
+
+	if s.err == nil {
+		s.err = fmt.Errorf("local pipe spill closed")
+	}
+}
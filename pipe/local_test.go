@@ -22,14 +22,18 @@ package pipe
 
 import (
 	"bytes"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/raksh93/storagetapper/config"
 	"github.com/raksh93/storagetapper/log"
 	"github.com/raksh93/storagetapper/shutdown"
 	"github.com/raksh93/storagetapper/test"
+	"github.com/raksh93/storagetapper/types"
+	"golang.org/x/net/context" //"context"
 )
 
 var cfg *config.AppConfig
@@ -104,6 +108,129 @@ func TestLocalType(t *testing.T) {
 	test.Assert(t, p.Type() == pt, "type should be "+pt)
 }
 
+func TestLocalSpill(t *testing.T) {
+	deleteTestTopics(t)
+
+	saveSize := localSpillFileSize
+	localSpillFileSize = 256
+	defer func() { localSpillFileSize = saveSize }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lcfg := *cfg
+	lcfg.LocalPipeSpill = config.LocalPipeSpillConfig{Dir: baseDir + "/spill", MaxMemoryMessages: 4}
+	p, err := initLocalPipe(ctx, 16, &lcfg, nil)
+	test.CheckFail(err, t)
+
+	pr, err := p.NewProducer("spill-key")
+	test.CheckFail(err, t)
+
+	//Producer doesn't block without consumer
+	for i := 0; i < 100; i++ {
+		var msg interface{} = []byte("message" + strconv.Itoa(i))
+		if i%2 == 0 {
+			msg = &types.RowMessage{Type: types.Insert, Key: strconv.Itoa(i), Data: &[]interface{}{int64(i), nil, "str", time.Unix(int64(i), 0).UTC()}, SeqNo: uint64(i)}
+		}
+		test.CheckFail(pr.PushBatch("", msg), t)
+	}
+	test.CheckFail(pr.Push([]byte{}), t)
+	test.CheckFail(pr.Push(nil), t)
+
+	files, err := ioutil.ReadDir(baseDir + "/spill/spill-key")
+	test.CheckFail(err, t)
+	test.Assert(t, len(files) > 1, "messages should be spilled to multiple files, got %v", len(files))
+
+	c, err := p.NewConsumer("spill-key")
+	test.CheckFail(err, t)
+
+	for i := 0; i < 100; i++ {
+		test.Assert(t, c.FetchNext(), "message expected")
+		m, err := c.Pop()
+		test.CheckFail(err, t)
+		if i%2 == 0 {
+			r := m.(*types.RowMessage)
+			d := *r.Data
+			test.Assert(t, r.SeqNo == uint64(i) && r.Key == strconv.Itoa(i) && d[0] == int64(i) && d[1] == nil && d[2] == "str" && d[3] == time.Unix(int64(i), 0).UTC(), "unexpected row message: %+v", d)
+		} else {
+			test.Assert(t, string(m.([]byte)) == "message"+strconv.Itoa(i), "unexpected message: %v", string(m.([]byte)))
+		}
+	}
+
+	test.Assert(t, c.FetchNext(), "empty message expected")
+	m, err := c.Pop()
+	test.CheckFail(err, t)
+	test.Assert(t, m != nil && len(m.([]byte)) == 0, "empty message expected: %v", m)
+
+	test.Assert(t, !c.FetchNext(), "end of stream expected")
+
+	//Moved files are removed
+	files, err = ioutil.ReadDir(baseDir + "/spill/spill-key")
+	test.CheckFail(err, t)
+	test.Assert(t, len(files) <= 1, "moved files should be removed, got %v", len(files))
+
+	//Messages go to the channel directly when nothing is spilled
+	test.CheckFail(pr.Push([]byte("direct")), t)
+	test.Assert(t, c.FetchNext(), "message expected")
+	m, err = c.Pop()
+	test.CheckFail(err, t)
+	test.Assert(t, string(m.([]byte)) == "direct", "unexpected message: %v", m)
+
+	cancel()
+	for i := 0; i < 100; i++ {
+		if _, err = os.Stat(baseDir + "/spill/spill-key"); os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Assert(t, os.IsNotExist(err), "spill directory should be removed on shutdown")
+}
+
+func TestLocalSpillDiskLimit(t *testing.T) {
+	deleteTestTopics(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lcfg := *cfg
+	lcfg.LocalPipeSpill = config.LocalPipeSpillConfig{Dir: baseDir + "/spill", MaxMemoryMessages: 1, MaxDiskBytes: 1}
+	p, err := initLocalPipe(ctx, 16, &lcfg, nil)
+	test.CheckFail(err, t)
+
+	pr, err := p.NewProducer("spill-key")
+	test.CheckFail(err, t)
+	c, err := p.NewConsumer("spill-key")
+	test.CheckFail(err, t)
+
+	//One message in memory, one on disk
+	test.CheckFail(pr.Push([]byte("message0")), t)
+	test.CheckFail(pr.Push([]byte("message1")), t)
+
+	done := make(chan error)
+	go func() {
+		done <- pr.Push([]byte("message2"))
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("producer should block when disk limit is reached")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	for i := 0; i < 3; i++ {
+		test.Assert(t, c.FetchNext(), "message expected")
+		m, err := c.Pop()
+		test.CheckFail(err, t)
+		test.Assert(t, string(m.([]byte)) == "message"+strconv.Itoa(i), "unexpected message: %v", string(m.([]byte)))
+		if i == 0 {
+			test.CheckFail(<-done, t)
+		}
+	}
+
+	test.CheckFail(pr.Close(), t)
+	test.CheckFail(c.Close(), t)
+}
+
 func TestMain(m *testing.M) {
 	cfg = test.LoadConfig()
 
@@ -0,0 +1,94 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pipe
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/raksh93/storagetapper/encoder"
+	"github.com/raksh93/storagetapper/types"
+)
+
+//Names of the event metadata headers
+const (
+	HeaderFormat        = "format"
+	HeaderSchemaName    = "schema_name"
+	HeaderSchemaVersion = "schema_version"
+	HeaderService       = "service"
+	HeaderCluster       = "cluster"
+	HeaderDb            = "db"
+	HeaderTable         = "table"
+	HeaderSeqNo         = "seqno"
+	HeaderGtid          = "gtid"
+)
+
+//MessageOptions holds optional message attributes. Producers ignore the
+//attributes they don't support
+type MessageOptions struct {
+	//PartitionKey determines message partition instead of message key, unless
+	//it's empty
+	PartitionKey string
+	//Headers carry event metadata, which consumers can inspect without
+	//decoding the message
+	Headers map[string]string
+	//EventTime partitions the files of file based pipes by event time. Zero
+	//means unknown, current time is used then
+	EventTime time.Time
+}
+
+//optionsProducer is implemented by the producers which support message
+//options
+type optionsProducer interface {
+	pushBatchOptions(key string, data interface{}, opts *MessageOptions) error
+}
+
+//PushBatchOptions queues the message the same way as PushBatch, applying
+//given options. Falls back to PushBatch if options are nil or producer
+//doesn't support them
+func PushBatchOptions(p Producer, key string, data interface{}, opts *MessageOptions) error {
+	if s, ok := p.(optionsProducer); ok && opts != nil {
+		return s.pushBatchOptions(key, data, opts)
+	}
+	return p.PushBatch(key, data)
+}
+
+//EventHeaders builds metadata headers of the event of the given table,
+//encoded in the given format. Zero seqno and empty gtid are omitted, which is
+//the case for snapshot events
+func EventHeaders(t *types.TableLoc, format string, seqno uint64, gtid string) map[string]string {
+	h := map[string]string{
+		HeaderFormat:        format,
+		HeaderSchemaName:    encoder.GetOutputSchemaName(t.Service, t.Db, t.Table),
+		HeaderSchemaVersion: strconv.Itoa(t.Version),
+		HeaderService:       t.Service,
+		HeaderCluster:       t.Cluster,
+		HeaderDb:            t.Db,
+		HeaderTable:         t.Table,
+	}
+	if seqno != 0 {
+		h[HeaderSeqNo] = strconv.FormatUint(seqno, 10)
+	}
+	if gtid != "" {
+		h[HeaderGtid] = gtid
+	}
+	return h
+}
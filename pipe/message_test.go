@@ -0,0 +1,68 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pipe
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/raksh93/storagetapper/test"
+	"github.com/raksh93/storagetapper/types"
+)
+
+func TestEventHeaders(t *testing.T) {
+	loc := &types.TableLoc{Service: "svc1", Cluster: "clst1", Db: "db1", Table: "t1", Version: 2}
+
+	h := EventHeaders(loc, "json", 0, "")
+	exp := map[string]string{
+		HeaderFormat:        "json",
+		HeaderSchemaName:    "hp-tap-svc1-db1-t1",
+		HeaderSchemaVersion: "2",
+		HeaderService:       "svc1",
+		HeaderCluster:       "clst1",
+		HeaderDb:            "db1",
+		HeaderTable:         "t1",
+	}
+	test.Assert(t, reflect.DeepEqual(h, exp), "expected %v, got %v", exp, h)
+
+	h = EventHeaders(loc, "json", 12, "3e11fa47-71ca-11e1-9e33-c80aa9429562:23")
+	exp[HeaderSeqNo] = "12"
+	exp[HeaderGtid] = "3e11fa47-71ca-11e1-9e33-c80aa9429562:23"
+	test.Assert(t, reflect.DeepEqual(h, exp), "expected %v, got %v", exp, h)
+}
+
+func TestRecordHeaders(t *testing.T) {
+	test.Assert(t, recordHeaders(nil) == nil, "nil headers expected")
+	test.Assert(t, headersMap(nil) == nil, "nil map expected")
+
+	h := map[string]string{"b": "2", "a": "1", "c": ""}
+	r := recordHeaders(h)
+	test.Assert(t, len(r) == 3, "expected 3 headers, got %v", len(r))
+	test.Assert(t, string(r[0].Key) == "a" && string(r[1].Key) == "b" && string(r[2].Key) == "c", "headers should be sorted by name: %v", r)
+
+	p := make([]*sarama.RecordHeader, 0, len(r))
+	for i := range r {
+		p = append(p, &r[i])
+	}
+	m := headersMap(p)
+	test.Assert(t, reflect.DeepEqual(m, h), "expected %v, got %v", h, m)
+}
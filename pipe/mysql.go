@@ -0,0 +1,495 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pipe
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/db"
+	"github.com/raksh93/storagetapper/log"
+	"github.com/raksh93/storagetapper/schema"
+	"github.com/raksh93/storagetapper/types"
+	"golang.org/x/net/context" //"context"
+)
+
+//mysqlSeqnoTable keeps last applied seqno of every target table. It's created
+//in the target database along with the tables
+const mysqlSeqnoTable = "storagetapper_seqno"
+
+//mysqlPipe applies events to the tables of target MySQL database. Topic name
+//is the name of target table, optionally prefixed by database name
+type mysqlPipe struct {
+	addr  *db.Addr
+	err   error //configuration error
+	mutex sync.Mutex
+	conn  *sql.DB
+}
+
+//mysqlProducer applies events to single target table. Inserts are applied as
+//upserts and deletes by primary key, so as events can be safely reapplied.
+//Events with seqno not greater than the last applied are skipped
+type mysqlProducer struct {
+	conn   *sql.DB
+	dbName string
+	table  string
+	format string
+
+	//target table schema, nil if table doesn't exist yet
+	schema *types.TableSchema
+	key    []string
+	seqno  uint64
+	batch  [][]byte
+}
+
+func init() {
+	registerPlugin("mysql", initMySQLPipe)
+}
+
+func initMySQLPipe(pctx context.Context, batchSize int, cfg *config.AppConfig, conn *sql.DB) (Pipe, error) {
+	//Pipes of all the types are created on startup, so configuration errors
+	//are reported when the pipe is used
+	p := &mysqlPipe{}
+	if cfg.MySQLSink.ConnectURL == "" {
+		p.err = fmt.Errorf("mysql_sink.connect_url is not configured")
+	} else {
+		p.addr, p.err = db.ParseConnectURL(cfg.MySQLSink.ConnectURL)
+	}
+	return p, nil
+}
+
+//Type returns pipe type
+func (p *mysqlPipe) Type() string {
+	return "mysql"
+}
+
+//connect lazily opens connection to target database, shared by all the
+//producers of the pipe
+func (p *mysqlPipe) connect() (*sql.DB, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	if p.conn == nil {
+		addr := *p.addr
+		conn, err := db.Open(&addr)
+		if err != nil {
+			return nil, err
+		}
+		p.conn = conn
+	}
+
+	return p.conn, nil
+}
+
+//NewProducer creates producer which applies events to the table named by
+//topic
+func (p *mysqlPipe) NewProducer(topic string) (Producer, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	dbName, table := p.addr.Db, topic
+	if i := strings.Index(topic, "."); i != -1 {
+		dbName, table = topic[:i], topic[i+1:]
+	}
+	if dbName == "" || table == "" {
+		return nil, fmt.Errorf("Target database is not specified for topic: %v", topic)
+	}
+
+	m := &mysqlProducer{conn: conn, dbName: dbName, table: table}
+
+	if err = m.init(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+//NewConsumer is not supported by MySQL pipe
+func (p *mysqlPipe) NewConsumer(topic string) (Consumer, error) {
+	return nil, fmt.Errorf("mysql pipe doesn't support consumers")
+}
+
+func quoteName(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+func (p *mysqlProducer) tableName() string {
+	return quoteName(p.dbName) + "." + quoteName(p.table)
+}
+
+//init creates seqno table and reads last applied seqno and schema of the
+//target table
+func (p *mysqlProducer) init() error {
+	_, err := p.conn.Exec("CREATE TABLE IF NOT EXISTS " + quoteName(p.dbName) + "." + mysqlSeqnoTable + ` (
+		tableName VARCHAR(128) NOT NULL PRIMARY KEY,
+		seqno BIGINT UNSIGNED NOT NULL
+	)`)
+	if log.E(err) {
+		return err
+	}
+
+	err = p.conn.QueryRow("SELECT seqno FROM "+quoteName(p.dbName)+"."+mysqlSeqnoTable+" WHERE tableName=?", p.table).Scan(&p.seqno)
+	if err != nil && err != sql.ErrNoRows {
+		log.E(err)
+		return err
+	}
+
+	return p.loadSchema()
+}
+
+func (p *mysqlProducer) loadSchema() error {
+	s, err := schema.GetColumns(p.conn, p.dbName, p.table, "information_schema.columns", "")
+	if _, ok := err.(*schema.ErrNoTable); ok {
+		p.schema, p.key = nil, nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	p.schema, p.key = s, nil
+	for _, c := range s.Columns {
+		if c.Key == "PRI" {
+			p.key = append(p.key, c.Name)
+		}
+	}
+
+	return nil
+}
+
+func (p *mysqlProducer) column(name string) *types.ColumnSchema {
+	if p.schema == nil {
+		return nil
+	}
+	for i := range p.schema.Columns {
+		if strings.EqualFold(p.schema.Columns[i].Name, name) {
+			return &p.schema.Columns[i]
+		}
+	}
+	return nil
+}
+
+//fixJSONField restores binary values of text and blob columns, which are
+//base64 encoded in JSON
+func (p *mysqlProducer) fixJSONField(v *interface{}, name string) error {
+	s, ok := (*v).(string)
+	c := p.column(name)
+	if !ok || c == nil {
+		return nil
+	}
+	switch c.DataType {
+	case "text", "tinytext", "mediumtext", "longtext", "blob", "tinyblob", "mediumblob", "longblob", "binary", "varbinary":
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return err
+		}
+		*v = b
+	}
+	return nil
+}
+
+func (p *mysqlProducer) decode(b []byte) (*types.CommonFormatEvent, error) {
+	cf := &types.CommonFormatEvent{}
+
+	switch p.format {
+	case "json":
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.UseNumber()
+		if err := d.Decode(cf); err != nil {
+			return nil, err
+		}
+		if cf.Type == "schema" {
+			break
+		}
+		for i := 0; i < len(cf.Key) && i < len(p.key); i++ {
+			if err := p.fixJSONField(&cf.Key[i], p.key[i]); err != nil {
+				return nil, err
+			}
+		}
+		if cf.Fields != nil {
+			for i := range *cf.Fields {
+				f := &(*cf.Fields)[i]
+				if err := p.fixJSONField(&f.Value, f.Name); err != nil {
+					return nil, err
+				}
+			}
+		}
+	case "msgpack":
+		if _, err := cf.UnmarshalMsg(b); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported mysql pipe format: %v", p.format)
+	}
+
+	return cf, nil
+}
+
+//applySchema creates target table or adds and modifies its columns to match
+//the schema event. Columns missing in the event are left intact
+func (p *mysqlProducer) applySchema(cf *types.CommonFormatEvent) error {
+	if cf.Fields == nil {
+		return nil
+	}
+
+	var defs []string
+	for _, f := range *cf.Fields {
+		typ, ok := f.Value.(string)
+		if !ok {
+			return fmt.Errorf("Broken schema event, field: %v, type: %v", f.Name, f.Value)
+		}
+		c := p.column(f.Name)
+		if p.schema == nil {
+			defs = append(defs, quoteName(f.Name)+" "+typ)
+		} else if c == nil {
+			defs = append(defs, "ADD COLUMN "+quoteName(f.Name)+" "+typ)
+		} else if !strings.EqualFold(c.Type, typ) {
+			defs = append(defs, "MODIFY COLUMN "+quoteName(f.Name)+" "+typ)
+		}
+	}
+
+	var query string
+	if p.schema == nil {
+		var key []string
+		for _, k := range cf.Key {
+			key = append(key, quoteName(fmt.Sprintf("%v", k)))
+		}
+		if len(key) == 0 {
+			return fmt.Errorf("Primary key required to create target table %v", p.tableName())
+		}
+		defs = append(defs, "PRIMARY KEY ("+strings.Join(key, ",")+")")
+		query = "CREATE TABLE IF NOT EXISTS " + p.tableName() + " (" + strings.Join(defs, ",") + ")"
+	} else if len(defs) != 0 {
+		query = "ALTER TABLE " + p.tableName() + " " + strings.Join(defs, ",")
+	} else {
+		return nil
+	}
+
+	log.Debugf("Applying schema: %v", query)
+	if _, err := p.conn.Exec(query); err != nil {
+		return err
+	}
+
+	return p.loadSchema()
+}
+
+func (p *mysqlProducer) applyRow(tx *sql.Tx, cf *types.CommonFormatEvent) error {
+	if p.schema == nil {
+		return fmt.Errorf("Target table %v doesn't exist", p.tableName())
+	}
+
+	var query string
+	var args []interface{}
+
+	switch cf.Type {
+	case "insert":
+		if cf.Fields == nil || len(*cf.Fields) == 0 {
+			return fmt.Errorf("Insert event without fields")
+		}
+		var names, values, updates []string
+		for _, f := range *cf.Fields {
+			n := quoteName(f.Name)
+			names = append(names, n)
+			values = append(values, "?")
+			updates = append(updates, n+"=VALUES("+n+")")
+			args = append(args, f.Value)
+		}
+		query = "INSERT INTO " + p.tableName() + " (" + strings.Join(names, ",") + ") VALUES (" + strings.Join(values, ",") + ") ON DUPLICATE KEY UPDATE " + strings.Join(updates, ",")
+	case "delete":
+		if len(cf.Key) != len(p.key) {
+			return fmt.Errorf("Delete event key doesn't match primary key of %v", p.tableName())
+		}
+		var cond []string
+		for i, k := range p.key {
+			cond = append(cond, quoteName(k)+"=?")
+			args = append(args, cf.Key[i])
+		}
+		query = "DELETE FROM " + p.tableName() + " WHERE " + strings.Join(cond, " AND ")
+	default:
+		return fmt.Errorf("Unsupported event type: %v", cf.Type)
+	}
+
+	_, err := tx.Exec(query, args...)
+	return err
+}
+
+//commit saves seqno along with the applied rows
+func (p *mysqlProducer) commit(tx *sql.Tx, seqno uint64) error {
+	if seqno > p.seqno {
+		_, err := tx.Exec("INSERT INTO "+quoteName(p.dbName)+"."+mysqlSeqnoTable+" (tableName, seqno) VALUES (?, ?) ON DUPLICATE KEY UPDATE seqno=VALUES(seqno)", p.table, seqno)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if seqno > p.seqno {
+		p.seqno = seqno
+	}
+
+	return nil
+}
+
+//apply applies the events in a transaction. Schema events commit preceding
+//rows, because DDL statements commit implicitly in MySQL
+func (p *mysqlProducer) apply(batch [][]byte) error {
+	var tx *sql.Tx
+	seqno := p.seqno
+
+	for _, b := range batch {
+		cf, err := p.decode(b)
+		if err != nil {
+			if tx != nil {
+				_ = tx.Rollback()
+			}
+			return err
+		}
+
+		if cf.Type == "schema" {
+			if tx != nil {
+				if err = p.commit(tx, seqno); err != nil {
+					return err
+				}
+				tx = nil
+			}
+			if err = p.applySchema(cf); err != nil {
+				return err
+			}
+			if cf.SeqNo > p.seqno {
+				if tx, err = p.conn.Begin(); err != nil {
+					return err
+				}
+				if err = p.commit(tx, cf.SeqNo); err != nil {
+					return err
+				}
+				tx = nil
+			}
+			seqno = p.seqno
+			continue
+		}
+
+		//Snapshot events have zero seqno
+		if cf.SeqNo != 0 && cf.SeqNo <= seqno {
+			continue
+		}
+
+		if tx == nil {
+			if tx, err = p.conn.Begin(); err != nil {
+				return err
+			}
+		}
+
+		if err = p.applyRow(tx, cf); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		if cf.SeqNo > seqno {
+			seqno = cf.SeqNo
+		}
+	}
+
+	if tx == nil {
+		return nil
+	}
+
+	return p.commit(tx, seqno)
+}
+
+func (p *mysqlProducer) push(data interface{}) error {
+	b, ok := data.([]byte)
+	if !ok {
+		return fmt.Errorf("mysql pipe can push binary messages only")
+	}
+	return p.apply([][]byte{b})
+}
+
+//Push applies the event immediately
+func (p *mysqlProducer) Push(data interface{}) error {
+	err := p.push(data)
+	log.E(err)
+	return err
+}
+
+//PushK applies the event immediately. Key is ignored, primary key from the
+//event is used instead
+func (p *mysqlProducer) PushK(key string, data interface{}) error {
+	return p.Push(data)
+}
+
+//PushSchema applies schema event immediately
+func (p *mysqlProducer) PushSchema(key string, data []byte) error {
+	return p.Push(data)
+}
+
+//PushBatch queues the event to be applied by PushBatchCommit
+func (p *mysqlProducer) PushBatch(key string, data interface{}) error {
+	b, ok := data.([]byte)
+	if !ok {
+		return fmt.Errorf("mysql pipe can push binary messages only")
+	}
+	p.batch = append(p.batch, b)
+	return nil
+}
+
+//PushBatchCommit applies queued events in a transaction. Batch is kept on
+//error, so as the call can be retried
+func (p *mysqlProducer) PushBatchCommit() error {
+	if len(p.batch) == 0 {
+		return nil
+	}
+
+	err := p.apply(p.batch)
+	if log.E(err) {
+		return err
+	}
+
+	p.batch = p.batch[:0]
+
+	return nil
+}
+
+//SetFormat sets the format of the events. Supported formats are: json,
+//msgpack
+func (p *mysqlProducer) SetFormat(format string) {
+	p.format = format
+}
+
+//Close producer. Connection is shared by the producers and kept open
+func (p *mysqlProducer) Close() error {
+	return nil
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pipe
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/db"
+	"github.com/raksh93/storagetapper/shutdown"
+	"github.com/raksh93/storagetapper/test"
+	"github.com/raksh93/storagetapper/types"
+)
+
+const mysqlSinkTestDB = "storagetapper_sink_test"
+
+func mysqlSinkEvent(t *testing.T, format string, tp string, seqno uint64, key []interface{}, fields ...interface{}) []byte {
+	cf := &types.CommonFormatEvent{Type: tp, Key: key, SeqNo: seqno}
+	if len(fields) != 0 {
+		f := make([]types.CommonFormatField, 0)
+		for i := 0; i < len(fields); i += 2 {
+			f = append(f, types.CommonFormatField{Name: fields[i].(string), Value: fields[i+1]})
+		}
+		cf.Fields = &f
+	}
+
+	var b []byte
+	var err error
+	if format == "msgpack" {
+		b, err = cf.MarshalMsg(nil)
+	} else {
+		b, err = json.Marshal(cf)
+	}
+	test.CheckFail(err, t)
+
+	return b
+}
+
+func checkMySQLSinkRow(t *testing.T, conn *sql.DB, id int, name string, data string) {
+	var n, d sql.NullString
+	err := conn.QueryRow("SELECT name, data FROM "+mysqlSinkTestDB+".t1 WHERE id=?", id).Scan(&n, &d)
+	if name == "" {
+		test.Assert(t, err == sql.ErrNoRows, "row %v shouldn't exist", id)
+		return
+	}
+	test.CheckFail(err, t)
+	test.Assert(t, n.String == name && d.String == data, "unexpected row %v: %v %v", id, n.String, d.String)
+}
+
+func prepareMySQLSink(t *testing.T) (Pipe, *sql.DB) {
+	addr := db.GetInfoForTest(&db.Loc{}, db.Master)
+	conn, err := db.Open(addr)
+	test.CheckFail(err, t)
+
+	_, err = conn.Exec("DROP DATABASE IF EXISTS " + mysqlSinkTestDB)
+	test.CheckFail(err, t)
+	_, err = conn.Exec("CREATE DATABASE " + mysqlSinkTestDB)
+	test.CheckFail(err, t)
+
+	c := &config.AppConfig{}
+	c.MySQLSink.ConnectURL = fmt.Sprintf("%v:%v@%v:%v/%v", addr.User, addr.Pwd, addr.Host, addr.Port, mysqlSinkTestDB)
+	p, err := Create(shutdown.Context, "mysql", 16, c, nil)
+	test.CheckFail(err, t)
+
+	return p, conn
+}
+
+func TestMySQLPipeNotConfigured(t *testing.T) {
+	p, err := Create(shutdown.Context, "mysql", 16, &config.AppConfig{}, nil)
+	test.CheckFail(err, t)
+	test.Assert(t, p.Type() == "mysql", "unexpected pipe type")
+
+	_, err = p.NewProducer("t1")
+	test.Assert(t, err != nil, "producer of not configured pipe should fail")
+	_, err = p.NewConsumer("t1")
+	test.Assert(t, err != nil, "mysql pipe doesn't support consumers")
+}
+
+func TestMySQLPipe(t *testing.T) {
+	test.SkipIfNoMySQLAvailable(t)
+
+	p, conn := prepareMySQLSink(t)
+	defer func() { test.CheckFail(conn.Close(), t) }()
+
+	pr, err := p.NewProducer("t1")
+	test.CheckFail(err, t)
+	pr.SetFormat("json")
+
+	_, err = conn.Exec("SELECT 1 FROM " + mysqlSinkTestDB + ".t1")
+	test.Assert(t, err != nil, "target table shouldn't exist before schema event")
+
+	//Snapshot
+	test.CheckFail(pr.PushSchema("", mysqlSinkEvent(t, "json", "schema", 0, []interface{}{"id"}, "id", "int(11)", "name", "varchar(32)", "data", "blob")), t)
+	test.CheckFail(pr.PushBatch("1", mysqlSinkEvent(t, "json", "insert", 0, []interface{}{1}, "id", 1, "name", "one", "data", []byte("d1"))), t)
+	test.CheckFail(pr.PushBatch("2", mysqlSinkEvent(t, "json", "insert", 0, []interface{}{2}, "id", 2, "name", "two", "data", []byte("d2"))), t)
+	test.CheckFail(pr.PushBatchCommit(), t)
+
+	checkMySQLSinkRow(t, conn, 1, "one", "d1")
+	checkMySQLSinkRow(t, conn, 2, "two", "d2")
+
+	//Changes
+	test.CheckFail(pr.PushBatch("1", mysqlSinkEvent(t, "json", "insert", 10, []interface{}{1}, "id", 1, "name", "one1", "data", []byte("d11"))), t)
+	test.CheckFail(pr.PushBatch("2", mysqlSinkEvent(t, "json", "delete", 11, []interface{}{2})), t)
+	test.CheckFail(pr.PushBatch("3", mysqlSinkEvent(t, "json", "insert", 12, []interface{}{3}, "id", 3, "name", "three", "data", []byte("d3"))), t)
+	test.CheckFail(pr.PushBatchCommit(), t)
+
+	checkMySQLSinkRow(t, conn, 1, "one1", "d11")
+	checkMySQLSinkRow(t, conn, 2, "", "")
+	checkMySQLSinkRow(t, conn, 3, "three", "d3")
+
+	//Already applied events are skipped
+	test.CheckFail(pr.PushBatch("2", mysqlSinkEvent(t, "json", "insert", 11, []interface{}{2}, "id", 2, "name", "two", "data", []byte("d2"))), t)
+	test.CheckFail(pr.PushBatch("3", mysqlSinkEvent(t, "json", "delete", 12, []interface{}{3})), t)
+	test.CheckFail(pr.PushBatchCommit(), t)
+
+	checkMySQLSinkRow(t, conn, 2, "", "")
+	checkMySQLSinkRow(t, conn, 3, "three", "d3")
+
+	//Schema change adds column
+	test.CheckFail(pr.PushSchema("", mysqlSinkEvent(t, "json", "schema", 13, []interface{}{"id"}, "id", "int(11)", "name", "varchar(64)", "data", "blob", "extra", "bigint(20)")), t)
+	test.CheckFail(pr.PushBatch("4", mysqlSinkEvent(t, "json", "insert", 14, []interface{}{4}, "id", 4, "name", "four", "data", []byte("d4"), "extra", int64(1)<<40)), t)
+	test.CheckFail(pr.PushBatchCommit(), t)
+	test.CheckFail(pr.Close(), t)
+
+	var typ string
+	err = conn.QueryRow("SELECT COLUMN_TYPE FROM information_schema.columns WHERE TABLE_SCHEMA=? AND TABLE_NAME='t1' AND COLUMN_NAME='name'", mysqlSinkTestDB).Scan(&typ)
+	test.CheckFail(err, t)
+	test.Assert(t, typ == "varchar(64)", "column should be modified, got %v", typ)
+
+	var extra int64
+	err = conn.QueryRow("SELECT extra FROM " + mysqlSinkTestDB + ".t1 WHERE id=4").Scan(&extra)
+	test.CheckFail(err, t)
+	test.Assert(t, extra == int64(1)<<40, "unexpected value of added column: %v", extra)
+
+	//Applied seqno survives restart
+	pr, err = p.NewProducer(mysqlSinkTestDB + ".t1")
+	test.CheckFail(err, t)
+	pr.SetFormat("msgpack")
+
+	test.CheckFail(pr.PushBatch("4", mysqlSinkEvent(t, "msgpack", "delete", 14, []interface{}{4})), t)
+	test.CheckFail(pr.PushBatch("1", mysqlSinkEvent(t, "msgpack", "delete", 15, []interface{}{1})), t)
+	test.CheckFail(pr.PushBatchCommit(), t)
+	test.CheckFail(pr.Close(), t)
+
+	checkMySQLSinkRow(t, conn, 1, "", "")
+	checkMySQLSinkRow(t, conn, 4, "four", "d4")
+
+	var seqno uint64
+	err = conn.QueryRow("SELECT seqno FROM " + mysqlSinkTestDB + "." + mysqlSeqnoTable + " WHERE tableName='t1'").Scan(&seqno)
+	test.CheckFail(err, t)
+	test.Assert(t, seqno == 15, "unexpected applied seqno: %v", seqno)
+}
+
+func TestMySQLPipeFailure(t *testing.T) {
+	test.SkipIfNoMySQLAvailable(t)
+
+	p, conn := prepareMySQLSink(t)
+	defer func() { test.CheckFail(conn.Close(), t) }()
+
+	pr, err := p.NewProducer("t1")
+	test.CheckFail(err, t)
+
+	pr.SetFormat("avro")
+	test.Assert(t, pr.Push(mysqlSinkEvent(t, "json", "schema", 0, []interface{}{"id"}, "id", "int(11)")) != nil, "unsupported format should fail")
+
+	pr.SetFormat("json")
+	test.Assert(t, pr.Push(mysqlSinkEvent(t, "json", "insert", 1, []interface{}{1}, "id", 1)) != nil, "insert should fail if table doesn't exist")
+	test.Assert(t, pr.Push(mysqlSinkEvent(t, "json", "schema", 0, nil, "id", "int(11)")) != nil, "table without primary key shouldn't be created")
+	test.Assert(t, pr.Push("string") != nil, "only binary messages supported")
+}
@@ -0,0 +1,624 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package pipe
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/DataDog/zstd"
+	"github.com/golang/snappy"
+)
+
+//Parquet files writer. Rows are Avro records of flat schema, produced by
+//Avro encoder, which fields are primitive types or unions of null and
+//primitive type. Every column chunk is written as a single PLAIN encoded data
+//page.
+//See: https://github.com/apache/parquet-format
+
+const parquetMagic = "PAR1"
+
+//Parquet physical types
+const (
+	parquetBoolean   = 0
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetFloat     = 4
+	parquetDouble    = 5
+	parquetByteArray = 6
+)
+
+//Parquet enums used by the writer
+const (
+	parquetRequired      = 0
+	parquetOptional      = 1
+	parquetUTF8          = 0
+	parquetEncodingPlain = 0
+	parquetEncodingRLE   = 3
+	parquetPageTypeData  = 0
+	parquetFileVersion   = 1
+	parquetCreatedBy     = "storagetapper"
+	parquetAvroSchemaKey = "parquet.avro.schema"
+)
+
+type parquetCodec struct {
+	id       int32
+	compress func(b []byte) ([]byte, error)
+}
+
+var parquetCodecs = map[string]parquetCodec{
+	"uncompressed": {0, func(b []byte) ([]byte, error) { return b, nil }},
+	"snappy":       {1, func(b []byte) ([]byte, error) { return snappy.Encode(nil, b), nil }},
+	"gzip": {2, func(b []byte) ([]byte, error) {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		err := w.Close()
+		return buf.Bytes(), err
+	}},
+	"zstd": {6, func(b []byte) ([]byte, error) { return zstd.Compress(nil, b) }},
+}
+
+var avroToParquetType = map[string]int32{
+	"boolean": parquetBoolean,
+	"int":     parquetInt32,
+	"long":    parquetInt64,
+	"float":   parquetFloat,
+	"double":  parquetDouble,
+	"bytes":   parquetByteArray,
+	"string":  parquetByteArray,
+}
+
+//parquetColumn accumulates PLAIN encoded values and definition levels of the
+//current row group
+type parquetColumn struct {
+	name     string
+	avroType string
+	typ      int32
+	optional bool
+	branches int64 //number of union branches, 0 if type is not a union
+	nullIdx  int64 //union branch of null
+
+	levels []byte
+	bools  []bool
+	values bytes.Buffer
+}
+
+type parquetRowGroup struct {
+	columns []parquetColumnChunk
+	size    int64
+	rows    int64
+}
+
+type parquetColumnChunk struct {
+	offset           int64
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+//parquetWriter writes every Write call as a row. Rows are buffered in memory
+//and written as a row group, when row group size is reached or on Close
+type parquetWriter struct {
+	w            io.Writer
+	offset       int64
+	codec        parquetCodec
+	codecName    string
+	schema       []byte
+	name         string
+	columns      []*parquetColumn
+	rowGroupSize int
+
+	rows      int64
+	size      int
+	rowGroups []parquetRowGroup
+	closed    bool
+}
+
+//parquetColumns converts flat Avro record schema to Parquet columns
+func parquetColumns(schema []byte) (string, []*parquetColumn, error) {
+	var s struct {
+		Name   string
+		Fields []struct {
+			Name string
+			Type interface{}
+		}
+	}
+	if err := json.Unmarshal(schema, &s); err != nil {
+		return "", nil, err
+	}
+
+	var columns []*parquetColumn
+	for _, f := range s.Fields {
+		c := &parquetColumn{name: f.Name, nullIdx: -1}
+
+		var types []interface{}
+		switch t := f.Type.(type) {
+		case string:
+			types = []interface{}{t}
+		case []interface{}:
+			types = t
+			c.branches = int64(len(t))
+		}
+
+		for i, v := range types {
+			t, _ := v.(string)
+			if t == "null" && c.nullIdx == -1 {
+				c.nullIdx = int64(i)
+				c.optional = true
+			} else if _, ok := avroToParquetType[t]; ok && c.avroType == "" {
+				c.avroType = t
+			} else {
+				return "", nil, fmt.Errorf("unsupported parquet column type: %v: %v", f.Name, f.Type)
+			}
+		}
+
+		if c.avroType == "" {
+			return "", nil, fmt.Errorf("unsupported parquet column type: %v: %v", f.Name, f.Type)
+		}
+		c.typ = avroToParquetType[c.avroType]
+		columns = append(columns, c)
+	}
+
+	if len(columns) == 0 {
+		return "", nil, fmt.Errorf("parquet schema should have at least one column")
+	}
+
+	if s.Name == "" {
+		s.Name = "schema"
+	}
+
+	return s.Name, columns, nil
+}
+
+//newParquetWriter writes file magic. Parquet schema is derived from given
+//Avro schema
+func newParquetWriter(w io.Writer, schema []byte, codec string, rowGroupSize int) (*parquetWriter, error) {
+	c, ok := parquetCodecs[codec]
+	if !ok {
+		return nil, fmt.Errorf("unsupported parquet codec: %v", codec)
+	}
+
+	name, columns, err := parquetColumns(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parquetWriter{w: w, codec: c, codecName: codec, schema: schema, name: name, columns: columns, rowGroupSize: rowGroupSize}
+	if err = p.write([]byte(parquetMagic)); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *parquetWriter) write(b []byte) error {
+	n, err := p.w.Write(b)
+	p.offset += int64(n)
+	return err
+}
+
+//appendValue converts Avro binary encoded value to PLAIN encoded Parquet
+//value
+func (c *parquetColumn) appendValue(r *bytes.Reader) error {
+	switch c.avroType {
+	case "boolean":
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		c.bools = append(c.bools, b != 0)
+	case "int":
+		v, err := binary.ReadVarint(r)
+		if err != nil {
+			return err
+		}
+		return binary.Write(&c.values, binary.LittleEndian, int32(v))
+	case "long":
+		v, err := binary.ReadVarint(r)
+		if err != nil {
+			return err
+		}
+		return binary.Write(&c.values, binary.LittleEndian, v)
+	case "float", "double":
+		n := int64(4)
+		if c.avroType == "double" {
+			n = 8
+		}
+		_, err := io.CopyN(&c.values, r, n)
+		return err
+	case "bytes", "string":
+		n, err := binary.ReadVarint(r)
+		if err != nil {
+			return err
+		}
+		if n < 0 || n > int64(r.Len()) {
+			return io.ErrUnexpectedEOF
+		}
+		if err = binary.Write(&c.values, binary.LittleEndian, int32(n)); err != nil {
+			return err
+		}
+		_, err = io.CopyN(&c.values, r, n)
+		return err
+	}
+	return nil
+}
+
+//addRow decodes Avro record into the columns. Columns are rolled back on
+//failure
+func (p *parquetWriter) addRow(b []byte) error {
+	type state struct{ levels, bools, values int }
+	saved := make([]state, len(p.columns))
+	for i, c := range p.columns {
+		saved[i] = state{len(c.levels), len(c.bools), c.values.Len()}
+	}
+
+	r := bytes.NewReader(b)
+	err := func() error {
+		for _, c := range p.columns {
+			if c.branches != 0 {
+				branch, err := binary.ReadVarint(r)
+				if err != nil {
+					return err
+				}
+				if branch < 0 || branch >= c.branches {
+					return fmt.Errorf("invalid avro union branch: %v", branch)
+				}
+				if branch == c.nullIdx {
+					c.levels = append(c.levels, 0)
+					continue
+				}
+			}
+			if c.optional {
+				c.levels = append(c.levels, 1)
+			}
+			if err := c.appendValue(r); err != nil {
+				return err
+			}
+		}
+		if r.Len() != 0 {
+			return fmt.Errorf("avro record doesn't match parquet schema, %v bytes left", r.Len())
+		}
+		return nil
+	}()
+
+	if err != nil {
+		for i, c := range p.columns {
+			c.levels = c.levels[:saved[i].levels]
+			c.bools = c.bools[:saved[i].bools]
+			c.values.Truncate(saved[i].values)
+		}
+	}
+
+	return err
+}
+
+func (p *parquetWriter) Write(b []byte) (int, error) {
+	if err := p.addRow(b); err != nil {
+		return 0, err
+	}
+	p.rows++
+	p.size += len(b)
+	if p.size >= p.rowGroupSize {
+		if err := p.writeRowGroup(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+//Flush is no-op, rows are persisted by row groups
+func (p *parquetWriter) Flush() error {
+	return nil
+}
+
+//Close writes buffered rows and file footer. Underlying writer is not closed
+func (p *parquetWriter) Close() error {
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+
+	if err := p.writeRowGroup(); err != nil {
+		return err
+	}
+
+	meta := p.fileMetaData()
+	if err := p.write(meta); err != nil {
+		return err
+	}
+
+	l := make([]byte, 4)
+	binary.LittleEndian.PutUint32(l, uint32(len(meta)))
+	if err := p.write(l); err != nil {
+		return err
+	}
+
+	return p.write([]byte(parquetMagic))
+}
+
+//rleLevels encodes definition levels as RLE runs of the RLE/bit-packing
+//hybrid encoding with bit width 1, prepended by the length
+func rleLevels(levels []byte) []byte {
+	var b bytes.Buffer
+	v := make([]byte, binary.MaxVarintLen64)
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		b.Write(v[:binary.PutUvarint(v, uint64(j-i)<<1)])
+		b.WriteByte(levels[i])
+		i = j
+	}
+
+	r := make([]byte, 4, 4+b.Len())
+	binary.LittleEndian.PutUint32(r, uint32(b.Len()))
+	return append(r, b.Bytes()...)
+}
+
+//page returns uncompressed data page content of the column
+func (c *parquetColumn) page() []byte {
+	var b []byte
+	if c.optional {
+		b = rleLevels(c.levels)
+	}
+
+	if c.typ == parquetBoolean {
+		bits := make([]byte, (len(c.bools)+7)/8)
+		for i, v := range c.bools {
+			if v {
+				bits[i/8] |= 1 << uint(i%8)
+			}
+		}
+		return append(b, bits...)
+	}
+
+	return append(b, c.values.Bytes()...)
+}
+
+func (c *parquetColumn) reset() {
+	c.levels = c.levels[:0]
+	c.bools = c.bools[:0]
+	c.values.Reset()
+}
+
+func (p *parquetWriter) writeRowGroup() error {
+	if p.rows == 0 {
+		return nil
+	}
+
+	g := parquetRowGroup{rows: p.rows}
+	for _, c := range p.columns {
+		data := c.page()
+		compressed, err := p.codec.compress(data)
+		if err != nil {
+			return err
+		}
+
+		var t thriftWriter
+		t.i32(1, parquetPageTypeData)
+		t.i32(2, int32(len(data)))
+		t.i32(3, int32(len(compressed)))
+		t.structBegin(5)
+		t.i32(1, int32(p.rows))
+		t.i32(2, parquetEncodingPlain)
+		t.i32(3, parquetEncodingRLE)
+		t.i32(4, parquetEncodingRLE)
+		t.structEnd()
+		t.stop()
+
+		chunk := parquetColumnChunk{
+			offset:           p.offset,
+			uncompressedSize: int64(t.buf.Len() + len(data)),
+			compressedSize:   int64(t.buf.Len() + len(compressed)),
+		}
+
+		if err = p.write(t.buf.Bytes()); err != nil {
+			return err
+		}
+		if err = p.write(compressed); err != nil {
+			return err
+		}
+
+		g.size += chunk.uncompressedSize
+		g.columns = append(g.columns, chunk)
+
+		c.reset()
+	}
+
+	p.rowGroups = append(p.rowGroups, g)
+	p.rows = 0
+	p.size = 0
+
+	return nil
+}
+
+//fileMetaData serializes file footer
+func (p *parquetWriter) fileMetaData() []byte {
+	var t thriftWriter
+	var numRows int64
+
+	t.i32(1, parquetFileVersion)
+
+	t.listBegin(2, thriftStruct, len(p.columns)+1)
+	t.elemBegin()
+	t.binary(4, []byte(p.name))
+	t.i32(5, int32(len(p.columns)))
+	t.elemEnd()
+	for _, c := range p.columns {
+		t.elemBegin()
+		t.i32(1, c.typ)
+		if c.optional {
+			t.i32(3, parquetOptional)
+		} else {
+			t.i32(3, parquetRequired)
+		}
+		t.binary(4, []byte(c.name))
+		if c.avroType == "string" {
+			t.i32(6, parquetUTF8)
+		}
+		t.elemEnd()
+	}
+
+	for _, g := range p.rowGroups {
+		numRows += g.rows
+	}
+	t.i64(3, numRows)
+
+	t.listBegin(4, thriftStruct, len(p.rowGroups))
+	for _, g := range p.rowGroups {
+		t.elemBegin()
+		t.listBegin(1, thriftStruct, len(g.columns))
+		for i, ch := range g.columns {
+			c := p.columns[i]
+			t.elemBegin()
+			t.i64(2, ch.offset)
+			t.structBegin(3)
+			t.i32(1, c.typ)
+			t.listBegin(2, thriftI32, 2)
+			t.listI32(parquetEncodingPlain)
+			t.listI32(parquetEncodingRLE)
+			t.listBegin(3, thriftBinary, 1)
+			t.listBinary([]byte(c.name))
+			t.i32(4, p.codec.id)
+			t.i64(5, g.rows)
+			t.i64(6, ch.uncompressedSize)
+			t.i64(7, ch.compressedSize)
+			t.i64(9, ch.offset)
+			t.structEnd()
+			t.elemEnd()
+		}
+		t.i64(2, g.size)
+		t.i64(3, g.rows)
+		t.elemEnd()
+	}
+
+	t.listBegin(5, thriftStruct, 1)
+	t.elemBegin()
+	t.binary(1, []byte(parquetAvroSchemaKey))
+	t.binary(2, p.schema)
+	t.elemEnd()
+
+	t.binary(6, []byte(parquetCreatedBy))
+	t.stop()
+
+	return t.buf.Bytes()
+}
+
+//Thrift compact protocol types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+//thriftWriter serializes structures using Thrift compact protocol
+type thriftWriter struct {
+	buf   bytes.Buffer
+	last  int16
+	stack []int16
+}
+
+func (t *thriftWriter) uvarint(v uint64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	t.buf.Write(b[:binary.PutUvarint(b, v)])
+}
+
+func (t *thriftWriter) varint(v int64) {
+	t.uvarint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if id > t.last && id-t.last <= 15 {
+		t.buf.WriteByte(byte(id-t.last)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(int64(id))
+	}
+	t.last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(v)
+}
+
+func (t *thriftWriter) binary(id int16, b []byte) {
+	t.field(id, thriftBinary)
+	t.listBinary(b)
+}
+
+func (t *thriftWriter) structBegin(id int16) {
+	t.field(id, thriftStruct)
+	t.elemBegin()
+}
+
+func (t *thriftWriter) structEnd() {
+	t.elemEnd()
+}
+
+func (t *thriftWriter) listBegin(id int16, elemType byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | elemType)
+	} else {
+		t.buf.WriteByte(0xf0 | elemType)
+		t.uvarint(uint64(n))
+	}
+}
+
+func (t *thriftWriter) listI32(v int32) {
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) listBinary(b []byte) {
+	t.uvarint(uint64(len(b)))
+	t.buf.Write(b)
+}
+
+//elemBegin starts nested structure
+func (t *thriftWriter) elemBegin() {
+	t.stack = append(t.stack, t.last)
+	t.last = 0
+}
+
+//elemEnd writes field stop and restores field id of the enclosing structure
+func (t *thriftWriter) elemEnd() {
+	t.stop()
+	t.last = t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+}
+
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+}
@@ -0,0 +1,445 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package pipe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/test"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+var parquetTestSchema = `{"name":"db-table","type":"record","fields":[` +
+	`{"name":"id","type":["long"]},{"name":"name","type":["null","string"]},` +
+	`{"name":"flag","type":["null","boolean"]},{"name":"score","type":["null","double"]},` +
+	`{"name":"n","type":["null","int"]},{"name":"raw","type":"bytes"}]}`
+
+type parquetTestRow struct {
+	id    int64
+	name  *string
+	flag  *bool
+	score *float64
+	n     *int32
+	raw   []byte
+}
+
+func parquetTestRows(num int) []parquetTestRow {
+	var rows []parquetTestRow
+	for i := 0; i < num; i++ {
+		r := parquetTestRow{id: int64(i) * 1000000007, raw: []byte{byte(i), 0, byte(i)}}
+		if i%3 != 0 {
+			s := "name" + string(rune('a'+i%26))
+			r.name = &s
+		}
+		if i%4 != 0 {
+			b := i%2 == 0
+			r.flag = &b
+		}
+		if i%5 != 0 {
+			f := float64(i) / 3
+			r.score = &f
+		}
+		if i%2 != 0 {
+			n := int32(-i)
+			r.n = &n
+		}
+		rows = append(rows, r)
+	}
+	return rows
+}
+
+//avro encodes the row according to parquetTestSchema
+func (r parquetTestRow) avro() []byte {
+	b := avroLong(0)
+	b = append(b, avroLong(r.id)...)
+	if r.name == nil {
+		b = append(b, avroLong(0)...)
+	} else {
+		b = append(b, avroLong(1)...)
+		b = append(b, avroString(*r.name)...)
+	}
+	if r.flag == nil {
+		b = append(b, avroLong(0)...)
+	} else if *r.flag {
+		b = append(b, avroLong(1)...)
+		b = append(b, 1)
+	} else {
+		b = append(b, avroLong(1)...)
+		b = append(b, 0)
+	}
+	if r.score == nil {
+		b = append(b, avroLong(0)...)
+	} else {
+		b = append(b, avroLong(1)...)
+		f := make([]byte, 8)
+		binary.LittleEndian.PutUint64(f, math.Float64bits(*r.score))
+		b = append(b, f...)
+	}
+	if r.n == nil {
+		b = append(b, avroLong(0)...)
+	} else {
+		b = append(b, avroLong(1)...)
+		b = append(b, avroLong(int64(*r.n))...)
+	}
+	b = append(b, avroLong(int64(len(r.raw)))...)
+	return append(b, r.raw...)
+}
+
+//thriftReader decodes Thrift compact protocol structures into maps keyed by
+//field id
+type thriftReader struct {
+	*bytes.Reader
+	t *testing.T
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case 1:
+		return true
+	case 2:
+		return false
+	case 5, 6:
+		v, err := binary.ReadVarint(r)
+		test.CheckFail(err, r.t)
+		return v
+	case 8:
+		n, err := binary.ReadUvarint(r)
+		test.CheckFail(err, r.t)
+		b := make([]byte, n)
+		_, err = r.Read(b)
+		test.CheckFail(err, r.t)
+		return b
+	case 9:
+		h, err := r.ReadByte()
+		test.CheckFail(err, r.t)
+		n := uint64(h >> 4)
+		if n == 15 {
+			n, err = binary.ReadUvarint(r)
+			test.CheckFail(err, r.t)
+		}
+		var l []interface{}
+		for i := uint64(0); i < n; i++ {
+			l = append(l, r.value(h&0x0f))
+		}
+		return l
+	case 12:
+		return r.object()
+	}
+	r.t.Fatalf("unexpected thrift type: %v", typ)
+	return nil
+}
+
+func (r *thriftReader) object() map[int64]interface{} {
+	m := make(map[int64]interface{})
+	var last int64
+	for {
+		b, err := r.ReadByte()
+		test.CheckFail(err, r.t)
+		if b == 0 {
+			return m
+		}
+		id := last + int64(b>>4)
+		if b>>4 == 0 {
+			id, err = binary.ReadVarint(r)
+			test.CheckFail(err, r.t)
+		}
+		last = id
+		m[id] = r.value(b & 0x0f)
+	}
+}
+
+//readParquetColumn decodes definition levels and PLAIN encoded values of the
+//data page
+func readParquetColumn(t *testing.T, page []byte, optional bool, typ int64, num int) ([]byte, []interface{}) {
+	r := bytes.NewReader(page)
+	levels := make([]byte, 0, num)
+	nvalues := num
+	if optional {
+		var l uint32
+		test.CheckFail(binary.Read(r, binary.LittleEndian, &l), t)
+		lr := bytes.NewReader(page[4 : 4+l])
+		for lr.Len() > 0 {
+			h, err := binary.ReadUvarint(lr)
+			test.CheckFail(err, t)
+			test.Assert(t, h&1 == 0, "expected RLE run")
+			v, err := lr.ReadByte()
+			test.CheckFail(err, t)
+			for i := uint64(0); i < h>>1; i++ {
+				levels = append(levels, v)
+			}
+		}
+		test.Assert(t, len(levels) == num, "unexpected number of levels: %v", len(levels))
+		_, _ = r.Seek(int64(4+l), 0)
+		nvalues = 0
+		for _, v := range levels {
+			nvalues += int(v)
+		}
+	}
+
+	var values []interface{}
+	if typ == parquetBoolean {
+		bits := make([]byte, (nvalues+7)/8)
+		_, _ = r.Read(bits)
+		for i := 0; i < nvalues; i++ {
+			values = append(values, bits[i/8]&(1<<uint(i%8)) != 0)
+		}
+		return levels, values
+	}
+
+	for i := 0; i < nvalues; i++ {
+		switch typ {
+		case parquetInt32:
+			var v int32
+			test.CheckFail(binary.Read(r, binary.LittleEndian, &v), t)
+			values = append(values, v)
+		case parquetInt64:
+			var v int64
+			test.CheckFail(binary.Read(r, binary.LittleEndian, &v), t)
+			values = append(values, v)
+		case parquetDouble:
+			var v float64
+			test.CheckFail(binary.Read(r, binary.LittleEndian, &v), t)
+			values = append(values, v)
+		case parquetByteArray:
+			var l int32
+			test.CheckFail(binary.Read(r, binary.LittleEndian, &l), t)
+			b := make([]byte, l)
+			_, err := r.Read(b)
+			test.CheckFail(err, t)
+			values = append(values, string(b))
+		}
+	}
+	test.Assert(t, r.Len() == 0, "unexpected bytes after page values: %v", r.Len())
+
+	return levels, values
+}
+
+//readParquet validates file structure and returns values of all the columns
+//in the file. nil value represent null
+func readParquet(t *testing.T, b []byte) (map[int64]interface{}, [][]interface{}) {
+	test.Assert(t, string(b[:4]) == parquetMagic && string(b[len(b)-4:]) == parquetMagic, "no parquet magic")
+
+	l := binary.LittleEndian.Uint32(b[len(b)-8:])
+	footer := b[len(b)-8-int(l) : len(b)-8]
+	meta := (&thriftReader{bytes.NewReader(footer), t}).object()
+
+	schema := meta[2].([]interface{})
+	columns := make([][]interface{}, len(schema)-1)
+
+	for _, g := range meta[4].([]interface{}) {
+		rg := g.(map[int64]interface{})
+		rows := int(rg[3].(int64))
+		for i, c := range rg[1].([]interface{}) {
+			cm := c.(map[int64]interface{})[3].(map[int64]interface{})
+			el := schema[i+1].(map[int64]interface{})
+			test.Assert(t, cm[1] == el[1], "column type mismatch")
+			test.Assert(t, string(cm[3].([]interface{})[0].([]byte)) == string(el[4].([]byte)), "column path mismatch")
+			test.Assert(t, cm[5].(int64) == int64(rows), "column values count mismatch")
+
+			r := &thriftReader{bytes.NewReader(b[cm[9].(int64):]), t}
+			ph := r.object()
+			hsize := int64(len(b)) - cm[9].(int64) - int64(r.Len())
+			test.Assert(t, ph[3].(int64)+hsize == cm[7].(int64), "compressed size mismatch")
+			test.Assert(t, ph[2].(int64)+hsize == cm[6].(int64), "uncompressed size mismatch")
+			test.Assert(t, ph[5].(map[int64]interface{})[1].(int64) == int64(rows), "page values count mismatch")
+
+			start := int(cm[9].(int64) + hsize)
+			page := b[start : start+int(ph[3].(int64))]
+			if cm[4].(int64) == 1 {
+				var err error
+				page, err = snappy.Decode(nil, page)
+				test.CheckFail(err, t)
+			}
+
+			optional := el[3].(int64) == parquetOptional
+			levels, values := readParquetColumn(t, page, optional, el[1].(int64), rows)
+			for j := 0; j < rows; j++ {
+				if optional && levels[j] == 0 {
+					columns[i] = append(columns[i], nil)
+					continue
+				}
+				columns[i] = append(columns[i], values[0])
+				values = values[1:]
+			}
+		}
+	}
+
+	return meta, columns
+}
+
+func testParquetWriter(t *testing.T, codec string) {
+	var buf bytes.Buffer
+	w, err := newParquetWriter(&buf, []byte(parquetTestSchema), codec, 256)
+	test.CheckFail(err, t)
+
+	rows := parquetTestRows(100)
+	for _, r := range rows {
+		_, err = w.Write(r.avro())
+		test.CheckFail(err, t)
+	}
+
+	_, err = w.Write([]byte{1, 2, 3})
+	test.Assert(t, err != nil, "malformed row should fail")
+
+	test.CheckFail(w.Close(), t)
+
+	meta, columns := readParquet(t, buf.Bytes())
+
+	test.Assert(t, meta[3].(int64) == 100, "unexpected number of rows: %v", meta[3])
+	test.Assert(t, len(meta[4].([]interface{})) > 1, "expected multiple row groups")
+
+	kv := meta[5].([]interface{})[0].(map[int64]interface{})
+	test.Assert(t, string(kv[1].([]byte)) == parquetAvroSchemaKey && string(kv[2].([]byte)) == parquetTestSchema, "avro schema should be in metadata")
+
+	schema := meta[2].([]interface{})
+	test.Assert(t, string(schema[0].(map[int64]interface{})[4].([]byte)) == "db-table", "unexpected schema root name")
+	test.Assert(t, schema[1].(map[int64]interface{})[3].(int64) == parquetRequired, "id should be required")
+	test.Assert(t, schema[2].(map[int64]interface{})[6].(int64) == parquetUTF8, "name should be UTF8")
+
+	for i, r := range rows {
+		test.Assert(t, columns[0][i] == r.id, "%v: id mismatch: %v", i, columns[0][i])
+		test.Assert(t, (r.name == nil && columns[1][i] == nil) || (r.name != nil && columns[1][i] == *r.name), "%v: name mismatch: %v", i, columns[1][i])
+		test.Assert(t, (r.flag == nil && columns[2][i] == nil) || (r.flag != nil && columns[2][i] == *r.flag), "%v: flag mismatch: %v", i, columns[2][i])
+		test.Assert(t, (r.score == nil && columns[3][i] == nil) || (r.score != nil && columns[3][i] == *r.score), "%v: score mismatch: %v", i, columns[3][i])
+		test.Assert(t, (r.n == nil && columns[4][i] == nil) || (r.n != nil && columns[4][i] == *r.n), "%v: n mismatch: %v", i, columns[4][i])
+		test.Assert(t, columns[5][i] == string(r.raw), "%v: raw mismatch: %v", i, columns[5][i])
+	}
+}
+
+func TestParquetWriter(t *testing.T) {
+	testParquetWriter(t, "uncompressed")
+	testParquetWriter(t, "snappy")
+}
+
+//parquetReaderRow maps parquetTestSchema columns for the independent
+//parquet-go reader
+type parquetReaderRow struct {
+	ID    int64    `parquet:"name=id, type=INT64"`
+	Name  *string  `parquet:"name=name, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	Flag  *bool    `parquet:"name=flag, type=BOOLEAN, repetitiontype=OPTIONAL"`
+	Score *float64 `parquet:"name=score, type=DOUBLE, repetitiontype=OPTIONAL"`
+	N     *int32   `parquet:"name=n, type=INT32, repetitiontype=OPTIONAL"`
+	Raw   string   `parquet:"name=raw, type=BYTE_ARRAY"`
+}
+
+//TestParquetIndependentReader reads the files with xitongsys/parquet-go, so
+//as the output is not only checked by the test's own decoder
+func TestParquetIndependentReader(t *testing.T) {
+	for _, codec := range []string{"uncompressed", "snappy", "gzip", "zstd"} {
+		var buf bytes.Buffer
+		w, err := newParquetWriter(&buf, []byte(parquetTestSchema), codec, 256)
+		test.CheckFail(err, t)
+
+		rows := parquetTestRows(100)
+		for _, r := range rows {
+			_, err = w.Write(r.avro())
+			test.CheckFail(err, t)
+		}
+		test.CheckFail(w.Close(), t)
+
+		f, err := buffer.NewBufferFile(buf.Bytes())
+		test.CheckFail(err, t)
+		pr, err := reader.NewParquetReader(f, new(parquetReaderRow), 1)
+		test.CheckFail(err, t)
+		test.Assert(t, pr.GetNumRows() == int64(len(rows)), "%v: unexpected number of rows: %v", codec, pr.GetNumRows())
+
+		res := make([]parquetReaderRow, len(rows))
+		test.CheckFail(pr.Read(&res), t)
+		pr.ReadStop()
+
+		for i, r := range rows {
+			g := res[i]
+			test.Assert(t, g.ID == r.id, "%v: %v: id mismatch: %v", codec, i, g.ID)
+			test.Assert(t, (r.name == nil && g.Name == nil) || (r.name != nil && g.Name != nil && *g.Name == *r.name), "%v: %v: name mismatch: %v", codec, i, g.Name)
+			test.Assert(t, (r.flag == nil && g.Flag == nil) || (r.flag != nil && g.Flag != nil && *g.Flag == *r.flag), "%v: %v: flag mismatch: %v", codec, i, g.Flag)
+			test.Assert(t, (r.score == nil && g.Score == nil) || (r.score != nil && g.Score != nil && *g.Score == *r.score), "%v: %v: score mismatch: %v", codec, i, g.Score)
+			test.Assert(t, (r.n == nil && g.N == nil) || (r.n != nil && g.N != nil && *g.N == *r.n), "%v: %v: n mismatch: %v", codec, i, g.N)
+			test.Assert(t, g.Raw == string(r.raw), "%v: %v: raw mismatch: %v", codec, i, g.Raw)
+		}
+	}
+}
+
+func TestParquetUnsupportedSchema(t *testing.T) {
+	for _, s := range []string{
+		`{"type":"record","name":"r","fields":[{"name":"a","type":["string","long"]}]}`,
+		`{"type":"record","name":"r","fields":[{"name":"a","type":{"type":"array","items":"int"}}]}`,
+		`{"type":"record","name":"r","fields":[]}`,
+	} {
+		_, err := newParquetWriter(ioutil.Discard, []byte(s), "snappy", 1024)
+		test.Assert(t, err != nil, "schema should be rejected: %v", s)
+	}
+}
+
+func TestParquetFilePipe(t *testing.T) {
+	deleteTestTopics(t)
+
+	fp := &filePipe{datadir: baseDir, maxFileSize: 1024 * 1024, delimited: true, parquet: config.ParquetConfig{Enabled: true, Codec: "gzip", RowGroupSize: 1024, MaxFileAge: 3600}}
+
+	p, err := fp.NewProducer("parquet-test-topic")
+	test.CheckFail(err, t)
+	p.SetFormat("avro")
+
+	err = p.PushSchema("", []byte(parquetTestSchema))
+	test.CheckFail(err, t)
+
+	rows := parquetTestRows(30)
+	for _, r := range rows[:10] {
+		test.CheckFail(p.PushBatch("log", r.avro()), t)
+	}
+	test.CheckFail(p.PushBatchCommit(), t)
+
+	//Flush persists buffered rows by closing the file
+	test.CheckFail(Flush(p), t)
+
+	for _, r := range rows[10:20] {
+		test.CheckFail(p.PushBatch("log", r.avro()), t)
+	}
+
+	//Expired file is closed by the next push
+	p.(*fileProducer).files["log"].created = time.Now().Add(-2 * time.Hour)
+	test.CheckFail(p.PushBatch("log", rows[20].avro()), t)
+
+	for _, r := range rows[21:] {
+		test.CheckFail(p.PushBatch("log", r.avro()), t)
+	}
+	test.CheckFail(p.Close(), t)
+
+	files, err := ioutil.ReadDir(baseDir + "/parquet-test-topic")
+	test.CheckFail(err, t)
+	test.Assert(t, len(files) == 3, "expected three files, got: %v", len(files))
+
+	for i, n := range []int64{10, 11, 9} {
+		b, err := ioutil.ReadFile(baseDir + "/parquet-test-topic/" + files[i].Name())
+		test.CheckFail(err, t)
+		l := binary.LittleEndian.Uint32(b[len(b)-8:])
+		meta := (&thriftReader{bytes.NewReader(b[len(b)-8-int(l) : len(b)-8]), t}).object()
+		test.Assert(t, meta[3].(int64) == n, "file %v: unexpected number of rows: %v", i, meta[3])
+	}
+
+	test.Assert(t, NeedsAvroSchema(fp), "parquet pipe needs avro schema")
+}
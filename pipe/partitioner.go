@@ -0,0 +1,139 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pipe
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/Shopify/sarama"
+	"github.com/raksh93/storagetapper/config"
+)
+
+//messageMetadata is passed in the producer message metadata. partKey is used
+//by the partitioner, when message should be partitioned by the key other than
+//message key. batch tracks acknowledgement of the message sent by async
+//producer
+type messageMetadata struct {
+	partKey string
+	batch   *asyncBatch
+}
+
+//kafkaPartitioner implements hash, murmur2 and explicit partitioners
+//configured per output topic
+type kafkaPartitioner struct {
+	cfg    *config.KafkaPartitioner
+	random sarama.Partitioner
+}
+
+//newPartitionerConstructor returns sarama partitioner constructor, which
+//creates partitioner configured for the topic or falls back to the given
+//default constructor
+func newPartitionerConstructor(def sarama.PartitionerConstructor) sarama.PartitionerConstructor {
+	return func(topic string) sarama.Partitioner {
+		cfg := config.Get().GetKafkaPartitioner(topic)
+		if cfg.Type == "" {
+			return def(topic)
+		}
+		return &kafkaPartitioner{cfg: cfg, random: sarama.NewRandomPartitioner(topic)}
+	}
+}
+
+func (p *kafkaPartitioner) Partition(m *sarama.ProducerMessage, numPartitions int32) (int32, error) {
+	var key []byte
+	if md, ok := m.Metadata.(*messageMetadata); ok && md.partKey != "" {
+		key = []byte(md.partKey)
+	} else if m.Key != nil {
+		var err error
+		if key, err = m.Key.Encode(); err != nil {
+			return -1, err
+		}
+	}
+
+	if key == nil {
+		return p.random.Partition(m, numPartitions)
+	}
+
+	switch p.cfg.Type {
+	case config.KafkaPartitionerHash:
+		h := fnv.New32a()
+		_, _ = h.Write(key)
+		partition := int32(h.Sum32()) % numPartitions
+		if partition < 0 {
+			partition = -partition
+		}
+		return partition, nil
+	case config.KafkaPartitionerExplicit:
+		if partition, ok := p.cfg.Partitions[string(key)]; ok {
+			if partition >= numPartitions {
+				return -1, fmt.Errorf("Partition %v of key '%v' exceeds number of partitions %v", partition, string(key), numPartitions)
+			}
+			return partition, nil
+		}
+	}
+
+	return int32(murmur2(key)&0x7fffffff) % numPartitions, nil
+}
+
+func (p *kafkaPartitioner) RequiresConsistency() bool {
+	return true
+}
+
+//murmur2 is the port of the hash function used by Java client default
+//partitioner
+func murmur2(data []byte) uint32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+
+	l := len(data)
+	h := seed ^ uint32(l)
+
+	for i := 0; i+4 <= l; i += 4 {
+		k := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := data[l&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+
+	return h
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pipe
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/test"
+)
+
+//Reference values produced by Java client Utils.murmur2
+var murmur2Tests = []struct {
+	in  string
+	out int32
+}{
+	{"21", -973932308},
+	{"foobar", -790332482},
+	{"a-little-bit-long-string", -985981536},
+	{"a-little-bit-longer-string", -1486304829},
+	{"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8", -58897971},
+	{"abc", 479470107},
+}
+
+func TestMurmur2(t *testing.T) {
+	for _, v := range murmur2Tests {
+		h := int32(murmur2([]byte(v.in)))
+		test.Assert(t, h == v.out, "%v: expected %v, got %v", v.in, v.out, h)
+	}
+}
+
+func partition(t *testing.T, p sarama.Partitioner, key string, partKey string) int32 {
+	m := &sarama.ProducerMessage{Key: sarama.StringEncoder(key)}
+	if partKey != "" {
+		m.Metadata = &messageMetadata{partKey: partKey}
+	}
+	n, err := p.Partition(m, 16)
+	test.CheckFail(err, t)
+	return n
+}
+
+func TestKafkaPartitioner(t *testing.T) {
+	p := &kafkaPartitioner{cfg: &config.KafkaPartitioner{Type: config.KafkaPartitionerMurmur2}}
+	test.Assert(t, partition(t, p, "foobar", "") == int32(murmur2([]byte("foobar"))&0x7fffffff)%16, "murmur2 of message key expected")
+	test.Assert(t, partition(t, p, "key1", "foobar") == partition(t, p, "key2", "foobar"), "should be partitioned by partition key")
+
+	p = &kafkaPartitioner{cfg: &config.KafkaPartitioner{Type: config.KafkaPartitionerHash}}
+	h := sarama.NewHashPartitioner("topic")
+	for _, k := range []string{"a", "foobar", "12345"} {
+		n, err := h.Partition(&sarama.ProducerMessage{Key: sarama.StringEncoder(k)}, 16)
+		test.CheckFail(err, t)
+		test.Assert(t, partition(t, p, "", k) == n, "should be the same as sarama hash partitioner")
+	}
+
+	p = &kafkaPartitioner{cfg: &config.KafkaPartitioner{Type: config.KafkaPartitionerExplicit, Partitions: map[string]int32{"tenant1": 7, "tenant2": 20}}}
+	test.Assert(t, partition(t, p, "key1", "tenant1") == 7, "explicitly mapped partition expected")
+	test.Assert(t, partition(t, p, "key1", "foobar") == int32(murmur2([]byte("foobar"))&0x7fffffff)%16, "unmapped keys should be partitioned by murmur2")
+
+	_, err := p.Partition(&sarama.ProducerMessage{Key: sarama.StringEncoder("tenant2")}, 16)
+	test.Assert(t, err != nil, "partition out of range should fail")
+}
@@ -45,6 +45,10 @@ type Consumer interface {
 	//SetFormat allow to tell consumer the format of the file when there is no
 	//header
 	SetFormat(format string)
+
+	//Headers returns metadata headers of the last fetched message. Returns
+	//nil if the pipe doesn't support headers
+	Headers() map[string]string
 }
 
 //Producer producer interface for pipe
@@ -68,6 +72,105 @@ type Pipe interface {
 	Type() string
 }
 
+//initialOffsetSetter is implemented by the pipes which allow to override
+//global InitialOffset
+type initialOffsetSetter interface {
+	setInitialOffset(offset int64)
+}
+
+//SetInitialOffset overrides global InitialOffset for the consumers created
+//by the given pipe instance afterwards. Returns false if the pipe doesn't
+//support it
+func SetInitialOffset(p Pipe, offset int64) bool {
+	s, ok := p.(initialOffsetSetter)
+	if ok {
+		s.setInitialOffset(offset)
+	}
+	return ok
+}
+
+//startOffsetsSetter is implemented by the pipes which consumers can start
+//from the given positions
+type startOffsetsSetter interface {
+	setStartOffsets(offsets []Offset)
+}
+
+//SetStartOffsets makes the consumers created by the given pipe instance
+//afterwards to start from the given positions. Partitions not in the list are
+//consumed from the oldest offset. Returns false if the pipe doesn't support it
+func SetStartOffsets(p Pipe, offsets []Offset) bool {
+	s, ok := p.(startOffsetsSetter)
+	if ok {
+		s.setStartOffsets(offsets)
+	}
+	return ok
+}
+
+//messageKeyer is implemented by the consumers of the pipes, which preserve
+//message keys
+type messageKeyer interface {
+	messageKey() string
+}
+
+//MessageKey returns key of the message last fetched by the consumer. Returns
+//false if the pipe doesn't preserve message keys
+func MessageKey(c Consumer) (string, bool) {
+	k, ok := c.(messageKeyer)
+	if !ok {
+		return "", false
+	}
+	return k.messageKey(), true
+}
+
+//flusher is implemented by the producers which may return from
+//PushBatchCommit before the messages are acknowledged
+type flusher interface {
+	flush() error
+}
+
+//Flush waits for all the committed messages to be acknowledged. Consumer
+//positions of the messages should be persisted only after that
+func Flush(p Producer) error {
+	if f, ok := p.(flusher); ok {
+		return f.flush()
+	}
+	return nil
+}
+
+//FileBased returns true for the pipes, which write messages to the files
+//named after the message key, so as callers use the same key for all the
+//messages of the stream
+func FileBased(p Pipe) bool {
+	switch p.Type() {
+	case "file", "s3":
+		return true
+	}
+	return false
+}
+
+//NeedsAvroSchema returns true for the pipes, which write Avro output format
+//as Avro Object Container Files or Parquet files. Avro schema should be
+//passed to their producers by PushSchema
+func NeedsAvroSchema(p Pipe) bool {
+	var f *filePipe
+	switch v := p.(type) {
+	case *filePipe:
+		f = v
+	case *s3Pipe:
+		f = &v.filePipe
+	default:
+		return false
+	}
+	return f.avroOCF.Enabled || f.parquet.Enabled
+}
+
+func startOffset(o *int64) int64 {
+	if o != nil {
+		return *o
+	}
+	return InitialOffset
+}
+
 type constructor func(pctx context.Context, batchSize int, cfg *config.AppConfig, db *sql.DB) (Pipe, error)
 
 //Pipes is the list of registered pipes
@@ -0,0 +1,266 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pipe
+
+import (
+	"database/sql"
+	"fmt"
+	"golang.org/x/net/context" //"context"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/log"
+)
+
+//s3PollInterval is how often S3 consumer checks for the new files
+var s3PollInterval = 5 * time.Second
+
+//s3Pipe is the file pipe, which stores the files in S3 compatible object
+//storage. File is uploaded under the final name when it's closed by the
+//producer, so as consumers never see incomplete files
+type s3Pipe struct {
+	filePipe
+	client   *s3Client
+	partSize int
+	err      error //configuration error
+}
+
+//s3Writer buffers file content and uploads it in parts of partSize. Files
+//smaller than partSize are uploaded in a single request. First part is kept
+//in memory till the file is closed, so as the header can be rewritten
+type s3Writer struct {
+	client   *s3Client
+	key      string
+	partSize int
+	head     []byte //first part
+	buf      []byte
+	size     int64
+	pos      int64
+	uploadID string
+	parts    []s3Part
+}
+
+//s3FileInfo describes S3 object as a file
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func init() {
+	registerPlugin("s3", initS3Pipe)
+}
+
+func initS3Pipe(pctx context.Context, batchSize int, cfg *config.AppConfig, db *sql.DB) (Pipe, error) {
+	//Pipes of all the types are created on startup, so configuration errors
+	//are reported when the pipe is used
+	client, err := newS3Client(&cfg.S3)
+	return &s3Pipe{filePipe{cfg.S3.BaseDir, cfg.MaxFileSize, cfg.PipeAES256Key, cfg.PipeHMACKey, cfg.PipeVerifyHMAC, newKeyring(cfg), pipeCompression(cfg), cfg.PipeCompressionLevel, cfg.PipeFileNoHeader, cfg.AvroOCF, cfg.Parquet, cfg.FilePartitionTemplateParsed, cfg.FilePartition.Time == config.PartitionTimeEvent, Delimited, nil}, client, cfg.S3.PartSize, err}, nil
+}
+
+// Type returns Pipe type as S3
+func (p *s3Pipe) Type() string {
+	return "s3"
+}
+
+//NewProducer registers a new sync producer
+func (p *s3Pipe) NewProducer(topic string) (Producer, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &fileProducer{filePipe: &p.filePipe, topic: topic, files: make(map[string]*file), fs: p}, nil
+}
+
+//NewConsumer registers a new S3 consumer
+func (p *s3Pipe) NewConsumer(topic string) (Consumer, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	c := &fileConsumer{filePipe: &p.filePipe, topic: topic, fs: p}
+	return p.initConsumer(c)
+}
+
+func (p *s3Pipe) pollInterval() time.Duration {
+	return s3PollInterval
+}
+
+//MkdirAll is no-op, since S3 has no directories
+func (p *s3Pipe) MkdirAll(path string, perm os.FileMode) error {
+	return nil
+}
+
+//Rename is no-op for the files being closed, since they are uploaded under
+//the final name already
+func (p *s3Pipe) Rename(oldpath, newpath string) error {
+	if strings.TrimSuffix(oldpath, ".open") != newpath {
+		return fmt.Errorf("S3 pipe doesn't support renaming %v to %v", oldpath, newpath)
+	}
+	return nil
+}
+
+func (p *s3Pipe) ReadDir(dirname string) ([]os.FileInfo, error) {
+	prefix := strings.TrimSuffix(dirname, "/") + "/"
+	objs, prefixes, err := p.client.listObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]os.FileInfo, 0, len(objs)+len(prefixes))
+	for _, o := range objs {
+		res = append(res, &s3FileInfo{path.Base(o.Key), o.Size, o.LastModified, false})
+	}
+
+	//Common prefixes are the "directories" of partitioned layout
+	for _, d := range prefixes {
+		res = append(res, &s3FileInfo{path.Base(d.Prefix), 0, time.Time{}, true})
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Name() < res[j].Name() })
+
+	return res, nil
+}
+
+func (p *s3Pipe) OpenRead(name string, offset int64) (io.ReadCloser, error) {
+	return p.client.getObject(name, offset)
+}
+
+//OpenWrite returns writer, which uploads the file under the final name when
+//closed. Seeking is supported within the first part only
+func (p *s3Pipe) OpenWrite(name string) (io.WriteCloser, io.Seeker, error) {
+	w := &s3Writer{client: p.client, key: strings.TrimSuffix(name, ".open"), partSize: p.partSize}
+	return w, w, nil
+}
+
+func (p *s3Pipe) Remove(name string) error {
+	return p.client.deleteObject(name)
+}
+
+func (w *s3Writer) uploadPart(num int, data []byte) error {
+	if w.uploadID == "" {
+		id, err := w.client.createMultipartUpload(w.key)
+		if err != nil {
+			return err
+		}
+		w.uploadID = id
+	}
+
+	etag, err := w.client.uploadPart(w.key, w.uploadID, num, data)
+	if err != nil {
+		return err
+	}
+
+	w.parts = append(w.parts, s3Part{num, etag})
+	log.Debugf("Uploaded part %v of %v, size %v", num, w.key, len(data))
+
+	return nil
+}
+
+func (w *s3Writer) Write(b []byte) (int, error) {
+	//Overwrite previously written data
+	if w.pos < w.size {
+		if w.pos+int64(len(b)) > int64(len(w.head)) {
+			return 0, fmt.Errorf("S3 pipe can't overwrite beyond the first part of %v", w.key)
+		}
+		copy(w.head[w.pos:], b)
+		w.pos += int64(len(b))
+		return len(b), nil
+	}
+
+	n := len(b)
+	if len(w.head) < w.partSize {
+		h := w.partSize - len(w.head)
+		if h > len(b) {
+			h = len(b)
+		}
+		w.head = append(w.head, b[:h]...)
+		b = b[h:]
+	}
+
+	w.buf = append(w.buf, b...)
+	for len(w.buf) >= w.partSize {
+		if err := w.uploadPart(len(w.parts)+2, w.buf[:w.partSize]); err != nil {
+			return 0, err
+		}
+		w.buf = append([]byte{}, w.buf[w.partSize:]...)
+	}
+
+	w.size += int64(n)
+	w.pos = w.size
+
+	return n, nil
+}
+
+//Seek sets position of the next write
+func (w *s3Writer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += w.pos
+	case io.SeekEnd:
+		offset += w.size
+	}
+	if offset < 0 || offset > w.size {
+		return 0, fmt.Errorf("Invalid S3 writer seek offset: %v", offset)
+	}
+	w.pos = offset
+	return offset, nil
+}
+
+//Close uploads the rest of the file and completes multipart upload. Upload
+//is aborted on failure
+func (w *s3Writer) Close() error {
+	if w.uploadID == "" && len(w.buf) == 0 {
+		return w.client.putObject(w.key, w.head)
+	}
+
+	var err error
+	if len(w.buf) != 0 {
+		err = w.uploadPart(len(w.parts)+2, w.buf)
+	}
+	if err == nil {
+		err = w.uploadPart(1, w.head)
+	}
+	if err == nil {
+		sort.Slice(w.parts, func(i, j int) bool { return w.parts[i].PartNumber < w.parts[j].PartNumber })
+		err = w.client.completeMultipartUpload(w.key, w.uploadID, w.parts)
+	}
+	if err != nil {
+		log.E(w.client.abortMultipartUpload(w.key, w.uploadID))
+		return err
+	}
+
+	w.head, w.buf = nil, nil
+
+	return nil
+}
+
+func (f *s3FileInfo) Name() string       { return f.name }
+func (f *s3FileInfo) Size() int64        { return f.size }
+func (f *s3FileInfo) Mode() os.FileMode  { return 0640 }
+func (f *s3FileInfo) ModTime() time.Time { return f.modTime }
+func (f *s3FileInfo) IsDir() bool        { return f.dir }
+func (f *s3FileInfo) Sys() interface{}   { return nil }
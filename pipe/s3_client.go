@@ -0,0 +1,368 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pipe
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/log"
+)
+
+//Retries of S3 requests failed with network or server errors
+var (
+	s3Retries      = 3
+	s3RetryBackoff = 500 * time.Millisecond
+)
+
+const s3TimeFormat = "20060102T150405Z"
+
+//s3Client is minimal S3 REST API client, which supports requests required by
+//the S3 pipe. Requests are signed by AWS Signature Version 4
+type s3Client struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	http      *http.Client
+}
+
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+type s3Prefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListResult struct {
+	Contents              []s3Object `xml:"Contents"`
+	CommonPrefixes        []s3Prefix `xml:"CommonPrefixes"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func newS3Client(cfg *config.S3Config) (*s3Client, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("S3 bucket is not configured")
+	}
+
+	ep := cfg.Endpoint
+	if ep == "" {
+		ep = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+
+	u, err := url.Parse(ep)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Client{endpoint: u, region: cfg.Region, bucket: cfg.Bucket, accessKey: cfg.AccessKeyID, secretKey: cfg.SecretAccessKey, pathStyle: cfg.PathStyle, http: &http.Client{Timeout: 5 * time.Minute}}, nil
+}
+
+//uriEncode encodes the string as required by AWS signature: every byte
+//except unreserved characters is percent encoded, slash is optionally
+//preserved
+func uriEncode(s string, encodeSlash bool) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var res []string
+	for _, k := range keys {
+		vals := append([]string{}, q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			res = append(res, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(res, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+//sign adds AWS Signature Version 4 authorization header to the request.
+//Host, Range and x-amz-* headers are signed
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(s3TimeFormat)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	if c.accessKey == "" {
+		return
+	}
+
+	hdrs := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") || k == "range" {
+			hdrs[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+
+	names := make([]string, 0, len(hdrs))
+	for k := range hdrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders string
+	for _, k := range names {
+		canonicalHeaders += k + ":" + hdrs[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{req.Method, req.URL.EscapedPath(), canonicalQuery(req.URL.Query()), canonicalHeaders, signedHeaders, payloadHash}, "\n")
+
+	scope := amzDate[:8] + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), amzDate[:8])
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+//objectURL returns URL of the object with the given key, bucket URL is
+//returned for empty key
+func (c *s3Client) objectURL(key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	p := strings.TrimSuffix(u.Path, "/") + "/"
+	if c.pathStyle {
+		p += c.bucket + "/"
+	} else {
+		u.Host = c.bucket + "." + u.Host
+	}
+	p += key
+	u.Path = p
+	u.RawPath = uriEncode(p, false)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+func s3ResponseError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	var e s3Error
+	if xml.Unmarshal(body, &e) == nil && e.Code != "" {
+		return fmt.Errorf("S3 request failed: %v: %v: %v", resp.Status, e.Code, e.Message)
+	}
+	return fmt.Errorf("S3 request failed: %v", resp.Status)
+}
+
+//do sends signed request, retrying on network and server errors. Response
+//body should be closed by the caller
+func (c *s3Client) do(method string, key string, query url.Values, hdr http.Header, body []byte) (*http.Response, error) {
+	var err error
+	for i := 0; i < s3Retries; i++ {
+		if i != 0 {
+			time.Sleep(s3RetryBackoff * time.Duration(i))
+		}
+
+		var req *http.Request
+		req, err = http.NewRequest(method, c.objectURL(key, query).String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range hdr {
+			req.Header[k] = v
+		}
+		c.sign(req, sha256Hex(body), time.Now())
+
+		var resp *http.Response
+		resp, err = c.http.Do(req)
+		if err != nil {
+			log.Warnf("S3 %v %v failed: %v", method, key, err)
+			continue
+		}
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		err = s3ResponseError(resp)
+		log.E(resp.Body.Close())
+		if resp.StatusCode < 500 {
+			break
+		}
+		log.Warnf("S3 %v %v failed: %v", method, key, err)
+	}
+	return nil, err
+}
+
+//call sends the request and decodes XML response into res, if it's not nil
+func (c *s3Client) call(method string, key string, query url.Values, body []byte, res interface{}) (http.Header, error) {
+	resp, err := c.do(method, key, query, nil, body)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { log.E(resp.Body.Close()) }()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	//Complete multipart upload may fail after 200 OK response is sent
+	var e s3Error
+	if xml.Unmarshal(b, &e) == nil && e.Code != "" {
+		return nil, fmt.Errorf("S3 request failed: %v: %v", e.Code, e.Message)
+	}
+
+	if res != nil {
+		if err = xml.Unmarshal(b, res); err != nil {
+			return nil, err
+		}
+	}
+
+	return resp.Header, nil
+}
+
+func (c *s3Client) putObject(key string, data []byte) error {
+	_, err := c.call("PUT", key, nil, data, nil)
+	return err
+}
+
+func (c *s3Client) deleteObject(key string) error {
+	_, err := c.call("DELETE", key, nil, nil, nil)
+	return err
+}
+
+//getObject returns object content starting from the given offset
+func (c *s3Client) getObject(key string, offset int64) (io.ReadCloser, error) {
+	var hdr http.Header
+	if offset != 0 {
+		hdr = http.Header{"Range": []string{"bytes=" + strconv.FormatInt(offset, 10) + "-"}}
+	}
+	resp, err := c.do("GET", key, nil, hdr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+//listObjects returns objects with the given prefix, not including objects
+//in the nested "directories", sorted by key. Nested "directories" are
+//returned as common prefixes
+func (c *s3Client) listObjects(prefix string) ([]s3Object, []s3Prefix, error) {
+	var res []s3Object
+	var prefixes []s3Prefix
+	q := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+	for {
+		var r s3ListResult
+		if _, err := c.call("GET", "", q, nil, &r); err != nil {
+			return nil, nil, err
+		}
+		res = append(res, r.Contents...)
+		prefixes = append(prefixes, r.CommonPrefixes...)
+		if !r.IsTruncated {
+			return res, prefixes, nil
+		}
+		q.Set("continuation-token", r.NextContinuationToken)
+	}
+}
+
+func (c *s3Client) createMultipartUpload(key string) (string, error) {
+	var r struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if _, err := c.call("POST", key, url.Values{"uploads": {""}}, nil, &r); err != nil {
+		return "", err
+	}
+	return r.UploadID, nil
+}
+
+func (c *s3Client) uploadPart(key string, uploadID string, num int, data []byte) (string, error) {
+	hdr, err := c.call("PUT", key, url.Values{"uploadId": {uploadID}, "partNumber": {strconv.Itoa(num)}}, data, nil)
+	if err != nil {
+		return "", err
+	}
+	return hdr.Get("ETag"), nil
+}
+
+func (c *s3Client) completeMultipartUpload(key string, uploadID string, parts []s3Part) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	_, err = c.call("POST", key, url.Values{"uploadId": {uploadID}}, body, nil)
+	return err
+}
+
+func (c *s3Client) abortMultipartUpload(key string, uploadID string) error {
+	_, err := c.call("DELETE", key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	return err
+}
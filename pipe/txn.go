@@ -0,0 +1,102 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pipe
+
+import (
+	"fmt"
+)
+
+//Offset is the consumer group position in the topic partition, which is the
+//offset of the next message to consume
+type Offset struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Metadata  string
+}
+
+//TxnProducer produces messages to multiple topics and commits consumer group
+//offsets atomically. Transaction ID identifies the producer across restarts,
+//so as unfinished transactions of the previous instance with the same ID are
+//aborted when new instance is created
+type TxnProducer interface {
+	//NewProducer returns producer of the topic. Messages queued by its
+	//PushBatch are produced by the next Commit. PushBatchCommit of the
+	//producer commits the transaction without offsets
+	NewProducer(topic string) (Producer, error)
+	//Commit produces messages queued by all the producers and commits given
+	//offsets of the consumer group in a single transaction. Offsets are not
+	//committed if group is empty. Transaction is aborted on error and
+	//producer can't be used afterwards
+	Commit(group string, offsets []Offset) error
+	Close() error
+}
+
+//txnPipe is implemented by the pipes which support transactions
+type txnPipe interface {
+	newTxnProducer(id string) (TxnProducer, error)
+	committedOffsets(group string) ([]Offset, error)
+}
+
+//NewTxnProducer creates transactional producer with given transaction ID
+func NewTxnProducer(p Pipe, id string) (TxnProducer, error) {
+	t, ok := p.(txnPipe)
+	if !ok {
+		return nil, fmt.Errorf("%v pipe doesn't support transactions", p.Type())
+	}
+	return t.newTxnProducer(id)
+}
+
+//CommittedOffsets returns offsets committed by the consumer group for all
+//the topics
+func CommittedOffsets(p Pipe, group string) ([]Offset, error) {
+	t, ok := p.(txnPipe)
+	if !ok {
+		return nil, fmt.Errorf("%v pipe doesn't support transactions", p.Type())
+	}
+	return t.committedOffsets(group)
+}
+
+//offsetConsumer is implemented by the consumers, which positions can be
+//committed by transactional producer
+type offsetConsumer interface {
+	groupID() string
+	nextOffset() *Offset
+}
+
+//ConsumerGroup returns consumer group of the consumer, or empty string if
+//consumer doesn't belong to a group
+func ConsumerGroup(c Consumer) string {
+	if o, ok := c.(offsetConsumer); ok {
+		return o.groupID()
+	}
+	return ""
+}
+
+//NextOffset returns the position following the last fetched message, which
+//should be committed after the message is processed. Returns nil if consumer
+//doesn't support it
+func NextOffset(c Consumer) *Offset {
+	if o, ok := c.(offsetConsumer); ok {
+		return o.nextOffset()
+	}
+	return nil
+}
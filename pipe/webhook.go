@@ -0,0 +1,309 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pipe
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/log"
+	"golang.org/x/net/context" //"context"
+)
+
+//WebhookSignatureHeader carries hex encoded HMAC-SHA256 of the request body,
+//signed by pipe_hmac_key, prefixed by "sha256="
+const WebhookSignatureHeader = "X-Storagetapper-Signature"
+
+//webhookPipe POSTs the messages to HTTP endpoint
+type webhookPipe struct {
+	ctx     context.Context
+	cfg     *config.WebhookConfig
+	appCfg  *config.AppConfig
+	hmacKey string
+	client  *http.Client
+}
+
+type webhookMessage struct {
+	key     string
+	partKey string
+	headers map[string]string
+	value   []byte
+}
+
+//webhookBodyMessage is the representation of the message in the request body.
+//Value is embedded as is if the format is json, otherwise it's base64 encoded
+type webhookBodyMessage struct {
+	Key     string            `json:"key"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Value   interface{}       `json:"value"`
+}
+
+//webhookBody is the body of the request
+type webhookBody struct {
+	Topic    string               `json:"topic"`
+	Format   string               `json:"format"`
+	Messages []webhookBodyMessage `json:"messages"`
+}
+
+//webhookProducer sends the batch in up to Concurrency parallel requests.
+//Messages are assigned to the requests by the hash of the key, so as the
+//messages with the same key are delivered in order
+type webhookProducer struct {
+	pipe   *webhookPipe
+	topic  string
+	url    string
+	format string
+	batch  []webhookMessage
+}
+
+func init() {
+	registerPlugin("webhook", initWebhookPipe)
+}
+
+func initWebhookPipe(pctx context.Context, batchSize int, cfg *config.AppConfig, db *sql.DB) (Pipe, error) {
+	if pctx == nil {
+		pctx = context.Background()
+	}
+	return &webhookPipe{
+		ctx:     pctx,
+		cfg:     &cfg.Webhook,
+		appCfg:  cfg,
+		hmacKey: cfg.PipeHMACKey,
+		client:  &http.Client{Timeout: time.Duration(cfg.Webhook.Timeout) * time.Second},
+	}, nil
+}
+
+//Type returns pipe type
+func (p *webhookPipe) Type() string {
+	return "webhook"
+}
+
+//NewProducer creates producer which sends messages to the URL of the topic
+func (p *webhookPipe) NewProducer(topic string) (Producer, error) {
+	url, err := p.appCfg.GetWebhookURL(topic)
+	if err != nil {
+		return nil, err
+	}
+	return &webhookProducer{pipe: p, topic: topic, url: url, format: "json"}, nil
+}
+
+//NewConsumer is not supported by webhook pipe
+func (p *webhookPipe) NewConsumer(topic string) (Consumer, error) {
+	return nil, fmt.Errorf("webhook pipe doesn't support consumers")
+}
+
+//post sends the request once. Returns true if the request can be retried
+func (p *webhookProducer) post(body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(p.pipe.ctx)
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range p.pipe.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	if p.pipe.hmacKey != "" {
+		h := hmac.New(sha256.New, []byte(p.pipe.hmacKey))
+		_, _ = h.Write(body)
+		req.Header.Set(WebhookSignatureHeader, fmt.Sprintf("sha256=%0x", h.Sum(nil)))
+	}
+
+	resp, err := p.pipe.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	log.E(resp.Body.Close())
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	err = fmt.Errorf("Webhook %v responded: %v", p.url, resp.Status)
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+
+	return retry, err
+}
+
+func (p *webhookProducer) encode(msgs []webhookMessage) ([]byte, error) {
+	b := &webhookBody{Topic: p.topic, Format: p.format, Messages: make([]webhookBodyMessage, 0, len(msgs))}
+	for _, m := range msgs {
+		var v interface{}
+		if m.value != nil {
+			v = m.value
+			if p.format == "json" && json.Valid(m.value) {
+				v = json.RawMessage(m.value)
+			}
+		}
+		b.Messages = append(b.Messages, webhookBodyMessage{Key: m.key, Headers: m.headers, Value: v})
+	}
+	return json.Marshal(b)
+}
+
+//send delivers the messages in single request, retrying with exponential
+//backoff
+func (p *webhookProducer) send(msgs []webhookMessage) error {
+	body, err := p.encode(msgs)
+	if err != nil {
+		return err
+	}
+
+	backoff := time.Duration(p.pipe.cfg.RetryBackoff) * time.Millisecond
+	maxBackoff := time.Duration(p.pipe.cfg.MaxRetryBackoff) * time.Millisecond
+	for i := 0; ; i++ {
+		retry, err := p.post(body)
+		if err == nil || !retry || i >= p.pipe.cfg.Retries {
+			return err
+		}
+
+		log.Warnf("Retrying webhook request in %v. Attempt %v: %v", backoff, i+1, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-p.pipe.ctx.Done():
+			return err
+		}
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (p *webhookProducer) lane(m *webhookMessage, n int) int {
+	key := m.partKey
+	if key == "" {
+		key = m.key
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+func (p *webhookProducer) pushBatchOptions(key string, data interface{}, opts *MessageOptions) error {
+	m := webhookMessage{key: key}
+	switch v := data.(type) {
+	case nil:
+	case []byte:
+		m.value = v
+	default:
+		return fmt.Errorf("webhook pipe can handle binary arrays only")
+	}
+	if opts != nil {
+		m.partKey = opts.PartitionKey
+		m.headers = opts.Headers
+	}
+	p.batch = append(p.batch, m)
+	return nil
+}
+
+//PushBatch queues the message to be sent by PushBatchCommit
+func (p *webhookProducer) PushBatch(key string, data interface{}) error {
+	return p.pushBatchOptions(key, data, nil)
+}
+
+//PushBatchCommit sends queued messages. Only the messages of failed requests
+//are kept in the batch on error, so as retried commit doesn't resend
+//delivered messages
+func (p *webhookProducer) PushBatchCommit() error {
+	if len(p.batch) == 0 {
+		return nil
+	}
+
+	lanes := make([][]webhookMessage, p.pipe.cfg.Concurrency)
+	for i := range p.batch {
+		l := p.lane(&p.batch[i], len(lanes))
+		lanes[l] = append(lanes[l], p.batch[i])
+	}
+
+	errs := make([]error, len(lanes))
+	var wg sync.WaitGroup
+	for i := range lanes {
+		if len(lanes[i]) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = p.send(lanes[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var err error
+	p.batch = p.batch[:0]
+	for i := range lanes {
+		if errs[i] != nil {
+			err = errs[i]
+			p.batch = append(p.batch, lanes[i]...)
+		}
+	}
+
+	log.E(err)
+
+	return err
+}
+
+//Push sends the message immediately
+func (p *webhookProducer) Push(data interface{}) error {
+	return p.PushK("", data)
+}
+
+//PushK sends keyed message immediately
+func (p *webhookProducer) PushK(key string, data interface{}) error {
+	b, ok := data.([]byte)
+	if !ok && data != nil {
+		return fmt.Errorf("webhook pipe can handle binary arrays only")
+	}
+	err := p.send([]webhookMessage{{key: key, value: b}})
+	log.E(err)
+	return err
+}
+
+//PushSchema sends schema message in the batch, the same way as other
+//messages
+func (p *webhookProducer) PushSchema(key string, data []byte) error {
+	return p.PushBatch(key, data)
+}
+
+//SetFormat sets the format of the messages, which is passed in the request
+//body
+func (p *webhookProducer) SetFormat(format string) {
+	p.format = format
+}
+
+//Close producer. Messages not committed by PushBatchCommit are discarded
+func (p *webhookProducer) Close() error {
+	return nil
+}
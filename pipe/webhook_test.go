@@ -0,0 +1,190 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pipe
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"text/template"
+
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/test"
+)
+
+type testWebhookMessage struct {
+	Key     string
+	Headers map[string]string
+	Value   json.RawMessage
+}
+
+type testWebhookBody struct {
+	Topic    string
+	Format   string
+	Messages []testWebhookMessage
+}
+
+//fakeWebhook records received messages. First "fail" requests are responded
+//with "status"
+type fakeWebhook struct {
+	t        *testing.T
+	mutex    sync.Mutex
+	paths    map[string]int
+	messages []testWebhookMessage
+	requests int
+	fail     int
+	status   int
+}
+
+func (s *fakeWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	test.CheckFail(err, s.t)
+
+	h := hmac.New(sha256.New, []byte("hmac_key"))
+	_, _ = h.Write(body)
+	test.Assert(s.t, r.Header.Get(WebhookSignatureHeader) == fmt.Sprintf("sha256=%0x", h.Sum(nil)), "signature mismatch")
+	test.Assert(s.t, r.Header.Get("X-Test") == "value1", "configured header expected")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.requests++
+	if s.fail > 0 {
+		s.fail--
+		w.WriteHeader(s.status)
+		return
+	}
+
+	var b testWebhookBody
+	test.CheckFail(json.Unmarshal(body, &b), s.t)
+	s.paths[r.URL.Path]++
+	s.messages = append(s.messages, b.Messages...)
+}
+
+func (s *fakeWebhook) failNext(n int, status int) {
+	s.mutex.Lock()
+	s.fail, s.status, s.requests = n, status, 0
+	s.mutex.Unlock()
+}
+
+func newTestWebhookPipe(t *testing.T, concurrency int) (*fakeWebhook, Pipe, func()) {
+	fw := &fakeWebhook{t: t, paths: make(map[string]int)}
+	srv := httptest.NewServer(fw)
+
+	c := &config.AppConfig{}
+	c.PipeHMACKey = "hmac_key"
+	c.Webhook = config.WebhookConfig{Timeout: 5, Retries: 2, RetryBackoff: 1, MaxRetryBackoff: 2, Concurrency: concurrency, Headers: map[string]string{"X-Test": "value1"}}
+	c.WebhookURLTemplateParsed = template.Must(template.New("webhook").Parse(srv.URL + "/events/{{.Topic}}"))
+
+	p, err := Create(nil, "webhook", 16, c, nil)
+	test.CheckFail(err, t)
+
+	return fw, p, srv.Close
+}
+
+func TestWebhookPipe(t *testing.T) {
+	fw, p, stop := newTestWebhookPipe(t, 3)
+	defer stop()
+
+	test.Assert(t, p.Type() == "webhook", "unexpected pipe type")
+	_, err := p.NewConsumer("topic1")
+	test.Assert(t, err != nil, "webhook pipe doesn't support consumers")
+
+	pr, err := p.NewProducer("topic1")
+	test.CheckFail(err, t)
+	pr.SetFormat("json")
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%v", i%10)
+		test.CheckFail(PushBatchOptions(pr, key, []byte(fmt.Sprintf(`{"seq":%v}`, i)), &MessageOptions{Headers: map[string]string{HeaderTable: "t1"}}), t)
+	}
+	test.CheckFail(pr.PushBatchCommit(), t)
+
+	test.Assert(t, len(fw.messages) == 100, "expected 100 messages, got %v", len(fw.messages))
+	test.Assert(t, fw.paths["/events/topic1"] > 1 && fw.paths["/events/topic1"] <= 3, "expected up to 3 parallel requests, got %v", fw.paths)
+
+	last := make(map[string]int)
+	for _, m := range fw.messages {
+		var v struct{ Seq int }
+		test.CheckFail(json.Unmarshal(m.Value, &v), t)
+		test.Assert(t, m.Key == fmt.Sprintf("key%v", v.Seq%10), "unexpected key %v of message %v", m.Key, v.Seq)
+		test.Assert(t, m.Headers[HeaderTable] == "t1", "headers expected")
+		if l, ok := last[m.Key]; ok {
+			test.Assert(t, l < v.Seq, "messages of the key %v out of order: %v after %v", m.Key, v.Seq, l)
+		}
+		last[m.Key] = v.Seq
+	}
+
+	//Binary formats are base64 encoded
+	pr.SetFormat("msgpack")
+	test.CheckFail(pr.PushK("key1", []byte{0x81, 0x01}), t)
+	var b []byte
+	test.CheckFail(json.Unmarshal(fw.messages[100].Value, &b), t)
+	test.Assert(t, base64.StdEncoding.EncodeToString(b) == "gQE=", "unexpected binary value: %v", b)
+	test.CheckFail(pr.Close(), t)
+}
+
+func TestWebhookPipeRetry(t *testing.T) {
+	fw, p, stop := newTestWebhookPipe(t, 1)
+	defer stop()
+
+	pr, err := p.NewProducer("topic1")
+	test.CheckFail(err, t)
+
+	//Transient failures are retried
+	fw.failNext(2, http.StatusServiceUnavailable)
+	test.CheckFail(pr.PushBatch("key1", []byte(`"msg1"`)), t)
+	test.CheckFail(pr.PushBatchCommit(), t)
+	test.Assert(t, fw.requests == 3 && len(fw.messages) == 1, "expected 3 requests, got %v", fw.requests)
+
+	//Retries exhausted
+	fw.failNext(3, http.StatusTooManyRequests)
+	test.CheckFail(pr.PushBatch("key1", []byte(`"msg2"`)), t)
+	test.Assert(t, pr.PushBatchCommit() != nil, "commit should fail after retries")
+	test.Assert(t, fw.requests == 3 && len(fw.messages) == 1, "expected 3 requests, got %v", fw.requests)
+
+	//Client errors are not retried
+	fw.failNext(1, http.StatusBadRequest)
+	test.Assert(t, pr.PushBatchCommit() != nil, "commit should fail on client error")
+	test.Assert(t, fw.requests == 1, "client error shouldn't be retried")
+
+	//Failed messages are kept in the batch
+	test.CheckFail(pr.PushBatchCommit(), t)
+	test.Assert(t, len(fw.messages) == 2 && string(fw.messages[1].Value) == `"msg2"`, "failed message should be resent")
+
+	test.CheckFail(pr.PushBatchCommit(), t)
+	test.Assert(t, len(fw.messages) == 2, "delivered messages shouldn't be resent")
+}
+
+func TestWebhookPipeNotConfigured(t *testing.T) {
+	p, err := Create(nil, "webhook", 16, &config.AppConfig{}, nil)
+	test.CheckFail(err, t)
+
+	_, err = p.NewProducer("topic1")
+	test.Assert(t, err != nil, "producer of not configured pipe should fail")
+}
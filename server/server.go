@@ -32,6 +32,8 @@ func init() {
 	http.HandleFunc("/schema", schemaCmd)
 	http.HandleFunc("/cluster", clusterInfoCmd)
 	http.HandleFunc("/table", tableCmd)
+	http.HandleFunc("/verify", verifyCmd)
+	http.HandleFunc("/stream", streamCmd)
 }
 
 //StartHTTPServer starts listening and serving traffic on configured port and sets up http routes.
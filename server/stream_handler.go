@@ -0,0 +1,176 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/encoder"
+	"github.com/raksh93/storagetapper/log"
+	"github.com/raksh93/storagetapper/pipe"
+	"github.com/raksh93/storagetapper/state"
+	"github.com/raksh93/storagetapper/stream"
+)
+
+//streamReq parameters of the stream request
+type streamReq struct {
+	Service string
+	Db      string
+	Table   string
+	Input   string
+	Output  string
+	Version int
+	Cursor  string
+	SeqNo   uint64
+	Limit   int
+}
+
+var streamLock sync.Mutex
+var streamClients int
+
+func parseStreamReq(r *http.Request) (*streamReq, error) {
+	q := r.URL.Query()
+	t := &streamReq{Service: q.Get("service"), Db: q.Get("db"), Table: q.Get("table"), Input: q.Get("input"), Output: q.Get("output"), Cursor: q.Get("cursor")}
+	if len(t.Service) == 0 || len(t.Db) == 0 || len(t.Table) == 0 || len(t.Output) == 0 {
+		return nil, fmt.Errorf("Invalid request. All fields(service,db,table,output) must not be empty")
+	}
+	if t.Input == "" {
+		t.Input = config.Get().DefaultInputType
+	}
+
+	var err error
+	if v := q.Get("version"); v != "" {
+		if t.Version, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("Invalid version: %v", v)
+		}
+	}
+	if v := q.Get("seqno"); v != "" {
+		if t.SeqNo, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("Invalid seqno: %v", v)
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if t.Limit, err = strconv.Atoi(v); err != nil || t.Limit < 0 {
+			return nil, fmt.Errorf("Invalid limit: %v", v)
+		}
+	}
+
+	return t, nil
+}
+
+//acquireStream returns false if maximum number of concurrent streams reached
+func acquireStream(max int) bool {
+	streamLock.Lock()
+	defer streamLock.Unlock()
+	if streamClients >= max {
+		return false
+	}
+	streamClients++
+	return true
+}
+
+func releaseStream() {
+	streamLock.Lock()
+	streamClients--
+	streamLock.Unlock()
+}
+
+//openStream creates consumer of the table output topic, positioned at the
+//cursor
+func openStream(cfg *config.AppConfig, r *http.Request, t *streamReq) (*stream.Request, error) {
+	rows, err := state.GetCond("service=? AND db=? AND tableName=? AND input=? AND output=? AND version=?", t.Service, t.Db, t.Table, t.Input, t.Output, t.Version)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("Table is not registered: service=%v db=%v table=%v", t.Service, t.Db, t.Table)
+	}
+
+	cursor, err := stream.ParseCursor(t.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	enc, err := encoder.Create(rows[0].OutputFormat, t.Service, t.Db, t.Table)
+	if err != nil {
+		return nil, err
+	}
+
+	topic, err := cfg.GetOutputTopicName(t.Service, t.Db, t.Table, t.Input, t.Output, t.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := pipe.Create(r.Context(), t.Output, cfg.PipeBatchSize, cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !pipe.SetStartOffsets(p, cursor.Offsets(topic)) && !pipe.SetInitialOffset(p, pipe.OffsetOldest) {
+		return nil, fmt.Errorf("Streaming is not supported for %v pipe", p.Type())
+	}
+
+	c, err := p.NewConsumer(topic)
+	if err != nil {
+		return nil, err
+	}
+	c.SetFormat(rows[0].OutputFormat)
+
+	return &stream.Request{Consumer: c, Decoder: enc, Cursor: cursor, SeqNo: t.SeqNo, Limit: t.Limit, Heartbeat: time.Duration(cfg.Stream.HeartbeatInterval) * time.Second}, nil
+}
+
+//streamCmd streams output events of the table as JSON lines, until client
+//disconnects or limit is reached
+func streamCmd(w http.ResponseWriter, r *http.Request) {
+	cfg := config.Get()
+
+	t, err := parseStreamReq(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !acquireStream(cfg.Stream.MaxClients) {
+		http.Error(w, "Too many streams", http.StatusServiceUnavailable)
+		return
+	}
+	defer releaseStream()
+
+	s, err := openStream(cfg, r, t)
+	if err != nil {
+		log.Errorf("Stream http: service=%v, db=%v, table=%v, error=%v", t.Service, t.Db, t.Table, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer func() { log.E(s.Consumer.CloseOnFailure()) }()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	err = stream.Run(r.Context(), w, s)
+	if err != nil {
+		log.Errorf("Stream http: service=%v, db=%v, table=%v, error=%v", t.Service, t.Db, t.Table, err)
+	}
+}
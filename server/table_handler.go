@@ -78,6 +78,78 @@ type tableListResponse struct {
 	Output       string
 	Version      int
 	OutputFormat string
+	//SnapshotStatus is not empty when table snapshot is running or deferred
+	SnapshotStatus string `json:",omitempty"`
+	SnapshotInfo   string `json:",omitempty"`
+}
+
+//createTopics creates Kafka topics of the registered table, if topics
+//provisioning is enabled
+func createTopics(t *tableCmdReq, sdb string, table string) error {
+	cfg := config.Get()
+	if !cfg.KafkaTopics.Create {
+		return nil
+	}
+	topics, err := cfg.GetKafkaTopics(t.Service, sdb, table, t.Input, t.Output, t.Version)
+	if err != nil {
+		return err
+	}
+	return pipe.CreateKafkaTopics(cfg, topics)
+}
+
+//deleteTopics deletes Kafka topics of the deregistered table, if topics
+//deletion is enabled. Changelog topic is deleted only when no other registered
+//table shares it
+func deleteTopics(svc string, sdb string, table string, input string, output string, version int) error {
+	cfg := config.Get()
+	if !cfg.KafkaTopics.Delete {
+		return nil
+	}
+	topics, err := cfg.GetKafkaTopics(svc, sdb, table, input, output, version)
+	if err != nil {
+		return err
+	}
+	var changelog string
+	if cfg.ChangelogPipeType == "kafka" {
+		if changelog, err = cfg.GetChangelogTopicName(svc, sdb, table, input, output, version); err != nil {
+			return err
+		}
+	}
+	var names []string
+	for n := range topics {
+		if n == changelog {
+			var used bool
+			if used, err = changelogTopicUsed(cfg, n); err != nil {
+				return err
+			}
+			if used {
+				log.Infof("Changelog topic %v is used by other registered tables, skipping deletion", n)
+				continue
+			}
+		}
+		names = append(names, n)
+	}
+	return pipe.DeleteKafkaTopics(cfg, names)
+}
+
+//changelogTopicUsed checks whether any of the registered tables resolves to
+//the given changelog topic name. Changelog topic name template may not include
+//all the table fields, so the topic can be shared by multiple tables
+func changelogTopicUsed(cfg *config.AppConfig, topic string) (bool, error) {
+	rows, err := state.Get()
+	if err != nil {
+		return false, err
+	}
+	for _, r := range rows {
+		n, err := cfg.GetChangelogTopicName(r.Service, r.Db, r.Table, r.Input, r.Output, r.Version)
+		if err != nil {
+			return false, err
+		}
+		if n == topic {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 func iterateRows(rows *sql.Rows, t *tableCmdReq) error {
@@ -89,6 +161,9 @@ func iterateRows(rows *sql.Rows, t *tableCmdReq) error {
 		if !state.RegisterTable(&db.Loc{Cluster: t.Cluster, Service: t.Service, Name: d}, n, t.Input, t.Output, t.Version, t.OutputFormat) {
 			return fmt.Errorf("Error registering table: %v.%v", d, n)
 		}
+		if err := createTopics(t, d, n); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -104,7 +179,7 @@ func handleAddCmd(w http.ResponseWriter, t *tableCmdReq) error {
 			return errors.New("Error registering table")
 		}
 		updateTableRegCnt()
-		return nil
+		return createTopics(t, t.Db, t.Table)
 	}
 
 	conn, err := db.OpenService(&db.Loc{Service: t.Service, Cluster: t.Cluster, Name: ""}, "")
@@ -160,7 +235,16 @@ func handleDelListCmd(w http.ResponseWriter, t *tableCmdReq, del bool) error {
 				err = fmt.Errorf("Error deregistering table: service=%v db=%v table=%v", v.Service, v.Db, v.Table)
 				break
 			}
-			if b, err = json.Marshal(&tableListResponse{Cluster: v.Cluster, Service: v.Service, Db: v.Db, Table: v.Table, Input: v.Input, Output: v.Output, Version: v.Version, OutputFormat: v.OutputFormat}); err != nil {
+			if del && strings.ToLower(t.Apply) == "yes" {
+				if err = deleteTopics(v.Service, v.Db, v.Table, v.Input, v.Output, v.Version); err != nil {
+					break
+				}
+			}
+			var status, info string
+			if status, info, err = state.GetSnapshotStatus(v.ID); err != nil {
+				break
+			}
+			if b, err = json.Marshal(&tableListResponse{Cluster: v.Cluster, Service: v.Service, Db: v.Db, Table: v.Table, Input: v.Input, Output: v.Output, Version: v.Version, OutputFormat: v.OutputFormat, SnapshotStatus: status, SnapshotInfo: info}); err != nil {
 				break
 			}
 			resp = append(resp, b...)
@@ -28,6 +28,7 @@ import (
 	"strconv"
 	"testing"
 
+	"github.com/raksh93/storagetapper/db"
 	"github.com/raksh93/storagetapper/log"
 	"github.com/raksh93/storagetapper/state"
 	"github.com/raksh93/storagetapper/test"
@@ -386,3 +387,27 @@ func TestServerTableNegative(t *testing.T) {
 	tableCmd(res, req)
 	test.Assert(t, res.Code == http.StatusInternalServerError, "Not OK")
 }
+
+func TestServerTableChangelogTopicUsed(t *testing.T) {
+	serverTableInit(t)
+
+	loc := &db.Loc{Cluster: "test_cluster_1", Service: "test_service_1", Name: "st_table_http_test0"}
+	for ver := 0; ver < 2; ver++ {
+		test.Assert(t, state.RegisterTable(loc, "table_http_test0", "mysql", "kafka", ver, "json"), "Registration failed")
+	}
+
+	topic, err := cfg.GetChangelogTopicName("test_service_1", "st_table_http_test0", "table_http_test0", "mysql", "kafka", 0)
+	test.CheckFail(err, t)
+
+	test.Assert(t, state.DeregisterTable("test_service_1", "st_table_http_test0", "table_http_test0", "mysql", "kafka", 0), "Deregistration failed")
+
+	used, err := changelogTopicUsed(cfg, topic)
+	test.CheckFail(err, t)
+	test.Assert(t, used, "Changelog topic is still used by version 1 of the table")
+
+	test.Assert(t, state.DeregisterTable("test_service_1", "st_table_http_test0", "table_http_test0", "mysql", "kafka", 1), "Deregistration failed")
+
+	used, err = changelogTopicUsed(cfg, topic)
+	test.CheckFail(err, t)
+	test.Assert(t, !used, "Changelog topic is not used by any table")
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/log"
+	"github.com/raksh93/storagetapper/verify"
+)
+
+//verifyCmdReq body of the verification job request
+type verifyCmdReq struct {
+	Cmd        string
+	ID         int64
+	Service    string
+	Db         string
+	Table      string
+	Input      string
+	Output     string
+	Version    int
+	Resnapshot bool
+}
+
+type verifyStartResponse struct {
+	ID int64
+}
+
+func handleVerifyStartCmd(w http.ResponseWriter, t *verifyCmdReq) error {
+	if len(t.Service) == 0 || len(t.Db) == 0 || len(t.Table) == 0 || len(t.Output) == 0 {
+		return errors.New("Invalid command. All fields(service,db,table,output) must not be empty")
+	}
+	if t.Input == "" {
+		t.Input = config.Get().DefaultInputType
+	}
+
+	id, err := verify.Start(config.Get(), &verify.Request{Service: t.Service, Db: t.Db, Table: t.Table, Input: t.Input, Output: t.Output, Version: t.Version, Resnapshot: t.Resnapshot})
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(&verifyStartResponse{ID: id})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func handleVerifyListCmd(w http.ResponseWriter, t *verifyCmdReq) error {
+	var resp []byte
+	for _, v := range verify.Get(t.ID) {
+		b, err := json.Marshal(&v)
+		if err != nil {
+			return err
+		}
+		resp = append(resp, b...)
+		resp = append(resp, '\n')
+	}
+	_, err := w.Write(resp)
+	return err
+}
+
+func verifyCmd(w http.ResponseWriter, r *http.Request) {
+	t := verifyCmdReq{}
+	err := json.NewDecoder(r.Body).Decode(&t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if t.Cmd == "start" {
+		err = handleVerifyStartCmd(w, &t)
+	} else if t.Cmd == "list" {
+		err = handleVerifyListCmd(w, &t)
+	} else {
+		err = errors.New("Unknown command (possible commands start/list)")
+	}
+	if err != nil {
+		log.Errorf("Verify http: cmd=%v, service=%v, db=%v, table=%v, error=%v", t.Cmd, t.Service, t.Db, t.Table, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -42,6 +42,7 @@ type mysqlReader struct {
 	encoder encoder.Encoder
 	outMsg  []byte
 	key     string
+	row     []interface{}
 	err     error
 }
 
@@ -192,11 +193,40 @@ func driverTypeToGoType(p []interface{}, schema *types.TableSchema) []interface{
 	return v
 }
 
+//ScanRow scans current row of the result set into the Go types expected by
+//encoders. Result set columns should be in the table schema order
+func ScanRow(rows *sql.Rows, schema *types.TableSchema) ([]interface{}, error) {
+	c, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c) != len(schema.Columns) {
+		return nil, fmt.Errorf("Rows column count(%v) should be equal to schema's column count(%v)", len(c), len(schema.Columns))
+	}
+
+	p := make([]interface{}, len(c))
+	for i := 0; i < len(c); i++ {
+		mySQLToDriverType(&p[i], schema.Columns[i].DataType)
+	}
+
+	if err = rows.Scan(p...); err != nil {
+		return nil, err
+	}
+
+	return driverTypeToGoType(p, schema), nil
+}
+
 //GetNext pops record fetched by HasNext
 func (s *mysqlReader) GetNext() (string, []byte, error) {
 	return s.key, s.outMsg, s.err
 }
 
+//Row returns column values of the record fetched by HasNext
+func (s *mysqlReader) Row() *[]interface{} {
+	return &s.row
+}
+
 //HasNext fetches the record from MySQL and encodes using encoder provided when
 //reader created
 func (s *mysqlReader) HasNext() bool {
@@ -210,37 +240,17 @@ func (s *mysqlReader) HasNext() bool {
 		return false
 	}
 
-	var c []string
-	c, s.err = s.rows.Columns()
+	s.row, s.err = ScanRow(s.rows, s.encoder.Schema())
 	if log.EL(s.log, s.err) {
 		return true
 	}
 
-	schema := s.encoder.Schema()
-
-	if len(c) != len(schema.Columns) {
-		s.err = fmt.Errorf("Rows column count(%v) should be equal to schema's column count(%v)", len(c), len(schema.Columns))
-		return true
-	}
-
-	p := make([]interface{}, len(c))
-	for i := 0; i < len(c); i++ {
-		mySQLToDriverType(&p[i], schema.Columns[i].DataType)
-	}
-
-	s.err = s.rows.Scan(p...)
-	if log.EL(s.log, s.err) {
-		return true
-	}
-
-	v := driverTypeToGoType(p, schema)
-
-	s.outMsg, s.err = s.encoder.Row(types.Insert, &v, 0)
+	s.outMsg, s.err = s.encoder.Row(types.Insert, &s.row, 0)
 	if log.EL(s.log, s.err) {
 		return true
 	}
 
-	s.key = encoder.GetRowKey(s.encoder.Schema(), &v)
+	s.key = encoder.GetRowKey(s.encoder.Schema(), &s.row)
 
 	//Statistics maybe inaccurate so we can have some rows even if we got 0 when
 	//read rows count
@@ -198,6 +198,8 @@ func TestBasic(t *testing.T) {
 			refcf := types.CommonFormatEvent{Type: "insert", Key: []interface{}{float64(i)}, SeqNo: 0, Timestamp: 0, Fields: &[]types.CommonFormatField{{Name: "f1", Value: float64(i)}, {Name: "f2", Value: strconv.FormatInt(i, 10)}, {Name: "f3", Value: float64(i) / 3}}}
 			// refcf := types.CommonFormatEvent{Type: "insert", Key: []interface{}{i}, SeqNo: 0, Timestamp: 0, Fields: &[]types.CommonFormatField{{Name: "f1", Value: i}, {Name: "f2", Value: strconv.FormatInt(i, 10)}, {Name: "f3", Value: float64(i) / 3}}}
 
+			test.Assert(t, key == encoder.GetRowKey(enc.Schema(), s.Row()), "row values should match the key")
+
 			ChangeCfFields(cf)
 			if !reflect.DeepEqual(&refcf, cf) {
 				log.Errorf("Received: %+v %+v", cf, cf.Fields)
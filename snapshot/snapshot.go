@@ -26,6 +26,9 @@ type Reader interface {
 	//returns: key and encoded message
 	GetNext() (string, []byte, error)
 
+	//Row returns column values of the record fetched by HasNext
+	Row() *[]interface{}
+
 	//HasNext fetches the record from the source and encodes using encoder provided when reader created
 	//This is a blocking method
 	HasNext() bool
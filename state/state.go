@@ -23,10 +23,8 @@ package state
 import (
 	"database/sql"
 	"errors"
-	"net"
-	"net/url"
-	"strconv"
-	"strings"
+	"fmt"
+	"sort"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/raksh93/storagetapper/config"
@@ -66,33 +64,12 @@ var nodbconn *sql.DB
 //as any other database in the system
 func ConnectLow(cfg *config.AppConfig, nodb bool) *sql.DB {
 	if cfg.StateConnectURL != "" {
-		cs := cfg.StateConnectURL
-		/* url.Parse requires scheme in the beginning of the URL, just prepend
-		* with random scheme if it wasn't in the config file URL */
-		if !strings.Contains(cfg.StateConnectURL, "://") {
-			cs = "dsn://" + cfg.StateConnectURL
-		}
-		u, err := url.Parse(cs)
-		if log.E(err) {
-			return nil
-		}
-		var host, port string = u.Host, ""
-		if strings.Contains(u.Host, ":") {
-			host, port, _ = net.SplitHostPort(u.Host)
-		}
-		if u.User.Username() == "" || host == "" {
-			log.Errorf("Host and username required in DB db URL")
-			return nil
-		}
-		if port == "" {
-			port = "3306"
-		}
-		uport, err := strconv.ParseUint(port, 10, 16)
+		var err error
+		dbAddr, err = db.ParseConnectURL(cfg.StateConnectURL)
 		if log.E(err) {
 			return nil
 		}
-		pwd, _ := u.User.Password()
-		dbAddr = &db.Addr{Host: host, Port: uint16(uport), User: u.User.Username(), Pwd: pwd, Db: types.MyDbName}
+		dbAddr.Db = types.MyDbName
 	} else {
 		dbAddr = db.GetInfo(&db.Loc{Service: types.MySvcName, Name: types.MyDbName}, db.Master)
 		if dbAddr == nil {
@@ -197,6 +174,33 @@ func create(cfg *config.AppConfig) bool {
 		log.Errorf("schema table create failed: " + err.Error())
 		return false
 	}
+	err = util.ExecSQL(nodbconn, `CREATE TABLE IF NOT EXISTS `+types.MyDbName+`.fieldNumbers (
+		service varchar(64) NOT NULL DEFAULT '',
+		db varchar(64) NOT NULL DEFAULT '',
+		tableName varchar(64) NOT NULL DEFAULT '',
+		columnName varchar(64) NOT NULL DEFAULT '',
+		fieldType varchar(32) NOT NULL DEFAULT '',
+		fieldNumber int NOT NULL,
+		PRIMARY KEY(service, db, tableName, columnName, fieldType),
+		UNIQUE KEY(service, db, tableName, fieldNumber)
+	) ENGINE=INNODB`)
+	if err != nil {
+		log.Errorf("field numbers table create failed: " + err.Error())
+		return false
+	}
+	err = util.ExecSQL(nodbconn, `CREATE TABLE IF NOT EXISTS `+types.MyDbName+`.snapshots (
+		id BIGINT NOT NULL,
+		cluster VARCHAR(128) NOT NULL,
+		status VARCHAR(32) NOT NULL DEFAULT 'running',
+		info VARCHAR(255) NOT NULL DEFAULT '',
+		updatedAt TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(id),
+		KEY(cluster)
+	) ENGINE=INNODB`)
+	if err != nil {
+		log.Errorf("snapshots table create failed: " + err.Error())
+		return false
+	}
 	log.Debugf("State DB initialized")
 	return true
 }
@@ -356,6 +360,70 @@ func SetTableNewFlag(service, cluster, db, table, input, output string, version
 		"AND tableName=? AND input=? AND output=? AND version=?", flag, service, cluster, db, table, input, output, version)
 }
 
+//Snapshot statuses
+const (
+	SnapshotRunning  = "running"
+	SnapshotDeferred = "deferred"
+)
+
+//RegisterSnapshot marks snapshot of the table with given id as running on the
+//given cluster. Subsequent calls refresh the registration
+func RegisterSnapshot(id int64, cluster string) error {
+	return util.ExecSQL(conn, "INSERT INTO snapshots(id, cluster, status, info) VALUES(?, ?, ?, '') ON DUPLICATE KEY UPDATE cluster=?, status=?, info='', updatedAt=CURRENT_TIMESTAMP", id, cluster, SnapshotRunning, cluster, SnapshotRunning)
+}
+
+//DeferSnapshot marks snapshot of the table with given id as deferred, info
+//describes the reason
+func DeferSnapshot(id int64, cluster string, info string) error {
+	return util.ExecSQL(conn, "INSERT INTO snapshots(id, cluster, status, info) VALUES(?, ?, ?, ?) ON DUPLICATE KEY UPDATE cluster=?, status=?, info=?, updatedAt=CURRENT_TIMESTAMP", id, cluster, SnapshotDeferred, info, cluster, SnapshotDeferred, info)
+}
+
+//ClearDeferredSnapshot removes deferred status of the snapshot of the table
+//with given id, when the snapshot is allowed to start
+func ClearDeferredSnapshot(id int64) error {
+	return util.ExecSQL(conn, "DELETE FROM snapshots WHERE id=? AND status=?", id, SnapshotDeferred)
+}
+
+//GetSnapshotStatus returns status of the snapshot of the table with given id
+//and additional status information. Empty status returned if the table has
+//no snapshot running or pending
+func GetSnapshotStatus(id int64) (status string, info string, err error) {
+	err = util.QueryRowSQL(conn, "SELECT status, info FROM snapshots WHERE id=?", id).Scan(&status, &info)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+//DeregisterSnapshot removes snapshot of the table with given id from the list
+//of running snapshots
+func DeregisterSnapshot(id int64) error {
+	return util.ExecSQL(conn, "DELETE FROM snapshots WHERE id=?", id)
+}
+
+//GetNumActiveSnapshots returns the number of snapshots running on the given
+//cluster, which registration has been refreshed during last ttl seconds.
+//Database time is used, so as the result is consistent across instances
+func GetNumActiveSnapshots(cluster string, ttl int) (int, error) {
+	var cnt int
+	err := util.QueryRowSQL(conn, "SELECT COUNT(*) FROM snapshots WHERE cluster=? AND status=? AND updatedAt >= NOW() - INTERVAL ? SECOND", cluster, SnapshotRunning, ttl).Scan(&cnt)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	return cnt, nil
+}
+
+//GetSnapshotRank returns the number of active snapshots on the given cluster,
+//same as GetNumActiveSnapshots, and the number of them, which belong to the
+//tables with lower id than the given one
+func GetSnapshotRank(id int64, cluster string, ttl int) (n int, rank int, err error) {
+	err = util.QueryRowSQL(conn, "SELECT COUNT(*), COALESCE(SUM(id < ?), 0) FROM snapshots WHERE cluster=? AND status=? AND updatedAt >= NOW() - INTERVAL ? SECOND", id, cluster, SnapshotRunning, ttl).Scan(&n, &rank)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
 //SaveBinlogState saves current state of the  binlog reader to the state DB
 //binlog state is current GTID set and current seqNo
 func SaveBinlogState(d *db.Loc, gtid string, seqNo uint64) error {
@@ -467,6 +535,10 @@ func DeregisterTable(svc string, sdb string, table string, input string, output
 		return false
 	}
 
+	if log.E(util.ExecSQL(conn, "DELETE FROM snapshots WHERE NOT EXISTS (SELECT 1 FROM state WHERE state.id=snapshots.id)")) {
+		return false
+	}
+
 	log.Debugf("Deregistered table: %v, %v, %v %v %v v%d", svc, sdb, table, input, output, version)
 	return true
 }
@@ -577,6 +649,73 @@ func GetOutputSchema(name string, typ string) string {
 	return body
 }
 
+func readFieldNumbers(svc string, sdb string, table string) (map[string]map[string]int, error) {
+	rows, err := util.QuerySQL(conn, "SELECT columnName, fieldType, fieldNumber FROM fieldNumbers WHERE service=? AND db=? AND tableName=?", svc, sdb, table)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { log.E(rows.Close()) }()
+
+	res := make(map[string]map[string]int)
+	for rows.Next() {
+		var name, typ string
+		var num int
+		if err := rows.Scan(&name, &typ, &num); err != nil {
+			return nil, err
+		}
+		if res[name] == nil {
+			res[name] = make(map[string]int)
+		}
+		res[name][typ] = num
+	}
+
+	return res, rows.Err()
+}
+
+//GetFieldNumbers returns stable field numbers of the columns of the table.
+//Columns are given as a map of column names to field types. New number is
+//allocated when the column is seen for the first time or its type has
+//changed. Numbers are never reused, so as the messages encoded before ALTER
+//TABLE can be decoded with the new schema and vice versa
+func GetFieldNumbers(svc string, sdb string, table string, columns map[string]string) (map[string]int, error) {
+	//Concurrent allocations may pick the same number, in this case one of the
+	//inserts is ignored and the allocation is retried
+	for i := 0; ; i++ {
+		cur, err := readFieldNumbers(svc, sdb, table)
+		if err != nil {
+			return nil, err
+		}
+
+		res := make(map[string]int)
+		missing := make([]string, 0)
+		for name, typ := range columns {
+			if num, ok := cur[name][typ]; ok {
+				res[name] = num
+			} else {
+				missing = append(missing, name)
+			}
+		}
+
+		if len(missing) == 0 {
+			return res, nil
+		}
+
+		if i > len(columns) {
+			return nil, fmt.Errorf("failed to allocate field numbers for %v.%v.%v: %v", svc, sdb, table, missing)
+		}
+
+		sort.Strings(missing)
+		for _, name := range missing {
+			err = util.ExecSQL(conn, "INSERT IGNORE INTO fieldNumbers SELECT ?, ?, ?, ?, ?, COALESCE(MAX(fieldNumber), 0) + 1 FROM fieldNumbers WHERE service=? AND db=? AND tableName=?", svc, sdb, table, name, columns[name], svc, sdb, table)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		log.Debugf("Allocated field numbers for %v.%v.%v: %v", svc, sdb, table, missing)
+	}
+}
+
 //Close deinitializes the state
 func Close() error {
 	log.Debugf("DB deinitialized")
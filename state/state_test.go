@@ -642,6 +642,109 @@ func TestNewFlag(t *testing.T) {
 	}
 }
 
+func TestFieldNumbers(t *testing.T) {
+	initState(t)
+
+	n, err := GetFieldNumbers("svc1", "db1_state", "table1", map[string]string{"f1": "int64", "f2": "string", "f3": "bytes"})
+	test.CheckFail(err, t)
+	test.Assert(t, len(n) == 3 && n["f1"] != n["f2"] && n["f2"] != n["f3"] && n["f1"] != n["f3"], "unique numbers expected: %v", n)
+	for _, v := range n {
+		test.Assert(t, v >= 1 && v <= 3, "numbers should be allocated sequentially: %v", n)
+	}
+
+	//Numbers are stable
+	n1, err := GetFieldNumbers("svc1", "db1_state", "table1", map[string]string{"f1": "int64", "f2": "string", "f3": "bytes"})
+	test.CheckFail(err, t)
+	test.Assert(t, reflect.DeepEqual(n, n1), "numbers should be stable: %v %v", n, n1)
+
+	//f2 dropped, f4 added, f3 type changed
+	n1, err = GetFieldNumbers("svc1", "db1_state", "table1", map[string]string{"f1": "int64", "f3": "string", "f4": "int32"})
+	test.CheckFail(err, t)
+	test.Assert(t, n1["f1"] == n["f1"] && n1["f3"] > 3 && n1["f4"] > 3 && n1["f3"] != n1["f4"], "unexpected numbers: %v", n1)
+
+	//f2 added back gets its number
+	n2, err := GetFieldNumbers("svc1", "db1_state", "table1", map[string]string{"f2": "string"})
+	test.CheckFail(err, t)
+	test.Assert(t, n2["f2"] == n["f2"], "unexpected numbers: %v", n2)
+
+	//Numbers are allocated per table
+	n2, err = GetFieldNumbers("svc1", "db1_state", "table2", map[string]string{"f1": "int64"})
+	test.CheckFail(err, t)
+	test.Assert(t, n2["f1"] == 1, "unexpected numbers: %v", n2)
+}
+
+func TestSnapshots(t *testing.T) {
+	initState(t)
+
+	n, err := GetNumActiveSnapshots("clst1", 15)
+	test.CheckFail(err, t)
+	test.Assert(t, n == 0, "There should be no active snapshots yet, got %v", n)
+
+	test.CheckFail(RegisterSnapshot(1, "clst1"), t)
+	test.CheckFail(RegisterSnapshot(2, "clst1"), t)
+	test.CheckFail(RegisterSnapshot(3, "clst2"), t)
+	//Refresh doesn't create new registration
+	test.CheckFail(RegisterSnapshot(1, "clst1"), t)
+
+	n, err = GetNumActiveSnapshots("clst1", 15)
+	test.CheckFail(err, t)
+	test.Assert(t, n == 2, "Expected 2 active snapshots, got %v", n)
+
+	n, rank, err := GetSnapshotRank(2, "clst1", 15)
+	test.CheckFail(err, t)
+	test.Assert(t, n == 2 && rank == 1, "Expected rank 1 of 2, got %v of %v", rank, n)
+	n, rank, err = GetSnapshotRank(1, "clst1", 15)
+	test.CheckFail(err, t)
+	test.Assert(t, n == 2 && rank == 0, "Expected rank 0 of 2, got %v of %v", rank, n)
+
+	test.ExecSQL(conn, t, "UPDATE snapshots SET updatedAt = NOW() - INTERVAL 1 HOUR WHERE id=2")
+
+	n, err = GetNumActiveSnapshots("clst1", 15)
+	test.CheckFail(err, t)
+	test.Assert(t, n == 1, "Stale snapshot shouldn't be counted, got %v", n)
+
+	test.CheckFail(DeregisterSnapshot(1), t)
+
+	n, err = GetNumActiveSnapshots("clst1", 15)
+	test.CheckFail(err, t)
+	test.Assert(t, n == 0, "Expected no active snapshots, got %v", n)
+
+	n, err = GetNumActiveSnapshots("clst2", 15)
+	test.CheckFail(err, t)
+	test.Assert(t, n == 1, "Expected 1 active snapshot, got %v", n)
+
+	status, info, err := GetSnapshotStatus(3)
+	test.CheckFail(err, t)
+	test.Assert(t, status == SnapshotRunning && info == "", "Unexpected status: %v %v", status, info)
+
+	test.CheckFail(DeferSnapshot(3, "clst2", "outside of window"), t)
+
+	status, info, err = GetSnapshotStatus(3)
+	test.CheckFail(err, t)
+	test.Assert(t, status == SnapshotDeferred && info == "outside of window", "Unexpected status: %v %v", status, info)
+
+	n, err = GetNumActiveSnapshots("clst2", 15)
+	test.CheckFail(err, t)
+	test.Assert(t, n == 0, "Deferred snapshot shouldn't be counted, got %v", n)
+
+	//Running snapshot is not affected
+	test.CheckFail(RegisterSnapshot(4, "clst2"), t)
+	test.CheckFail(ClearDeferredSnapshot(4), t)
+	status, _, err = GetSnapshotStatus(4)
+	test.CheckFail(err, t)
+	test.Assert(t, status == SnapshotRunning, "Unexpected status: %v", status)
+	test.CheckFail(DeregisterSnapshot(4), t)
+
+	test.CheckFail(ClearDeferredSnapshot(3), t)
+	status, _, err = GetSnapshotStatus(3)
+	test.CheckFail(err, t)
+	test.Assert(t, status == "", "Deferred status should be cleared, got: %v", status)
+
+	status, _, err = GetSnapshotStatus(1)
+	test.CheckFail(err, t)
+	test.Assert(t, status == "", "Unexpected status: %v", status)
+}
+
 func TestMain(m *testing.M) {
 	cfg = test.LoadConfig()
 	os.Exit(m.Run())
@@ -0,0 +1,275 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raksh93/storagetapper/encoder"
+	"github.com/raksh93/storagetapper/log"
+	"github.com/raksh93/storagetapper/pipe"
+	"golang.org/x/net/context" //"context"
+)
+
+//Cursor is the position of the client in the output stream. It maps pipe
+//partitions to the offsets of the next messages to deliver. Pipes, which
+//don't expose message offsets, have single partition 0, which offset is the
+//number of messages consumed from the beginning of the stream
+type Cursor map[int32]int64
+
+//ParseCursor parses cursor in the "partition:offset,partition:offset" form.
+//Empty string is the beginning of the stream
+func ParseCursor(s string) (Cursor, error) {
+	c := make(Cursor)
+	if s == "" {
+		return c, nil
+	}
+	for _, v := range strings.Split(s, ",") {
+		po := strings.Split(v, ":")
+		if len(po) != 2 {
+			return nil, fmt.Errorf("Invalid cursor: %v", s)
+		}
+		p, err := strconv.ParseInt(po[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cursor: %v", s)
+		}
+		o, err := strconv.ParseInt(po[1], 10, 64)
+		if err != nil || o < 0 {
+			return nil, fmt.Errorf("Invalid cursor: %v", s)
+		}
+		c[int32(p)] = o
+	}
+	return c, nil
+}
+
+func (c Cursor) String() string {
+	parts := make([]int, 0, len(c))
+	for p := range c {
+		parts = append(parts, int(p))
+	}
+	sort.Ints(parts)
+
+	s := make([]string, 0, len(parts))
+	for _, p := range parts {
+		s = append(s, fmt.Sprintf("%v:%v", p, c[int32(p)]))
+	}
+	return strings.Join(s, ",")
+}
+
+//Offsets returns the cursor as the positions in the given topic
+func (c Cursor) Offsets(topic string) []pipe.Offset {
+	res := make([]pipe.Offset, 0, len(c))
+	for p, o := range c {
+		res = append(res, pipe.Offset{Topic: topic, Partition: p, Offset: o})
+	}
+	return res
+}
+
+//Event types, which are not output events
+const (
+	//Heartbeat event is sent when there is no events to deliver during
+	//heartbeat interval. It carries current cursor, which can be advanced by
+	//skipped messages
+	Heartbeat = "heartbeat"
+)
+
+//Event is a line of the stream. Value is embedded as is for json format and
+//base64 encoded for other formats
+type Event struct {
+	Cursor  string            `json:"cursor"`
+	Type    string            `json:"type"`
+	SeqNo   uint64            `json:"seqno,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Value   interface{}       `json:"value,omitempty"`
+}
+
+//Request describes the stream
+type Request struct {
+	Consumer pipe.Consumer
+	//Decoder of the output format
+	Decoder encoder.Encoder
+	//Cursor to resume the stream from
+	Cursor Cursor
+	//SeqNo skips the events with lower seqno, including snapshot events,
+	//unless it's zero
+	SeqNo uint64
+	//Limit is the number of events, after which the stream ends. Unlimited if
+	//zero
+	Limit     int
+	Heartbeat time.Duration
+}
+
+type message struct {
+	data    []byte
+	err     error
+	offset  *pipe.Offset
+	headers map[string]string
+}
+
+//position tracks the cursor of the stream
+type position struct {
+	start    Cursor
+	cur      Cursor
+	consumed int64
+}
+
+//advance moves the cursor past the message. Returns false if the message
+//precedes the start cursor, so it has been delivered already
+func (p *position) advance(m *message) bool {
+	if m.offset == nil {
+		p.consumed++
+		if p.consumed <= p.start[0] {
+			return false
+		}
+		p.cur[0] = p.consumed
+		return true
+	}
+
+	if o, ok := p.start[m.offset.Partition]; ok && m.offset.Offset <= o {
+		return false
+	}
+	p.cur[m.offset.Partition] = m.offset.Offset
+
+	return true
+}
+
+func fetch(c pipe.Consumer, msgs chan<- *message, exit <-chan bool) {
+	defer close(msgs)
+	for c.FetchNext() {
+		m := &message{offset: pipe.NextOffset(c), headers: c.Headers()}
+		var d interface{}
+		d, m.err = c.Pop()
+		if m.err == nil && d != nil {
+			var ok bool
+			if m.data, ok = d.([]byte); !ok {
+				m.err = fmt.Errorf("Unsupported message type: %T", d)
+			}
+		}
+		select {
+		case msgs <- m:
+		case <-exit:
+			return
+		}
+		if m.err != nil {
+			return
+		}
+	}
+}
+
+//event decodes the message. Returns nil if the message should be skipped
+func (r *Request) event(m *message) *Event {
+	//Tombstones follow delete events of the same key
+	if len(m.data) == 0 {
+		return nil
+	}
+
+	cf, err := r.Decoder.DecodeEvent(m.data)
+	if err != nil {
+		log.Warnf("Skipping event, which failed to decode: %v", err)
+		return nil
+	}
+	if r.SeqNo != 0 && cf.SeqNo < r.SeqNo {
+		return nil
+	}
+
+	e := &Event{Type: cf.Type, SeqNo: cf.SeqNo, Headers: m.headers, Value: m.data}
+	if r.Decoder.Type() == "json" {
+		e.Value = json.RawMessage(m.data)
+	}
+
+	return e
+}
+
+//Run writes the events consumed by request consumer to w, a JSON object per
+//line, until the context is canceled, limit is reached or consumer fails.
+//Every line is flushed, if w is http.Flusher, so as slow client throttles the
+//consumption. Caller should close the consumer afterwards
+func Run(ctx context.Context, w io.Writer, r *Request) error {
+	msgs := make(chan *message)
+	exit := make(chan bool)
+	defer close(exit)
+	go fetch(r.Consumer, msgs, exit)
+
+	pos := &position{start: r.Cursor, cur: make(Cursor)}
+	for k, v := range r.Cursor {
+		pos.cur[k] = v
+	}
+
+	enc := json.NewEncoder(w)
+	write := func(e *Event) error {
+		e.Cursor = pos.cur.String()
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		return nil
+	}
+
+	heartbeat := time.NewTicker(r.Heartbeat)
+	defer heartbeat.Stop()
+	lastWrite := time.Now()
+
+	var sent int
+	for {
+		select {
+		case m, ok := <-msgs:
+			if !ok {
+				return nil
+			}
+			if m.err != nil {
+				return m.err
+			}
+			if !pos.advance(m) {
+				continue
+			}
+			e := r.event(m)
+			if e == nil {
+				continue
+			}
+			if err := write(e); err != nil {
+				return err
+			}
+			lastWrite = time.Now()
+			if sent++; r.Limit != 0 && sent >= r.Limit {
+				return nil
+			}
+		case <-heartbeat.C:
+			if time.Since(lastWrite) < r.Heartbeat {
+				continue
+			}
+			if err := write(&Event{Type: Heartbeat}); err != nil {
+				return err
+			}
+			lastWrite = time.Now()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
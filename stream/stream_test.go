@@ -0,0 +1,169 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/encoder"
+	"github.com/raksh93/storagetapper/pipe"
+	"github.com/raksh93/storagetapper/shutdown"
+	"github.com/raksh93/storagetapper/test"
+	"github.com/raksh93/storagetapper/types"
+	"golang.org/x/net/context" //"context"
+)
+
+var cfg *config.AppConfig
+
+const testTopic = "stream_test_topic"
+
+func produceTestEvents(t *testing.T, p pipe.Pipe) {
+	pr, err := p.NewProducer(testTopic)
+	test.CheckFail(err, t)
+	pr.SetFormat("json")
+
+	push := func(tp string, seqno uint64) {
+		b, err := json.Marshal(&types.CommonFormatEvent{Type: tp, SeqNo: seqno, Key: []interface{}{1}})
+		test.CheckFail(err, t)
+		test.CheckFail(pr.PushBatch("log", b), t)
+	}
+
+	push("schema", 0)
+	for i := 0; i < 5; i++ {
+		push("insert", 0)
+	}
+	for i := uint64(10); i < 15; i++ {
+		push("insert", i)
+	}
+	test.CheckFail(pr.PushBatchCommit(), t)
+	test.CheckFail(pr.Close(), t)
+}
+
+func runTestStream(t *testing.T, p pipe.Pipe, r *Request, timeout time.Duration) []Event {
+	c, err := p.NewConsumer(testTopic)
+	test.CheckFail(err, t)
+	c.SetFormat("json")
+
+	r.Consumer = c
+	if r.Decoder == nil {
+		r.Decoder, err = encoder.InitEncoder("json", "", "", "")
+		test.CheckFail(err, t)
+	}
+	if r.Heartbeat == 0 {
+		r.Heartbeat = time.Hour
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var buf bytes.Buffer
+	test.CheckFail(Run(ctx, &buf, r), t)
+	test.CheckFail(c.CloseOnFailure(), t)
+
+	var res []Event
+	s := bufio.NewScanner(&buf)
+	for s.Scan() {
+		var e Event
+		test.CheckFail(json.Unmarshal(s.Bytes(), &e), t)
+		res = append(res, e)
+	}
+
+	return res
+}
+
+func TestStreamResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stream_test")
+	test.CheckFail(err, t)
+	defer func() { test.CheckFail(os.RemoveAll(dir), t) }()
+
+	c := *cfg
+	c.DataDir = dir
+	p, err := pipe.Create(shutdown.Context, "file", 16, &c, nil)
+	test.CheckFail(err, t)
+	test.Assert(t, !pipe.SetStartOffsets(p, nil), "file pipe doesn't support start offsets")
+	test.Assert(t, pipe.SetInitialOffset(p, pipe.OffsetOldest), "file pipe should support initial offset")
+
+	produceTestEvents(t, p)
+
+	ev := runTestStream(t, p, &Request{Cursor: Cursor{}, Limit: 4}, time.Minute)
+	test.Assert(t, len(ev) == 4, "expected 4 events, got %v", len(ev))
+	test.Assert(t, ev[0].Type == "schema" && ev[1].Type == "insert", "unexpected events: %+v", ev)
+	test.Assert(t, ev[3].Cursor == "0:4", "unexpected cursor: %v", ev[3].Cursor)
+
+	//json events are embedded as is
+	val, ok := ev[1].Value.(map[string]interface{})
+	test.Assert(t, ok && val["Type"] == "insert", "unexpected event value: %+v", ev[1].Value)
+
+	cur, err := ParseCursor(ev[3].Cursor)
+	test.CheckFail(err, t)
+	ev = runTestStream(t, p, &Request{Cursor: cur, Limit: 7}, time.Minute)
+	test.Assert(t, len(ev) == 7, "expected 7 events, got %v", len(ev))
+	test.Assert(t, ev[0].SeqNo == 0 && ev[1].SeqNo == 0 && ev[2].SeqNo == 10 && ev[6].SeqNo == 14, "unexpected events: %+v", ev)
+	test.Assert(t, ev[6].Cursor == "0:11", "unexpected cursor: %v", ev[6].Cursor)
+
+	ev = runTestStream(t, p, &Request{Cursor: Cursor{}, SeqNo: 12, Limit: 3}, time.Minute)
+	test.Assert(t, len(ev) == 3 && ev[0].SeqNo == 12 && ev[2].SeqNo == 14, "unexpected events: %+v", ev)
+
+	//Heartbeats are sent, when there is no more events
+	ev = runTestStream(t, p, &Request{Cursor: Cursor{0: 11}, Heartbeat: 10 * time.Millisecond}, 200*time.Millisecond)
+	test.Assert(t, len(ev) > 0, "heartbeats expected")
+	for _, e := range ev {
+		test.Assert(t, e.Type == Heartbeat && e.Cursor == "0:11", "unexpected event: %+v", e)
+	}
+}
+
+func TestStreamPosition(t *testing.T) {
+	p := &position{start: Cursor{0: 5}, cur: Cursor{0: 5}}
+
+	test.Assert(t, !p.advance(&message{offset: &pipe.Offset{Partition: 0, Offset: 5}}), "delivered message should be skipped")
+	test.Assert(t, p.advance(&message{offset: &pipe.Offset{Partition: 0, Offset: 6}}), "message after cursor should be delivered")
+	test.Assert(t, p.advance(&message{offset: &pipe.Offset{Partition: 1, Offset: 3}}), "message of new partition should be delivered")
+	test.Assert(t, p.cur.String() == "0:6,1:3", "unexpected cursor: %v", p.cur.String())
+}
+
+func TestStreamCursor(t *testing.T) {
+	c, err := ParseCursor("3:10,1:5")
+	test.CheckFail(err, t)
+	test.Assert(t, c.String() == "1:5,3:10", "unexpected cursor: %v", c.String())
+	test.Assert(t, len(c.Offsets("t1")) == 2, "expected 2 offsets")
+
+	c, err = ParseCursor("")
+	test.CheckFail(err, t)
+	test.Assert(t, len(c) == 0 && c.String() == "", "empty cursor expected")
+
+	for _, s := range []string{"1", "a:1", "1:b", "1:-1", "1:2,"} {
+		_, err = ParseCursor(s)
+		test.Assert(t, err != nil, "cursor should fail to parse: %v", s)
+	}
+}
+
+func TestMain(m *testing.M) {
+	cfg = test.LoadConfig()
+	pipe.Delimited = true
+	os.Exit(m.Run())
+}
@@ -22,9 +22,11 @@ package streamer
 
 import (
 	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/raksh93/storagetapper/config"
 	"github.com/raksh93/storagetapper/encoder"
 	"github.com/raksh93/storagetapper/log"
 	"github.com/raksh93/storagetapper/pipe"
@@ -41,7 +43,19 @@ func (s *Streamer) getTag() map[string]string {
 	}
 }
 
-func (s *Streamer) encodeCommonFormat(data []byte) (key string, outMsg []byte, err error) {
+//outEvent is the event encoded in the output format along with the metadata
+//required to produce it
+type outEvent struct {
+	key      string
+	part     []interface{} //values of partition columns, in configured order
+	msg      []byte
+	isDelete bool
+	seqNo    uint64
+	gtid     string
+	time     int64 //time the event has been read from the binlog, in nanoseconds
+}
+
+func (s *Streamer) encodeCommonFormat(data []byte) (ev outEvent, err error) {
 	cfEvent := &types.CommonFormatEvent{}
 	payload, err := s.envEncoder.UnwrapEvent(data, cfEvent)
 	if log.EL(s.log, err) {
@@ -53,41 +67,71 @@ func (s *Streamer) encodeCommonFormat(data []byte) (key string, outMsg []byte, e
 
 	//	log.Debugf("commont format received %v %v", cfEvent, cfEvent.Fields)
 
+	ev.seqNo = cfEvent.SeqNo
+	ev.gtid = cfEvent.Gtid
+	ev.time = cfEvent.EventTime
+
 	if cfEvent.Type == "insert" || cfEvent.Type == "delete" || cfEvent.Type == "schema" {
-		outMsg, err = s.outEncoder.CommonFormat(cfEvent)
+		ev.msg, err = s.outEncoder.CommonFormat(cfEvent)
 		if log.EL(s.log, err) {
 			return
 		}
 
-		key = encoder.GetCommonFormatKey(cfEvent)
+		ev.key = encoder.GetCommonFormatKey(cfEvent)
+		ev.isDelete = cfEvent.Type == "delete"
+		if cfEvent.Type != "schema" {
+			if ev.part, err = s.commonFormatPartition(cfEvent); log.EL(s.log, err) {
+				return
+			}
+		}
 
-		if cfEvent.Type == "schema" && outMsg != nil {
-			if s.outPipe.Type() == "file" {
-				key = "log"
+		if cfEvent.Type == "schema" && ev.msg != nil {
+			if pipe.FileBased(s.outPipe) {
+				ev.key = "log"
 			}
 
-			err = s.outProducer.PushSchema(key, outMsg)
+			err = s.outProducer.PushSchema(ev.key, ev.msg)
 			log.EL(s.log, err)
 
-			outMsg = nil
+			ev.msg = nil
+			return
+		}
+
+		if cfEvent.Type == "schema" && !s.pushContainerSchema() {
+			err = fmt.Errorf("failed to push avro container schema")
 			return
 		}
 	} else if cfEvent.Type == s.outputFormat {
-		outMsg = payload
-		key = cfEvent.Key[0].(string)
+		ev.msg = payload
+		ev.key = cfEvent.Key[0].(string)
+		ev.part = cfEvent.Key[1:]
+		if err = s.fixPartitionTypes(ev.part); log.EL(s.log, err) {
+			return
+		}
+		if s.tombstones != "" {
+			var e *types.CommonFormatEvent
+			if e, err = s.outEncoder.DecodeEvent(payload); log.EL(s.log, err) {
+				return
+			}
+			ev.isDelete = e.Type == "delete"
+		}
 		//		log.Debugf("Data in final format already. Forwarding. Key=%v, SeqNo=%v", key, cfEvent.SeqNo)
 	} else if cfEvent.Type == s.envEncoder.Type() {
-		var ev *types.CommonFormatEvent
-		ev, err = s.envEncoder.DecodeEvent(payload)
+		var e *types.CommonFormatEvent
+		e, err = s.envEncoder.DecodeEvent(payload)
 		if log.EL(s.log, err) {
 			return
 		}
-		outMsg, err = s.outEncoder.CommonFormat(ev)
+		ev.msg, err = s.outEncoder.CommonFormat(e)
 		if log.EL(s.log, err) {
 			return
 		}
 
-		key = encoder.GetCommonFormatKey(ev)
+		ev.key = encoder.GetCommonFormatKey(e)
+		ev.isDelete = e.Type == "delete"
+		if ev.part, err = s.commonFormatPartition(e); log.EL(s.log, err) {
+			return
+		}
 	} else {
 		err = fmt.Errorf("Unsupported conversion from: %v to %v", cfEvent.Type, s.outputFormat)
 	}
@@ -97,19 +141,25 @@ func (s *Streamer) encodeCommonFormat(data []byte) (key string, outMsg []byte, e
 
 func (s *Streamer) produceEvent(data interface{}) error {
 	var err error
-	var outMsg []byte
-	var key string
+	var ev outEvent
 
 	//FIXME: We currently support only raw messages from local pipe or
 	//CommonFormat messages
 	switch m := data.(type) {
 	case *types.RowMessage:
 		//log.Debugf("Received raw message %v %v %v %v", m.Type, m.SeqNo, m.Data, m.Key)
-		key = m.Key
-		outMsg, err = s.outEncoder.Row(m.Type, m.Data, m.SeqNo)
+		ev.key = m.Key
+		ev.msg, err = s.outEncoder.Row(m.Type, m.Data, m.SeqNo)
+		ev.isDelete = m.Type == types.Delete
+		ev.seqNo = m.SeqNo
+		ev.gtid = m.Gtid
+		ev.time = m.EventTime
+		if err == nil && len(s.partitionColumns) != 0 {
+			ev.part, err = encoder.GetRowColumnValues(s.outEncoder.Schema(), m.Data, s.partitionColumns)
+		}
 	case []byte:
 		s.BytesRead += int64(len(m))
-		key, outMsg, err = s.encodeCommonFormat(m)
+		ev, err = s.encodeCommonFormat(m)
 	}
 
 	if err != nil {
@@ -117,30 +167,203 @@ func (s *Streamer) produceEvent(data interface{}) error {
 	}
 
 	/* Schema events skipped */
-	if outMsg == nil {
+	if ev.msg == nil {
 		return nil
 	}
 
-	if s.outPipe.Type() == "file" {
-		key = "log"
+	if pipe.FileBased(s.outPipe) {
+		ev.key = "log"
 	}
 
-	err = s.outProducer.PushBatch(key, outMsg)
+	partKey, err := s.partitionKey(ev.part)
+	if log.EL(s.log, err) {
+		return err
+	}
+
+	opts := s.messageOptions(partKey, ev.seqNo, ev.gtid, ev.time)
+
+	if ev.isDelete && s.tombstones != "" {
+		return s.produceTombstone(ev.key, ev.msg, opts)
+	}
+
+	err = pipe.PushBatchOptions(s.outProducer, ev.key, ev.msg, opts)
 
 	log.EL(s.log, err)
 
 	if err == nil {
+		s.BytesWritten += int64(len(ev.msg))
+	}
+
+	return err
+}
+
+//produceTombstone produces tombstone for the deleted row key, preceded by the
+//delete event itself in append mode
+func (s *Streamer) produceTombstone(key string, outMsg []byte, opts *pipe.MessageOptions) error {
+	if s.tombstones == config.KafkaTombstonesAppend {
+		if err := pipe.PushBatchOptions(s.outProducer, key, outMsg, opts); log.EL(s.log, err) {
+			return err
+		}
 		s.BytesWritten += int64(len(outMsg))
 	}
 
+	err := pipe.PushBatchOptions(s.outProducer, key, nil, opts)
+	log.EL(s.log, err)
+
 	return err
 }
 
+//messageOptions returns options of the produced message: partition key,
+//event time and event metadata headers, if enabled. Returns nil if none is
+//applicable
+func (s *Streamer) messageOptions(partKey string, seqno uint64, gtid string, eventTime int64) *pipe.MessageOptions {
+	if partKey == "" && !s.headers && eventTime == 0 {
+		return nil
+	}
+
+	opts := &pipe.MessageOptions{PartitionKey: partKey}
+	if eventTime != 0 {
+		opts.EventTime = time.Unix(0, eventTime)
+	}
+	if s.headers {
+		loc := &types.TableLoc{Service: s.svc, Cluster: s.cluster, Db: s.db, Table: s.table, Input: s.input, Output: s.output, Version: s.version}
+		opts.Headers = pipe.EventHeaders(loc, s.outputFormat, seqno, gtid)
+	}
+
+	return opts
+}
+
+//partitionKey builds partition key from the values of the table's partition
+//columns. Returns empty key, meaning partitioning by message key, if partition
+//columns are not configured or their values are not available
+func (s *Streamer) partitionKey(values []interface{}) (string, error) {
+	if len(s.partitionColumns) == 0 || len(values) == 0 {
+		return "", nil
+	}
+
+	if len(values) != len(s.partitionColumns) {
+		return "", fmt.Errorf("Expected %v partition column values, got %v", len(s.partitionColumns), len(values))
+	}
+
+	//Single column value is used as is to be compatible with other producers
+	if len(values) == 1 {
+		return partitionValue(values[0]), nil
+	}
+
+	var key string
+	for _, v := range values {
+		k := partitionValue(v)
+		key += fmt.Sprintf("%v%v", len(k), k)
+	}
+
+	return key, nil
+}
+
+//partitionValue formats partition column value, so as the value produces the
+//same string regardless of the numeric type it's read or decoded as
+func partitionValue(v interface{}) string {
+	switch t := v.(type) {
+	case int:
+		return strconv.FormatInt(int64(t), 10)
+	case int8:
+		return strconv.FormatInt(int64(t), 10)
+	case int16:
+		return strconv.FormatInt(int64(t), 10)
+	case int32:
+		return strconv.FormatInt(int64(t), 10)
+	case int64:
+		return strconv.FormatInt(t, 10)
+	case uint:
+		return strconv.FormatUint(uint64(t), 10)
+	case uint8:
+		return strconv.FormatUint(uint64(t), 10)
+	case uint16:
+		return strconv.FormatUint(uint64(t), 10)
+	case uint32:
+		return strconv.FormatUint(uint64(t), 10)
+	case uint64:
+		return strconv.FormatUint(t, 10)
+	case float32:
+		return strconv.FormatFloat(float64(t), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case []byte:
+		return string(t)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+//fixPartitionTypes converts partition column values passed in the JSON
+//envelope to their column types, the same as the values of snapshot rows
+func (s *Streamer) fixPartitionTypes(values []interface{}) error {
+	if s.envEncoder.Type() != "json" || len(values) != len(s.partitionColumns) {
+		return nil
+	}
+	for i, c := range s.partitionColumns {
+		for _, col := range s.outEncoder.Schema().Columns {
+			if col.Name != c {
+				continue
+			}
+			if err := encoder.FixJSONValue(&values[i], col.DataType); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return nil
+}
+
+//commonFormatPartition returns values of partition columns of the common
+//format event. Delete events carry primary key only, so partitioning by non
+//primary key columns requires the values to be passed in the envelope
+func (s *Streamer) commonFormatPartition(cf *types.CommonFormatEvent) ([]interface{}, error) {
+	if len(s.partitionColumns) == 0 {
+		return nil, nil
+	}
+
+	res := make([]interface{}, 0, len(s.partitionColumns))
+	for _, c := range s.partitionColumns {
+		v, ok := commonFormatValue(s.outEncoder.Schema(), cf, c)
+		if !ok {
+			return nil, fmt.Errorf("Value of partition column '%v' is not available in %v event", c, cf.Type)
+		}
+		res = append(res, v)
+	}
+
+	return res, nil
+}
+
+//commonFormatValue looks up column value in the event fields, then in the
+//event key
+func commonFormatValue(schema *types.TableSchema, cf *types.CommonFormatEvent, column string) (interface{}, bool) {
+	if cf.Fields != nil {
+		for _, f := range *cf.Fields {
+			if f.Name == column {
+				return f.Value, true
+			}
+		}
+	}
+
+	var k int
+	for _, c := range schema.Columns {
+		if c.Key != "PRI" {
+			continue
+		}
+		if c.Name == column && k < len(cf.Key) {
+			return cf.Key[k], true
+		}
+		k++
+	}
+
+	return nil, false
+}
+
 //message passed from fetcher to the main loop
 type result struct {
 	data    interface{}
 	err     error
 	hasNext bool
+	offset  *pipe.Offset //position following the message
 }
 
 func (s *Streamer) processBatch(c pipe.Consumer, next *result, msgCh chan *result) bool {
@@ -150,9 +373,10 @@ L:
 		if log.EL(s.log, next.err) {
 			return false
 		}
-		if err := s.produceEvent(next.data); err != nil {
+		if err := s.processEvent(next.data); err != nil {
 			return false
 		}
+		s.trackOffset(next.offset)
 		b++
 		if b >= int64(s.batchSize) {
 			break
@@ -173,7 +397,7 @@ L:
 
 	w := s.metrics.ProduceLatency
 	w.Start()
-	err := s.outProducer.PushBatchCommit()
+	err := s.commitBatch()
 	w.Stop()
 	return !log.EL(s.log, err)
 }
@@ -188,6 +412,7 @@ L:
 		//FetchNextBatch doesn't persist offsets, PopAck does
 		if msg.hasNext = c.FetchNext(); msg.hasNext {
 			msg.data, msg.err = c.Pop()
+			msg.offset = pipe.NextOffset(c)
 		}
 		//		w.Stop()
 
@@ -214,6 +439,11 @@ func (s *Streamer) StreamTable(consumer pipe.Consumer) bool {
 	wg.Add(1)
 
 	defer func() {
+		//Consumer position can be persisted only after all the produced
+		//messages are acknowledged
+		if saveOffsets && log.EL(s.log, pipe.Flush(s.outProducer)) {
+			saveOffsets = false
+		}
 		if saveOffsets {
 			log.EL(s.log, consumer.Close())
 		} else {
@@ -245,6 +475,11 @@ func (s *Streamer) StreamTable(consumer pipe.Consumer) bool {
 				return true
 			}
 
+			if log.EL(s.log, pipe.Flush(s.outProducer)) {
+				saveOffsets = false
+				return false
+			}
+
 			//Guarantee that we can loose no more than state_update_interval
 			//seconds of writes
 			if err := consumer.SaveOffset(); err != nil {
@@ -0,0 +1,171 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package streamer
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/log"
+	"github.com/raksh93/storagetapper/pipe"
+	"github.com/raksh93/storagetapper/shutdown"
+	"github.com/raksh93/storagetapper/types"
+)
+
+//retryDelay is the delay between attempts of the retry dead letter policy
+var retryDelay = time.Second
+
+//retry calls f until it succeeds or the number of retries of the table's dead
+//letter policy exhausted. Returns the number of attempts made and the last error
+func (s *Streamer) retry(err error, f func() error) (int, error) {
+	attempts := 1
+	if s.deadLetter == nil || s.deadLetter.Policy != config.DeadLetterRetry {
+		return attempts, err
+	}
+	for ; err != nil && attempts <= s.deadLetter.Retries; attempts++ {
+		s.log.Warnf("Retrying...Attempt %v. Error: %v", attempts, err)
+		s.metrics.EventsRetried.Inc(1)
+		select {
+		case <-time.After(retryDelay):
+		case <-shutdown.InitiatedCh():
+			return attempts, err
+		}
+		err = f()
+	}
+	return attempts, err
+}
+
+//processEvent produces the event, applying table's dead letter policy if it
+//fails. Returns error if the streaming of the table should be stopped
+func (s *Streamer) processEvent(data interface{}) error {
+	err := s.produceEvent(data)
+	if err == nil || s.deadLetter == nil || s.deadLetter.Policy == config.DeadLetterHalt {
+		return err
+	}
+
+	attempts, err := s.retry(err, func() error { return s.produceEvent(data) })
+	if err == nil {
+		return nil
+	}
+
+	if dlErr := s.pushDeadLetter(data, err, attempts); log.EL(s.log, dlErr) {
+		return err
+	}
+
+	s.log.Warnf("Event written to dead letter topic after %v attempt(s). Error: %v", attempts, err)
+	s.metrics.EventsDeadLettered.Inc(1)
+
+	return nil
+}
+
+//commitBatch commits output batch, retrying if table's dead letter policy is
+//retry
+func (s *Streamer) commitBatch() error {
+	//Transaction can't be retried, streamer restarts from the committed
+	//offsets instead
+	if s.txn != nil {
+		return s.commitTxn()
+	}
+
+	err := s.outProducer.PushBatchCommit()
+	if err != nil {
+		_, err = s.retry(err, s.outProducer.PushBatchCommit)
+	}
+	return err
+}
+
+func (s *Streamer) initDeadLetterProducer() error {
+	pipeType := s.deadLetter.Pipe
+	if pipeType == "" {
+		pipeType = s.output
+	}
+
+	if s.outPipes == nil || (*s.outPipes)[pipeType] == nil {
+		return fmt.Errorf("Unknown dead letter pipe type: %v", pipeType)
+	}
+	s.dlPipe = (*s.outPipes)[pipeType]
+
+	topic, err := config.Get().GetDeadLetterTopicName(s.svc, s.db, s.table, s.input, s.output, s.version)
+	if err != nil {
+		return err
+	}
+
+	s.dlProducer, err = s.dlPipe.NewProducer(topic)
+	if err != nil {
+		return err
+	}
+	s.dlProducer.SetFormat("json")
+
+	return nil
+}
+
+//pushDeadLetter writes failed event along with the error and table metadata
+//to the dead letter topic
+func (s *Streamer) pushDeadLetter(data interface{}, cause error, attempts int) error {
+	if s.dlProducer == nil {
+		if err := s.initDeadLetterProducer(); err != nil {
+			return err
+		}
+	}
+
+	ev := &types.DeadLetterEvent{Service: s.svc, Cluster: s.cluster, Db: s.db, Table: s.table, Input: s.input, Output: s.output, Version: s.version, Error: cause.Error(), Attempts: attempts, Timestamp: time.Now().UnixNano()}
+
+	var err error
+	switch m := data.(type) {
+	case []byte:
+		ev.Data = m
+	case *types.RowMessage:
+		if ev.Data, err = json.Marshal(m); err != nil {
+			return err
+		}
+	}
+
+	ev.DataSize = len(ev.Data)
+	if s.deadLetter.MaxDataSize > 0 && len(ev.Data) > s.deadLetter.MaxDataSize {
+		ev.Data = ev.Data[:s.deadLetter.MaxDataSize]
+		ev.Truncated = true
+	}
+
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	key := s.table
+	if pipe.FileBased(s.dlPipe) {
+		key = "log"
+	}
+
+	if err = s.dlProducer.PushBatch(key, b); err != nil {
+		return err
+	}
+
+	return s.dlProducer.PushBatchCommit()
+}
+
+func (s *Streamer) closeDeadLetterProducer() {
+	if s.dlProducer != nil {
+		log.EL(s.log, s.dlProducer.Close())
+		s.dlProducer = nil
+	}
+}
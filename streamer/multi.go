@@ -0,0 +1,310 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package streamer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/raksh93/storagetapper/changelog"
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/lock"
+	"github.com/raksh93/storagetapper/log"
+	"github.com/raksh93/storagetapper/pipe"
+	"github.com/raksh93/storagetapper/shutdown"
+	"github.com/raksh93/storagetapper/state"
+)
+
+//tableStream is the table handled by multi table worker
+type tableStream struct {
+	*Streamer
+	consumer pipe.Consumer
+	exitCh   chan bool
+	wg       sync.WaitGroup
+}
+
+//tableResult is the message passed from the table fetcher to the main loop of
+//multi table worker
+type tableResult struct {
+	*result
+	t *tableStream
+}
+
+//multiStreamer multiplexes up to streamer_tables_per_worker tables in single
+//worker. Tables share worker goroutine, lock connection and producer
+//connections, if output pipe allows. Failure of the table detaches only this
+//table from the worker. Only tables which doesn't need snapshot are
+//multiplexed, snapshots are taken by single table workers
+type multiStreamer struct {
+	inPipe      pipe.Pipe
+	outPipes    *map[string]pipe.Pipe
+	lockConn    lock.Lock //parent of table locks, holds shared connection
+	clusterLock lock.Lock
+	tables      map[int64]*tableStream
+	msgCh       chan *tableResult
+	batchSize   int
+}
+
+func readStreamingState(cfg *config.AppConfig) (state.Type, error) {
+	if cfg.ChangelogPipeType == "local" {
+		return state.GetCond("cluster=? AND needBootstrap=0", changelog.ThisInstanceCluster())
+	}
+	return state.GetCond("needBootstrap=0")
+}
+
+//fetch is blocking call to the worker channel converter for the table
+func (m *multiStreamer) fetch(t *tableStream) {
+	defer t.wg.Done()
+	for {
+		msg := &result{}
+		if msg.hasNext = t.consumer.FetchNext(); msg.hasNext {
+			msg.data, msg.err = t.consumer.Pop()
+			msg.offset = pipe.NextOffset(t.consumer)
+		}
+
+		select {
+		case m.msgCh <- &tableResult{msg, t}:
+			if !msg.hasNext || msg.err != nil {
+				return
+			}
+		case <-t.exitCh:
+			return
+		}
+	}
+}
+
+//attachTables locks and initializes not yet bootstrapped tables until worker
+//has streamer_tables_per_worker of them
+func (m *multiStreamer) attachTables(cfg *config.AppConfig) {
+	if len(m.tables) >= cfg.StreamerTablesPerWorker {
+		return
+	}
+
+	st, err := readStreamingState(cfg)
+	if log.E(err) {
+		return
+	}
+
+	for _, row := range st {
+		if len(m.tables) >= cfg.StreamerTablesPerWorker || shutdown.Initiated() {
+			break
+		}
+		//Locks are reentrant in the same connection, so skip the tables
+		//we already have
+		if m.tables[row.ID] != nil {
+			continue
+		}
+
+		s := &Streamer{inPipe: m.inPipe}
+		s.tableLock = lock.CreateShared(m.lockConn, cfg.OutputPipeConcurrency)
+		s.lockTable(state.Type{row}, m.outPipes)
+		if s.table == "" {
+			s.tableLock.Close()
+			continue
+		}
+
+		consumer, ok := s.initTable(cfg)
+		if !ok {
+			if s.outProducer != nil {
+				s.closeOutProducer()
+			}
+			s.tableLock.Close()
+			continue
+		}
+
+		t := &tableStream{Streamer: s, consumer: consumer, exitCh: make(chan bool)}
+		m.tables[s.id] = t
+		s.metrics.NumWorkers.Inc()
+
+		t.wg.Add(1)
+		go m.fetch(t)
+
+		s.log.Infof("Table attached to multi table worker. Tables in the worker: %v", len(m.tables))
+	}
+}
+
+//detach stops streaming the table and releases its resources. Offsets are
+//persisted only if graceful is true and pending batch committed successfully
+func (m *multiStreamer) detach(t *tableStream, graceful bool) {
+	if graceful && (log.EL(t.log, t.commitBatch()) || log.EL(t.log, pipe.Flush(t.outProducer))) {
+		graceful = false
+	}
+	if graceful {
+		log.EL(t.log, t.consumer.Close())
+	} else {
+		log.EL(t.log, t.consumer.CloseOnFailure())
+	}
+	close(t.exitCh)
+	t.wg.Wait()
+
+	t.closeOutProducer()
+	t.closeDeadLetterProducer()
+	t.tableLock.Close()
+	t.metrics.NumWorkers.Dec()
+
+	delete(m.tables, t.id)
+
+	t.log.Infof("Table detached from multi table worker. Tables in the worker: %v", len(m.tables))
+}
+
+//refresh checks the locks and registration of the tables and persists their
+//consumers positions. Returns false if the worker should exit
+func (m *multiStreamer) refresh() bool {
+	if m.clusterLock != nil && !m.clusterLock.Refresh() {
+		return false
+	}
+
+	for _, t := range m.tables {
+		t.metrics.NumWorkers.Emit()
+
+		if !t.tableLock.Refresh() {
+			m.detach(t, true)
+			continue
+		}
+		reg, _ := state.TableRegistered(t.id)
+		if !reg {
+			t.log.Warnf("Table removed from ingestion")
+			m.detach(t, true)
+			continue
+		}
+
+		if log.EL(t.log, pipe.Flush(t.outProducer)) {
+			m.detach(t, false)
+			continue
+		}
+
+		//Guarantee that we can loose no more than state_update_interval
+		//seconds of writes
+		if err := t.consumer.SaveOffset(); err != nil {
+			t.log.Errorf("Error persisting pipe position")
+			m.detach(t, true)
+		}
+	}
+
+	return true
+}
+
+//processBatch produces up to batch_size messages, which may belong to
+//different tables, and commits batches of the affected tables
+func (m *multiStreamer) processBatch(next *tableResult) {
+	batch := make(map[*tableStream]int64)
+
+L:
+	for i := 1; ; i++ {
+		t := next.t
+		//Skip messages of the tables detached already
+		if m.tables[t.id] == t {
+			if !next.hasNext {
+				m.detach(t, true)
+			} else if log.EL(t.log, next.err) || t.processEvent(next.data) != nil {
+				m.detach(t, false)
+			} else {
+				t.trackOffset(next.offset)
+				batch[t]++
+			}
+		}
+
+		if i >= m.batchSize {
+			break
+		}
+
+		//Break if we would block
+		select {
+		case next = <-m.msgCh:
+		default:
+			break L
+		}
+	}
+
+	for t, b := range batch {
+		if m.tables[t.id] != t {
+			continue
+		}
+
+		t.metrics.EventsRead.Inc(b)
+		t.metrics.EventsWritten.Inc(b)
+		t.metrics.BatchSize.Record(time.Duration(b * 1000000))
+		t.metrics.BytesWritten.Set(t.BytesWritten)
+		t.metrics.BytesRead.Set(t.BytesRead)
+
+		w := t.metrics.ProduceLatency
+		w.Start()
+		err := t.commitBatch()
+		w.Stop()
+		if log.EL(t.log, err) {
+			m.detach(t, false)
+		}
+	}
+}
+
+func (m *multiStreamer) start(cfg *config.AppConfig) bool {
+	//Multi table worker takes single cluster concurrency ticket, same as single
+	//table worker, which is not bound to the cluster at this point
+	if cfg.ClusterConcurrency != 0 {
+		m.clusterLock = lock.Create(state.GetDbAddr(), cfg.ClusterConcurrency)
+
+		if !m.clusterLock.TryLock(".") {
+			log.Debugf("All cluster concurrency tickets are taken")
+			return false
+		}
+
+		defer m.clusterLock.Close()
+	}
+
+	m.lockConn = lock.Create(state.GetDbAddr(), 1)
+	defer m.lockConn.Close()
+
+	m.batchSize = cfg.PipeBatchSize
+	m.msgCh = make(chan *tableResult, m.batchSize)
+	m.tables = make(map[int64]*tableStream)
+
+	m.attachTables(cfg)
+
+	if len(m.tables) == 0 {
+		log.Debugf("Finished multi table streamer: No bootstrapped tables to work on")
+		return false
+	}
+
+	defer func() {
+		for _, t := range m.tables {
+			m.detach(t, true)
+		}
+	}()
+
+	tickCh := time.NewTicker(time.Second * time.Duration(cfg.StateUpdateTimeout)).C
+
+	for !shutdown.Initiated() && len(m.tables) != 0 {
+		select {
+		case <-tickCh:
+			if !m.refresh() {
+				return true
+			}
+			m.attachTables(cfg)
+		case next := <-m.msgCh:
+			m.processBatch(next)
+		case <-shutdown.InitiatedCh():
+		}
+	}
+
+	log.Debugf("Finished multi table streamer")
+
+	return true
+}
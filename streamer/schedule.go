@@ -0,0 +1,130 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package streamer
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/lock"
+	"github.com/raksh93/storagetapper/log"
+	"github.com/raksh93/storagetapper/state"
+)
+
+//sortByPriority orders state rows by snapshot priority, so as streamers pick
+//up higher priority tables first
+func sortByPriority(cfg *config.AppConfig, st state.Type) {
+	sort.SliceStable(st, func(i, j int) bool {
+		return cfg.GetSnapshotSchedule(st[i].Cluster, st[i].Db, st[i].Table).Priority >
+			cfg.GetSnapshotSchedule(st[j].Cluster, st[j].Db, st[j].Table).Priority
+	})
+}
+
+//pendingHigherPriority returns the name of the table on the same cluster,
+//which waits for the snapshot, has higher priority and is allowed to start
+//snapshot now
+func (s *Streamer) pendingHigherPriority(cfg *config.AppConfig, priority int, now time.Time) (string, error) {
+	rows, err := state.GetCond("cluster=? AND needBootstrap=1 AND id<>?", s.cluster, s.id)
+	if err != nil {
+		return "", err
+	}
+
+	for _, r := range rows {
+		sched := cfg.GetSnapshotSchedule(r.Cluster, r.Db, r.Table)
+		if sched.Priority <= priority {
+			continue
+		}
+		allowed, err := sched.Allowed(now)
+		if err != nil {
+			return "", err
+		}
+		if allowed {
+			return r.Db + "." + r.Table, nil
+		}
+	}
+
+	return "", nil
+}
+
+//deferReason checks table snapshot schedule and returns the reason why snapshot
+//cannot be started now, or empty string if it's allowed to start. Takes
+//cluster snapshot concurrency ticket if the number of concurrent snapshots is
+//limited
+func (s *Streamer) deferReason(cfg *config.AppConfig, now time.Time) (string, error) {
+	sched := cfg.GetSnapshotSchedule(s.cluster, s.db, s.table)
+
+	allowed, err := sched.Allowed(now)
+	if err != nil {
+		return "", err
+	}
+	if !allowed {
+		return fmt.Sprintf("outside of snapshot windows %v %v", sched.Windows, sched.Timezone), nil
+	}
+
+	t, err := s.pendingHigherPriority(cfg, sched.Priority, now)
+	if err != nil {
+		return "", err
+	}
+	if t != "" {
+		return fmt.Sprintf("waiting for higher priority table %v", t), nil
+	}
+
+	if sched.MaxConcurrent != 0 {
+		s.snapshotLock = lock.Create(state.GetDbAddr(), sched.MaxConcurrent)
+		if !s.snapshotLock.TryLock("snapshot." + s.cluster) {
+			s.snapshotLock.Close()
+			s.snapshotLock = nil
+			return fmt.Sprintf("%v snapshot(s) already running on the cluster", sched.MaxConcurrent), nil
+		}
+	}
+
+	return "", nil
+}
+
+//snapshotAllowed returns true if table snapshot can be started now, clearing
+//deferred status of the snapshot. Otherwise snapshot marked as deferred in the
+//state
+func (s *Streamer) snapshotAllowed(cfg *config.AppConfig) bool {
+	reason, err := s.deferReason(cfg, time.Now())
+	if log.EL(s.log, err) {
+		return false
+	}
+
+	if reason == "" {
+		return !log.EL(s.log, state.ClearDeferredSnapshot(s.id))
+	}
+
+	s.log.Infof("Snapshot deferred: %v", reason)
+	log.EL(s.log, state.DeferSnapshot(s.id, s.cluster, reason))
+
+	return false
+}
+
+//releaseSnapshotLock returns cluster snapshot concurrency ticket, so as other
+//tables of the cluster can start their snapshots
+func (s *Streamer) releaseSnapshotLock() {
+	if s.snapshotLock != nil {
+		s.snapshotLock.Close()
+		s.snapshotLock = nil
+	}
+}
@@ -23,6 +23,8 @@ package streamer
 import (
 	"time"
 
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/encoder"
 	"github.com/raksh93/storagetapper/log"
 	"github.com/raksh93/storagetapper/metrics"
 	"github.com/raksh93/storagetapper/pipe"
@@ -35,6 +37,10 @@ import (
 var numRetries = 5
 var cancelCheckInterval = 60 * time.Second
 
+//throttleUpdateInterval is how often snapshot refreshes its registration in
+//the state and recalculates its share of the cluster throttling budget
+var throttleUpdateInterval = 5 * time.Second
+
 func (s *Streamer) streamBatch(snReader snapshot.Reader, outProducer pipe.Producer, batchSize int, snapshotMetrics *metrics.Snapshot) (bool, int64, int64, error) {
 	var i, b int
 	for i < batchSize && snReader.HasNext() {
@@ -45,10 +51,21 @@ func (s *Streamer) streamBatch(snReader snapshot.Reader, outProducer pipe.Produc
 
 		b += len(outMsg)
 
-		if s.outPipe.Type() == "file" {
+		var partKey string
+		if len(s.partitionColumns) != 0 {
+			var part []interface{}
+			if part, err = encoder.GetRowColumnValues(s.outEncoder.Schema(), snReader.Row(), s.partitionColumns); log.EL(s.log, err) {
+				return false, 0, 0, err
+			}
+			if partKey, err = s.partitionKey(part); log.EL(s.log, err) {
+				return false, 0, 0, err
+			}
+		}
+
+		if pipe.FileBased(s.outPipe) {
 			key = "snapshot"
 		}
-		err = outProducer.PushBatch(key, outMsg)
+		err = pipe.PushBatchOptions(outProducer, key, outMsg, s.messageOptions(partKey, 0, "", 0))
 
 		if log.EL(s.log, err) {
 			return false, 0, 0, err
@@ -93,12 +110,26 @@ func (s *Streamer) pushSchema() bool {
 		return false
 	}
 	if outMsg == nil {
-		return true
+		return s.pushContainerSchema()
 	}
 	err = s.outProducer.PushSchema("", outMsg)
 	return !log.EL(s.log, err)
 }
 
+//pushContainerSchema passes Avro schema to the pipes writing Avro container
+//or Parquet files. Avro format has no schema in the stream otherwise
+func (s *Streamer) pushContainerSchema() bool {
+	if s.outputFormat != "avro" || !pipe.NeedsAvroSchema(s.outPipe) {
+		return true
+	}
+	schema, err := encoder.AvroSchema(s.outEncoder)
+	if log.EL(s.log, err) {
+		return false
+	}
+	err = s.outProducer.PushSchema("", schema)
+	return !log.EL(s.log, err)
+}
+
 func yield(iops *throttle.Throttle, mb *throttle.Throttle, nEvents int64, nBytes int64) {
 	c := iops.Advice(nEvents)
 	m := mb.Advice(nBytes)
@@ -111,9 +142,96 @@ func yield(iops *throttle.Throttle, mb *throttle.Throttle, nEvents int64, nBytes
 	}
 }
 
+//throttleShare returns throttling target of the single snapshot, when n
+//snapshots share cluster wide budget. Per table target is used instead if it's
+//lower than the share. Zero means no throttling. When the budget is smaller
+//than the number of snapshots, it's given to the first snapshots by rank, one
+//unit each, and false is returned for the rest, which should wait
+func throttleShare(tableTarget int64, clusterTarget int64, n int, rank int) (int64, bool) {
+	if clusterTarget == 0 {
+		return tableTarget, true
+	}
+
+	if n < 1 {
+		n = 1
+	}
+
+	share := clusterTarget / int64(n)
+	if share == 0 {
+		if int64(rank) >= clusterTarget {
+			return 0, false
+		}
+		share = 1 //Zero target disables throttling
+	}
+
+	if tableTarget != 0 && tableTarget < share {
+		return tableTarget, true
+	}
+
+	return share, true
+}
+
+func clusterThrottleEnabled(cfg *config.AppConfig) bool {
+	return cfg.ClusterThrottleTargetMB != 0 || cfg.ClusterThrottleTargetIOPS != 0
+}
+
+//updateThrottle refreshes snapshot registration in the state and, if cluster
+//throttling is enabled, adjusts throttlers targets to the share of the cluster
+//budget, according to the number of snapshots currently active on the cluster
+//across all instances. Returns false in run if the snapshot has no share of
+//the budget and should wait for the next update
+func (s *Streamer) updateThrottle(cfg *config.AppConfig, iops *throttle.Throttle, mb *throttle.Throttle) (n int, run bool, err error) {
+	if err = state.RegisterSnapshot(s.id, s.cluster); err != nil {
+		return 0, false, err
+	}
+
+	if !clusterThrottleEnabled(cfg) {
+		return 0, true, nil
+	}
+
+	n, rank, err := state.GetSnapshotRank(s.id, s.cluster, int(3*throttleUpdateInterval/time.Second))
+	if err != nil {
+		return 0, false, err
+	}
+
+	var runMB bool
+	iops.Target, run = throttleShare(cfg.ThrottleTargetIOPS, cfg.ClusterThrottleTargetIOPS, n, rank)
+	mb.Target, runMB = throttleShare(cfg.ThrottleTargetMB*1024*1024, cfg.ClusterThrottleTargetMB*1024*1024, n, rank)
+
+	return n, run && runMB, nil
+}
+
+//joinClusterThrottle registers the snapshot in the state as running.
+//If cluster throttling is enabled and there are other snapshots running on the
+//cluster it waits for them to pick up the new budget share before proceeding,
+//so as cluster limit is never exceeded. Returns false in run if the snapshot
+//has no share of the budget yet
+func (s *Streamer) joinClusterThrottle(cfg *config.AppConfig, iops *throttle.Throttle, mb *throttle.Throttle) (run bool, ok bool) {
+	n, run, err := s.updateThrottle(cfg, iops, mb)
+	if log.EL(s.log, err) {
+		return false, false
+	}
+
+	if !clusterThrottleEnabled(cfg) {
+		return true, true
+	}
+
+	s.log.Debugf("Cluster throttle enabled: %v IOPS, %v MBs, shared by %v snapshot(s)", cfg.ClusterThrottleTargetIOPS, cfg.ClusterThrottleTargetMB, n)
+
+	if n > 1 {
+		select {
+		case <-time.After(throttleUpdateInterval):
+		case <-shutdown.InitiatedCh():
+			return false, false
+		}
+	}
+
+	return run, true
+}
+
 // StreamFromConsistentSnapshot initializes and pulls event from the Snapshot reader, serializes
 // them in Avro format and publishes to output Kafka topic.
-func (s *Streamer) streamFromConsistentSnapshot(throttleMB int64, throttleIOPS int64) bool {
+func (s *Streamer) streamFromConsistentSnapshot(cfg *config.AppConfig) bool {
 	snReader, err := snapshot.InitReader(s.input)
 	if log.EL(s.log, err) {
 		return false
@@ -138,29 +256,51 @@ func (s *Streamer) streamFromConsistentSnapshot(throttleMB int64, throttleIOPS i
 	snapshotMetrics.NumWorkers.Inc()
 	defer snapshotMetrics.NumWorkers.Dec()
 
-	iopsThrottler := throttle.New(throttleIOPS, 1000000, 3)
-	mbThrottler := throttle.New(throttleMB*1024*1024, 1000000, 3)
+	iopsThrottler := throttle.New(cfg.ThrottleTargetIOPS, 1000000, 3)
+	mbThrottler := throttle.New(cfg.ThrottleTargetMB*1024*1024, 1000000, 3)
+
+	if cfg.ThrottleTargetIOPS != 0 || cfg.ThrottleTargetMB != 0 {
+		s.log.Debugf("Snapshot throttle enabled: %v IOPS, %v MBs", cfg.ThrottleTargetIOPS, cfg.ThrottleTargetMB)
+	}
 
-	if throttleIOPS != 0 || throttleMB != 0 {
-		s.log.Debugf("Snapshot throttle enabled: %v IOPS, %v MBs", throttleIOPS, throttleMB)
+	defer func() { log.EL(s.log, state.DeregisterSnapshot(s.id)) }()
+	run, ok := s.joinClusterThrottle(cfg, iopsThrottler, mbThrottler)
+	if !ok {
+		return false
 	}
 
-	tickChan := time.NewTicker(cancelCheckInterval).C
+	throttleTicker := time.NewTicker(throttleUpdateInterval)
+	defer throttleTicker.Stop()
+	throttleTickChan := throttleTicker.C
+
+	ticker := time.NewTicker(cancelCheckInterval)
+	defer ticker.Stop()
+	tickChan := ticker.C
 	for !shutdown.Initiated() {
-		next, nBytes, nEvents, err1 := s.streamBatch(snReader, outProducer, s.batchSize, snapshotMetrics)
+		if run {
+			next, nBytes, nEvents, err1 := s.streamBatch(snReader, outProducer, s.batchSize, snapshotMetrics)
 
-		if log.EL(s.log, err1) {
-			return false
-		}
-		if !next {
-			break
-		}
+			if log.EL(s.log, err1) {
+				return false
+			}
+			if !next {
+				break
+			}
 
-		if !s.commitWithRetry(snapshotMetrics) {
-			return false
-		}
+			if !s.commitWithRetry(snapshotMetrics) {
+				return false
+			}
 
-		yield(iopsThrottler, mbThrottler, nEvents, nBytes)
+			yield(iopsThrottler, mbThrottler, nEvents, nBytes)
+		} else {
+			//No share of the cluster budget, wait for the next update
+			select {
+			case <-throttleTickChan:
+				_, run, err = s.updateThrottle(cfg, iopsThrottler, mbThrottler)
+				log.EL(s.log, err)
+			case <-shutdown.InitiatedCh():
+			}
+		}
 
 		select {
 		case <-tickChan:
@@ -169,6 +309,9 @@ func (s *Streamer) streamFromConsistentSnapshot(throttleMB int64, throttleIOPS i
 				s.log.Warnf("Table removed from ingestion. Snapshot cancelled.")
 				return false
 			}
+		case <-throttleTickChan:
+			_, run, err = s.updateThrottle(cfg, iopsThrottler, mbThrottler)
+			log.EL(s.log, err)
 		default:
 		}
 	}
@@ -177,6 +320,10 @@ func (s *Streamer) streamFromConsistentSnapshot(throttleMB int64, throttleIOPS i
 		return false
 	}
 
+	if log.EL(s.log, pipe.Flush(outProducer)) {
+		return false
+	}
+
 	err = state.SetTableNewFlag(s.svc, s.cluster, s.db, s.table, s.input, s.output, s.version, false)
 	return !log.EL(s.log, err)
 }
@@ -52,6 +52,7 @@ type Streamer struct {
 	output      string
 	inPipe      pipe.Pipe
 	outPipe     pipe.Pipe
+	outPipes    *map[string]pipe.Pipe
 	outProducer pipe.Producer
 	outEncoder  encoder.Encoder
 	envEncoder  encoder.Encoder
@@ -66,6 +67,19 @@ type Streamer struct {
 	batchSize          int
 	tableLock          lock.Lock
 	clusterLock        lock.Lock
+	snapshotLock       lock.Lock
+	tombstones         string
+	partitionColumns   []string
+	headers            bool
+
+	deadLetter *config.DeadLetterPolicy
+	dlPipe     pipe.Pipe
+	dlProducer pipe.Producer
+
+	//Exactly-once mode state
+	txn        pipe.TxnProducer
+	txnGroup   string
+	txnOffsets map[int32]pipe.Offset //positions of the processed messages
 }
 
 // ensureBinlogReaderStart ensures that Binlog reader worker has started publishing to Kafka buffer
@@ -136,15 +150,27 @@ func (s *Streamer) waitForGtid(svc string, sdb string, gtid string) bool {
 	return true
 }
 
-func (s *Streamer) startBootstrap(cfg *config.AppConfig) bool {
-	// Checks whether table is new and needs bootstrapping.
-	// Stream events by invoking Consistent Snapshot Reader and allowing it to complete
+//checkBootstrap returns true in needsBootstrap if the table is new and
+//needs to be snapshotted. Returns false in ok if the snapshot is deferred by
+//the schedule. Called before the table is initialized, so as deferred tables
+//don't create output producers and don't wait for binlog reader
+func (s *Streamer) checkBootstrap(cfg *config.AppConfig) (needsBootstrap bool, ok bool) {
 	needsBootstrap, err := state.GetTableNewFlag(s.svc, s.cluster, s.db, s.table, s.input, s.output, s.version)
 	if log.EL(s.log, err) {
-		return false
+		return false, false
+	}
+
+	if !needsBootstrap {
+		return false, true
 	}
 
-	return !needsBootstrap || s.streamFromConsistentSnapshot(cfg.ThrottleTargetMB, cfg.ThrottleTargetIOPS)
+	// Snapshots are subject to schedule. Deferred snapshot will be retried
+	// next time streamer picks up the table
+	if !s.snapshotAllowed(cfg) {
+		return true, false
+	}
+
+	return true, true
 }
 
 func (s *Streamer) lockTable(st state.Type, outPipes *map[string]pipe.Pipe) {
@@ -155,6 +181,7 @@ func (s *Streamer) lockTable(st state.Type, outPipes *map[string]pipe.Pipe) {
 			s.db = row.Db
 			s.table = row.Table
 			s.id = row.ID
+			s.outPipes = outPipes
 			s.outPipe = (*outPipes)[row.Output]
 			if s.outPipe == nil {
 				s.table = ""
@@ -166,11 +193,33 @@ func (s *Streamer) lockTable(st state.Type, outPipes *map[string]pipe.Pipe) {
 			s.output = row.Output
 			s.version = row.Version
 			s.outputFormat = row.OutputFormat
+			s.log = log.WithFields(log.Fields{"service": s.svc, "db": s.db, "table": s.table})
 			break
 		}
 	}
 }
 
+//lockEligibleTable locks the first table, which can be streamed now. Tables,
+//which snapshots are deferred by the schedule, are unlocked and skipped, so as
+//they don't block the rest of the tables. Returns true if locked table needs
+//to be snapshotted
+func (s *Streamer) lockEligibleTable(cfg *config.AppConfig, st state.Type, outPipes *map[string]pipe.Pipe) bool {
+	for _, row := range st {
+		s.lockTable(state.Type{row}, outPipes)
+		if s.table == "" {
+			continue
+		}
+		needsBootstrap, ok := s.checkBootstrap(cfg)
+		if ok {
+			return needsBootstrap
+		}
+		s.releaseSnapshotLock()
+		s.tableLock.Unlock()
+		s.table = ""
+	}
+	return false
+}
+
 func readState(cfg *config.AppConfig) (state.Type, error) {
 	if cfg.ChangelogPipeType == "local" {
 		return state.GetForCluster(changelog.ThisInstanceCluster())
@@ -178,68 +227,31 @@ func readState(cfg *config.AppConfig) (state.Type, error) {
 	return state.Get()
 }
 
-func (s *Streamer) start(cfg *config.AppConfig, outPipes *map[string]pipe.Pipe) bool {
-	// Fetch Lock on a service-db-table entry in State.
-	// Currently, each event streamer worker handles a single table.
-	//TODO: Handle multiple tables per event streamer worker in future
-	var st state.Type
+//initTable initializes metrics, output producer, encoders and changelog
+//consumer of the locked table. Caller is responsible for closing output
+//producer if it has been created
+func (s *Streamer) initTable(cfg *config.AppConfig) (pipe.Consumer, bool) {
 	var err error
 
-	log.Debugf("Started streamer thread")
-
-	if st, err = readState(cfg); log.E(err) {
-		log.Errorf("Error reading state: %v", err.Error())
-	}
-
-	//If cluster concurrency is limited, try to get our ticket
-	if cfg.ClusterConcurrency != 0 {
-		s.clusterLock = lock.Create(state.GetDbAddr(), cfg.ClusterConcurrency)
-
-		if !s.clusterLock.TryLock(fmt.Sprintf("%v.%v", s.svc, s.cluster)) {
-			log.Debugf("All cluster concurrency tickets are taken")
-			return false
-		}
-
-		defer s.clusterLock.Close()
-	}
-
-	s.tableLock = lock.Create(state.GetDbAddr(), cfg.OutputPipeConcurrency)
-
-	s.lockTable(st, outPipes)
-
-	//If unable to take a lock, return back
-	if s.table == "" {
-		log.Debugf("Finished streamer: No free tables to work on")
-		return false
-	}
-
-	defer s.tableLock.Close()
-
 	sTag := s.getTag()
 	s.metrics = metrics.GetStreamerMetrics(sTag)
 	log.Debugf("Initializing metrics for streamer: Cluster: %s, DB: %s, Table: %s -- Tags: %v",
 		s.cluster, s.db, s.table, sTag)
 
-	s.metrics.NumWorkers.Inc()
-	defer s.metrics.NumWorkers.Dec()
-
-	s.log = log.WithFields(log.Fields{"service": s.svc, "db": s.db, "table": s.table})
-
 	// Event Streamer worker has successfully acquired a lock on a table. Proceed further
 	// Each Event Streamer handles events from all partitions from Input buffer for a table
 	s.topic, err = cfg.GetOutputTopicName(s.svc, s.db, s.table, s.input, s.output, s.version)
 	if log.E(err) {
-		return false
+		return nil, false
 	}
 	s.batchSize = cfg.PipeBatchSize
 
 	log.Debugf("Will be streaming to topic: %v", s.topic)
 
-	s.outProducer, err = s.outPipe.NewProducer(s.topic)
+	s.outProducer, err = s.newOutProducer(cfg)
 	if log.E(err) {
-		return false
+		return nil, false
 	}
-	defer func() { log.EL(s.log, s.outProducer.Close()) }()
 
 	s.outProducer.SetFormat(s.outputFormat)
 
@@ -247,41 +259,117 @@ func (s *Streamer) start(cfg *config.AppConfig, outPipes *map[string]pipe.Pipe)
 	// which the table resides.
 	gtid, err := s.ensureBinlogReaderStart()
 	if err != nil {
-		return false
+		return nil, false
 	}
 
 	s.waitForGtid(s.svc, s.db, gtid)
 
 	s.stateUpdateTimeout = cfg.StateUpdateTimeout
+	s.deadLetter = cfg.GetDeadLetterPolicy(s.cluster, s.db, s.table)
+	if s.outPipe.Type() == "kafka" {
+		s.tombstones = cfg.KafkaTombstones
+		s.partitionColumns = cfg.GetKafkaPartitioner(s.topic).Columns
+		s.headers = cfg.KafkaHeaders
+	}
 
 	s.outEncoder, err = encoder.Create(s.outputFormat, s.svc, s.db, s.table)
 	if log.EL(s.log, err) {
-		return false
+		return nil, false
+	}
+
+	if !s.pushContainerSchema() {
+		return nil, false
 	}
 
 	//Transit format encoder, aka envelope encoder
 	//It must be per table to be able to decode schematized events
 	s.envEncoder, err = encoder.Create(encoder.Internal.Type(), s.svc, s.db, s.table)
 	if log.EL(s.log, err) {
-		return false
+		return nil, false
 	}
 
 	//Consumer should registered before snapshot started, so it sees all the
 	//event during the snapshot
 	tn, err := config.Get().GetChangelogTopicName(s.svc, s.db, s.table, s.input, s.output, s.version)
 	if log.EL(s.log, err) {
-		return false
+		return nil, false
 	}
 	consumer, err := s.inPipe.NewConsumer(tn)
 	if log.EL(s.log, err) {
+		return nil, false
+	}
+	s.txnGroup = pipe.ConsumerGroup(consumer)
+
+	return consumer, true
+}
+
+func (s *Streamer) start(cfg *config.AppConfig, outPipes *map[string]pipe.Pipe) bool {
+	// Fetch Lock on a service-db-table entry in State.
+	// Each event streamer worker handles a single table here. Multiple tables
+	// per worker are handled by multiStreamer
+	var st state.Type
+	var err error
+
+	log.Debugf("Started streamer thread")
+
+	if st, err = readState(cfg); log.E(err) {
+		log.Errorf("Error reading state: %v", err.Error())
+	}
+
+	sortByPriority(cfg, st)
+
+	//If cluster concurrency is limited, try to get our ticket
+	if cfg.ClusterConcurrency != 0 {
+		s.clusterLock = lock.Create(state.GetDbAddr(), cfg.ClusterConcurrency)
+
+		if !s.clusterLock.TryLock(fmt.Sprintf("%v.%v", s.svc, s.cluster)) {
+			log.Debugf("All cluster concurrency tickets are taken")
+			return false
+		}
+
+		defer s.clusterLock.Close()
+	}
+
+	s.tableLock = lock.Create(state.GetDbAddr(), cfg.OutputPipeConcurrency)
+
+	needsBootstrap := s.lockEligibleTable(cfg, st, outPipes)
+
+	//If unable to take a lock, return back
+	if s.table == "" {
+		log.Debugf("Finished streamer: No free tables to work on")
 		return false
 	}
 
-	if !s.startBootstrap(cfg) {
-		log.E(consumer.CloseOnFailure())
+	defer s.tableLock.Close()
+
+	//Snapshot ticket is released as soon as snapshot is finished, this
+	//releases it on the failure paths
+	defer s.releaseSnapshotLock()
+
+	consumer, ok := s.initTable(cfg)
+	if s.outProducer != nil {
+		defer s.closeOutProducer()
+	}
+	if !ok {
 		return false
 	}
 
+	s.metrics.NumWorkers.Inc()
+	defer s.metrics.NumWorkers.Dec()
+
+	defer s.closeDeadLetterProducer()
+
+	// Stream events by invoking Consistent Snapshot Reader and allowing it
+	// to complete
+	if needsBootstrap {
+		ok = s.streamFromConsistentSnapshot(cfg)
+		s.releaseSnapshotLock()
+		if !ok {
+			log.E(consumer.CloseOnFailure())
+			return false
+		}
+	}
+
 	if cfg.ChangelogBuffer {
 		s.StreamTable(consumer)
 	}
@@ -293,6 +381,14 @@ func (s *Streamer) start(cfg *config.AppConfig, outPipes *map[string]pipe.Pipe)
 
 // Worker : Initializer function
 func Worker(cfg *config.AppConfig, inP pipe.Pipe, outPipes *map[string]pipe.Pipe) bool {
+	//Tables which are already bootstrapped are multiplexed, if configured.
+	//Snapshots always run in single table workers
+	if cfg.StreamerTablesPerWorker > 1 && cfg.ChangelogBuffer {
+		m := &multiStreamer{inPipe: inP, outPipes: outPipes}
+		if m.start(cfg) {
+			return true
+		}
+	}
 	s := &Streamer{inPipe: inP}
 	return s.start(cfg, outPipes)
 }
@@ -27,6 +27,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -34,7 +35,9 @@ import (
 	"github.com/raksh93/storagetapper/config"
 	"github.com/raksh93/storagetapper/db"
 	"github.com/raksh93/storagetapper/encoder"
+	"github.com/raksh93/storagetapper/lock"
 	"github.com/raksh93/storagetapper/log"
+	"github.com/raksh93/storagetapper/metrics"
 	"github.com/raksh93/storagetapper/pipe"
 	"github.com/raksh93/storagetapper/schema"
 	"github.com/raksh93/storagetapper/shutdown"
@@ -385,6 +388,448 @@ func TestStreamerShutdown(t *testing.T) {
 	shutdown.Wait()
 }
 
+func TestMultiTableWorker(t *testing.T) {
+	test.SkipIfNoMySQLAvailable(t)
+	test.SkipIfNoKafkaAvailable(t)
+
+	testPipeType = "kafka"
+	testOutputFormat = "json"
+
+	save := cfg.StreamerTablesPerWorker
+	cfg.StreamerTablesPerWorker = 2
+	defer func() { cfg.StreamerTablesPerWorker = save }()
+
+	shutdown.Setup()
+	defer func() {
+		shutdown.Initiate()
+		shutdown.Wait()
+	}()
+
+	dbConn := setupDB(t)
+	defer func() { test.CheckFail(dbConn.Close(), t) }()
+
+	//Only bootstrapped tables are multiplexed
+	for _, tbl := range []string{testTbl, testTbl1} {
+		test.CheckFail(state.SetTableNewFlag(testSvc, "", testDb, tbl, "mysql", testPipeType, 0, false), t)
+	}
+
+	//Buffer is big enough to hold test events, before consumers registered
+	bufPipe, err := pipe.Create(shutdown.Context, "local", 256, cfg, nil)
+	test.CheckFail(err, t)
+
+	var producers []pipe.Producer
+	for _, tbl := range []string{testTbl, testTbl1} {
+		tn, err := config.Get().GetChangelogTopicName(testSvc, testDb, tbl, "mysql", testPipeType, 0)
+		test.CheckFail(err, t)
+		producer, err := bufPipe.NewProducer(tn)
+		test.CheckFail(err, t)
+		producers = append(producers, producer)
+	}
+
+	outPipe := make(map[string]pipe.Pipe)
+	outPipe["kafka"], err = pipe.Create(shutdown.Context, "kafka", cfg.PipeBatchSize, cfg, state.GetDB())
+	test.CheckFail(err, t)
+
+	var consumers []pipe.Consumer
+	for _, tbl := range []string{testTbl, testTbl1} {
+		tn, err := cfg.GetOutputTopicName(testSvc, testDb, tbl, "mysql", testPipeType, 0)
+		test.CheckFail(err, t)
+		consumer, err := outPipe["kafka"].NewConsumer(tn)
+		test.CheckFail(err, t)
+		consumers = append(consumers, consumer)
+	}
+
+	setupBufferData(producers[0], "json", "json", 0, 100, t)
+	setupBufferData(producers[1], "json", "json", 0, 100, t)
+
+	//Single worker streams both tables
+	shutdown.Register(1)
+	go EventWorker(cfg, bufPipe, outPipe, t)
+
+	verifyFromOutputKafka(100, consumers[0], "json", testTbl, t)
+	verifyFromOutputKafka(100, consumers[1], "json", testTbl1, t)
+
+	for i := range consumers {
+		test.CheckFail(consumers[i].Close(), t)
+		test.CheckFail(producers[i].Close(), t)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	lp, err := pipe.Create(shutdown.Context, "local", 16, cfg, nil)
+	test.CheckFail(err, t)
+
+	outPipes := map[string]pipe.Pipe{"local": lp}
+	s := &Streamer{svc: testSvc, db: testDb, table: testTbl, output: "local", outPipe: lp, outPipes: &outPipes}
+	s.log = log.WithFields(log.Fields{"service": s.svc, "db": s.db, "table": s.table})
+	s.metrics = metrics.GetStreamerMetrics(s.getTag())
+	s.envEncoder, err = encoder.InitEncoder("json", testSvc, testDb, testTbl)
+	test.CheckFail(err, t)
+	s.outProducer, err = lp.NewProducer("output")
+	test.CheckFail(err, t)
+
+	tn, err := cfg.GetDeadLetterTopicName(testSvc, testDb, testTbl, "", "local", 0)
+	test.CheckFail(err, t)
+	dlConsumer, err := lp.NewConsumer(tn)
+	test.CheckFail(err, t)
+
+	saveDelay := retryDelay
+	retryDelay = time.Millisecond
+	defer func() { retryDelay = saveDelay }()
+
+	broken := []byte("broken event")
+
+	s.deadLetter = &config.DeadLetterPolicy{Policy: config.DeadLetterHalt}
+	test.Assert(t, s.processEvent(broken) != nil, "halt policy should return error")
+
+	for _, p := range []config.DeadLetterPolicy{{Policy: config.DeadLetterSkip}, {Policy: config.DeadLetterRetry, Retries: 2}} {
+		s.deadLetter = &p
+		test.CheckFail(s.processEvent(broken), t)
+
+		test.Assert(t, dlConsumer.FetchNext(), "dead letter expected")
+		m, err := dlConsumer.Pop()
+		test.CheckFail(err, t)
+
+		var ev types.DeadLetterEvent
+		test.CheckFail(json.Unmarshal(m.([]byte), &ev), t)
+		test.Assert(t, bytes.Equal(ev.Data, broken), "original event expected, got: %v", string(ev.Data))
+		test.Assert(t, ev.Table == testTbl && ev.Db == testDb && ev.Error != "", "metadata expected, got: %+v", ev)
+		test.Assert(t, ev.Attempts == p.Retries+1, "expected %v attempts, got %v", p.Retries+1, ev.Attempts)
+	}
+
+	test.Assert(t, s.metrics.EventsDeadLettered.Get() == 2, "dead lettered counter")
+	test.Assert(t, s.metrics.EventsRetried.Get() == 2, "retried counter")
+
+	s.closeDeadLetterProducer()
+}
+
+//limitedPipe rejects messages larger than max, the same way as Kafka rejects
+//messages larger than max.message.bytes
+type limitedPipe struct {
+	pipe.Pipe
+	max int
+}
+
+type limitedProducer struct {
+	pipe.Producer
+	max int
+}
+
+func (p *limitedPipe) NewProducer(topic string) (pipe.Producer, error) {
+	pr, err := p.Pipe.NewProducer(topic)
+	return &limitedProducer{pr, p.max}, err
+}
+
+func (p *limitedProducer) PushBatch(key string, data interface{}) error {
+	if b, ok := data.([]byte); ok && len(b) > p.max {
+		return fmt.Errorf("message size %v exceeds %v", len(b), p.max)
+	}
+	return p.Producer.PushBatch(key, data)
+}
+
+func TestDeadLetterOversized(t *testing.T) {
+	lp, err := pipe.Create(shutdown.Context, "local", 16, cfg, nil)
+	test.CheckFail(err, t)
+	limited := &limitedPipe{lp, 1024}
+
+	outPipes := map[string]pipe.Pipe{"local": limited}
+	s := &Streamer{svc: testSvc, db: testDb, table: testTbl, output: "local", outPipe: limited, outPipes: &outPipes}
+	s.log = log.WithFields(log.Fields{"service": s.svc, "db": s.db, "table": s.table})
+	s.metrics = metrics.GetStreamerMetrics(s.getTag())
+	s.outEncoder, err = encoder.InitEncoder("json", testSvc, testDb, testTbl)
+	test.CheckFail(err, t)
+	s.outProducer, err = limited.NewProducer("output")
+	test.CheckFail(err, t)
+	s.deadLetter = &config.DeadLetterPolicy{Policy: config.DeadLetterSkip, MaxDataSize: 256}
+
+	tn, err := cfg.GetDeadLetterTopicName(testSvc, testDb, testTbl, "", "local", 0)
+	test.CheckFail(err, t)
+	dlConsumer, err := lp.NewConsumer(tn)
+	test.CheckFail(err, t)
+
+	//Event is too large for the output pipe, which is also dead letter pipe
+	row := []interface{}{int64(1), strings.Repeat("a", 2048)}
+	msg := &types.RowMessage{Type: types.Insert, Key: "1", Data: &row, SeqNo: 1}
+	test.CheckFail(s.processEvent(msg), t)
+
+	test.Assert(t, dlConsumer.FetchNext(), "dead letter expected")
+	m, err := dlConsumer.Pop()
+	test.CheckFail(err, t)
+
+	var ev types.DeadLetterEvent
+	test.CheckFail(json.Unmarshal(m.([]byte), &ev), t)
+	test.Assert(t, ev.Truncated && len(ev.Data) == 256 && ev.DataSize > 2048, "truncated event expected, got: %v %v %v", ev.Truncated, len(ev.Data), ev.DataSize)
+	test.Assert(t, s.metrics.EventsDeadLettered.Get() == 1, "dead lettered counter")
+
+	s.closeDeadLetterProducer()
+}
+
+func TestThrottleShare(t *testing.T) {
+	tests := []struct {
+		table   int64
+		cluster int64
+		n       int
+		rank    int
+		res     int64
+		run     bool
+	}{
+		{0, 0, 5, 0, 0, true},
+		{10, 0, 5, 4, 10, true},
+		{0, 100, 0, 0, 100, true},
+		{0, 100, 1, 0, 100, true},
+		{0, 100, 4, 3, 25, true},
+		{10, 100, 4, 0, 10, true},
+		{50, 100, 4, 0, 25, true},
+		{0, 3, 5, 0, 1, true},
+		{0, 3, 5, 2, 1, true},
+		//Budget is exhausted by the lower ranked snapshots
+		{0, 3, 5, 3, 0, false},
+		{10, 3, 5, 4, 0, false},
+	}
+
+	for _, v := range tests {
+		r, run := throttleShare(v.table, v.cluster, v.n, v.rank)
+		test.Assert(t, r == v.res && run == v.run, "table=%v cluster=%v n=%v rank=%v: expected %v %v, got %v %v", v.table, v.cluster, v.n, v.rank, v.res, v.run, r, run)
+	}
+}
+
+func TestPartitionKey(t *testing.T) {
+	sch := &types.TableSchema{Columns: []types.ColumnSchema{
+		{Name: "id", Key: "PRI"},
+		{Name: "tenant_id"},
+		{Name: "seq", Key: "PRI"},
+	}}
+
+	fields := []types.CommonFormatField{{Name: "id", Value: 1}, {Name: "tenant_id", Value: "t1"}, {Name: "seq", Value: 7}}
+	ins := &types.CommonFormatEvent{Type: "insert", Key: []interface{}{1, 7}, Fields: &fields}
+	del := &types.CommonFormatEvent{Type: "delete", Key: []interface{}{1, 7}}
+
+	v, ok := commonFormatValue(sch, ins, "tenant_id")
+	test.Assert(t, ok && v == "t1", "expected tenant_id from fields, got %v %v", v, ok)
+	v, ok = commonFormatValue(sch, del, "seq")
+	test.Assert(t, ok && v == 7, "expected seq from the key, got %v %v", v, ok)
+	_, ok = commonFormatValue(sch, del, "tenant_id")
+	test.Assert(t, !ok, "non primary key column is not available in delete event")
+
+	row := []interface{}{1, "t1", 7}
+	vals, err := encoder.GetRowColumnValues(sch, &row, []string{"tenant_id", "id"})
+	test.CheckFail(err, t)
+
+	s := &Streamer{partitionColumns: []string{"tenant_id", "id"}}
+	k, err := s.partitionKey(vals)
+	test.CheckFail(err, t)
+	test.Assert(t, k == "2t111", "unexpected partition key: %v", k)
+
+	s.partitionColumns = []string{"tenant_id"}
+	k, err = s.partitionKey(vals[:1])
+	test.CheckFail(err, t)
+	test.Assert(t, k == "t1", "single column value should be used as is: %v", k)
+
+	_, err = s.partitionKey(vals)
+	test.Assert(t, err != nil, "number of values should match number of partition columns")
+
+	_, err = encoder.GetRowColumnValues(sch, &row, []string{"region"})
+	test.Assert(t, err != nil, "unknown column should fail")
+}
+
+//TestPartitionKeySnapshotBinlog checks that the row gets the same partition
+//key, whether it's read by the snapshot or passed in the JSON envelope from
+//the binlog reader
+func TestPartitionKeySnapshotBinlog(t *testing.T) {
+	dbConn := setupDB(t)
+	defer func() { test.CheckFail(dbConn.Close(), t) }()
+
+	tbl := "test_partkey"
+	execSQL(dbConn, t, fmt.Sprintf("CREATE TABLE %s.%s (id BIGINT NOT NULL, seq INT NOT NULL, "+
+		"score FLOAT, name VARCHAR(32), PRIMARY KEY(id, seq))", testDb, tbl))
+
+	env, err := encoder.Create("json", testSvc, testDb, tbl)
+	test.CheckFail(err, t)
+	out, err := encoder.Create("json", testSvc, testDb, tbl)
+	test.CheckFail(err, t)
+
+	s := &Streamer{svc: testSvc, db: testDb, table: tbl, outputFormat: "json", envEncoder: env, outEncoder: out}
+	s.log = log.WithFields(log.Fields{"table": tbl})
+	s.metrics = metrics.GetStreamerMetrics(s.getTag())
+	s.partitionColumns = []string{"seq", "score", "name", "id"}
+
+	row := []interface{}{int64(1234567), int32(7654321), float32(0.1), "n1"}
+
+	part, err := encoder.GetRowColumnValues(out.Schema(), &row, s.partitionColumns)
+	test.CheckFail(err, t)
+	snKey, err := s.partitionKey(part)
+	test.CheckFail(err, t)
+
+	//Wrap the event the same way as binlog reader does. JSON envelope
+	//decodes numbers as float64
+	rowKey := encoder.GetRowKey(out.Schema(), &row)
+	bd, err := out.Row(types.Insert, &row, 1)
+	test.CheckFail(err, t)
+	cfw := &types.CommonFormatEvent{Type: "json", Key: append([]interface{}{rowKey}, part...), SeqNo: 1, Timestamp: time.Now().UnixNano()}
+	cfb, err := env.CommonFormat(cfw)
+	test.CheckFail(err, t)
+
+	ev, err := s.encodeCommonFormat(append(cfb, bd...))
+	test.CheckFail(err, t)
+	test.Assert(t, ev.key == rowKey, "unexpected row key: %v", ev.key)
+	blKey, err := s.partitionKey(ev.part)
+	test.CheckFail(err, t)
+
+	test.Assert(t, snKey == "7765432130.12n171234567", "unexpected snapshot partition key: %v", snKey)
+	test.Assert(t, blKey == snKey, "binlog partition key %v should match snapshot partition key %v", blKey, snKey)
+}
+
+func TestSnapshotScheduleDefer(t *testing.T) {
+	dbConn := setupDB(t)
+	defer func() { test.CheckFail(dbConn.Close(), t) }()
+
+	save := cfg.SnapshotSchedule
+	defer func() { cfg.SnapshotSchedule = save }()
+
+	st, err := state.GetTable(testSvc, testDb, testTbl)
+	test.CheckFail(err, t)
+	test.Assert(t, len(st) == 1, "Expected single state row for %v", testTbl)
+
+	s := &Streamer{id: st[0].ID, cluster: st[0].Cluster, svc: testSvc, db: testDb, table: testTbl, log: log.WithFields(log.Fields{"table": testTbl})}
+	now, err := time.Parse(time.RFC3339, "2017-01-01T12:00:00Z")
+	test.CheckFail(err, t)
+
+	cfg.SnapshotSchedule = config.SnapshotScheduleConfig{}
+	r, err := s.deferReason(cfg, now)
+	test.CheckFail(err, t)
+	test.Assert(t, r == "", "Snapshot should be allowed without schedule, got: %v", r)
+
+	cfg.SnapshotSchedule.Default.Windows = []string{"22:00-06:00"}
+	r, err = s.deferReason(cfg, now)
+	test.CheckFail(err, t)
+	test.Assert(t, r != "", "Snapshot should be deferred outside of the window")
+
+	cfg.SnapshotSchedule.Default.Windows = []string{"11:00-13:00"}
+	cfg.SnapshotSchedule.Tables = map[string]config.SnapshotSchedule{
+		st[0].Cluster + "." + testDb + "." + testTbl1: {Priority: 1},
+	}
+	r, err = s.deferReason(cfg, now)
+	test.CheckFail(err, t)
+	test.Assert(t, r != "", "Snapshot should wait for higher priority table")
+
+	cfg.SnapshotSchedule.Tables = nil
+	cfg.SnapshotSchedule.Default.MaxConcurrent = 1
+
+	r, err = s.deferReason(cfg, now)
+	test.CheckFail(err, t)
+	test.Assert(t, r == "" && s.snapshotLock != nil, "Snapshot should be allowed, got: %v", r)
+
+	s1 := &Streamer{id: st[0].ID + 1, cluster: st[0].Cluster, svc: testSvc, db: testDb, table: testTbl1, log: s.log}
+	r, err = s1.deferReason(cfg, now)
+	test.CheckFail(err, t)
+	test.Assert(t, r != "", "Second snapshot should exceed cluster concurrency")
+
+	s.snapshotLock.Close()
+}
+
+func TestSnapshotScheduleSkipDeferred(t *testing.T) {
+	dbConn := setupDB(t)
+	defer func() { test.CheckFail(dbConn.Close(), t) }()
+
+	save := cfg.SnapshotSchedule
+	defer func() { cfg.SnapshotSchedule = save }()
+
+	st, err := state.Get()
+	test.CheckFail(err, t)
+	test.Assert(t, len(st) == 2, "Expected two state rows, got %v", len(st))
+
+	//Higher priority table is sorted first, but it's outside of its window
+	h := time.Now().UTC().Hour()
+	cfg.SnapshotSchedule = config.SnapshotScheduleConfig{Tables: map[string]config.SnapshotSchedule{
+		st[0].Cluster + "." + testDb + "." + testTbl: {Priority: 1, Windows: []string{fmt.Sprintf("%02d:00-%02d:00", (h+2)%24, (h+3)%24)}},
+	}}
+	sortByPriority(cfg, st)
+	test.Assert(t, st[0].Table == testTbl, "Higher priority table should be first")
+
+	lp, err := pipe.Create(shutdown.Context, "local", 16, cfg, nil)
+	test.CheckFail(err, t)
+	outPipes := map[string]pipe.Pipe{testPipeType: lp}
+	s := &Streamer{}
+	s.tableLock = lock.Create(state.GetDbAddr(), cfg.OutputPipeConcurrency)
+	defer s.tableLock.Close()
+
+	needsBootstrap := s.lockEligibleTable(cfg, st, &outPipes)
+	test.Assert(t, s.table == testTbl1 && needsBootstrap, "Deferred table should be skipped, locked: %v", s.table)
+
+	status, _, err := state.GetSnapshotStatus(st[0].ID)
+	test.CheckFail(err, t)
+	test.Assert(t, status == state.SnapshotDeferred, "Skipped table should be marked deferred: %v", status)
+}
+
+//TestSnapshotTicketRelease checks that the table releases cluster snapshot
+//ticket when its snapshot is finished, while it's still streaming
+func TestSnapshotTicketRelease(t *testing.T) {
+	test.SkipIfNoMySQLAvailable(t)
+	test.SkipIfNoKafkaAvailable(t)
+
+	testPipeType = "kafka"
+	testOutputFormat = "json"
+
+	save := cfg.SnapshotSchedule
+	cfg.SnapshotSchedule = config.SnapshotScheduleConfig{Default: config.SnapshotSchedule{MaxConcurrent: 1}}
+	defer func() { cfg.SnapshotSchedule = save }()
+
+	shutdown.Setup()
+	defer func() {
+		shutdown.Initiate()
+		shutdown.Wait()
+	}()
+
+	dbConn := setupDB(t)
+	defer func() { test.CheckFail(dbConn.Close(), t) }()
+
+	bufPipe, err := pipe.Create(shutdown.Context, "kafka", 16, cfg, nil)
+	test.CheckFail(err, t)
+	tn, err := config.Get().GetChangelogTopicName(testSvc, testDb, testTbl, "mysql", testPipeType, 0)
+	test.CheckFail(err, t)
+	producer, err := bufPipe.NewProducer(tn)
+	test.CheckFail(err, t)
+
+	setupData(dbConn, 0, t)
+
+	outPipe := map[string]pipe.Pipe{}
+	outPipe["kafka"], err = pipe.Create(shutdown.Context, "kafka", cfg.PipeBatchSize, cfg, state.GetDB())
+	test.CheckFail(err, t)
+
+	var consumers []pipe.Consumer
+	for _, tbl := range []string{testTbl, testTbl1} {
+		tn, err := cfg.GetOutputTopicName(testSvc, testDb, tbl, "mysql", testPipeType, 0)
+		test.CheckFail(err, t)
+		consumer, err := outPipe["kafka"].NewConsumer(tn)
+		test.CheckFail(err, t)
+		consumers = append(consumers, consumer)
+	}
+
+	//Workers retry deferred snapshots, the same way as the main loop does
+	shutdown.Register(2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			defer shutdown.Done()
+			for !shutdown.Initiated() && !Worker(cfg, bufPipe, &outPipe) {
+				time.Sleep(100 * time.Millisecond)
+			}
+		}()
+	}
+
+	//Both snapshots are completed one after another with single ticket
+	verifyFromOutputKafka(0, consumers[0], "json", testTbl, t)
+	verifyFromOutputKafka(0, consumers[1], "json", testTbl1, t)
+
+	//First table is still streaming
+	setupBufferData(producer, "json", "json", 0, 100, t)
+	verifyFromOutputKafka(100, consumers[0], "json", testTbl, t)
+
+	for _, c := range consumers {
+		test.CheckFail(c.Close(), t)
+	}
+	test.CheckFail(producer.Close(), t)
+}
+
 func TestMain(m *testing.M) {
 	cfg = test.LoadConfig()
 
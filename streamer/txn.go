@@ -0,0 +1,79 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package streamer
+
+import (
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/log"
+	"github.com/raksh93/storagetapper/pipe"
+	"github.com/raksh93/storagetapper/types"
+)
+
+//newOutProducer creates output producer. In exactly-once mode events are
+//produced by transactional producer, which commits them along with changelog
+//consumer offsets
+func (s *Streamer) newOutProducer(cfg *config.AppConfig) (pipe.Producer, error) {
+	if !cfg.KafkaExactlyOnce || s.outPipe.Type() != "kafka" || s.inPipe.Type() != "kafka" {
+		return s.outPipe.NewProducer(s.topic)
+	}
+
+	var err error
+	s.txn, err = pipe.NewTxnProducer(s.outPipe, types.MySvcName+".streamer."+s.topic)
+	if err != nil {
+		return nil, err
+	}
+	s.txnOffsets = make(map[int32]pipe.Offset)
+
+	return s.txn.NewProducer(s.topic)
+}
+
+//closeOutProducer closes output producer and transactional producer, if any
+func (s *Streamer) closeOutProducer() {
+	log.EL(s.log, s.outProducer.Close())
+	if s.txn != nil {
+		log.EL(s.log, s.txn.Close())
+		s.txn = nil
+	}
+}
+
+//trackOffset remembers position of the processed message to be committed
+//with the transaction
+func (s *Streamer) trackOffset(o *pipe.Offset) {
+	if s.txn != nil && o != nil {
+		s.txnOffsets[o.Partition] = *o
+	}
+}
+
+//commitTxn commits produced events along with the positions of the processed
+//changelog messages
+func (s *Streamer) commitTxn() error {
+	offsets := make([]pipe.Offset, 0, len(s.txnOffsets))
+	for _, o := range s.txnOffsets {
+		offsets = append(offsets, o)
+	}
+
+	err := s.txn.Commit(s.txnGroup, offsets)
+	if err == nil {
+		s.txnOffsets = make(map[int32]pipe.Offset)
+	}
+
+	return err
+}
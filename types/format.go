@@ -41,6 +41,8 @@ type CommonFormatEvent struct {
 	Type      string //insert, delete, schema
 	Key       []interface{}
 	SeqNo     uint64
-	Timestamp int64                //This only used for metrics, to measure time in buffer
+	Timestamp int64                //Time the event has been read from the binlog. Used to measure time in buffer
 	Fields    *[]CommonFormatField `json:",omitempty"`
+	Gtid      string               `json:",omitempty"` //Set in envelope only
+	EventTime int64                `json:",omitempty"` //MySQL event time from the binlog event header, in nanoseconds. Set in envelope only
 }
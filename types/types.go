@@ -22,10 +22,12 @@ package types
 
 /*RowMessage is used to pass message to the local streamer */
 type RowMessage struct {
-	Type  int
-	Key   string
-	Data  *[]interface{}
-	SeqNo uint64
+	Type      int
+	Key       string
+	Data      *[]interface{}
+	SeqNo     uint64
+	Gtid      string
+	EventTime int64 //MySQL event time from the binlog event header, in nanoseconds
 }
 
 /*TableLoc - table location */
@@ -38,3 +40,25 @@ type TableLoc struct {
 	Output  string
 	Version int
 }
+
+/*DeadLetterEvent is written to the dead letter topic for the event which
+* streamer failed to encode or produce */
+type DeadLetterEvent struct {
+	Service   string
+	Cluster   string
+	Db        string
+	Table     string
+	Input     string
+	Output    string
+	Version   int
+	Error     string
+	Attempts  int
+	Timestamp int64
+	//Data is the original event as read from the changelog buffer. Raw
+	//messages of the local pipe are JSON encoded. Data is truncated to the
+	//max_data_size of the dead letter policy
+	Data []byte
+	//DataSize is the size of the original event
+	DataSize  int
+	Truncated bool `json:",omitempty"`
+}
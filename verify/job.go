@@ -0,0 +1,642 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package verify
+
+import (
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/db"
+	"github.com/raksh93/storagetapper/encoder"
+	"github.com/raksh93/storagetapper/log"
+	"github.com/raksh93/storagetapper/metrics"
+	"github.com/raksh93/storagetapper/pipe"
+	"github.com/raksh93/storagetapper/schema"
+	"github.com/raksh93/storagetapper/shutdown"
+	"github.com/raksh93/storagetapper/snapshot"
+	"github.com/raksh93/storagetapper/types"
+	"github.com/raksh93/storagetapper/util"
+)
+
+type chunk struct {
+	idx   int
+	first []interface{}
+	last  []interface{}
+	rows  int
+	sum   uint64
+	gen   int //number of times the chunk has been read from the source
+
+	//rows of the chunk found in the output and their checksum, calculated
+	//by the last comparison
+	outRows int
+	outSum  uint64
+}
+
+//extraRow is the row present in the output, but not in the source
+type extraRow struct {
+	key string
+	pk  []interface{}
+}
+
+//outputMsg is the message of the output stream along with its key
+type outputMsg struct {
+	key   string
+	value []byte
+}
+
+type sourceRow struct {
+	row []interface{}
+	cf  *types.CommonFormatEvent
+}
+
+type job struct {
+	res          Result //protected by global lock
+	cfg          *config.AppConfig
+	log          log.Logger
+	outputFormat string
+
+	enc      encoder.Encoder
+	conn     *sql.DB
+	outPipe  pipe.Pipe
+	topic    string
+	consumer pipe.Consumer
+	msgs     chan interface{}
+	exit     chan bool
+
+	pkColumns  string
+	pkHolders  string
+	chunks     []*chunk
+	dir        string
+	source     *spill
+	output     *spill
+	outputRows int
+	extra      []extraRow
+
+	decodeErrors int
+	metrics      *metrics.Verify
+}
+
+func (j *job) init() error {
+	var err error
+	r := &j.res
+
+	j.enc, err = encoder.Create(j.outputFormat, r.Service, r.Db, r.Table)
+	if err != nil {
+		return err
+	}
+
+	s := j.enc.Schema()
+	if !schema.HasPrimaryKey(s) {
+		return errors.New("Table has no primary key")
+	}
+
+	var cols []string
+	for _, c := range s.Columns {
+		if c.Key == "PRI" {
+			cols = append(cols, "`"+c.Name+"`")
+		}
+	}
+	j.pkColumns = strings.Join(cols, ",")
+	j.pkHolders = "(" + strings.Repeat("?,", len(cols)-1) + "?)"
+
+	ci := db.GetInfo(&db.Loc{Cluster: r.Cluster, Service: r.Service, Name: r.Db}, db.Slave)
+	if ci == nil {
+		return errors.New("No db info received")
+	}
+	if j.conn, err = db.Open(ci); err != nil {
+		return err
+	}
+
+	j.outPipe, err = pipe.Create(shutdown.Context, r.Output, j.cfg.PipeBatchSize, j.cfg, nil)
+	if err != nil {
+		return err
+	}
+	if !pipe.SetInitialOffset(j.outPipe, pipe.OffsetOldest) {
+		return fmt.Errorf("Verification is not supported for %v pipe", j.outPipe.Type())
+	}
+
+	j.topic, err = j.cfg.GetOutputTopicName(r.Service, r.Db, r.Table, r.Input, r.Output, r.Version)
+	if err != nil {
+		return err
+	}
+
+	j.consumer, err = j.outPipe.NewConsumer(j.topic)
+	if err != nil {
+		return err
+	}
+	j.consumer.SetFormat(j.outputFormat)
+
+	if err = j.initSpill(); err != nil {
+		return err
+	}
+
+	j.metrics = metrics.GetVerifyMetrics(map[string]string{"table": r.Table, "db": r.Db, "cluster": r.Cluster})
+
+	return nil
+}
+
+//initSpill creates spill files of the source rows and output events. Number
+//of buckets is estimated so as a bucket holds about a chunk worth of rows
+func (j *job) initSpill() error {
+	var rows int64
+	err := util.QueryRowSQL(j.conn, "SELECT table_rows FROM information_schema.tables WHERE table_schema=? AND table_name=?", j.res.Db, j.res.Table).Scan(&rows)
+	if err != nil {
+		return err
+	}
+
+	n := int(rows/int64(j.cfg.VerifyChunkSize)) + 1
+	if n > maxSpillBuckets {
+		n = maxSpillBuckets
+	}
+
+	//Job IDs start over after restart, so leftovers of the previous run are
+	//removed
+	j.dir = filepath.Join(j.cfg.DataDir, "verify", strconv.FormatInt(j.res.ID, 10))
+	if err = os.RemoveAll(j.dir); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(j.dir, 0770); err != nil {
+		return err
+	}
+	if j.source, err = newSpill(j.dir, "source", n); err != nil {
+		return err
+	}
+	j.output, err = newSpill(j.dir, "output", n)
+	return err
+}
+
+func (j *job) close() {
+	if j.consumer != nil {
+		close(j.exit)
+		log.EL(j.log, j.consumer.CloseOnFailure())
+	}
+	if j.conn != nil {
+		log.EL(j.log, j.conn.Close())
+	}
+	if j.source != nil {
+		j.source.close()
+	}
+	if j.output != nil {
+		j.output.close()
+	}
+	if j.dir != "" {
+		log.EL(j.log, os.RemoveAll(j.dir))
+	}
+}
+
+func (j *job) fetch() {
+	defer close(j.msgs)
+	for j.consumer.FetchNext() {
+		msg, err := j.consumer.Pop()
+		if err != nil {
+			msg = err
+		} else if b, ok := msg.([]byte); ok {
+			key, _ := pipe.MessageKey(j.consumer)
+			msg = &outputMsg{key, b}
+		}
+		select {
+		case j.msgs <- msg:
+		case <-j.exit:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+//decode returns decoded event and its row key
+func (j *job) decode(b []byte) (*types.CommonFormatEvent, string, error) {
+	cf, err := j.enc.DecodeEvent(b)
+	if err != nil {
+		return nil, "", err
+	}
+	//Avro delete events carry encoded row key instead of primary key fields
+	if cf.Type == "delete" && j.enc.Type() == "avro" && len(cf.Key) == 1 {
+		if k, ok := cf.Key[0].(string); ok {
+			return cf, k, nil
+		}
+	}
+	return cf, encoder.GetCommonFormatKey(cf), nil
+}
+
+//apply spills output event. Events are compacted into the latest state of
+//every row by the comparison
+func (j *job) apply(msgKey string, b []byte) error {
+	//Tombstone deletes the row of the message key. It follows delete event in
+	//append mode or replaces it in replace mode
+	if len(b) == 0 {
+		if msgKey == "" {
+			return nil
+		}
+		return j.output.write(msgKey, &outputRecord{Key: msgKey, Delete: true})
+	}
+	cf, key, err := j.decode(b)
+	if err != nil {
+		j.log.Warnf("Error decoding output event: %v", err)
+		j.decodeErrors++
+		return nil
+	}
+	switch cf.Type {
+	case "insert":
+		return j.output.write(key, &outputRecord{Key: key, PK: cf.Key, Sum: rowChecksum(cf)})
+	case "delete":
+		return j.output.write(key, &outputRecord{Key: key, Delete: true})
+	}
+	return nil
+}
+
+//catchUp consumes output stream until there is no new events during
+//verify_idle_timeout
+func (j *job) catchUp() error {
+	idle := time.Duration(j.cfg.VerifyIdleTimeout) * time.Second
+	for {
+		select {
+		case m, ok := <-j.msgs:
+			if !ok {
+				return nil
+			}
+			switch v := m.(type) {
+			case error:
+				return v
+			case *outputMsg:
+				if err := j.apply(v.key, v.value); err != nil {
+					return err
+				}
+			}
+		case <-time.After(idle):
+			return nil
+		case <-shutdown.InitiatedCh():
+			return errors.New("Shutdown initiated")
+		}
+	}
+}
+
+func (j *job) pkValues(row []interface{}) []interface{} {
+	var k []interface{}
+	for i, c := range j.enc.Schema().Columns {
+		if c.Key == "PRI" {
+			k = append(k, row[i])
+		}
+	}
+	return k
+}
+
+//readRows reads source rows satisfying the condition in primary key order
+func (j *job) readRows(cond string, limit int, args ...interface{}) ([]sourceRow, error) {
+	query := "SELECT * FROM `" + j.res.Db + "`.`" + j.res.Table + "`" + cond + " ORDER BY " + j.pkColumns
+	if limit != 0 {
+		query += " LIMIT " + strconv.Itoa(limit)
+	}
+
+	rows, err := util.QuerySQL(j.conn, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { log.EL(j.log, rows.Close()) }()
+
+	var res []sourceRow
+	for rows.Next() {
+		v, err := snapshot.ScanRow(rows, j.enc.Schema())
+		if err != nil {
+			return nil, err
+		}
+		//Pass row through the encoder to get the same representation as
+		//the one decoded from the output stream
+		b, err := j.enc.Row(types.Insert, &v, 0)
+		if err != nil {
+			return nil, err
+		}
+		cf, _, err := j.decode(b)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, sourceRow{v, cf})
+	}
+
+	return res, rows.Err()
+}
+
+//fillChunk calculates chunk checksum and spills chunk rows keys
+func (j *job) fillChunk(c *chunk, rows []sourceRow) error {
+	c.rows, c.sum = len(rows), 0
+	c.gen++
+	for _, r := range rows {
+		k := encoder.GetCommonFormatKey(r.cf)
+		if err := j.source.write(k, &sourceRecord{Key: k, Chunk: c.idx, Gen: c.gen}); err != nil {
+			return err
+		}
+		c.sum += rowChecksum(r.cf)
+	}
+	return nil
+}
+
+//scan splits source table into chunks
+func (j *job) scan() error {
+	var after []interface{}
+	for {
+		var cond string
+		if after != nil {
+			cond = " WHERE (" + j.pkColumns + ") > " + j.pkHolders
+		}
+		rows, err := j.readRows(cond, j.cfg.VerifyChunkSize, after...)
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		c := &chunk{idx: len(j.chunks), first: j.pkValues(rows[0].row), last: j.pkValues(rows[len(rows)-1].row)}
+		if err = j.fillChunk(c, rows); err != nil {
+			return err
+		}
+		j.chunks = append(j.chunks, c)
+		after = c.last
+		if len(rows) < j.cfg.VerifyChunkSize {
+			return nil
+		}
+		if shutdown.Initiated() {
+			return errors.New("Shutdown initiated")
+		}
+	}
+}
+
+//reread reads chunk range from the source again
+func (j *job) reread(c *chunk) ([]sourceRow, error) {
+	cond := " WHERE (" + j.pkColumns + ") >= " + j.pkHolders + " AND (" + j.pkColumns + ") <= " + j.pkHolders
+	rows, err := j.readRows(cond, 0, append(append([]interface{}{}, c.first...), c.last...)...)
+	if err != nil {
+		return nil, err
+	}
+	return rows, j.fillChunk(c, rows)
+}
+
+//compareBucket compacts output events of the bucket into the latest state of
+//every row and matches source rows of the bucket against it
+func (j *job) compareBucket(b int) error {
+	rows := make(map[string]*outputRecord)
+	err := j.output.read(b, func(d *gob.Decoder) error {
+		r := &outputRecord{}
+		if err := d.Decode(r); err != nil {
+			return err
+		}
+		if r.Delete {
+			delete(rows, r.Key)
+		} else {
+			rows[r.Key] = r
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	j.outputRows += len(rows)
+
+	err = j.source.read(b, func(d *gob.Decoder) error {
+		var s sourceRecord
+		if err := d.Decode(&s); err != nil {
+			return err
+		}
+		c := j.chunks[s.Chunk]
+		if s.Gen != c.gen {
+			return nil
+		}
+		if r := rows[s.Key]; r != nil {
+			c.outRows++
+			c.outSum += r.Sum
+			delete(rows, s.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for k, r := range rows {
+		j.extra = append(j.extra, extraRow{k, r.PK})
+	}
+
+	return nil
+}
+
+//compareAll compares all the chunks with the output consumed so far, bucket by
+//bucket, and finds the rows present in the output only
+func (j *job) compareAll() error {
+	for _, c := range j.chunks {
+		c.outRows, c.outSum = 0, 0
+	}
+	j.outputRows, j.extra = 0, nil
+
+	for b := 0; b < j.output.buckets(); b++ {
+		if err := j.compareBucket(b); err != nil {
+			return err
+		}
+		if shutdown.Initiated() {
+			return errors.New("Shutdown initiated")
+		}
+	}
+
+	return nil
+}
+
+//compare returns the number of chunk rows present in the output and whether
+//the output matches the source, as of the last comparison
+func (j *job) compare(c *chunk) (int, bool) {
+	return c.outRows, c.outRows == c.rows && c.outSum == c.sum
+}
+
+func (j *job) mismatched(chunks []*chunk) ([]*chunk, error) {
+	if err := j.compareAll(); err != nil {
+		return nil, err
+	}
+	var res []*chunk
+	for _, c := range chunks {
+		if _, ok := j.compare(c); !ok {
+			res = append(res, c)
+		}
+	}
+	return res, nil
+}
+
+//recheckExtra reads the extra rows from the source by primary key and returns
+//the ones which are still missing. Rows inserted after the scan passed their
+//chunk are present in the output, but not in the scanned chunks
+func (j *job) recheckExtra(extra []extraRow) ([]extraRow, error) {
+	var res []extraRow
+	cond := " WHERE (" + j.pkColumns + ") = " + j.pkHolders
+	for _, e := range extra {
+		rows, err := j.readRows(cond, 1, e.pk...)
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == 0 {
+			res = append(res, e)
+		}
+		if shutdown.Initiated() {
+			return nil, errors.New("Shutdown initiated")
+		}
+	}
+	return res, nil
+}
+
+//resnapshot pushes current source rows of mismatched chunks and deletes of
+//the extra rows to the output stream
+func (j *job) resnapshot(mismatched []*chunk, extra []extraRow) (int, error) {
+	p, err := j.outPipe.NewProducer(j.topic)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { log.EL(j.log, p.Close()) }()
+	p.SetFormat(j.outputFormat)
+
+	push := func(key string, b []byte) error {
+		if pipe.FileBased(j.outPipe) {
+			key = "snapshot"
+		}
+		return p.PushBatch(key, b)
+	}
+
+	var n int
+	for _, c := range mismatched {
+		rows, err := j.reread(c)
+		if err != nil {
+			return n, err
+		}
+		for _, r := range rows {
+			b, err := j.enc.Row(types.Insert, &r.row, 0)
+			if err != nil {
+				return n, err
+			}
+			if err = push(encoder.GetRowKey(j.enc.Schema(), &r.row), b); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+
+	for _, e := range extra {
+		cf := &types.CommonFormatEvent{Type: "delete", Key: e.pk, Timestamp: time.Now().UnixNano()}
+		b, err := j.enc.CommonFormat(cf)
+		if err != nil {
+			return n, err
+		}
+		if err = push(e.key, b); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, p.PushBatchCommit()
+}
+
+func (j *job) run() error {
+	j.msgs = make(chan interface{})
+	j.exit = make(chan bool)
+	defer j.close()
+
+	if err := j.init(); err != nil {
+		return err
+	}
+
+	j.metrics.NumWorkers.Inc()
+	defer j.metrics.NumWorkers.Dec()
+
+	go j.fetch()
+
+	j.log.Infof("Verification started")
+
+	if err := j.scan(); err != nil {
+		return err
+	}
+
+	mismatched := j.chunks
+	for i := 0; ; i++ {
+		if err := j.catchUp(); err != nil {
+			return err
+		}
+		var err error
+		if mismatched, err = j.mismatched(mismatched); err != nil {
+			return err
+		}
+		if len(mismatched) == 0 || i == numRechecks {
+			break
+		}
+		j.log.Infof("%v chunks mismatched, rechecking", len(mismatched))
+		for _, c := range mismatched {
+			if _, err := j.reread(c); err != nil {
+				return err
+			}
+		}
+	}
+
+	extra, err := j.recheckExtra(j.extra)
+	if err != nil {
+		return err
+	}
+
+	var sourceRows int
+	ranges := make([]Range, 0)
+	for _, c := range j.chunks {
+		sourceRows += c.rows
+	}
+	for _, c := range mismatched {
+		n, _ := j.compare(c)
+		ranges = append(ranges, Range{First: c.first, Last: c.last, SourceRows: c.rows, OutputRows: n})
+	}
+
+	j.metrics.ChunksVerified.Set(int64(len(j.chunks)))
+	j.metrics.ChunksMismatched.Set(int64(len(mismatched)))
+	j.metrics.RowsExtra.Set(int64(len(extra)))
+
+	j.log.Infof("Verification finished. Chunks: %v, mismatched: %v, extra rows: %v", len(j.chunks), len(mismatched), len(extra))
+
+	var resnapshotted int
+	if j.res.Resnapshot && (len(mismatched) != 0 || len(extra) != 0) {
+		resnapshotted, err = j.resnapshot(mismatched, extra)
+	}
+
+	var keys []string
+	for i := 0; i < len(extra) && i < maxExtraKeys; i++ {
+		keys = append(keys, extra[i].key)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	j.res.Chunks = len(j.chunks)
+	j.res.SourceRows = sourceRows
+	j.res.OutputRows = j.outputRows
+	j.res.DecodeErrors = j.decodeErrors
+	j.res.Mismatched = ranges
+	j.res.ExtraRows = len(extra)
+	j.res.ExtraKeys = keys
+	j.res.Resnapshotted = resnapshotted
+
+	return err
+}
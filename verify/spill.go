@@ -0,0 +1,131 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package verify
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/raksh93/storagetapper/log"
+)
+
+//maxSpillBuckets limits the number of spill files of the job
+const maxSpillBuckets = 256
+
+//sourceRecord is the spilled source row. Gen is the number of times the chunk
+//has been read, records of the previous reads are skipped
+type sourceRecord struct {
+	Key   string
+	Chunk int
+	Gen   int
+}
+
+//outputRecord is the spilled output stream event
+type outputRecord struct {
+	Key    string
+	Delete bool
+	PK     []interface{}
+	Sum    uint64
+}
+
+func init() {
+	//Primary keys of DATETIME and TIMESTAMP columns are decoded as time.Time
+	gob.Register(time.Time{})
+}
+
+//spill holds the records of the verification job in the files on disk, split
+//into buckets by the row key hash. Comparison loads one bucket at a time, so
+//as memory usage doesn't grow with the size of the table and its output
+type spill struct {
+	files []*os.File
+	bufs  []*bufio.Writer
+	encs  []*gob.Encoder
+}
+
+func newSpill(dir string, name string, n int) (*spill, error) {
+	s := &spill{}
+	for i := 0; i < n; i++ {
+		f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%v.%v", name, i)), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		w := bufio.NewWriter(f)
+		s.files = append(s.files, f)
+		s.bufs = append(s.bufs, w)
+		s.encs = append(s.encs, gob.NewEncoder(w))
+	}
+	return s, nil
+}
+
+func (s *spill) buckets() int {
+	return len(s.files)
+}
+
+func (s *spill) bucket(key string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(s.files)))
+}
+
+//write appends the record to the bucket of the key
+func (s *spill) write(key string, rec interface{}) error {
+	return s.encs[s.bucket(key)].Encode(rec)
+}
+
+//read calls fn for every record of the bucket in the write order. fn decodes
+//the record and returns io.EOF when there is no more records
+func (s *spill) read(b int, fn func(d *gob.Decoder) error) error {
+	if err := s.bufs[b].Flush(); err != nil {
+		return err
+	}
+
+	f, err := os.Open(s.files[b].Name())
+	if err != nil {
+		return err
+	}
+	defer func() { log.E(f.Close()) }()
+
+	d := gob.NewDecoder(bufio.NewReader(f))
+	for {
+		err := fn(d)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//close closes and removes the spill files
+func (s *spill) close() {
+	for _, f := range s.files {
+		log.E(f.Close())
+		log.E(os.Remove(f.Name()))
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+/*Package verify implements the job which compares the source table with the
+output stream of the table.
+
+Source table is read from the replica in primary key order in chunks of
+verify_chunk_size rows. Output stream is consumed from the beginning. Keys of
+the source rows and output events are spilled to the files in data_dir, split
+into buckets by the row key hash. Comparison loads one bucket at a time and
+compacts its output events into the latest state of every row, so as memory
+usage doesn't grow with the size of the table. Every row from both sides is
+passed through the table's output encoder, so as both sides are compared in
+the same representation. Chunk checksums are compared and mismatched chunks are
+rechecked after the output stream catches up, to filter out the differences
+caused by the replication lag.
+*/
+package verify
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/log"
+	"github.com/raksh93/storagetapper/shutdown"
+	"github.com/raksh93/storagetapper/state"
+	"github.com/raksh93/storagetapper/types"
+)
+
+//numRechecks is the number of times mismatched chunks are reread from the
+//source and compared again after consuming more of the output stream
+var numRechecks = 2
+
+//maxExtraKeys limits the number of extra keys reported in the result
+const maxExtraKeys = 100
+
+//Job statuses
+const (
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+)
+
+//Request identifies the table to verify
+type Request struct {
+	Service string
+	Db      string
+	Table   string
+	Input   string
+	Output  string
+	Version int
+	//Resnapshot enables re-snapshot of the mismatched ranges
+	Resnapshot bool
+}
+
+//Range is the range of primary keys, where source table and output stream
+//differ
+type Range struct {
+	First      []interface{}
+	Last       []interface{}
+	SourceRows int
+	OutputRows int
+}
+
+//Result contains verification job status and outcome
+type Result struct {
+	ID int64
+	Request
+	Cluster  string
+	Status   string
+	Error    string `json:",omitempty"`
+	Started  time.Time
+	Finished time.Time
+
+	Chunks       int
+	SourceRows   int
+	OutputRows   int
+	DecodeErrors int
+	Mismatched   []Range
+	//ExtraRows is the number of rows present in the output stream, but not
+	//in the source table
+	ExtraRows     int
+	ExtraKeys     []string `json:",omitempty"`
+	Resnapshotted int
+}
+
+var (
+	lock   sync.Mutex
+	jobs   = make(map[int64]*job)
+	nextID int64
+)
+
+func findRunning(r *Request) bool {
+	for _, j := range jobs {
+		if j.res.Status == StatusRunning && j.res.Service == r.Service && j.res.Db == r.Db && j.res.Table == r.Table && j.res.Input == r.Input && j.res.Output == r.Output && j.res.Version == r.Version {
+			return true
+		}
+	}
+	return false
+}
+
+//Start validates the request and starts verification job in the background.
+//Returns job ID, which can be used to query job result
+func Start(cfg *config.AppConfig, r *Request) (int64, error) {
+	rows, err := state.GetCond("service=? AND db=? AND tableName=? AND input=? AND output=? AND version=?", r.Service, r.Db, r.Table, r.Input, r.Output, r.Version)
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, fmt.Errorf("Table is not registered: service=%v db=%v table=%v", r.Service, r.Db, r.Table)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if findRunning(r) {
+		return 0, errors.New("Verification of the table is already running")
+	}
+
+	nextID++
+	j := &job{cfg: cfg, outputFormat: rows[0].OutputFormat}
+	j.res = Result{ID: nextID, Request: *r, Cluster: rows[0].Cluster, Status: StatusRunning, Started: time.Now()}
+	j.log = log.WithFields(log.Fields{"service": r.Service, "db": r.Db, "table": r.Table, "verify": nextID})
+	jobs[nextID] = j
+
+	shutdown.Register(1)
+	go func() {
+		defer shutdown.Done()
+		err := j.run()
+		lock.Lock()
+		defer lock.Unlock()
+		if log.EL(j.log, err) {
+			j.res.Status = StatusFailed
+			j.res.Error = err.Error()
+		} else {
+			j.res.Status = StatusDone
+		}
+		j.res.Finished = time.Now()
+	}()
+
+	return nextID, nil
+}
+
+//Get returns results of the job with given id or of all the jobs if id is 0
+func Get(id int64) []Result {
+	lock.Lock()
+	defer lock.Unlock()
+
+	res := make([]Result, 0)
+	for i := int64(1); i <= nextID; i++ {
+		if j := jobs[i]; j != nil && (id == 0 || i == id) {
+			res = append(res, j.res)
+		}
+	}
+
+	return res
+}
+
+//rowChecksum calculates checksum of the decoded row fields. Checksum of the
+//chunk is the sum of its rows checksums, so as it doesn't depend on the rows
+//order
+func rowChecksum(cf *types.CommonFormatEvent) uint64 {
+	h := sha256.New()
+	if cf.Fields != nil {
+		for _, f := range *cf.Fields {
+			_, _ = fmt.Fprintf(h, "%d%s%v", len(f.Name), f.Name, f.Value)
+			_, _ = h.Write([]byte{0})
+		}
+	}
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
@@ -0,0 +1,257 @@
+// Copyright (c) 2017 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package verify
+
+import (
+	"database/sql"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/raksh93/storagetapper/config"
+	"github.com/raksh93/storagetapper/db"
+	"github.com/raksh93/storagetapper/encoder"
+	"github.com/raksh93/storagetapper/log"
+	"github.com/raksh93/storagetapper/pipe"
+	"github.com/raksh93/storagetapper/shutdown"
+	"github.com/raksh93/storagetapper/state"
+	"github.com/raksh93/storagetapper/test"
+	"github.com/raksh93/storagetapper/types"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+var (
+	cfg     *config.AppConfig
+	testSvc = types.MySvcName
+	testDb  = types.MyDbName
+	testTbl = "test_verify"
+)
+
+func setupDB(t *testing.T) *sql.DB {
+	conn, err := db.OpenService(&db.Loc{Service: testSvc, Name: ""}, "")
+	test.CheckFail(err, t)
+
+	test.ExecSQL(conn, t, "DROP DATABASE IF EXISTS "+testDb)
+	test.ExecSQL(conn, t, "CREATE DATABASE "+testDb)
+	test.ExecSQL(conn, t, fmt.Sprintf("CREATE TABLE %s.%s (f1 BIGINT NOT NULL PRIMARY KEY, f2 VARCHAR(32))", testDb, testTbl))
+	for i := 0; i < 100; i++ {
+		test.ExecSQL(conn, t, fmt.Sprintf("INSERT INTO %s.%s VALUES(?,?)", testDb, testTbl), i, strconv.Itoa(i))
+	}
+
+	if !state.Init(cfg) {
+		t.FailNow()
+	}
+	if !state.RegisterTable(&db.Loc{Service: testSvc, Name: testDb}, testTbl, "mysql", "file", 0, "json") {
+		t.FailNow()
+	}
+
+	return conn
+}
+
+//setupOutput produces table rows to the output with row 15 modified, row 47
+//missing and extra row 200
+func setupOutput(t *testing.T) {
+	test.CheckFail(os.RemoveAll(cfg.DataDir), t)
+
+	enc, err := encoder.Create("json", testSvc, testDb, testTbl)
+	test.CheckFail(err, t)
+
+	p, err := pipe.Create(shutdown.Context, "file", cfg.PipeBatchSize, cfg, nil)
+	test.CheckFail(err, t)
+
+	topic, err := cfg.GetOutputTopicName(testSvc, testDb, testTbl, "mysql", "file", 0)
+	test.CheckFail(err, t)
+
+	producer, err := p.NewProducer(topic)
+	test.CheckFail(err, t)
+	producer.SetFormat("json")
+
+	for i := 0; i <= 200; i++ {
+		if (i >= 100 && i != 200) || i == 47 {
+			continue
+		}
+		v := strconv.Itoa(i)
+		if i == 15 {
+			v = "modified"
+		}
+		row := []interface{}{int64(i), v}
+		b, err := enc.Row(types.Insert, &row, 0)
+		test.CheckFail(err, t)
+		test.CheckFail(producer.PushBatch("snapshot", b), t)
+	}
+
+	test.CheckFail(producer.PushBatchCommit(), t)
+	test.CheckFail(producer.Close(), t)
+}
+
+func waitResult(id int64, t *testing.T) Result {
+	for i := 0; i < 600; i++ {
+		r := Get(id)
+		test.Assert(t, len(r) == 1, "job %v not found", id)
+		if r[0].Status != StatusRunning {
+			return r[0]
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("Timeout waiting for verification job to finish")
+	return Result{}
+}
+
+func TestVerify(t *testing.T) {
+	shutdown.Setup()
+	defer shutdown.InitiateAndWait()
+
+	conn := setupDB(t)
+	defer func() { test.CheckFail(conn.Close(), t) }()
+
+	setupOutput(t)
+
+	req := &Request{Service: testSvc, Db: testDb, Table: testTbl, Input: "mysql", Output: "file", Resnapshot: true}
+	id, err := Start(cfg, req)
+	test.CheckFail(err, t)
+
+	r := waitResult(id, t)
+	test.Assert(t, r.Status == StatusDone, "job failed: %v", r.Error)
+	test.Assert(t, r.Chunks == 10, "expected 10 chunks, got %v", r.Chunks)
+	test.Assert(t, r.SourceRows == 100, "expected 100 source rows, got %v", r.SourceRows)
+	test.Assert(t, len(r.Mismatched) == 2, "expected 2 mismatched ranges, got %+v", r.Mismatched)
+	test.Assert(t, r.Mismatched[0].First[0] == int64(10) && r.Mismatched[0].Last[0] == int64(19), "wrong range %+v", r.Mismatched[0])
+	test.Assert(t, r.Mismatched[1].First[0] == int64(40) && r.Mismatched[1].Last[0] == int64(49), "wrong range %+v", r.Mismatched[1])
+	test.Assert(t, r.Mismatched[1].SourceRows == 10 && r.Mismatched[1].OutputRows == 9, "wrong row counts %+v", r.Mismatched[1])
+	test.Assert(t, r.ExtraRows == 1, "expected 1 extra row, got %v", r.ExtraRows)
+	test.Assert(t, r.Resnapshotted == 21, "expected 21 resnapshotted rows, got %v", r.Resnapshotted)
+
+	//Output should match the source after re-snapshot
+	req.Resnapshot = false
+	id, err = Start(cfg, req)
+	test.CheckFail(err, t)
+
+	r = waitResult(id, t)
+	test.Assert(t, r.Status == StatusDone, "job failed: %v", r.Error)
+	test.Assert(t, len(r.Mismatched) == 0, "expected no mismatches, got %+v", r.Mismatched)
+	test.Assert(t, r.ExtraRows == 0, "expected no extra rows, got %v", r.ExtraRows)
+}
+
+func TestSpillCompare(t *testing.T) {
+	dir := "/tmp/storagetapper/verify_spill_test"
+	test.CheckFail(os.RemoveAll(dir), t)
+	test.CheckFail(os.MkdirAll(dir, 0770), t)
+	defer func() { test.CheckFail(os.RemoveAll(dir), t) }()
+
+	var err error
+	j := &job{}
+	j.source, err = newSpill(dir, "source", 3)
+	test.CheckFail(err, t)
+	defer j.source.close()
+	j.output, err = newSpill(dir, "output", 3)
+	test.CheckFail(err, t)
+	defer j.output.close()
+
+	c := &chunk{rows: 3, sum: 6, gen: 1}
+	j.chunks = []*chunk{c}
+	for _, k := range []string{"11", "12", "13"} {
+		test.CheckFail(j.source.write(k, &sourceRecord{Key: k, Gen: 1}), t)
+	}
+	//Record of the previous chunk read
+	test.CheckFail(j.source.write("14", &sourceRecord{Key: "14", Gen: 0}), t)
+
+	for i, k := range []string{"11", "12", "13", "14"} {
+		test.CheckFail(j.output.write(k, &outputRecord{Key: k, PK: []interface{}{int64(i + 1)}, Sum: uint64(i + 1)}), t)
+	}
+
+	mismatched, err := j.mismatched(j.chunks)
+	test.CheckFail(err, t)
+	test.Assert(t, len(mismatched) == 0, "chunk should match")
+	test.Assert(t, j.outputRows == 4, "expected 4 output rows, got %v", j.outputRows)
+	test.Assert(t, len(j.extra) == 1 && j.extra[0].key == "14" && j.extra[0].pk[0] == int64(4), "unexpected extra rows: %+v", j.extra)
+
+	//Tombstone deletes the row of the message key, tombstone without key
+	//is ignored
+	test.CheckFail(j.apply("12", nil), t)
+	test.CheckFail(j.apply("", nil), t)
+
+	mismatched, err = j.mismatched(j.chunks)
+	test.CheckFail(err, t)
+	test.Assert(t, len(mismatched) == 1, "chunk should mismatch after tombstone")
+	n, _ := j.compare(c)
+	test.Assert(t, n == 2, "expected 2 rows of the chunk in the output, got %v", n)
+	test.Assert(t, j.outputRows == 3, "expected 3 output rows, got %v", j.outputRows)
+}
+
+func TestRecheckExtra(t *testing.T) {
+	conn := setupDB(t)
+	defer func() { test.CheckFail(conn.Close(), t) }()
+
+	enc, err := encoder.Create("json", testSvc, testDb, testTbl)
+	test.CheckFail(err, t)
+
+	j := &job{res: Result{Request: Request{Db: testDb, Table: testTbl}}, enc: enc, conn: conn, pkColumns: "`f1`", pkHolders: "(?)"}
+	j.log = log.WithFields(log.Fields{"table": testTbl})
+
+	//Row 5 has been inserted after the scan, primary key decoded from JSON
+	//output is float64
+	extra := []extraRow{{"5", []interface{}{float64(5)}}, {"150", []interface{}{float64(150)}}}
+	res, err := j.recheckExtra(extra)
+	test.CheckFail(err, t)
+	test.Assert(t, len(res) == 1 && res[0].key == "150", "only missing rows should be extra: %+v", res)
+}
+
+func TestSpillTemporalKey(t *testing.T) {
+	dir := "/tmp/storagetapper/verify_spill_test"
+	test.CheckFail(os.RemoveAll(dir), t)
+	test.CheckFail(os.MkdirAll(dir, 0770), t)
+	defer func() { test.CheckFail(os.RemoveAll(dir), t) }()
+
+	s, err := newSpill(dir, "output", 1)
+	test.CheckFail(err, t)
+	defer s.close()
+
+	//DATETIME and TIMESTAMP primary keys are decoded as time.Time
+	ts := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	test.CheckFail(s.write("k", &outputRecord{Key: "k", PK: []interface{}{ts, "a"}}), t)
+
+	var r outputRecord
+	err = s.read(0, func(d *gob.Decoder) error { return d.Decode(&r) })
+	test.CheckFail(err, t)
+	test.Assert(t, r.Key == "k" && len(r.PK) == 2 && r.PK[0].(time.Time).Equal(ts) && r.PK[1] == "a", "unexpected record: %+v", r)
+}
+
+func TestMain(m *testing.M) {
+	cfg = test.LoadConfig()
+
+	cfg.DataDir = "/tmp/storagetapper/verify_test"
+	cfg.VerifyChunkSize = 10
+	cfg.VerifyIdleTimeout = 1
+	numRechecks = 1
+
+	conn, err := db.OpenService(&db.Loc{Service: testSvc, Name: ""}, "")
+	if err != nil {
+		log.Warnf("MySQL is not available")
+		os.Exit(0)
+	}
+	log.E(conn.Close())
+
+	os.Exit(m.Run())
+}